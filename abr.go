@@ -0,0 +1,308 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Defaults of AdaptiveBitrateConfig
+	_ABR_STEP_DOWN        = 0.7
+	_ABR_STEP_UP          = 1.25
+	_ABR_CONGESTION_DELAY = 3 * time.Second
+	_ABR_HEADROOM_DELAY   = 15 * time.Second
+	_ABR_MAX_JITTER       = 150 * time.Millisecond
+
+	// Period over which the throughput and the delivery rate are measured
+	_ABR_WINDOW = time.Second
+
+	// Media time delivered per wall clock time below which the stream is falling behind (congestion),
+	// and above which it keeps up (headroom)
+	_ABR_CONGESTION_RATIO = 0.9
+	_ABR_HEADROOM_RATIO   = 0.98
+
+	// Fraction of the measured throughput used as the new bitrate when the stream is falling behind
+	_ABR_THROUGHPUT_SAFETY = 0.85
+
+	// Gain of the frame arrival jitter estimate (as per RFC 3550)
+	_ABR_JITTER_GAIN = 1.0 / 16
+)
+
+// errUIBitrateSwitch is returned by uiStreamDemux() when the UI stream should reconnect with a new bitrate.
+var errUIBitrateSwitch = errors.New("UI bitrate switch")
+
+// AdaptiveBitrateConfig holds the settings of the adaptive UI bitrate control, see SessionUIStreamStartAdaptive().
+// Zero values are replaced by defaults.
+type AdaptiveBitrateConfig struct {
+	MinBitrate     int // Bitrate range in bits per second, required
+	MaxBitrate     int
+	InitialBitrate int // The bitrate of the first connection, the middle of the range if zero
+
+	StepDown float64 // Factor applied to the bitrate on congestion, 0.7 if zero
+	StepUp   float64 // Factor applied to the bitrate on headroom, 1.25 if zero
+
+	// How long congestion or headroom must last before the bitrate is changed, the longer headroom delay avoids
+	// oscillating around the available bandwidth. 3 and 15 seconds if zero.
+	CongestionDelay time.Duration
+	HeadroomDelay   time.Duration
+
+	// Frame arrival jitter above which the network is considered congested, 150 milliseconds if zero.
+	// Headroom requires the jitter to be below half of it.
+	MaxJitter time.Duration
+}
+
+// validate checks the configuration and returns a copy with the defaults applied and the range clamped
+// to the capabilities of the server.
+func (config *AdaptiveBitrateConfig) validate(caps *Capabilities) (*AdaptiveBitrateConfig, error) {
+	c := *config
+	if c.MinBitrate <= 0 || c.MaxBitrate < c.MinBitrate {
+		return nil, withClass(ErrInvalidArgument, fmt.Errorf("Invalid adaptive bitrate range %d-%d", c.MinBitrate, c.MaxBitrate))
+	}
+	if c.StepDown == 0 {
+		c.StepDown = _ABR_STEP_DOWN
+	}
+	if c.StepUp == 0 {
+		c.StepUp = _ABR_STEP_UP
+	}
+	if c.StepDown <= 0 || c.StepDown >= 1 || c.StepUp <= 1 {
+		return nil, withClass(ErrInvalidArgument, fmt.Errorf("Invalid adaptive bitrate steps %v and %v", c.StepDown, c.StepUp))
+	}
+	if c.CongestionDelay <= 0 {
+		c.CongestionDelay = _ABR_CONGESTION_DELAY
+	}
+	if c.HeadroomDelay <= 0 {
+		c.HeadroomDelay = _ABR_HEADROOM_DELAY
+	}
+	if c.MaxJitter <= 0 {
+		c.MaxJitter = _ABR_MAX_JITTER
+	}
+	if caps != nil && caps.Reported {
+		c.MinBitrate = caps.clampBitrate(c.MinBitrate)
+		c.MaxBitrate = caps.clampBitrate(c.MaxBitrate)
+	}
+	if c.InitialBitrate == 0 {
+		c.InitialBitrate = (c.MinBitrate + c.MaxBitrate) / 2
+	}
+	c.InitialBitrate = c.clamp(c.InitialBitrate)
+	return &c, nil
+}
+
+func (config *AdaptiveBitrateConfig) clamp(bitrate int) int {
+	if bitrate < config.MinBitrate {
+		return config.MinBitrate
+	}
+	if bitrate > config.MaxBitrate {
+		return config.MaxBitrate
+	}
+	return bitrate
+}
+
+// UIStreamStats holds the measurements of a UI stream, see SessionGetUIStreamStats().
+type UIStreamStats struct {
+	Bitrate    int           // The requested bitrate, zero for the server default
+	Throughput int           // Bits per second received during the last measurement window
+	Jitter     time.Duration // Estimated frame arrival jitter
+	Adaptive   bool          // Whether the bitrate is adapted, see SessionUIStreamStartAdaptive()
+	Switches   int           // Number of bitrate changes
+}
+
+// abrController measures a UI stream and, when a configuration is given, decides on bitrate changes.
+// The stream is congested when it falls behind real time or when frames arrive with a high jitter,
+// it has headroom when it keeps up with low jitter. The server is expected to send frames continuously.
+type abrController struct {
+	config   *AdaptiveBitrateConfig // Nil when the bitrate is fixed
+	mutex    sync.Mutex
+	bitrate  int
+	pending  int // The bitrate to switch to at the next key frame, zero if none
+	switches int
+
+	// The current measurement window
+	windowStart     time.Time
+	windowMediaTime time.Duration
+	windowBytes     int64
+	throughput      int
+
+	// Frame arrival jitter
+	lastArrival time.Time
+	lastTime    time.Duration
+	jitter      float64
+
+	// Start of the ongoing congestion or headroom, zero if none
+	congestedSince time.Time
+	headroomSince  time.Time
+}
+
+func newABRController(config *AdaptiveBitrateConfig, bitrate int) *abrController {
+	if config != nil {
+		bitrate = config.InitialBitrate
+	}
+	return &abrController{config: config, bitrate: bitrate}
+}
+
+// reset restarts the measurements, e.g. after reconnecting.
+func (abr *abrController) reset() {
+	abr.mutex.Lock()
+	defer abr.mutex.Unlock()
+	abr.windowStart = time.Time{}
+	abr.windowBytes = 0
+	abr.lastArrival = time.Time{}
+	abr.jitter = 0
+	abr.congestedSince = time.Time{}
+	abr.headroomSince = time.Time{}
+}
+
+func (abr *abrController) getBitrate() int {
+	abr.mutex.Lock()
+	defer abr.mutex.Unlock()
+	return abr.bitrate
+}
+
+func (abr *abrController) addBytes(n int) {
+	abr.mutex.Lock()
+	abr.windowBytes += int64(n)
+	abr.mutex.Unlock()
+}
+
+// onFrame records the arrival of a video frame with the given presentation time. It returns true when the stream
+// should be reconnected with the new bitrate (see getBitrate()), in which case the frame is a key frame and should
+// not be rendered since the new stream starts with a key frame.
+func (abr *abrController) onFrame(t time.Duration, isKeyFrame bool, now time.Time) bool {
+	abr.mutex.Lock()
+	defer abr.mutex.Unlock()
+
+	if abr.pending > 0 && isKeyFrame {
+		abr.bitrate = abr.pending
+		abr.pending = 0
+		abr.switches++
+		return true
+	}
+
+	if !abr.lastArrival.IsZero() {
+		d := now.Sub(abr.lastArrival) - (t - abr.lastTime)
+		if d < 0 {
+			d = -d
+		}
+		abr.jitter += (float64(d) - abr.jitter) * _ABR_JITTER_GAIN
+	}
+	abr.lastArrival, abr.lastTime = now, t
+
+	if abr.windowStart.IsZero() {
+		abr.windowStart, abr.windowMediaTime, abr.windowBytes = now, t, 0
+		return false
+	}
+	elapsed := now.Sub(abr.windowStart)
+	if elapsed < _ABR_WINDOW {
+		return false
+	}
+	ratio := float64(t-abr.windowMediaTime) / float64(elapsed)
+	abr.throughput = int(float64(abr.windowBytes*8) / elapsed.Seconds())
+	windowStart := abr.windowStart
+	abr.windowStart, abr.windowMediaTime, abr.windowBytes = now, t, 0
+
+	// A negative or too high ratio is caused by a timestamp discontinuity, skip the window
+	if abr.config != nil && abr.pending == 0 && ratio >= 0 && ratio <= 2 {
+		abr.evaluate(ratio, windowStart, now)
+	}
+	return false
+}
+
+// evaluate decides on a bitrate change at the end of a measurement window, it is called with the mutex locked.
+func (abr *abrController) evaluate(ratio float64, windowStart time.Time, now time.Time) {
+	config := abr.config
+	jitter := time.Duration(abr.jitter)
+	if ratio < _ABR_CONGESTION_RATIO || jitter > config.MaxJitter {
+		abr.headroomSince = time.Time{}
+		if abr.congestedSince.IsZero() {
+			abr.congestedSince = windowStart
+		}
+		if now.Sub(abr.congestedSince) < config.CongestionDelay || abr.bitrate <= config.MinBitrate {
+			return
+		}
+		target := int(float64(abr.bitrate) * config.StepDown)
+		if ratio < _ABR_CONGESTION_RATIO {
+			// Falling behind, the throughput is limited by the network rather than by the encoder
+			if measured := int(float64(abr.throughput) * _ABR_THROUGHPUT_SAFETY); measured > 0 && measured < target {
+				target = measured
+			}
+		}
+		abr.setPending(config.clamp(target))
+	} else if ratio >= _ABR_HEADROOM_RATIO && jitter < config.MaxJitter/2 {
+		abr.congestedSince = time.Time{}
+		if abr.headroomSince.IsZero() {
+			abr.headroomSince = windowStart
+		}
+		if now.Sub(abr.headroomSince) < config.HeadroomDelay || abr.bitrate >= config.MaxBitrate {
+			return
+		}
+		abr.setPending(config.clamp(int(float64(abr.bitrate) * config.StepUp)))
+	} else {
+		// In between the thresholds, keep the bitrate
+		abr.congestedSince = time.Time{}
+		abr.headroomSince = time.Time{}
+	}
+}
+
+func (abr *abrController) setPending(bitrate int) {
+	if bitrate != abr.bitrate {
+		abr.pending = bitrate
+	}
+	abr.congestedSince = time.Time{}
+	abr.headroomSince = time.Time{}
+}
+
+func (abr *abrController) stats() *UIStreamStats {
+	abr.mutex.Lock()
+	defer abr.mutex.Unlock()
+	return &UIStreamStats{
+		Bitrate:    abr.bitrate,
+		Throughput: abr.throughput,
+		Jitter:     time.Duration(abr.jitter),
+		Adaptive:   abr.config != nil,
+		Switches:   abr.switches,
+	}
+}
+
+// countingReader passes the number of bytes read to the abrController.
+type countingReader struct {
+	reader io.Reader
+	abr    *abrController
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.abr.addBytes(n)
+	return
+}
+
+// SessionUIStreamStartAdaptive is used to start streaming the UI like SessionUIStreamStart(), with a bitrate which
+// follows the available bandwidth. The throughput and the frame arrival jitter are measured, and on sustained
+// congestion or headroom the UI stream is reconnected with a new bitrate, at a key frame and with ts_discon set.
+// SESSION_EVENT_UI_BITRATE_CHANGED is emitted on each change.
+func SessionUIStreamStartAdaptive(ctx *SessionContext, format string, config *AdaptiveBitrateConfig) (err error) {
+	if config == nil {
+		return withClass(ErrInvalidArgument, errors.New("Missing adaptive bitrate configuration"))
+	}
+	config, err = config.validate(ctx.knownCapabilities())
+	if err != nil {
+		return
+	}
+	return uiStreamStart(ctx, format, true, config.InitialBitrate, config)
+}
+
+// SessionGetUIStreamStats returns the measurements of the UI stream.
+func SessionGetUIStreamStats(ctx *SessionContext) (stats *UIStreamStats, err error) {
+	ctx.mutex.Lock()
+	abr := ctx.uiABR
+	ctx.mutex.Unlock()
+	if abr == nil {
+		return nil, withClass(ErrInvalidState, errors.New("UI is not streaming"))
+	}
+	return abr.stats(), nil
+}
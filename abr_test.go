@@ -0,0 +1,192 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+const (
+	testFrameInterval = 40 * time.Millisecond // 25 fps
+	testGOPSize       = 50                    // A key frame every 2 seconds
+)
+
+// simulateABR feeds frames to the controller, the i-th frame has the presentation time media(i), arrives at arrival(i)
+// and is preceded by the given number of bytes. It returns the index of the frame at which the controller asked to
+// reconnect, -1 if it did not.
+func simulateABR(t *testing.T, abr *abrController, frames int, media func(i int) time.Duration,
+	arrival func(i int) time.Duration, frameBytes int) int {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < frames; i++ {
+		abr.addBytes(frameBytes)
+		isKeyFrame := i%testGOPSize == 0
+		if abr.onFrame(media(i), isKeyFrame, start.Add(arrival(i))) {
+			if !isKeyFrame {
+				t.Errorf("reconnect requested at frame %d which is not a key frame", i)
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func realTime(i int) time.Duration {
+	return time.Duration(i) * testFrameInterval
+}
+
+func TestABRControllerOnFrame(t *testing.T) {
+	config, err := (&AdaptiveBitrateConfig{MinBitrate: 1000000, MaxBitrate: 8000000, InitialBitrate: 4000000}).validate(nil)
+	if err != nil {
+		t.Fatalf("validate() failed: %v", err)
+	}
+	// Frames of the initial bitrate, and frames large enough for the throughput not to limit the bitrate
+	frameBytes := config.InitialBitrate / 8 / 25
+	largeFrameBytes := 10 * frameBytes
+
+	tests := []struct {
+		name        string
+		config      *AdaptiveBitrateConfig
+		frames      int
+		media       func(i int) time.Duration
+		arrival     func(i int) time.Duration
+		frameBytes  int
+		wantSwitch  bool
+		minFrame    int // The earliest frame at which the switch may happen
+		wantBitrate int
+	}{
+		{"headroom steps up after the headroom delay", config, 1000, realTime, realTime, frameBytes,
+			true, int(config.HeadroomDelay / testFrameInterval), int(float64(config.InitialBitrate) * config.StepUp)},
+		{"falling behind steps down to the throughput", config, 1000, realTime, func(i int) time.Duration {
+			return realTime(i) * 5 / 4 // 80% of real time
+		}, frameBytes, true, int(config.CongestionDelay / (testFrameInterval * 5 / 4)),
+			// 20 frames per second are received
+			int(float64(20*frameBytes*8) * _ABR_THROUGHPUT_SAFETY)},
+		{"jitter steps down", config, 1000, realTime, func(i int) time.Duration {
+			return realTime(i) + time.Duration(i%2)*400*time.Millisecond
+		}, largeFrameBytes, true, int(config.CongestionDelay / testFrameInterval),
+			int(float64(config.InitialBitrate) * config.StepDown)},
+		{"in between the thresholds", config, 1000, realTime, func(i int) time.Duration {
+			return realTime(i) * 100 / 95
+		}, frameBytes, false, 0, config.InitialBitrate},
+		{"too high ratio is a discontinuity", config, 1000, func(i int) time.Duration {
+			return realTime(i) * 3
+		}, realTime, frameBytes, false, 0, config.InitialBitrate},
+		{"negative ratio is a discontinuity", config, 1000, func(i int) time.Duration {
+			return -realTime(i)
+		}, realTime, frameBytes, false, 0, config.InitialBitrate},
+		{"fixed bitrate", nil, 1000, realTime, func(i int) time.Duration {
+			return realTime(i) * 2
+		}, frameBytes, false, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			abr := newABRController(test.config, 0)
+			frame := simulateABR(t, abr, test.frames, test.media, test.arrival, test.frameBytes)
+			if !test.wantSwitch {
+				if frame >= 0 {
+					t.Errorf("reconnect requested at frame %d", frame)
+				}
+			} else if frame < test.minFrame {
+				t.Errorf("reconnect requested at frame %d, want at least %d", frame, test.minFrame)
+			}
+			stats := abr.stats()
+			if stats.Bitrate != test.wantBitrate {
+				t.Errorf("bitrate %d, want %d", stats.Bitrate, test.wantBitrate)
+			}
+			if wantSwitches := map[bool]int{false: 0, true: 1}[test.wantSwitch]; stats.Switches != wantSwitches {
+				t.Errorf("%d switches, want %d", stats.Switches, wantSwitches)
+			}
+			if stats.Adaptive != (test.config != nil) {
+				t.Errorf("adaptive %v, want %v", stats.Adaptive, test.config != nil)
+			}
+		})
+	}
+}
+
+func TestABRControllerLimits(t *testing.T) {
+	config, _ := (&AdaptiveBitrateConfig{MinBitrate: 1000000, MaxBitrate: 2000000, InitialBitrate: 2000000}).validate(nil)
+	abr := newABRController(config, 0)
+	if frame := simulateABR(t, abr, 1000, realTime, realTime, 10000); frame >= 0 {
+		t.Errorf("stepped up at the maximum bitrate at frame %d", frame)
+	}
+
+	// Stepping down is clamped to the minimum, after which the bitrate is kept
+	slow := func(i int) time.Duration { return realTime(i) * 2 }
+	abr = newABRController(config, 0)
+	if frame := simulateABR(t, abr, 1000, realTime, slow, 100); frame < 0 {
+		t.Fatal("did not step down")
+	}
+	if bitrate := abr.getBitrate(); bitrate != config.MinBitrate {
+		t.Errorf("bitrate %d, want the minimum %d", bitrate, config.MinBitrate)
+	}
+	abr.reset()
+	if frame := simulateABR(t, abr, 1000, realTime, slow, 100); frame >= 0 {
+		t.Errorf("stepped down below the minimum at frame %d", frame)
+	}
+}
+
+func TestABRControllerThroughput(t *testing.T) {
+	abr := newABRController(nil, 3000000)
+	simulateABR(t, abr, 100, realTime, realTime, 10000)
+	stats := abr.stats()
+	// 25 frames of 10000 bytes per second
+	if want := 25 * 10000 * 8; stats.Throughput != want {
+		t.Errorf("throughput %d, want %d", stats.Throughput, want)
+	}
+	if stats.Jitter != 0 {
+		t.Errorf("jitter %v, want 0", stats.Jitter)
+	}
+	if stats.Bitrate != 3000000 {
+		t.Errorf("bitrate %d, want 3000000", stats.Bitrate)
+	}
+}
+
+func TestAdaptiveBitrateConfigValidate(t *testing.T) {
+	caps := &Capabilities{Reported: true, MinBitrate: 500000, MaxBitrate: 4000000}
+	tests := []struct {
+		name    string
+		config  AdaptiveBitrateConfig
+		caps    *Capabilities
+		min     int
+		max     int
+		initial int
+	}{
+		{"defaults", AdaptiveBitrateConfig{MinBitrate: 1000000, MaxBitrate: 3000000}, nil, 1000000, 3000000, 2000000},
+		{"initial clamped", AdaptiveBitrateConfig{MinBitrate: 1000000, MaxBitrate: 3000000, InitialBitrate: 100},
+			nil, 1000000, 3000000, 1000000},
+		{"range clamped to the capabilities", AdaptiveBitrateConfig{MinBitrate: 100000, MaxBitrate: 8000000},
+			caps, 500000, 4000000, 2250000},
+		{"unreported capabilities ignored", AdaptiveBitrateConfig{MinBitrate: 100000, MaxBitrate: 8000000},
+			&Capabilities{MinBitrate: 500000, MaxBitrate: 4000000}, 100000, 8000000, 4050000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := test.config.validate(test.caps)
+			if err != nil {
+				t.Fatalf("validate() failed: %v", err)
+			}
+			if c.MinBitrate != test.min || c.MaxBitrate != test.max || c.InitialBitrate != test.initial {
+				t.Errorf("got %d-%d from %d, want %d-%d from %d", c.MinBitrate, c.MaxBitrate, c.InitialBitrate,
+					test.min, test.max, test.initial)
+			}
+			if c.StepDown != _ABR_STEP_DOWN || c.StepUp != _ABR_STEP_UP || c.MaxJitter != _ABR_MAX_JITTER {
+				t.Errorf("defaults not applied: %+v", c)
+			}
+		})
+	}
+
+	for _, config := range []AdaptiveBitrateConfig{
+		{},
+		{MinBitrate: 2000000, MaxBitrate: 1000000},
+		{MinBitrate: 1000000, MaxBitrate: 2000000, StepDown: 1.5},
+		{MinBitrate: 1000000, MaxBitrate: 2000000, StepUp: 0.5},
+	} {
+		if _, err := config.validate(nil); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("validate(%+v) returned %v, want ErrInvalidArgument", config, err)
+		}
+	}
+}
@@ -9,6 +9,18 @@
 //  - Inject input to a session
 //  - Control channel implementation using HTTP long polling
 //  - UI video streaming and demuxing
+//  - Session state machine with lifecycle events (see SessionGetState() and SessionSubscribe())
+//  - Navigation, local history model and tabs (see SessionNavigate() and SessionTabOpen())
+//  - Persisting a session handle and re-attaching to a running session (see SessionAttach())
+//  - Cookie stores persisting the load balancer cookies (see SessionOptions and FileCookieStore)
+//  - Failover among several servers (see ServerPool)
+//  - Server capabilities and automatic UI format selection (see SessionGetCapabilities())
+//  - Adaptive UI bitrate based on the measured throughput (see SessionUIStreamStartAdaptive())
+//  - Automatic UI stream reconnection with discontinuity signalling (see UIDiscontinuityListener)
+//  - UI frames with codec config signalling and 90 kHz timestamps (see UIFrameListener)
+//  - H.264 and HEVC UI streams in Annex B or AVCC format (see SessionSetUIBitstreamFormat())
+//  - Recording the UI to MPEG-TS or fragmented MP4 files, with a ring buffer mode (see UIRecorder)
+//  - Serving the UI to local players as live HLS or continuous MPEG-TS over HTTP (see SessionUIProxyStart())
 //
 // The client needs to implement the AppFlingerListener interface in order to process the control channel commands.
 // An example is available under examples/stub.go which is just a stub implementation of the AppFlingerListener interface.
@@ -20,7 +32,7 @@ package appflinger
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -29,15 +41,11 @@ import (
 	"log"
 	"math"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"strconv"
 	"strings"
-
-	"github.com/nareix/joy4/av"
-	"github.com/nareix/joy4/codec/h264parser"
-	"github.com/nareix/joy4/format/ts"
-	"golang.org/x/net/publicsuffix"
+	"sync"
+	"time"
 )
 
 const (
@@ -64,6 +72,17 @@ const (
 	_SESSION_CONTROL_URL          = "${PROTHOST}/osb/session/control?session_id=${SID}"
 	_SESSION_CONTROL_RESPONSE_URL = "${PROTHOST}/osb/session/control/response?session_id=${SID}"
 	_SESSION_UI_URL               = "${PROTHOST}/osb/session/ui?session_id=${SID}&fmt=${FMT}&ts_discon=${TSDISCON}"
+	_SESSION_EVENT_CHANNEL_URL    = "${PROTHOST}/osb/session/event/channel?session_id=${SID}"
+	_SESSION_TAB_URL              = "${PROTHOST}/osb/session/tab?session_id=${SID}&action=${ACTION}"
+	_SESSION_CAPABILITIES_URL     = "${PROTHOST}/osb/session/capabilities?session_id=${SID}"
+
+	// UI stream reconnection backoff, the stream fails when it cannot be reconnected for longer than the timeout
+	_UI_RECONNECT_MIN_DELAY = 250 * time.Millisecond
+	_UI_RECONNECT_MAX_DELAY = 8 * time.Second
+	_UI_RECONNECT_TIMEOUT   = time.Minute
+
+	// A UI stream which delivers no frame for this long is reconnected
+	_UI_STALL_TIMEOUT = 10 * time.Second
 
 	// Keyboard codes for injecting events
 	KEY_UP        = 0x26
@@ -76,6 +95,7 @@ const (
 
 	// Media formats supported for UI stream
 	UI_FMT_TS_H264  = "mp2t;h264"
+	UI_FMT_TS_HEVC  = "mp2t;hevc"
 	UI_FMT_MP4_H264 = "mp4;h264"
 	UI_FMT_MP4_AV1  = "mp4;av1"
 	UI_FMT_WEBM_VP8 = "webm;vp8"
@@ -101,11 +121,16 @@ const (
 
 	// Do not read more than this number of bytes as a safety mechanism against attacks, etc.
 	_HTTP_MAX_RESPONSE_SIZE = 10000000
+
+	// How long SessionStop() waits for the UI proxy, the UI streaming, the UI recording and the control channel to end
+	// before stopping the session anyway, this deadline also bounds the request which stops the session
+	_SESSION_STOP_DRAIN_TIMEOUT = 5 * time.Second
 )
 
 // Allowed formats for streaming
 var _ALLOWED_UI_FMT = map[string]bool{
 	UI_FMT_TS_H264:  true,
+	UI_FMT_TS_HEVC:  true,
 	UI_FMT_MP4_H264: true,
 	UI_FMT_MP4_AV1:  true,
 	UI_FMT_WEBM_VP8: true,
@@ -119,17 +144,43 @@ var _ALLOWED_UI_FMT = map[string]bool{
 
 // The struct to which the JSON returned after successfully starting a session is parsed.
 type sessionStartResp struct {
-	SessionID string
+	SessionID    string
+	Capabilities *Capabilities // Reported by newer servers, see SessionGetCapabilities()
 }
 
 // SessionContext is returned when starting a session and needs to be passed to subsequent operations on the session.
 type SessionContext struct {
-	SessionId                               string
-	appflingerListener                      AppflingerListener
-	CookieJar                               *cookiejar.Jar
-	ServerProtocolHost                      string
-	isUIStreaming                           bool
-	shouldStopSession, shouldStopUI, isDone chan bool
+	SessionId            string
+	appflingerListener   AppflingerListener
+	CookieJar            http.CookieJar  // The SessionOptions.CookieStore if given, otherwise an in-memory jar
+	ServerProtocolHost   string          // The server running the session, see SessionOptions.ServerPool
+	startParams          string          // The /osb/session/start parameters other than the address and the session id
+	transports           *httpTransports // The pooled transports of the session, see HTTPConfig
+	httpClient           *http.Client    // Shared by all API requests of the session
+	controlClient        *http.Client    // Used by the control channel long polling
+	inputChannel         *inputChannel   // Non nil while the input channel is active
+	mutex                sync.Mutex
+	shouldStopSession    chan bool
+	controlDone          chan bool      // Closed when the control channel go routine exits
+	shouldStopUI, uiDone chan bool      // Created per UI stream, guarded by the mutex
+	uiABR                *abrController // The measurements of the UI stream, guarded by the mutex
+	uiFormat             string         // The arguments of the last SessionUIStreamStart(), guarded by the mutex
+	uiTsDiscon           bool
+	uiBitrate            int
+	uiBitstream          int            // See SessionSetUIBitstreamFormat(), guarded by the mutex
+	uiSinks              []*uiFrameSink // See SessionAddUIFrameSink(), guarded by the mutex
+	nextUISinkId         int
+	uiConfigFrames       [2]*UIFrame // The last codec config frames of the video and the audio, guarded by the mutex
+	uiRecorder           *UIRecorder // See SessionUIRecordStart(), guarded by the mutex
+	uiRecorderSinkId     int
+	uiProxy              *UIProxy // See SessionUIProxyStart(), guarded by the mutex
+	stopOnce, doneOnce   sync.Once
+	stopErr              error               // The result of SessionStop()
+	done                 chan bool           // Closed when the session ended, see SessionWait()
+	err                  error               // The terminal error of the session, valid once done is closed
+	state                sessionStateMachine // See SessionGetState() and SessionSubscribe()
+	nav                  navigation          // See SessionGetHistory() and the tab functions
+	capabilities         *Capabilities       // Nil until known, guarded by the mutex
 }
 
 // The struct to which the JSON received in a control channel as a request, is parsed.
@@ -356,13 +407,27 @@ type AppflingerListener interface {
 
 	// Misc Go SDK functions
 
+	// OnUIFrame is passed the frames of the UI stream, see UIFrame for the meaning of the arguments
+	// (the timestamps are in UI_TIMESCALE units).
 	OnUIFrame(sessionId string, isCodecConfig bool, isKeyFrame bool, idx int, pts int, dts int, data []byte) (err error)
 }
 
+// UIDiscontinuityListener can be implemented in addition to AppflingerListener in order to be notified of
+// discontinuities in the UI stream, e.g. when it is reconnected after a network error. OnUIDiscontinuity() is called
+// before the first frame following the discontinuity, which is a key frame, so that the decoder can be reset.
+// The timestamps of the frames which follow are not continuous with the previous ones.
+type UIDiscontinuityListener interface {
+	OnUIDiscontinuity(sessionId string) (err error)
+}
+
 var (
-	ErrInterrupted  = errors.New("Aborting due to interrupt")
-	globalRequestId = 0
-	sessionIdToCtx  = make(map[string]*SessionContext)
+	ErrInterrupted     = errors.New("Aborting due to interrupt")
+	errUIFrameListener = errors.New("UI frame listener failed")
+	globalRequestId    = 0
+
+	// The contexts of the running sessions by session id, see SessionGetSessionContext()
+	sessionIdToCtxMutex sync.Mutex
+	sessionIdToCtx      = make(map[string]*SessionContext)
 )
 
 func getRequestId() string {
@@ -917,6 +982,7 @@ func processRPCRequest(req *controlChannelRequest, payload []byte, appf Appfling
 // The caller needs to implement the AppFlinger interface and pass it as an argument to this function.
 func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error) {
 	shouldReset := true
+	isConnected := false
 	var postMessage []byte = nil
 
 	// Construct the URL
@@ -931,18 +997,6 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 	}
 	uri = replaceVars(uri, vars, vals)
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	defer tr.CloseIdleConnections()
-
-	var client http.Client
-	if ctx.CookieJar != nil {
-		client = http.Client{Jar: ctx.CookieJar, Transport: tr}
-	} else {
-		client = http.Client{Transport: tr}
-	}
-
 	errChan := make(chan error, 1)
 	for {
 		uri := uri
@@ -953,11 +1007,12 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 
 		var httpReq *http.Request
 		var httpRes *http.Response
-		httpReq, err = http.NewRequest("POST", uri, bytes.NewReader(postMessage))
+		reqCtx, cancel := context.WithCancel(context.Background())
+		httpReq, err = http.NewRequestWithContext(reqCtx, "POST", uri, bytes.NewReader(postMessage))
 		if err != nil {
+			cancel()
 			err = fmt.Errorf("Control channel HTTP request creation failed with error: %v", err)
 			log.Println(err)
-			ctx.isDone <- true
 			return
 		}
 
@@ -970,33 +1025,37 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 		// The request is made in a go function so that we can cancel it when requested to do so
 
 		go func() {
-			httpRes, err = client.Do(httpReq)
-			if err != nil {
-				err = fmt.Errorf("Control channel HTTP request failed with error: %v", err)
-				log.Println(err)
+			var e error
+			httpRes, e = ctx.controlClient.Do(httpReq)
+			if e != nil {
+				e = fmt.Errorf("Control channel HTTP request failed with error: %v", e)
+				log.Println(e)
 			}
-			errChan <- err
+			errChan <- e
 		}()
 
 		// Wait for the http request to complete
 		select {
 		case <-ctx.shouldStopSession:
-			tr.CancelRequest(httpReq)
-			ctx.isDone <- true
+			cancel()
 			err = ErrInterrupted
 			return
 		case err = <-errChan:
 			if err != nil {
-				ctx.isDone <- true
+				cancel()
 				return
 			}
 		}
 
+		httpRes.Body = &cancelOnClose{ReadCloser: httpRes.Body, cancel: cancel}
 		if httpRes.StatusCode != http.StatusOK {
 			err = fmt.Errorf("Control channel HTTP request failed with status: %s", httpRes.Status)
+			if httpRes.StatusCode == http.StatusNotFound || httpRes.StatusCode == http.StatusGone {
+				// The server no longer knows the session, i.e. it was terminated by the server
+				err = withClass(ErrSessionNotFound, err)
+			}
 			log.Println(err)
 			httpRes.Body.Close()
-			ctx.isDone <- true
 			return
 		}
 		if httpRes.Header.Get("Content-Type") != "text/json" {
@@ -1004,9 +1063,12 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 			log.Println(msg)
 			err = errors.New(msg)
 			httpRes.Body.Close()
-			ctx.isDone <- true
 			return
 		}
+		if !isConnected {
+			isConnected = true
+			ctx.state.event(SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_RUNNING, nil)
+		}
 
 		var body []byte
 		// Invoke the decode function in a go routine since it can block
@@ -1018,7 +1080,6 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 		select {
 		case <-ctx.shouldStopSession:
 			httpRes.Body.Close()
-			ctx.isDone <- true
 			err = ErrInterrupted
 			return
 		case err = <-errChan:
@@ -1028,7 +1089,6 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 			err = fmt.Errorf("Failed to read response from control channel with error: %v", err)
 			log.Println(err)
 			httpRes.Body.Close()
-			ctx.isDone <- true
 			return
 		}
 
@@ -1038,7 +1098,6 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 			err = fmt.Errorf("Invalid response from control channel, missing end of message newlines")
 			log.Println(err)
 			httpRes.Body.Close()
-			ctx.isDone <- true
 			return
 		}
 
@@ -1060,14 +1119,16 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 			case <-ctx.shouldStopSession:
 				err = ErrInterrupted
 				httpRes.Body.Close()
-				ctx.isDone <- true
 				return
 			default:
 			}
 
 			// This is most likely a timeout
 			log.Println("Failed to parse control channel HTTP response body with error: ", err)
+			httpRes.Body.Close()
 			shouldReset = true
+			isConnected = false
+			ctx.state.event(SESSION_EVENT_CONTROL_CHANNEL_DOWN, SESSION_STATE_RECONNECTING, err)
 			postMessage = nil
 			continue
 		}
@@ -1093,96 +1154,138 @@ func controlChannelRun(ctx *SessionContext, appf AppflingerListener) (err error)
 		if err != nil {
 			log.Println("Failed to process RPC message: ", req)
 			postMessage = nil
+		} else if req.Service == "onPageLoad" {
+			ctx.state.event(SESSION_EVENT_PAGE_LOAD, _SESSION_STATE_UNCHANGED, nil)
+		} else if req.Service == "onPageClose" {
+			ctx.state.event(SESSION_EVENT_PAGE_CLOSE, _SESSION_STATE_UNCHANGED, nil)
+		} else if req.Service == "onAddressBarChanged" {
+			ctx.nav.onAddressBarChanged(req.URL)
+		} else if req.Service == "onTitleChanged" {
+			ctx.nav.onTitleChanged(req.Title)
 		}
 		httpRes.Body.Close()
 	}
 }
 
-func printCookies(cookieJar *cookiejar.Jar, uri string) {
+func printCookies(cookieJar http.CookieJar, uri string) {
 	u, _ := url.Parse(uri)
 	for _, c := range cookieJar.Cookies(u) {
 		log.Println(c)
 	}
 }
 
-func httpReq(cookieJar *cookiejar.Jar, uri string, method string, body io.Reader, shouldStop chan bool) (io.ReadCloser, error) {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-	}
-	defer tr.CloseIdleConnections()
+// httpStatusError is returned by httpReq() when the server responds with an unexpected status.
+type httpStatusError struct {
+	statusCode int
+	msg        string
+}
 
-	var client http.Client
-	if cookieJar != nil {
-		client = http.Client{Jar: cookieJar, Transport: tr}
-	} else {
-		client = http.Client{Transport: tr}
-	}
+func (e *httpStatusError) Error() string {
+	return e.msg
+}
 
+// isHTTPStatus checks whether the given error is the result of the given HTTP status.
+func isHTTPStatus(err error, statusCode int) bool {
+	var statusErr *httpStatusError
+	return errors.As(err, &statusErr) && statusErr.statusCode == statusCode
+}
+
+func httpReq(client *http.Client, uri string, method string, body io.Reader, shouldStop chan bool) (io.ReadCloser, error) {
+	return httpReqContext(context.Background(), client, uri, method, body, shouldStop)
+}
+
+// httpReqContext is the same as httpReq() except that the request is also bounded by the given context.
+func httpReqContext(parent context.Context, client *http.Client, uri string, method string, body io.Reader, shouldStop chan bool) (io.ReadCloser, error) {
 	var err error
 	var httpReq *http.Request
 	var httpRes *http.Response
-	httpReq, err = http.NewRequest(method, uri, body)
+	reqCtx, cancel := context.WithCancel(parent)
+	httpReq, err = http.NewRequestWithContext(reqCtx, method, uri, body)
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	if shouldStop != nil {
-		errChan := make(chan error, 1)
+		type result struct {
+			res *http.Response
+			err error
+		}
+		resChan := make(chan result, 1)
 		go func() {
-			httpRes, err = client.Do(httpReq)
-			if err != nil {
-				err = fmt.Errorf("HTTP request failed with error: %v, uri: %s", err, uri)
+			res, e := client.Do(httpReq)
+			if e != nil {
+				e = withClass(ErrNetwork, fmt.Errorf("HTTP request failed with error: %w, uri: %s", e, uri))
 			}
-			errChan <- err
+			resChan <- result{res, e}
 		}()
 
 		// Wait for the http request to complete
 		select {
 		case <-shouldStop:
-			tr.CancelRequest(httpReq)
+			cancel()
+			// Release the response in case it arrived at the same time as the interruption
+			go func() {
+				if r := <-resChan; r.res != nil {
+					r.res.Body.Close()
+				}
+			}()
 			return nil, ErrInterrupted
-		case err = <-errChan:
-			if err != nil {
-				return nil, err
+		case r := <-resChan:
+			if r.err != nil {
+				cancel()
+				return nil, r.err
 			}
+			httpRes = r.res
 		}
 	} else {
 		httpRes, err = client.Do(httpReq)
 		if err != nil {
-			err = fmt.Errorf("HTTP request failed with error: %v, uri: %s", err, uri)
+			cancel()
+			err = withClass(ErrNetwork, fmt.Errorf("HTTP request failed with error: %w, uri: %s", err, uri))
 			return nil, err
 		}
 	}
 
 	if httpRes.StatusCode != http.StatusOK {
-		err = fmt.Errorf("HTTP request failed with status: %s, uri: %s", httpRes.Status, uri)
+		err = withClass(ErrServer, &httpStatusError{
+			statusCode: httpRes.StatusCode,
+			msg:        fmt.Sprintf("HTTP request failed with status: %s, uri: %s", httpRes.Status, uri),
+		})
 		httpRes.Body.Close()
+		cancel()
 		return nil, err
 	}
 
-	return httpRes.Body, nil
+	// The request context is released once the caller closes the body
+	return &cancelOnClose{ReadCloser: httpRes.Body, cancel: cancel}, nil
 }
 
-func httpGet(cookieJar *cookiejar.Jar, uri string, shouldStop chan bool) (io.ReadCloser, error) {
-	return httpReq(cookieJar, uri, http.MethodGet, nil, shouldStop)
+func httpGet(client *http.Client, uri string, shouldStop chan bool) (io.ReadCloser, error) {
+	return httpReq(client, uri, http.MethodGet, nil, shouldStop)
 }
 
-func httpPost(cookieJar *cookiejar.Jar, uri string, body []byte, shouldStop chan bool) (io.ReadCloser, error) {
+func httpPost(client *http.Client, uri string, body []byte, shouldStop chan bool) (io.ReadCloser, error) {
 	if body == nil {
-		return httpReq(cookieJar, uri, http.MethodPost, nil, shouldStop)
+		return httpReq(client, uri, http.MethodPost, nil, shouldStop)
 	} else {
-		return httpReq(cookieJar, uri, http.MethodPost, bytes.NewReader(body), shouldStop)
+		return httpReq(client, uri, http.MethodPost, bytes.NewReader(body), shouldStop)
 	}
 
 }
 
-func apiReq(cookieJar *cookiejar.Jar, uri string, body []byte, shouldStop chan bool, resp interface{}) (err error) {
+func apiReq(client *http.Client, uri string, body []byte, shouldStop chan bool, resp interface{}) (err error) {
+	return apiReqContext(context.Background(), client, uri, body, shouldStop, resp)
+}
+
+// apiReqContext is the same as apiReq() except that the request is also bounded by the given context.
+func apiReqContext(reqCtx context.Context, client *http.Client, uri string, body []byte, shouldStop chan bool, resp interface{}) (err error) {
 	var reader io.ReadCloser
 	var e error
 	if body == nil {
-		reader, e = httpReq(cookieJar, uri, http.MethodGet, nil, shouldStop)
+		reader, e = httpReqContext(reqCtx, client, uri, http.MethodGet, nil, shouldStop)
 	} else {
-		reader, e = httpReq(cookieJar, uri, http.MethodPost, bytes.NewReader(body), shouldStop)
+		reader, e = httpReqContext(reqCtx, client, uri, http.MethodPost, bytes.NewReader(body), shouldStop)
 	}
 	if e != nil {
 		return e
@@ -1220,103 +1323,249 @@ func controlChannelRoutine(ctx *SessionContext, appf AppflingerListener) {
 		// Although it is encloses in: if e.Source != nil
 		log.Println("Control channel connection ended with error")
 	}
+	close(ctx.controlDone)
+
+	if err == nil || err == ErrInterrupted {
+		// Stopped by SessionStop() which takes care of the state
+		return
+	}
+	if errors.Is(err, ErrSessionNotFound) {
+		ctx.state.event(SESSION_EVENT_TERMINATED, SESSION_STATE_STOPPED, err)
+	} else {
+		ctx.state.event(SESSION_EVENT_CONTROL_CHANNEL_DOWN, SESSION_STATE_FAILED, err)
+	}
+	ctx.finish(err)
+}
+
+// finish marks the session as ended with the given terminal error, only the first call has an effect.
+func (ctx *SessionContext) finish(err error) {
+	ctx.doneOnce.Do(func() {
+		ctx.err = err
+		close(ctx.done)
+	})
 }
 
 // SessionStart is used to start a new session or navigate an existing one to a new address.
 // The arguments to this function are as per the description of the /osb/session/start API in
 // the "AppFlinger API and Client Integration Guide".
+//
+// Deprecated: use SessionStartWithOptions(), which takes the same arguments as SessionOptions fields.
 func SessionStart(serverProtocolHost string, sessionId string, browserURL string, pullMode bool, isVideoPassthru bool, browserUIOutputURL string,
 	videoStreamURL string, width int, height int, appf AppflingerListener) (ctx *SessionContext, err error) {
-	var cookieJar *cookiejar.Jar
+	return SessionStartWithOptions(&SessionOptions{
+		ServerProtocolHost: serverProtocolHost,
+		SessionId:          sessionId,
+		BrowserURL:         browserURL,
+		PullMode:           pullMode,
+		VideoPassthru:      isVideoPassthru,
+		BrowserUIOutputURL: browserUIOutputURL,
+		VideoStreamURL:     videoStreamURL,
+		Width:              width,
+		Height:             height,
+	}, appf)
+}
+
+// SessionStartWithOptions is used to start a new session (or navigate an existing one to a new address, see also
+// SessionNavigate()). The options are checked using SessionOptions.Validate() first.
+func SessionStartWithOptions(options *SessionOptions, appf AppflingerListener) (ctx *SessionContext, err error) {
+	var cookieJar http.CookieJar
 	ctx = nil
+	if options == nil {
+		return nil, errNoOptions
+	}
+	err = options.Validate()
+	if err != nil {
+		return
+	}
 
 	// Create the cookie jar first, which needs to be used in all API requests for this session. Note that Cookies
 	// are important for load balancing stickyness such that a session start request is made without any cookies
 	// but may return a cookie when a load balancer is used. This returned cookie must be passed in any subsequent
 	// requests that need to use the session so that the load balancer will hit the correct server.
-	options := cookiejar.Options{
-		PublicSuffixList: publicsuffix.List,
-	}
-	cookieJar, err = cookiejar.New(&options)
-	if err != nil {
-		cookieJar = nil
-		return
+	if options.CookieStore != nil {
+		cookieJar = options.CookieStore
+	} else {
+		cookieJar, err = newCookieJar()
+		if err != nil {
+			cookieJar = nil
+			return
+		}
 	}
 
 	// Construct the URL
-	uri := _SESSION_START_URL
-	if !isVideoPassthru {
-		uri += "&video_stream_uri=${VURL}"
-	}
-	if pullMode {
-		uri += "&browser_ui_video_pull=yes"
-	} else {
-		uri += "&browser_ui_output_url=${UURL}"
-	}
-	if sessionId != "" {
+	params := options.startParams()
+	uri := _SESSION_START_URL + params
+	if options.SessionId != "" {
 		uri += "&session_id=${SID}"
 	}
-	if width > 0 && width <= 3840 {
-		uri += "&width=${WIDTH}"
-	}
-	if height > 0 && height <= 2160 {
-		uri += "&height=${HEIGHT}"
-	}
-
-	uri = replaceVars(uri, []string{
+	vars := []string{
 		"${PROTHOST}",
 		"${BURL}",
-		"${VURL}",
-		"${UURL}",
 		"${SID}",
-		"${WIDTH}",
-		"${HEIGHT}",
-	}, []string{
-		serverProtocolHost,
-		url.QueryEscape(browserURL),
-		url.QueryEscape(videoStreamURL),
-		url.QueryEscape(browserUIOutputURL),
-		url.QueryEscape(sessionId),
-		strconv.Itoa(width),
-		strconv.Itoa(height),
-	})
+	}
+	vals := []string{
+		"",
+		url.QueryEscape(options.BrowserURL),
+		url.QueryEscape(options.SessionId),
+	}
+
+	// The servers to try, failing over to the next one when a server cannot be connected to or fails
+	serverProtocolHost := options.ServerProtocolHost
+	hosts := []string{serverProtocolHost}
+	if options.ServerPool != nil {
+		hosts = options.ServerPool.candidates()
+		if len(hosts) == 0 {
+			return nil, withClass(ErrInvalidArgument, errors.New("Server pool is empty"))
+		}
+	}
 
 	// Make the request
 	// We get here a struct with the data returned from the server (namely the session id)
+	transports := newHTTPTransports(options.HTTPConfig)
+	client := newHTTPClient(transports.tr, cookieJar)
 	resp := &sessionStartResp{}
-	err = apiReq(cookieJar, uri, nil, nil, resp)
-	if err != nil {
+	for _, host := range hosts {
+		vals[0] = host
+		start := time.Now()
+		err = apiReq(client, replaceVars(uri, vars, vals), nil, nil, resp)
+		if options.ServerPool != nil {
+			options.ServerPool.report(host, err == nil || !serverFailed(err), time.Since(start))
+		}
+		if err == nil {
+			serverProtocolHost = host
+			break
+		}
 		log.Println("Failed to start session: ", err)
+		if !shouldFailover(err) {
+			break
+		}
+	}
+	if err != nil {
+		transports.close()
 		resp = nil
 		cookieJar = nil
 		return
 	}
+	ctx = newSessionContext(serverProtocolHost, resp.SessionID, cookieJar, transports, appf)
+	ctx.startParams = params
+	if resp.Capabilities != nil {
+		ctx.setCapabilities(resp.Capabilities)
+	}
+	for _, subscriber := range options.Subscribers {
+		SessionSubscribe(ctx, subscriber)
+	}
+	go controlChannelRoutine(ctx, appf)
+	return
+}
+
+// newSessionContext returns the context of a session which was started or attached to, the caller starts the control channel.
+func newSessionContext(serverProtocolHost string, sessionId string, cookieJar http.CookieJar, transports *httpTransports,
+	appf AppflingerListener) (ctx *SessionContext) {
 	ctx = &SessionContext{}
 	ctx.ServerProtocolHost = serverProtocolHost
-	ctx.SessionId = resp.SessionID
+	ctx.SessionId = sessionId
 	ctx.appflingerListener = appf
 	ctx.CookieJar = cookieJar
-	ctx.shouldStopSession = make(chan bool, 1)
-	ctx.shouldStopUI = make(chan bool, 1)
-	ctx.isDone = make(chan bool, 1)
+	ctx.transports = transports
+	ctx.httpClient = newHTTPClient(transports.tr, cookieJar)
+	ctx.controlClient = newHTTPClient(transports.controlTr, cookieJar)
+	ctx.shouldStopSession = make(chan bool)
+	ctx.controlDone = make(chan bool)
+	ctx.done = make(chan bool)
+	sessionIdToCtxMutex.Lock()
 	sessionIdToCtx[ctx.SessionId] = ctx
-	go controlChannelRoutine(ctx, appf)
+	sessionIdToCtxMutex.Unlock()
 	return
 }
 
-// SessionStop is used to stop a session.
+// removeSessionContext forgets the context of a stopped or detached session, unless the session was attached to again.
+func removeSessionContext(ctx *SessionContext) {
+	sessionIdToCtxMutex.Lock()
+	defer sessionIdToCtxMutex.Unlock()
+	if sessionIdToCtx[ctx.SessionId] == ctx {
+		delete(sessionIdToCtx, ctx.SessionId)
+	}
+}
+
+// newCookieJar returns the cookie jar used by all the API requests of a session. It is a MemoryCookieStore rather than
+// a net/http/cookiejar.Jar so that SessionGetHandle() can save the attributes of the cookies.
+func newCookieJar() (http.CookieJar, error) {
+	return NewMemoryCookieStore(), nil
+}
+
+// SessionStop is used to stop a session. It can be called more than once, subsequent calls return the result of the first.
+// It waits for the control channel and the UI streaming to end for a bounded time and then stops the session on the
+// server anyway.
 func SessionStop(ctx *SessionContext) (err error) {
+	ctx.stopOnce.Do(func() {
+		ctx.stopErr = sessionStop(ctx, true)
+	})
+	return ctx.stopErr
+}
 
-	// Stop and Wait for ui streaming to complete
-	if ctx.isUIStreaming {
-		SessionUIStreamStop(ctx)
+// sessionStop stops the go routines of the session and the session on the server if stopServer is set.
+func sessionStop(ctx *SessionContext, stopServer bool) (err error) {
+	if ctx.state.getState() != SESSION_STATE_STOPPED {
+		ctx.state.setState(SESSION_STATE_STOPPING)
+		defer ctx.state.setState(SESSION_STATE_STOPPED)
+	}
+	deadline, cancel := context.WithTimeout(context.Background(), _SESSION_STOP_DRAIN_TIMEOUT)
+	defer cancel()
+	defer ctx.transports.close()
+	defer removeSessionContext(ctx)
+
+	// Stop serving the UI to the local players
+	ctx.mutex.Lock()
+	proxying := ctx.uiProxy != nil
+	ctx.mutex.Unlock()
+	if proxying {
+		waitWithDeadline(deadline, "the UI proxy to stop", func() {
+			SessionUIProxyStop(ctx)
+		})
 	}
 
-	// Stop the control channel go routine and the ui steaming go routine
-	close(ctx.shouldStopSession)
+	// Stop and wait for ui streaming to complete
+	ctx.mutex.Lock()
+	shouldStopUI, uiDone := ctx.shouldStopUI, ctx.uiDone
+	ctx.shouldStopUI, ctx.uiDone, ctx.uiABR = nil, nil, nil
+	ctx.mutex.Unlock()
+	if shouldStopUI != nil {
+		close(shouldStopUI)
+		select {
+		case <-uiDone:
+		case <-deadline.Done():
+			log.Println("Timed out waiting for the UI streaming to end")
+		}
+	}
 
-	// Wait for control channel to confirm
-	<-ctx.isDone
+	// Complete the recording of the UI
+	ctx.mutex.Lock()
+	recording := ctx.uiRecorder != nil
+	ctx.mutex.Unlock()
+	if recording {
+		waitWithDeadline(deadline, "the UI recording to complete", func() {
+			if err := SessionUIRecordStop(ctx); err != nil {
+				log.Println("Failed to record the UI: ", err)
+			}
+		})
+	}
+
+	// Flush and close the input channel
+	if ctx.getInputChannel() != nil {
+		SessionInputChannelStop(ctx)
+	}
+
+	// Stop the control channel go routine and wait for it to confirm
+	close(ctx.shouldStopSession)
+	select {
+	case <-ctx.controlDone:
+	case <-deadline.Done():
+		log.Println("Timed out waiting for the control channel to end")
+	}
+	if !stopServer {
+		ctx.finish(nil)
+		return
+	}
 
 	// Construct the URL
 	uri := replaceVars(_SESSION_STOP_URL, []string{
@@ -1328,14 +1577,36 @@ func SessionStop(ctx *SessionContext) (err error) {
 	})
 
 	// Make the request
-	err = apiReq(ctx.CookieJar, uri, nil, nil, nil)
+	err = apiReqContext(deadline, ctx.httpClient, uri, nil, nil, nil)
 	if err != nil {
 		log.Println("Failed to stop session: ", err)
-		return
 	}
+	ctx.finish(err)
 	return
 }
 
+// waitWithDeadline runs fn and waits for it to return until the deadline, after which it completes in the background.
+func waitWithDeadline(deadline context.Context, what string, fn func()) {
+	done := make(chan bool)
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-deadline.Done():
+		log.Println("Timed out waiting for " + what)
+	}
+}
+
+// SessionWait blocks until the session ends and returns its terminal error. This is nil when the session was stopped
+// by SessionStop() successfully, an error of class ErrSessionNotFound when the server terminated the session, or the
+// error of the control channel when it failed.
+func SessionWait(ctx *SessionContext) (err error) {
+	<-ctx.done
+	return ctx.err
+}
+
 func SessionGetSessionId(ctx *SessionContext) (sessionId string, err error) {
 	sessionId = ctx.SessionId
 	err = nil
@@ -1343,73 +1614,51 @@ func SessionGetSessionId(ctx *SessionContext) (sessionId string, err error) {
 }
 
 func SessionGetSessionContext(sessionId string) (ctx *SessionContext, err error) {
+	sessionIdToCtxMutex.Lock()
 	ctx = sessionIdToCtx[sessionId]
+	sessionIdToCtxMutex.Unlock()
+	if ctx == nil {
+		err = ErrSessionNotFound
+		return
+	}
 	err = nil
 	return
 }
 
-// SessionSendEvent is used to inject input into a session.
+// SessionSendEvent is used to inject key and click input into a session, see SessionSendInputEvent() for other input types.
+// When the input channel is active (see SessionInputChannelStart()) the event is queued for sending over it and
+// this function returns without waiting for the server, otherwise a request is made to /osb/session/event.
 func SessionSendEvent(ctx *SessionContext, eventType string, code int, char rune, mod int, x int, y int) (err error) {
-	// Construct the URL
-	uri := _SESSION_EVENT_URL
 	eventType = strings.ToLower(eventType)
-	if eventType == "key" || eventType == "keydown" || eventType == "keyup" {
-		uri += "&code=${KEYCODE}"
-	} else if eventType == "click" {
-		uri += "&x=${X}&y=${Y}"
-	} else {
-		err = errors.New("Invalid event type: " + eventType)
+	if eventType != INPUT_EVENT_KEY && eventType != INPUT_EVENT_KEYDOWN && eventType != INPUT_EVENT_KEYUP && eventType != INPUT_EVENT_CLICK {
+		err = withClass(ErrInvalidArgument, errors.New("Invalid event type: "+eventType))
 		return
 	}
 
-	if char > 0 {
-		uri += "&char=${CHAR}"
-	}
-
-	if mod > 0 {
-		uri += "&mod=${MOD}"
-	}
-
-	uri = replaceVars(uri, []string{
-		"${PROTHOST}",
-		"${SID}",
-		"${TYPE}",
-		"${KEYCODE}",
-		"${CHAR}",
-		"${MOD}",
-		"${X}",
-		"${Y}",
-	}, []string{
-		ctx.ServerProtocolHost,
-		url.QueryEscape(ctx.SessionId),
-		eventType,
-		strconv.Itoa(code),
-		strconv.Itoa(int(char)),
-		strconv.Itoa(mod),
-		strconv.Itoa(x),
-		strconv.Itoa(y),
+	err = SessionSendInputEvent(ctx, &InputEvent{
+		Type: eventType,
+		Code: code,
+		Char: char,
+		Mod:  mod,
+		X:    x,
+		Y:    y,
 	})
-
-	// Make the request
-	err = apiReq(ctx.CookieJar, uri, nil, ctx.shouldStopSession, nil)
 	return
 }
 
 // SessionGetUIURL is used to obtain the HTTP URL from which the browser UI can be streamed.
 // Note that one should also consider the cookies for that URL before making the HTTP request.
 func SessionGetUIURL(ctx *SessionContext, fmt string, tsDiscon bool, bitrate int) (uri string, err error) {
-	err = nil
+	fmt, bitrate, err = checkUIFormat(ctx, fmt, bitrate)
+	if err != nil {
+		return
+	}
 
 	// Construct the URL
 	uri = _SESSION_UI_URL
 	if bitrate > 0 {
 		uri += "&bitrate=${BITRATE}"
 	}
-
-	if !_ALLOWED_UI_FMT[fmt] {
-		err = errors.New("Invalid format: " + fmt)
-		return
-	}
 	tsDisconStr := "0"
 	if tsDiscon {
 		tsDisconStr = "1"
@@ -1444,134 +1693,274 @@ func SessionGetURLCookies(ctx *SessionContext, uri string) (cookies []*http.Cook
 	return
 }
 
-func pktToBitstream(videoCodecData av.VideoCodecData, pkt *av.Packet) (data []byte) {
-	if videoCodecData.Type() == av.H264 {
-		// Prepare the h264 bitstream
-		h264CodecData := videoCodecData.(h264parser.CodecData)
+// uiStream streams the UI until stopped or failed. The stream is reconnected with a new bitrate when the abrController
+// decides so, and with a backoff when the connection fails after having been established.
+func uiStream(ctx *SessionContext, format string, tsDiscon bool, abr *abrController, shouldStop chan bool) (err error) {
+	connected := false
+	buffering := false
+	delay := _UI_RECONNECT_MIN_DELAY
+	var failedSince time.Time // Start of the ongoing reconnection, zero while frames are flowing
+	ctx.mutex.Lock()
+	var alloc func(size int) []byte
+	if allocator, ok := ctx.appflingerListener.(UIFrameBufferAllocator); ok {
+		alloc = func(size int) []byte {
+			return allocator.GetUIFrameBuffer(ctx.SessionId, size)
+		}
+	}
+	framer := newUIFramer(ctx.uiBitstream, alloc)
+	ctx.uiConfigFrames = [2]*UIFrame{}
+	ctx.mutex.Unlock()
+	for {
+		var uri string
+		uri, err = SessionGetUIURL(ctx, format, tsDiscon, abr.getBitrate())
+		if err != nil {
+			return
+		}
+
+		var reader io.ReadCloser
+		reader, err = httpGet(ctx.httpClient, uri, shouldStop)
+		if err == nil {
+			abr.reset()
+			if !connected {
+				ctx.state.event(SESSION_EVENT_UI_STREAM_STARTED, _SESSION_STATE_UNCHANGED, nil)
+			}
 
-		// Add SPS/PPS before each key frame
-		if pkt.IsKeyFrame {
-			data = append(data, h264parser.StartCodeBytes...)
-			data = append(data, h264CodecData.SPS()...)
-			data = append(data, h264parser.StartCodeBytes...)
-			data = append(data, h264CodecData.PPS()...)
+			// After a reconnection the frames preceding the first key frame cannot be decoded
+			discontinuity := connected
+			connected = true
+			err = uiStreamDemux(ctx, &countingReader{reader, abr}, abr, framer, discontinuity, func() error {
+				failedSince = time.Time{}
+				delay = _UI_RECONNECT_MIN_DELAY
+				if buffering {
+					buffering = false
+					ctx.state.event(SESSION_EVENT_UI_STREAM_RESUMED, _SESSION_STATE_UNCHANGED, nil)
+				}
+				if discontinuity {
+					framer.setDiscontinuity()
+					return uiDiscontinuity(ctx)
+				}
+				return nil
+			}, shouldStop)
+			reader.Close()
+
+			if err == errUIBitrateSwitch {
+				bitrate := abr.getBitrate()
+				log.Println("Switching UI bitrate to: ", bitrate)
+				ctx.mutex.Lock()
+				ctx.uiBitrate = bitrate
+				ctx.mutex.Unlock()
+				ctx.state.event(SESSION_EVENT_UI_BITRATE_CHANGED, _SESSION_STATE_UNCHANGED, nil)
+
+				// The timestamps of the new stream are not continuous with the previous ones
+				tsDiscon = true
+				continue
+			}
+		} else if err != ErrInterrupted {
+			err = fmt.Errorf("Failed HTTP request for UI streaming: %w", err)
 		}
 
-		pktnalus, _ := h264parser.SplitNALUs(pkt.Data)
-		for _, nalu := range pktnalus {
-			data = append(data, h264parser.StartCodeBytes...)
-			data = append(data, nalu...)
+		// Only reconnect a stream which was established, failing to connect in the first place is reported as is
+		if !connected || !shouldReconnectUI(err) {
+			return
 		}
-	} else {
-		data = pkt.Data
+		if failedSince.IsZero() {
+			failedSince = time.Now()
+		} else if time.Since(failedSince) > _UI_RECONNECT_TIMEOUT {
+			return
+		}
+		if !buffering {
+			buffering = true
+			log.Println("UI stream interrupted, reconnecting: ", err)
+			ctx.state.event(SESSION_EVENT_UI_STREAM_BUFFERING, _SESSION_STATE_UNCHANGED, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-shouldStop:
+			timer.Stop()
+			return ErrInterrupted
+		case <-ctx.done:
+			// The session ended, there is nothing to reconnect to
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		delay *= 2
+		if delay > _UI_RECONNECT_MAX_DELAY {
+			delay = _UI_RECONNECT_MAX_DELAY
+		}
+		tsDiscon = true
 	}
-	return
 }
 
-func uiStream(ctx *SessionContext, uri string) (err error) {
-	var reader io.ReadCloser
-	reader, err = httpGet(ctx.CookieJar, uri, ctx.shouldStopUI)
-	if err != nil {
-		err = fmt.Errorf("Failed HTTP request for UI streaming: %v", err)
-		return
+// shouldReconnectUI checks whether a UI stream which failed with the given error should be reconnected.
+func shouldReconnectUI(err error) bool {
+	if err == ErrInterrupted || errors.Is(err, errUIFrameListener) {
+		return false
 	}
-	defer reader.Close()
-
-	demuxer := ts.NewDemuxer(reader)
-	if demuxer == nil {
-		err = errors.New("Failed to create MPEG2TS demuxer from reader, uri: " + uri)
-		return
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		// E.g. the session no longer exists
+		return statusErr.statusCode >= http.StatusInternalServerError
 	}
+	return true
+}
 
-	var videoCodecData av.VideoCodecData
-	streams, _ := demuxer.Streams()
-	for _, stream := range streams {
-		if stream.Type().IsAudio() {
-			//astream := stream.(av.AudioCodecData)
-		} else if stream.Type().IsVideo() {
-			videoCodecData = stream.(av.VideoCodecData)
-		}
+// uiDiscontinuity notifies the listener of a discontinuity in the UI stream, if it implements UIDiscontinuityListener.
+func uiDiscontinuity(ctx *SessionContext) (err error) {
+	listener, ok := ctx.appflingerListener.(UIDiscontinuityListener)
+	if !ok {
+		return nil
+	}
+	err = listener.OnUIDiscontinuity(ctx.SessionId)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", errUIFrameListener, err)
 	}
+	return
+}
+
+// uiStreamDemux demuxes a UI stream connection and passes the frames to the listener. When skipToKeyFrame is set
+// the frames preceding the first key frame are dropped. onFirstFrame is called before passing the first frame.
+func uiStreamDemux(ctx *SessionContext, reader io.Reader, abr *abrController, framer *uiFramer, skipToKeyFrame bool, onFirstFrame func() error,
+	shouldStop chan bool) (err error) {
+	demuxer := newUITsDemuxer(reader)
 
 	// Double buffer the packets, we read a frame from the network while the previous frame read is being rendered
-	var pkts [2]av.Packet
+	var pkts [2]*uiPacket
 	readIndex := -1
 	writeIndex := 0
 	errChan := make(chan error, 1)
+	stall := time.NewTimer(_UI_STALL_TIMEOUT)
+	defer stall.Stop()
+	stall.Stop()
 	for {
 		go func() {
-			pkts[writeIndex], err = demuxer.ReadPacket()
-			if err != nil {
-				err = fmt.Errorf("UI streaming failed to demux packet: %v", err)
+			var e error
+			pkts[writeIndex], e = demuxer.readPacket()
+			if e != nil {
+				e = fmt.Errorf("UI streaming failed to demux packet: %v", e)
 			}
-			errChan <- err
+			errChan <- e
 		}()
 
 		if readIndex >= 0 {
-			var data []byte
-			pkt := &pkts[readIndex]
-			data = pktToBitstream(videoCodecData, pkt)
-			err = ctx.appflingerListener.OnUIFrame(ctx.SessionId, pkt.IsKeyFrame, pkt.IsKeyFrame, int(pkt.Idx), int(pkt.CompositionTime), int(pkt.Time), data)
-			if err != nil {
-				err = fmt.Errorf("UI frame listener failed: %v", err)
-				return
+			if onFirstFrame != nil {
+				err = onFirstFrame()
+				if err != nil {
+					return
+				}
+				onFirstFrame = nil
+			}
+
+			for _, frame := range framer.frames(pkts[readIndex]) {
+				err = deliverUIFrame(ctx, frame)
+				if err != nil {
+					err = fmt.Errorf("%w: %v", errUIFrameListener, err)
+					return
+				}
 			}
 		}
 
 		// Wait for reading from the http request to complete
+		stall.Reset(_UI_STALL_TIMEOUT)
 		select {
-		case <-ctx.shouldStopUI:
+		case <-shouldStop:
 			err = ErrInterrupted
 			return
+		case <-stall.C:
+			err = fmt.Errorf("UI streaming stalled for %v", _UI_STALL_TIMEOUT)
+			return
 		case err = <-errChan:
+			if !stall.Stop() {
+				<-stall.C
+			}
 			if err != nil {
 				return
 			}
 		}
 
+		readIndex = -1
+		pkt := pkts[writeIndex]
+		if !pkt.isAudio() && abr.onFrame(time.Duration(pkt.dts)*time.Second/UI_TIMESCALE, pkt.isKeyFrame, time.Now()) {
+			return errUIBitrateSwitch
+		}
+		if skipToKeyFrame && (pkt.isAudio() || !pkt.isKeyFrame) {
+			continue
+		}
+		skipToKeyFrame = false
 		readIndex = writeIndex
 		writeIndex = 1 - writeIndex
 	}
-
-	return nil
 }
 
-func uiStreamRoutine(ctx *SessionContext, uri string) {
-	err := uiStream(ctx, uri)
+func uiStreamRoutine(ctx *SessionContext, format string, tsDiscon bool, abr *abrController, shouldStop chan bool, done chan bool) {
+	err := uiStream(ctx, format, tsDiscon, abr, shouldStop)
 	if err != nil && err != ErrInterrupted {
 		log.Println("Failed to stream ui with error: ", err)
 	}
-	ctx.isUIStreaming = false
-	ctx.isDone <- true
+	ctx.mutex.Lock()
+	if ctx.uiDone == done {
+		// Ended on its own rather than by SessionUIStreamStop()
+		ctx.shouldStopUI, ctx.uiDone, ctx.uiABR = nil, nil, nil
+	}
+	ctx.mutex.Unlock()
+	close(done)
+	if err == nil || err == ErrInterrupted {
+		ctx.state.event(SESSION_EVENT_UI_STREAM_STOPPED, _SESSION_STATE_UNCHANGED, nil)
+	} else {
+		ctx.state.event(SESSION_EVENT_UI_STREAM_FAILED, _SESSION_STATE_UNCHANGED, err)
+	}
 }
 
 // SessionUIStreamStart is used to start streaming the UI, frames will be passed to OnUIFrame() in the AppFlinger listener
 func SessionUIStreamStart(ctx *SessionContext, format string, tsDiscon bool, bitrate int) (err error) {
-	if format != UI_FMT_TS_H264 {
-		return fmt.Errorf("Only format %s is supported by the SDK", UI_FMT_TS_H264)
+	return uiStreamStart(ctx, format, tsDiscon, bitrate, nil)
+}
+
+// uiStreamStart starts streaming the UI, with an adaptive bitrate when a configuration is given.
+func uiStreamStart(ctx *SessionContext, format string, tsDiscon bool, bitrate int, config *AdaptiveBitrateConfig) (err error) {
+	if format == UI_FMT_AUTO {
+		// The SDK can only demux these formats
+		format, err = SessionSelectUIFormat(ctx, UI_FMT_TS_H264, UI_FMT_TS_HEVC)
+		if err != nil {
+			return
+		}
+	}
+	if format != UI_FMT_TS_H264 && format != UI_FMT_TS_HEVC {
+		return withClass(ErrInvalidArgument, fmt.Errorf("Only formats %s and %s are supported by the SDK", UI_FMT_TS_H264, UI_FMT_TS_HEVC))
 	}
 
-	uri, e := SessionGetUIURL(ctx, format, tsDiscon, bitrate)
+	// Check the arguments before starting the go routine
+	_, e := SessionGetUIURL(ctx, format, tsDiscon, bitrate)
 	if e != nil {
 		return e
 	}
 
-	if ctx.isUIStreaming {
-		return errors.New("UI is already streaming")
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.uiDone != nil {
+		return withClass(ErrInvalidState, errors.New("UI is already streaming"))
 	}
 
-	ctx.isUIStreaming = true
-	go uiStreamRoutine(ctx, uri)
+	ctx.shouldStopUI = make(chan bool)
+	ctx.uiDone = make(chan bool)
+	ctx.uiABR = newABRController(config, bitrate)
+	ctx.uiFormat, ctx.uiTsDiscon, ctx.uiBitrate = format, tsDiscon, bitrate
+	go uiStreamRoutine(ctx, format, tsDiscon, ctx.uiABR, ctx.shouldStopUI, ctx.uiDone)
 	return nil
 }
 
 // SessionUIStreamStop is used to stop streaming the UI
 func SessionUIStreamStop(ctx *SessionContext) (err error) {
-	if !ctx.isUIStreaming {
-		return errors.New("UI is not streaming")
+	ctx.mutex.Lock()
+	shouldStop, done := ctx.shouldStopUI, ctx.uiDone
+	ctx.shouldStopUI, ctx.uiDone, ctx.uiABR = nil, nil, nil
+	ctx.mutex.Unlock()
+	if done == nil {
+		return withClass(ErrInvalidState, errors.New("UI is not streaming"))
 	}
-	ctx.shouldStopUI <- true
-	<-ctx.isDone
+	close(shouldStop)
+	<-done
 	return nil
 }
 
@@ -1587,7 +1976,7 @@ func SessionSendNotification(ctx *SessionContext, instanceId string, payload []b
 	})
 
 	// Make the request
-	err = apiReq(ctx.CookieJar, uri, payload, ctx.shouldStopSession, nil)
+	err = apiReq(ctx.httpClient, uri, payload, ctx.shouldStopSession, nil)
 	return
 }
 
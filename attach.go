@@ -0,0 +1,192 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The cookies of a session are those sent with its API requests, all of which are under this path
+const _SESSION_COOKIES_PATH = "/osb/session/"
+
+// HandleCookie is a cookie of a session handle, e.g. a load balancer stickiness cookie.
+type HandleCookie struct {
+	Name    string
+	Value   string
+	Domain  string    `json:",omitempty"` // Empty for cookies only sent to the server host
+	Path    string    `json:",omitempty"`
+	Secure  bool      `json:",omitempty"`
+	Expires time.Time // Zero for session cookies
+}
+
+// SessionHandle holds what is needed in order to re-attach to a running session, e.g. after the client restarted.
+// It can be marshaled to JSON, see SessionHandleSave() and SessionHandleLoad().
+type SessionHandle struct {
+	ServerProtocolHost string
+	SessionId          string
+	Cookies            []HandleCookie // The cookies of the session, they are needed for load balancing stickiness
+	StartParams        string         `json:",omitempty"` // Used by SessionNavigate()
+
+	// The UI stream which was active when the handle was taken, if any, it is resumed by SessionAttach().
+	// The resumed stream always has tsDiscon set since its timestamps do not follow those already received.
+	UIFormat   string `json:",omitempty"`
+	UITsDiscon bool   `json:",omitempty"`
+	UIBitrate  int    `json:",omitempty"`
+}
+
+// SessionGetHandle returns the handle of the given session.
+func SessionGetHandle(ctx *SessionContext) (handle *SessionHandle, err error) {
+	handle = &SessionHandle{
+		ServerProtocolHost: ctx.ServerProtocolHost,
+		SessionId:          ctx.SessionId,
+		StartParams:        ctx.startParams,
+	}
+
+	u, err := url.Parse(ctx.ServerProtocolHost + _SESSION_COOKIES_PATH)
+	if err != nil {
+		return nil, withClass(ErrInvalidState, fmt.Errorf("Failed to parse the server address: %v", err))
+	}
+	var cookies []*http.Cookie
+	if store, ok := ctx.CookieJar.(CookieStore); ok {
+		cookies, err = cookiesWithAttributes(store, u)
+		if err != nil {
+			return nil, withClass(ErrInvalidState, fmt.Errorf("Failed to get the session cookies: %v", err))
+		}
+	} else {
+		cookies = ctx.CookieJar.Cookies(u)
+	}
+	for _, c := range cookies {
+		handle.Cookies = append(handle.Cookies, HandleCookie{Name: c.Name, Value: c.Value, Domain: c.Domain, Path: c.Path,
+			Secure: c.Secure, Expires: c.Expires})
+	}
+
+	ctx.mutex.Lock()
+	if ctx.uiDone != nil {
+		handle.UIFormat, handle.UITsDiscon, handle.UIBitrate = ctx.uiFormat, ctx.uiTsDiscon, ctx.uiBitrate
+	}
+	ctx.mutex.Unlock()
+	return
+}
+
+// SessionHandleSave writes the given handle as JSON to the given file. The file is only readable by the owner
+// since the cookies grant access to the session.
+func SessionHandleSave(handle *SessionHandle, path string) (err error) {
+	data, err := json.Marshal(handle)
+	if err != nil {
+		return
+	}
+
+	// Write a temporary file and rename it so that a crash does not leave a partial handle behind
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return
+}
+
+// SessionHandleLoad reads a handle written by SessionHandleSave().
+func SessionHandleLoad(path string) (handle *SessionHandle, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	handle = &SessionHandle{}
+	err = json.Unmarshal(data, handle)
+	if err != nil {
+		return nil, withClass(ErrInvalidArgument, fmt.Errorf("Failed to parse session handle: %v", err))
+	}
+	return
+}
+
+// SessionAttach re-attaches to a running session using its handle, without reloading its page. The control
+// channel is reconnected with reset=1, and the UI stream is resumed if it was active when the handle was taken.
+// A session which no longer exists on the server is reported as a SESSION_EVENT_TERMINATED event,
+// see SessionSubscribe() and SessionWait().
+func SessionAttach(handle *SessionHandle, appf AppflingerListener) (ctx *SessionContext, err error) {
+	return SessionAttachWithOptions(handle, appf, nil)
+}
+
+// SessionAttachWithOptions is the same as SessionAttach() with additional options, nil means the default options.
+// The cookies of the handle are added to the SessionOptions.CookieStore if given.
+func SessionAttachWithOptions(handle *SessionHandle, appf AppflingerListener, options *SessionOptions) (ctx *SessionContext, err error) {
+	if options == nil {
+		options = &SessionOptions{}
+	}
+	if handle.ServerProtocolHost == "" || handle.SessionId == "" {
+		return nil, withClass(ErrInvalidArgument, errors.New("Session handle has no server or session id"))
+	}
+	u, err := url.Parse(handle.ServerProtocolHost + _SESSION_COOKIES_PATH)
+	if err != nil {
+		return nil, withClass(ErrInvalidArgument, fmt.Errorf("Failed to parse the server address: %v", err))
+	}
+
+	var cookieJar http.CookieJar
+	if options.CookieStore != nil {
+		cookieJar = options.CookieStore
+	} else {
+		cookieJar, err = newCookieJar()
+		if err != nil {
+			return
+		}
+	}
+	cookies := make([]*http.Cookie, len(handle.Cookies))
+	for i, c := range handle.Cookies {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value, Domain: c.Domain, Path: c.Path, Secure: c.Secure,
+			Expires: c.Expires}
+	}
+	cookieJar.SetCookies(u, cookies)
+
+	ctx = newSessionContext(handle.ServerProtocolHost, handle.SessionId, cookieJar, newHTTPTransports(options.HTTPConfig), appf)
+	ctx.startParams = handle.StartParams
+	for _, subscriber := range options.Subscribers {
+		SessionSubscribe(ctx, subscriber)
+	}
+
+	// The control channel always connects with reset=1 first
+	go controlChannelRoutine(ctx, appf)
+
+	if handle.UIFormat != "" {
+		// The resumed stream is not continuous with the one received before the handle was taken
+		err = SessionUIStreamStart(ctx, handle.UIFormat, true, handle.UIBitrate)
+		if err != nil {
+			log.Println("Failed to resume UI streaming: ", err)
+			SessionDetach(ctx)
+			return nil, err
+		}
+	}
+	return
+}
+
+// SessionDetach stops the UI stream, the input channel and the control channel of the session without stopping
+// the session on the server, e.g. before the client restarts. Take the handle with SessionGetHandle() first.
+// Like SessionStop(), subsequent calls to either function return the result of the first.
+func SessionDetach(ctx *SessionContext) (err error) {
+	ctx.stopOnce.Do(func() {
+		ctx.stopErr = sessionStop(ctx, false)
+	})
+	return ctx.stopErr
+}
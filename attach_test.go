@@ -0,0 +1,86 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSessionHandleCookies(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	u, _ := url.Parse("https://lb.example.com" + _SESSION_COOKIES_PATH + "start")
+	jar, _ := newCookieJar()
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "sticky", Value: "server1", Domain: "example.com", Path: "/", Secure: true, Expires: expires},
+		{Name: "host", Value: "1"},
+	})
+	ctx := newSessionContext("https://lb.example.com", "handle-session", jar, newHTTPTransports(nil), nil)
+	defer removeSessionContext(ctx)
+
+	handle, err := SessionGetHandle(ctx)
+	if err != nil {
+		t.Fatalf("SessionGetHandle() failed: %v", err)
+	}
+	want := []HandleCookie{
+		{Name: "host", Value: "1", Path: "/osb/session"},
+		{Name: "sticky", Value: "server1", Domain: "example.com", Path: "/", Secure: true, Expires: expires},
+	}
+	if !reflect.DeepEqual(handle.Cookies, want) {
+		t.Fatalf("got cookies %+v, want %+v", handle.Cookies, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "handle.json")
+	if err = SessionHandleSave(handle, path); err != nil {
+		t.Fatalf("SessionHandleSave() failed: %v", err)
+	}
+	loaded, err := SessionHandleLoad(path)
+	if err != nil {
+		t.Fatalf("SessionHandleLoad() failed: %v", err)
+	}
+	for i := range loaded.Cookies {
+		if !loaded.Cookies[i].Expires.Equal(want[i].Expires) {
+			t.Errorf("cookie %d: got expiration %v, want %v", i, loaded.Cookies[i].Expires, want[i].Expires)
+		}
+		loaded.Cookies[i].Expires = want[i].Expires
+	}
+	if !reflect.DeepEqual(loaded.Cookies, want) {
+		t.Errorf("got loaded cookies %+v, want %+v", loaded.Cookies, want)
+	}
+
+	// The domain cookie is also sent to the other hosts of the domain, unlike the host-only cookie
+	store := NewMemoryCookieStore()
+	for _, c := range loaded.Cookies {
+		store.SetCookies(u, []*http.Cookie{{Name: c.Name, Value: c.Value, Domain: c.Domain, Path: c.Path,
+			Secure: c.Secure, Expires: c.Expires}})
+	}
+	other, _ := url.Parse("https://server1.example.com/")
+	if got := store.Cookies(other); len(got) != 1 || got[0].Name != "sticky" {
+		t.Errorf("got cookies %v for another host, want the sticky cookie", got)
+	}
+}
+
+func TestSessionContextRemoved(t *testing.T) {
+	jar, _ := newCookieJar()
+	ctx := newSessionContext("http://127.0.0.1", "removed-session", jar, newHTTPTransports(nil), nil)
+	if got, err := SessionGetSessionContext("removed-session"); err != nil || got != ctx {
+		t.Fatalf("SessionGetSessionContext() returned %p, %v", got, err)
+	}
+
+	// A newer context of the same session is kept when the older one is removed
+	attached := newSessionContext("http://127.0.0.1", "removed-session", jar, newHTTPTransports(nil), nil)
+	removeSessionContext(ctx)
+	if got, _ := SessionGetSessionContext("removed-session"); got != attached {
+		t.Fatalf("SessionGetSessionContext() returned %p, want the attached context", got)
+	}
+	removeSessionContext(attached)
+	if _, err := SessionGetSessionContext("removed-session"); err != ErrSessionNotFound {
+		t.Errorf("SessionGetSessionContext() returned %v, want ErrSessionNotFound", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// UI_FMT_AUTO lets the SDK choose the UI format among the formats supported by the server, see SessionSelectUIFormat().
+const UI_FMT_AUTO = "auto"
+
+// The UI formats in the order of preference of UI_FMT_AUTO for SessionGetUIURL()
+var _UI_FMT_PREFERENCE = []string{
+	UI_FMT_TS_H264,
+	UI_FMT_MP4_H264,
+	UI_FMT_MPD_TS,
+	UI_FMT_MPD_MP4,
+	UI_FMT_WEBM_VP9,
+	UI_FMT_WEBM_VP8,
+	UI_FMT_MPD_WEBM,
+	UI_FMT_MP4_AV1,
+	UI_FMT_JPEG,
+	UI_FMT_PNG,
+}
+
+// Capabilities describes what the server running a session supports, see SessionGetCapabilities().
+type Capabilities struct {
+	// False when the server did not report its capabilities (older servers), in which case the other fields hold
+	// the assumptions the SDK made before capabilities were reported.
+	Reported bool `json:"-"`
+
+	// The fields which the server does not report keep their value from the default capabilities
+	ProtocolVersion int      `json:"ProtocolVersion"` // Zero if unknown
+	UIFormats       []string `json:"UIFormats"`       // The supported UI_FMT_* values
+	MaxWidth        int      `json:"MaxWidth"`        // Maximum UI resolution
+	MaxHeight       int      `json:"MaxHeight"`
+	MinBitrate      int      `json:"MinBitrate"` // UI bitrate range in bits per second, zero if not limited
+	MaxBitrate      int      `json:"MaxBitrate"`
+	EME             bool     `json:"EME"`          // Whether encrypted media (the EME listener methods) is supported
+	InputChannel    bool     `json:"InputChannel"` // Whether SessionInputChannelStart() is supported
+	Tabs            bool     `json:"Tabs"`         // Whether the tab functions (e.g. SessionTabOpen()) are supported
+}
+
+// defaultCapabilities returns the capabilities assumed for servers which do not report them.
+func defaultCapabilities() *Capabilities {
+	caps := &Capabilities{
+		MaxWidth:     MAX_UI_WIDTH,
+		MaxHeight:    MAX_UI_HEIGHT,
+		EME:          true,
+		InputChannel: true, // Unknown, the functions detect the lack of support themselves
+	}
+	caps.UIFormats = append(caps.UIFormats, _UI_FMT_PREFERENCE...)
+	return caps
+}
+
+// UnmarshalJSON implements json.Unmarshaler, the fields missing from the JSON are taken from the default capabilities.
+func (caps *Capabilities) UnmarshalJSON(data []byte) error {
+	type plainCapabilities Capabilities // Without the UnmarshalJSON() method
+	plain := plainCapabilities(*defaultCapabilities())
+	if err := json.Unmarshal(data, &plain); err != nil {
+		return err
+	}
+	*caps = Capabilities(plain)
+	return nil
+}
+
+// SupportsUIFormat checks whether the given UI format is supported.
+func (caps *Capabilities) SupportsUIFormat(format string) bool {
+	for _, f := range caps.UIFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// clampBitrate returns the given bitrate within the supported range, zero (the server default) is kept as is.
+func (caps *Capabilities) clampBitrate(bitrate int) int {
+	if bitrate <= 0 {
+		return bitrate
+	}
+	if caps.MinBitrate > 0 && bitrate < caps.MinBitrate {
+		return caps.MinBitrate
+	}
+	if caps.MaxBitrate > 0 && bitrate > caps.MaxBitrate {
+		return caps.MaxBitrate
+	}
+	return bitrate
+}
+
+// setCapabilities records the capabilities reported by the server, e.g. in the session start response.
+func (ctx *SessionContext) setCapabilities(caps *Capabilities) {
+	caps.Reported = true
+	ctx.mutex.Lock()
+	ctx.capabilities = caps
+	ctx.mutex.Unlock()
+}
+
+// knownCapabilities returns the capabilities if already known, without making a request.
+func (ctx *SessionContext) knownCapabilities() *Capabilities {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.capabilities
+}
+
+// SessionGetCapabilities returns the capabilities of the server running the session. They are taken from the session
+// start response, otherwise they are requested once from the server. Servers which do not report their capabilities
+// get default capabilities, see Capabilities.Reported.
+func SessionGetCapabilities(ctx *SessionContext) (caps *Capabilities, err error) {
+	if caps = ctx.knownCapabilities(); caps != nil {
+		return
+	}
+
+	// Construct the URL
+	uri := replaceVars(_SESSION_CAPABILITIES_URL, []string{
+		"${PROTHOST}",
+		"${SID}",
+	}, []string{
+		ctx.ServerProtocolHost,
+		url.QueryEscape(ctx.SessionId),
+	})
+
+	// Make the request
+	caps = &Capabilities{}
+	err = apiReq(ctx.httpClient, uri, nil, ctx.shouldStopSession, caps)
+	if isHTTPStatus(err, http.StatusNotFound) {
+		caps = defaultCapabilities()
+		ctx.mutex.Lock()
+		ctx.capabilities = caps
+		ctx.mutex.Unlock()
+		return caps, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ctx.setCapabilities(caps)
+	return
+}
+
+// SessionSelectUIFormat returns the first of the given UI formats which is supported by the server,
+// or the first format supported by the server if none is given.
+func SessionSelectUIFormat(ctx *SessionContext, preferred ...string) (format string, err error) {
+	caps, err := SessionGetCapabilities(ctx)
+	if err != nil {
+		return
+	}
+	if len(preferred) == 0 {
+		preferred = _UI_FMT_PREFERENCE
+	}
+	for _, f := range preferred {
+		if caps.SupportsUIFormat(f) {
+			return f, nil
+		}
+	}
+	return "", withClass(ErrInvalidArgument, fmt.Errorf("None of the UI formats %v is supported by the server", preferred))
+}
+
+// checkUIFormat resolves UI_FMT_AUTO and checks that the format is supported by the server.
+func checkUIFormat(ctx *SessionContext, format string, bitrate int) (string, int, error) {
+	if format == UI_FMT_AUTO {
+		f, err := SessionSelectUIFormat(ctx)
+		if err != nil {
+			return "", 0, err
+		}
+		format = f
+	}
+	if !_ALLOWED_UI_FMT[format] {
+		return "", 0, withClass(ErrInvalidArgument, errors.New("Invalid format: "+format))
+	}
+
+	// Only check against capabilities which are already known, so that getting a URL makes no request
+	if caps := ctx.knownCapabilities(); caps != nil && caps.Reported {
+		if !caps.SupportsUIFormat(format) {
+			return "", 0, withClass(ErrInvalidArgument, errors.New("Format is not supported by the server: "+format))
+		}
+		bitrate = caps.clampBitrate(bitrate)
+	}
+	return format, bitrate, nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCapabilitiesUnmarshal(t *testing.T) {
+	defaults := *defaultCapabilities()
+	withDefaults := func(change func(caps *Capabilities)) Capabilities {
+		caps := *defaultCapabilities()
+		change(&caps)
+		return caps
+	}
+	tests := []struct {
+		name string
+		data string
+		want Capabilities
+	}{
+		{"empty", `{}`, defaults},
+		{"formats only", `{"UIFormats": ["mp4;h264"]}`, withDefaults(func(caps *Capabilities) {
+			caps.UIFormats = []string{UI_FMT_MP4_H264}
+		})},
+		{"no formats", `{"UIFormats": []}`, withDefaults(func(caps *Capabilities) {
+			caps.UIFormats = []string{}
+		})},
+		{"flags", `{"ProtocolVersion": 2, "EME": false, "Tabs": true}`, withDefaults(func(caps *Capabilities) {
+			caps.ProtocolVersion, caps.EME, caps.Tabs = 2, false, true
+		})},
+		{"bitrate and resolution", `{"MaxWidth": 1280, "MaxHeight": 720, "MinBitrate": 500000, "MaxBitrate": 8000000}`,
+			withDefaults(func(caps *Capabilities) {
+				caps.MaxWidth, caps.MaxHeight, caps.MinBitrate, caps.MaxBitrate = 1280, 720, 500000, 8000000
+			})},
+		{"reported is not decoded", `{"Reported": true}`, defaults},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var caps Capabilities
+			if err := json.Unmarshal([]byte(test.data), &caps); err != nil {
+				t.Fatalf("Unmarshal() failed: %v", err)
+			}
+			if !reflect.DeepEqual(caps, test.want) {
+				t.Errorf("got %+v, want %+v", caps, test.want)
+			}
+		})
+	}
+
+	// Within the session start response
+	resp := &sessionStartResp{}
+	if err := json.Unmarshal([]byte(`{"SessionID": "id", "Capabilities": {"Tabs": true}}`), resp); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if want := withDefaults(func(caps *Capabilities) { caps.Tabs = true }); !reflect.DeepEqual(*resp.Capabilities, want) {
+		t.Errorf("got %+v, want %+v", *resp.Capabilities, want)
+	}
+}
+
+func TestSessionGetCapabilities(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		reported bool
+		format   string // Selected by SessionSelectUIFormat()
+	}{
+		{"older server", http.StatusNotFound, "", false, UI_FMT_TS_H264},
+		{"partial capabilities", http.StatusOK, `{"Tabs": true}`, true, UI_FMT_TS_H264},
+		{"formats", http.StatusOK, `{"UIFormats": ["webm;vp9", "mp4;h264"]}`, true, UI_FMT_MP4_H264},
+		{"no formats", http.StatusOK, `{"UIFormats": []}`, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer srv.Close()
+			jar, _ := newCookieJar()
+			ctx := newSessionContext(srv.URL, "capabilities-session", jar, newHTTPTransports(nil), nil)
+			defer removeSessionContext(ctx)
+
+			caps, err := SessionGetCapabilities(ctx)
+			if err != nil {
+				t.Fatalf("SessionGetCapabilities() failed: %v", err)
+			}
+			if caps.Reported != test.reported {
+				t.Errorf("Reported = %v, want %v", caps.Reported, test.reported)
+			}
+			format, err := SessionSelectUIFormat(ctx)
+			if test.format == "" {
+				if !errors.Is(err, ErrInvalidArgument) {
+					t.Errorf("SessionSelectUIFormat() returned %q, %v, want ErrInvalidArgument", format, err)
+				}
+			} else if err != nil || format != test.format {
+				t.Errorf("SessionSelectUIFormat() returned %q, %v, want %q", format, err, test.format)
+			}
+			if requests != 1 {
+				t.Errorf("%d requests made, want 1", requests)
+			}
+		})
+	}
+}
+
+func TestCheckUIFormat(t *testing.T) {
+	ctx := &SessionContext{}
+	// Nothing is checked against unknown capabilities
+	if _, _, err := checkUIFormat(ctx, UI_FMT_WEBM_VP8, 0); err != nil {
+		t.Errorf("checkUIFormat() failed with unknown capabilities: %v", err)
+	}
+
+	caps := &Capabilities{}
+	if err := json.Unmarshal([]byte(`{"UIFormats": ["mp4;h264"], "MinBitrate": 1000, "MaxBitrate": 2000}`), caps); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	ctx.setCapabilities(caps)
+	if _, _, err := checkUIFormat(ctx, UI_FMT_WEBM_VP8, 0); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("checkUIFormat() returned %v for an unsupported format, want ErrInvalidArgument", err)
+	}
+	for _, test := range []struct{ bitrate, want int }{{0, 0}, {500, 1000}, {1500, 1500}, {3000, 2000}} {
+		format, bitrate, err := checkUIFormat(ctx, UI_FMT_AUTO, test.bitrate)
+		if err != nil || format != UI_FMT_MP4_H264 || bitrate != test.want {
+			t.Errorf("checkUIFormat(%d) returned %q, %d, %v, want %q, %d", test.bitrate, format, bitrate, err,
+				UI_FMT_MP4_H264, test.want)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// CookieStore is a cookie jar whose cookies can be exported and imported, see SessionOptions.CookieStore.
+// The cookies set by a load balancer are what routes the requests of a session to the server running it,
+// so sharing a store between processes, or persisting it across restarts, keeps them on the same server.
+type CookieStore interface {
+	http.CookieJar
+
+	// Export writes all the cookies which did not expire in Netscape cookie file format.
+	Export(w io.Writer) error
+
+	// Import reads cookies in Netscape cookie file format and adds them to the store,
+	// replacing cookies with the same domain, path and name.
+	Import(r io.Reader) error
+}
+
+const _NETSCAPE_COOKIE_HEADER = "# Netscape HTTP Cookie File"
+
+// The prefix of the domain of HttpOnly cookies in a Netscape cookie file (as used by curl)
+const _NETSCAPE_HTTP_ONLY_PREFIX = "#HttpOnly_"
+
+// storedCookie is a cookie of a MemoryCookieStore.
+type storedCookie struct {
+	Name     string
+	Value    string
+	Domain   string // Without a leading dot
+	HostOnly bool   // Only sent to Domain itself rather than also to its subdomains
+	Path     string
+	Secure   bool
+	HttpOnly bool
+	Expires  time.Time // Zero for session cookies
+	seq      int       // Creation order, used for sorting cookies with the same path length
+}
+
+func (c *storedCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+func (c *storedCookie) equal(other *storedCookie) bool {
+	return c.Value == other.Value && c.HostOnly == other.HostOnly && c.Secure == other.Secure &&
+		c.HttpOnly == other.HttpOnly && c.Expires.Equal(other.Expires)
+}
+
+func (c *storedCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+// MemoryCookieStore is a CookieStore which keeps the cookies in memory.
+type MemoryCookieStore struct {
+	mutex   sync.Mutex
+	cookies map[string]*storedCookie
+	seq     int
+}
+
+// NewMemoryCookieStore returns an empty in-memory cookie store.
+func NewMemoryCookieStore() *MemoryCookieStore {
+	return &MemoryCookieStore{cookies: make(map[string]*storedCookie)}
+}
+
+// hostOf returns the canonical host of the given URL.
+func hostOf(u *url.URL) string {
+	return strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+}
+
+// domainMatch checks whether the host is the domain or one of its subdomains.
+func domainMatch(host string, domain string) bool {
+	return host == domain || (strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil)
+}
+
+// pathMatch checks whether the request path is within the cookie path, as per RFC 6265 section 5.1.4.
+func pathMatch(reqPath string, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if strings.HasPrefix(reqPath, cookiePath) {
+		return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+	}
+	return false
+}
+
+// defaultPath returns the default cookie path of the given request path, as per RFC 6265 section 5.1.4.
+func defaultPath(reqPath string) string {
+	if reqPath == "" || reqPath[0] != '/' {
+		return "/"
+	}
+	i := strings.LastIndex(reqPath, "/")
+	if i == 0 {
+		return "/"
+	}
+	return reqPath[:i]
+}
+
+// clear removes all the cookies.
+func (store *MemoryCookieStore) clear() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.cookies = make(map[string]*storedCookie)
+}
+
+// SetCookies implements http.CookieJar.
+func (store *MemoryCookieStore) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	store.setCookies(u, cookies)
+}
+
+// setCookies stores the cookies and reports whether any cookie was added, changed or removed.
+func (store *MemoryCookieStore) setCookies(u *url.URL, cookies []*http.Cookie) (changed bool) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+	host := hostOf(u)
+	if host == "" {
+		return
+	}
+	now := time.Now()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, c := range cookies {
+		sc := &storedCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+
+		domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		if domain == "" {
+			sc.Domain = host
+			sc.HostOnly = true
+		} else {
+			if !domainMatch(host, domain) {
+				continue
+			}
+			// Do not allow cookies for a public suffix, e.g. "co.uk"
+			if suffix, _ := publicsuffix.PublicSuffix(domain); suffix == domain && domain != host {
+				continue
+			}
+			sc.Domain = domain
+		}
+		if sc.Path == "" || sc.Path[0] != '/' {
+			sc.Path = defaultPath(u.Path)
+		}
+
+		if c.MaxAge < 0 {
+			sc.Expires = now
+		} else if c.MaxAge > 0 {
+			sc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		} else if !c.Expires.IsZero() {
+			sc.Expires = c.Expires
+		}
+
+		if store.put(sc, now) {
+			changed = true
+		}
+	}
+	return
+}
+
+// put adds, replaces or (when expired) removes a cookie, it is called with the mutex locked.
+func (store *MemoryCookieStore) put(sc *storedCookie, now time.Time) (changed bool) {
+	key := sc.key()
+	prev := store.cookies[key]
+	if sc.expired(now) {
+		if prev != nil {
+			delete(store.cookies, key)
+			return true
+		}
+		return false
+	}
+	if prev != nil {
+		sc.seq = prev.seq
+		if prev.equal(sc) {
+			return false
+		}
+	} else {
+		store.seq++
+		sc.seq = store.seq
+	}
+	store.cookies[key] = sc
+	return true
+}
+
+// Cookies implements http.CookieJar.
+func (store *MemoryCookieStore) Cookies(u *url.URL) (cookies []*http.Cookie) {
+	for _, sc := range store.selectCookies(u) {
+		cookies = append(cookies, &http.Cookie{Name: sc.Name, Value: sc.Value})
+	}
+	return
+}
+
+// selectCookies returns the cookies to send to the given URL in the order in which they are sent.
+func (store *MemoryCookieStore) selectCookies(u *url.URL) (selected []*storedCookie) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return
+	}
+	host := hostOf(u)
+	reqPath := u.Path
+	if reqPath == "" {
+		reqPath = "/"
+	}
+	now := time.Now()
+
+	store.mutex.Lock()
+	for key, sc := range store.cookies {
+		if sc.expired(now) {
+			delete(store.cookies, key)
+			continue
+		}
+		if sc.HostOnly && host != sc.Domain || !sc.HostOnly && !domainMatch(host, sc.Domain) {
+			continue
+		}
+		if !pathMatch(reqPath, sc.Path) || sc.Secure && u.Scheme != "https" {
+			continue
+		}
+		selected = append(selected, sc)
+	}
+	store.mutex.Unlock()
+
+	// Longer paths first, then older cookies first, as per RFC 6265 section 5.4
+	sort.Slice(selected, func(i, j int) bool {
+		if len(selected[i].Path) != len(selected[j].Path) {
+			return len(selected[i].Path) > len(selected[j].Path)
+		}
+		return selected[i].seq < selected[j].seq
+	})
+	return
+}
+
+// cookiesWithAttributes returns the cookies of the store which are sent to the given URL along with their attributes,
+// which http.CookieJar.Cookies() does not return. The Domain of host-only cookies is left empty.
+func cookiesWithAttributes(store CookieStore, u *url.URL) (cookies []*http.Cookie, err error) {
+	mem, ok := store.(*MemoryCookieStore)
+	if !ok {
+		// Go through the Netscape format, e.g. a FileCookieStore re-reads its file when exporting
+		var buf bytes.Buffer
+		if err = store.Export(&buf); err != nil {
+			return
+		}
+		mem = NewMemoryCookieStore()
+		if err = mem.Import(&buf); err != nil {
+			return
+		}
+	}
+	for _, sc := range mem.selectCookies(u) {
+		c := &http.Cookie{Name: sc.Name, Value: sc.Value, Path: sc.Path, Secure: sc.Secure, HttpOnly: sc.HttpOnly,
+			Expires: sc.Expires}
+		if !sc.HostOnly {
+			c.Domain = sc.Domain
+		}
+		cookies = append(cookies, c)
+	}
+	return
+}
+
+// Export implements CookieStore.
+func (store *MemoryCookieStore) Export(w io.Writer) (err error) {
+	now := time.Now()
+	store.mutex.Lock()
+	all := make([]*storedCookie, 0, len(store.cookies))
+	for _, sc := range store.cookies {
+		if !sc.expired(now) {
+			all = append(all, sc)
+		}
+	}
+	store.mutex.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].seq < all[j].seq
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, _NETSCAPE_COOKIE_HEADER)
+	for _, sc := range all {
+		domain := sc.Domain
+		if !sc.HostOnly {
+			domain = "." + domain
+		}
+		if sc.HttpOnly {
+			domain = _NETSCAPE_HTTP_ONLY_PREFIX + domain
+		}
+		var expires int64
+		if !sc.Expires.IsZero() {
+			expires = sc.Expires.Unix()
+		}
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, netscapeBool(!sc.HostOnly), sc.Path, netscapeBool(sc.Secure),
+			expires, sc.Name, sc.Value)
+	}
+	return bw.Flush()
+}
+
+func netscapeBool(val bool) string {
+	if val {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// Import implements CookieStore.
+func (store *MemoryCookieStore) Import(r io.Reader) (err error) {
+	_, err = store.importCookies(r)
+	return
+}
+
+// importCookies adds the cookies read from r and reports whether any cookie was added, changed or removed.
+func (store *MemoryCookieStore) importCookies(r io.Reader) (changed bool, err error) {
+	var cookies []*storedCookie
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := false
+		if strings.HasPrefix(line, _NETSCAPE_HTTP_ONLY_PREFIX) {
+			httpOnly = true
+			line = line[len(_NETSCAPE_HTTP_ONLY_PREFIX):]
+		} else if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) == 6 {
+			// Cookies with an empty value may lack the last field
+			fields = append(fields, "")
+		}
+		if len(fields) != 7 {
+			return false, withClass(ErrInvalidArgument, fmt.Errorf("Invalid Netscape cookie file line %d", lineNum))
+		}
+		expires, e := strconv.ParseInt(fields[4], 10, 64)
+		if e != nil {
+			return false, withClass(ErrInvalidArgument, fmt.Errorf("Invalid cookie expiration time in line %d: %s", lineNum, fields[4]))
+		}
+
+		sc := &storedCookie{
+			Domain:   strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			HostOnly: !strings.EqualFold(fields[1], "TRUE"),
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		}
+		if sc.Domain == "" {
+			return false, withClass(ErrInvalidArgument, fmt.Errorf("Missing cookie domain in line %d", lineNum))
+		}
+		if sc.Path == "" {
+			sc.Path = "/"
+		}
+		if expires > 0 {
+			sc.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, sc)
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+
+	now := time.Now()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, sc := range cookies {
+		if store.put(sc, now) {
+			changed = true
+		}
+	}
+	return
+}
+
+// FileCookieStore is a CookieStore which persists the cookies to a file in Netscape cookie file format.
+// The file is written whenever the cookies change and re-read when it was modified by another process,
+// so several processes can share the cookies of a session through the same file. Concurrent changes
+// by several processes are not merged, the last writer wins.
+type FileCookieStore struct {
+	*MemoryCookieStore
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time         // The modification time of the file when last read or written
+	size    int64             // The size of the file when last read or written
+	hash    [sha256.Size]byte // The hash of the content of the file when last read or written
+	checked time.Time         // When the content of the file was last read or written
+}
+
+// The resolution of the modification time of the files, which is 2 seconds on FAT file systems
+const _COOKIE_FILE_MTIME_RESOLUTION = 2 * time.Second
+
+// NewFileCookieStore returns a cookie store backed by the given file, which is read if it exists.
+func NewFileCookieStore(path string) (store *FileCookieStore, err error) {
+	store = &FileCookieStore{
+		MemoryCookieStore: NewMemoryCookieStore(),
+		path:              path,
+	}
+	err = store.reload()
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+// reload reads the file if it was modified since it was last read or written, it is called with the mutex locked.
+func (store *FileCookieStore) reload() (err error) {
+	info, err := os.Stat(store.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	// A file written again within the resolution of the modification time may keep the same modification time and
+	// size, so the content is compared unless the file was older than the resolution when it was last checked
+	now := time.Now()
+	if info.ModTime().Equal(store.modTime) && info.Size() == store.size &&
+		store.checked.Sub(store.modTime) > _COOKIE_FILE_MTIME_RESOLUTION {
+		return
+	}
+
+	data, err := ioutil.ReadFile(store.path)
+	if err != nil {
+		return
+	}
+	hash := sha256.Sum256(data)
+	if hash != store.hash {
+		// The file is the authoritative copy, e.g. cookies may have been removed by another process
+		store.MemoryCookieStore.clear()
+		_, err = store.MemoryCookieStore.importCookies(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+	}
+	store.modTime = info.ModTime()
+	store.size = info.Size()
+	store.hash = hash
+	store.checked = now
+	return
+}
+
+// save writes the file, it is called with the mutex locked.
+func (store *FileCookieStore) save() (err error) {
+	// Write a temporary file and rename it so that readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	var data bytes.Buffer
+	err = store.MemoryCookieStore.Export(&data)
+	if err == nil {
+		_, err = tmp.Write(data.Bytes())
+	}
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), store.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if info, e := os.Stat(store.path); e == nil {
+		store.modTime = info.ModTime()
+		store.size = info.Size()
+		store.hash = sha256.Sum256(data.Bytes())
+		store.checked = now
+	}
+	return
+}
+
+// SetCookies implements http.CookieJar, errors writing the file are logged.
+func (store *FileCookieStore) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.reload(); err != nil {
+		log.Println("Failed to read cookie file: ", err)
+	}
+	if store.MemoryCookieStore.setCookies(u, cookies) {
+		if err := store.save(); err != nil {
+			log.Println("Failed to write cookie file: ", err)
+		}
+	}
+}
+
+// Cookies implements http.CookieJar.
+func (store *FileCookieStore) Cookies(u *url.URL) []*http.Cookie {
+	store.mutex.Lock()
+	if err := store.reload(); err != nil {
+		log.Println("Failed to read cookie file: ", err)
+	}
+	store.mutex.Unlock()
+	return store.MemoryCookieStore.Cookies(u)
+}
+
+// Export implements CookieStore.
+func (store *FileCookieStore) Export(w io.Writer) (err error) {
+	store.mutex.Lock()
+	if err := store.reload(); err != nil {
+		log.Println("Failed to read cookie file: ", err)
+	}
+	store.mutex.Unlock()
+	return store.MemoryCookieStore.Export(w)
+}
+
+// Import implements CookieStore, the imported cookies are written to the file.
+func (store *FileCookieStore) Import(r io.Reader) (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	changed, err := store.MemoryCookieStore.importCookies(r)
+	if err != nil || !changed {
+		return
+	}
+	return store.save()
+}
+
+// Flush writes the file, e.g. in order to drop the expired cookies from it.
+func (store *FileCookieStore) Flush() (err error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	return store.save()
+}
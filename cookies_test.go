@@ -0,0 +1,170 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cookieNames returns the names and values of the cookies sent to the given URL as "name=value" strings.
+func cookieNames(jar http.CookieJar, uri string) (cookies []string) {
+	u, _ := url.Parse(uri)
+	for _, c := range jar.Cookies(u) {
+		cookies = append(cookies, c.Name+"="+c.Value)
+	}
+	return
+}
+
+func TestMemoryCookieStoreImport(t *testing.T) {
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+	tests := []struct {
+		name    string
+		file    string
+		uri     string
+		want    []string
+		wantErr bool
+	}{
+		{"domain cookie", fmt.Sprintf(".example.com\tTRUE\t/\tFALSE\t%d\tsticky\tserver1\n", future),
+			"http://lb.example.com/osb/session/start", []string{"sticky=server1"}, false},
+		{"host-only cookie", "lb.example.com\tFALSE\t/\tFALSE\t0\thost\t1\n",
+			"http://other.example.com/", nil, false},
+		{"secure cookie over http", "example.com\tFALSE\t/\tTRUE\t0\tsecure\t1\n",
+			"http://example.com/", nil, false},
+		{"secure cookie over https", "example.com\tFALSE\t/\tTRUE\t0\tsecure\t1\n",
+			"https://example.com/", []string{"secure=1"}, false},
+		{"path", "example.com\tFALSE\t/osb\tFALSE\t0\tosb\t1\nexample.com\tFALSE\t/other\tFALSE\t0\tother\t1\n",
+			"http://example.com/osb/session/start", []string{"osb=1"}, false},
+		{"http only prefix", "#HttpOnly_example.com\tFALSE\t/\tFALSE\t0\thttponly\t1\n",
+			"http://example.com/", []string{"httponly=1"}, false},
+		{"comments and blank lines", _NETSCAPE_COOKIE_HEADER + "\n# A comment\n\r\nexample.com\tFALSE\t/\tFALSE\t0\ta\t1\r\n",
+			"http://example.com/", []string{"a=1"}, false},
+		{"empty value without the last field", "example.com\tFALSE\t/\tFALSE\t0\tempty\n",
+			"http://example.com/", []string{"empty="}, false},
+		{"expired cookie", fmt.Sprintf("example.com\tFALSE\t/\tFALSE\t%d\told\t1\n", past),
+			"http://example.com/", nil, false},
+		{"missing fields", "example.com\tFALSE\t/\tFALSE\n", "", nil, true},
+		{"invalid expiration", "example.com\tFALSE\t/\tFALSE\tnever\ta\t1\n", "", nil, true},
+		{"missing domain", "\tFALSE\t/\tFALSE\t0\ta\t1\n", "", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := NewMemoryCookieStore()
+			err := store.Import(strings.NewReader(test.file))
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalidArgument) {
+					t.Errorf("Import() returned %v, want ErrInvalidArgument", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Import() failed: %v", err)
+			}
+			if got := cookieNames(store, test.uri); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemoryCookieStoreExport(t *testing.T) {
+	expires := time.Now().Add(time.Hour)
+	u, _ := url.Parse("https://lb.example.com/osb/session/start")
+	store := NewMemoryCookieStore()
+	store.SetCookies(u, []*http.Cookie{
+		{Name: "sticky", Value: "server1", Domain: ".example.com", Path: "/", Expires: expires},
+		{Name: "host", Value: "1", Secure: true, HttpOnly: true},
+		{Name: "gone", Value: "1", MaxAge: -1},
+	})
+
+	var buf bytes.Buffer
+	if err := store.Export(&buf); err != nil {
+		t.Fatalf("Export() failed: %v", err)
+	}
+	want := _NETSCAPE_COOKIE_HEADER + "\n" +
+		fmt.Sprintf(".example.com\tTRUE\t/\tFALSE\t%d\tsticky\tserver1\n", expires.Unix()) +
+		"#HttpOnly_lb.example.com\tFALSE\t/osb/session\tTRUE\t0\thost\t1\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// The exported cookies are imported as they were
+	imported := NewMemoryCookieStore()
+	if err := imported.Import(&buf); err != nil {
+		t.Fatalf("Import() failed: %v", err)
+	}
+	for _, uri := range []string{"https://lb.example.com/osb/session/ui", "https://server1.example.com/osb/session/ui",
+		"http://lb.example.com/osb/session/ui"} {
+		if got, want := cookieNames(imported, uri), cookieNames(store, uri); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", uri, got, want)
+		}
+	}
+}
+
+func TestMemoryCookieStoreImportReplaces(t *testing.T) {
+	store := NewMemoryCookieStore()
+	u, _ := url.Parse("http://example.com/")
+	store.SetCookies(u, []*http.Cookie{{Name: "a", Value: "old"}, {Name: "b", Value: "kept"}})
+	err := store.Import(strings.NewReader("example.com\tFALSE\t/\tFALSE\t0\ta\tnew\n"))
+	if err != nil {
+		t.Fatalf("Import() failed: %v", err)
+	}
+	// The replaced cookie keeps its creation order
+	if got, want := cookieNames(store, "http://example.com/"), []string{"a=new", "b=kept"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileCookieStoreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	first, err := NewFileCookieStore(path)
+	if err != nil {
+		t.Fatalf("NewFileCookieStore() failed: %v", err)
+	}
+	u, _ := url.Parse("http://example.com/")
+	first.SetCookies(u, []*http.Cookie{{Name: "sticky", Value: "server1", Path: "/"}})
+
+	second, err := NewFileCookieStore(path)
+	if err != nil {
+		t.Fatalf("NewFileCookieStore() failed: %v", err)
+	}
+	if got, want := cookieNames(second, "http://example.com/"), []string{"sticky=server1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFileCookieStoreSameModTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	first, err := NewFileCookieStore(path)
+	if err != nil {
+		t.Fatalf("NewFileCookieStore() failed: %v", err)
+	}
+	u, _ := url.Parse("http://example.com/")
+	first.SetCookies(u, []*http.Cookie{{Name: "sticky", Value: "server1", Path: "/"}})
+	second, err := NewFileCookieStore(path)
+	if err != nil {
+		t.Fatalf("NewFileCookieStore() failed: %v", err)
+	}
+
+	// A write of the same size within the resolution of the modification time is not missed
+	modTime := second.modTime
+	first.SetCookies(u, []*http.Cookie{{Name: "sticky", Value: "server2", Path: "/"}})
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatalf("os.Chtimes() failed: %v", err)
+	}
+	if got, want := cookieNames(second, "http://example.com/"), []string{"sticky=server2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
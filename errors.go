@@ -0,0 +1,40 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import "errors"
+
+// Error classes of the errors returned by the SDK, use errors.Is() in order to check the class of an error.
+// The messages of the returned errors are more specific than the messages of their class.
+var (
+	ErrInvalidArgument = errors.New("Invalid argument")
+	ErrInvalidState    = errors.New("Invalid state")
+	ErrNetwork         = errors.New("Network error")
+	ErrServer          = errors.New("Server error")
+	ErrSessionNotFound = errors.New("Session not found")
+)
+
+// classError associates an error with its class while keeping its message.
+type classError struct {
+	class error
+	err   error
+}
+
+func (e *classError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classError) Unwrap() error {
+	return e.err
+}
+
+func (e *classError) Is(target error) bool {
+	return target == e.class
+}
+
+// withClass returns the given error associated with the given class, e.g. withClass(ErrNetwork, err).
+func withClass(class error, err error) error {
+	return &classError{class: class, err: err}
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package evdev
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/tversity/appflinger-go"
+	"github.com/tversity/appflinger-go/keymap"
+)
+
+// Maximum number of events waiting to be sent, further events are dropped until the session catches up
+const _MAX_QUEUED_EVENTS = 256
+
+// Config holds the settings of a Bridge, zero values are replaced by defaults.
+type Config struct {
+	Table *keymap.Table // The key mapping table, keymap.Evdev if nil
+
+	// Software autorepeat of a held key. When RepeatDelay is zero the autorepeat events generated by the
+	// kernel are forwarded as is, otherwise they are ignored and keydown events are repeated by the bridge
+	// after RepeatDelay and then every RepeatInterval. The latter is useful for remote control receivers
+	// which do not generate autorepeat events.
+	RepeatDelay    time.Duration
+	RepeatInterval time.Duration
+
+	ScreenWidth  int // The mouse pointer is kept within the screen, 1280 if zero
+	ScreenHeight int // The mouse pointer is kept within the screen, 720 if zero
+	WheelStep    int // Pixels scrolled per wheel notch, 100 if zero
+}
+
+// Bridge forwards the input of local devices to a session, see the package documentation.
+type Bridge struct {
+	config     Config
+	mutex      sync.Mutex
+	ctx        *appflinger.SessionContext
+	send       func(ev *appflinger.InputEvent) error
+	translator *keymap.Translator
+
+	// Mouse state
+	x, y           int
+	dx, dy         int
+	wheelX, wheelY int
+	buttons        int // The MOD_*_MOUSE_BUTTON bits of the pressed buttons
+
+	// Software autorepeat state
+	repeatCode  uint16
+	repeatTimer *time.Timer
+
+	// The events waiting to be sent by the sending go routine, which runs while idle is not nil
+	queue []queuedEvent
+	idle  chan bool // Closed when the sending go routine exits
+}
+
+// queuedEvent is an event waiting to be sent along with its destination at the time it was generated.
+type queuedEvent struct {
+	ev   *appflinger.InputEvent
+	ctx  *appflinger.SessionContext
+	send func(ev *appflinger.InputEvent) error
+}
+
+// NewBridge returns a bridge with the given configuration, nil means the default configuration.
+// Events are dropped until a session is set using SetSession().
+func NewBridge(config *Config) *Bridge {
+	b := &Bridge{}
+	if config != nil {
+		b.config = *config
+	}
+	if b.config.Table == nil {
+		b.config.Table = keymap.Evdev
+	}
+	if b.config.RepeatDelay > 0 && b.config.RepeatInterval <= 0 {
+		b.config.RepeatInterval = 100 * time.Millisecond
+	}
+	if b.config.ScreenWidth <= 0 {
+		b.config.ScreenWidth = 1280
+	}
+	if b.config.ScreenHeight <= 0 {
+		b.config.ScreenHeight = 720
+	}
+	if b.config.WheelStep <= 0 {
+		b.config.WheelStep = 100
+	}
+	b.translator = keymap.NewTranslator(b.config.Table)
+	b.x = b.config.ScreenWidth / 2
+	b.y = b.config.ScreenHeight / 2
+	return b
+}
+
+// SetSession sets the session into which the events are injected, nil stops forwarding.
+func (b *Bridge) SetSession(ctx *appflinger.SessionContext) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.ctx = ctx
+	b.stopRepeat()
+}
+
+// SetSender replaces the injection of events into the session with the given function, e.g. for testing.
+func (b *Bridge) SetSender(send func(ev *appflinger.InputEvent) error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.send = send
+}
+
+// Run reads events from the given reader and forwards them until the reader returns an error.
+// It returns nil when the reader reaches EOF. It can be called concurrently for several devices.
+func (b *Bridge) Run(reader io.Reader) error {
+	r := NewReader(reader)
+	for {
+		ev, err := r.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		b.HandleEvent(ev)
+	}
+}
+
+// RunDevice opens the given input device and forwards its events until it is closed or fails, see OpenDevice().
+func (b *Bridge) RunDevice(path string, grab bool) error {
+	file, err := OpenDevice(path, grab)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return b.Run(file)
+}
+
+// Close stops the software autorepeat, if any. The events already generated are still sent, see Flush().
+func (b *Bridge) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.stopRepeat()
+}
+
+// Flush waits until the events generated so far are sent.
+func (b *Bridge) Flush() {
+	b.mutex.Lock()
+	idle := b.idle
+	b.mutex.Unlock()
+	if idle != nil {
+		<-idle
+	}
+}
+
+// HandleEvent processes a single event, events which do not result in input to the session are ignored.
+func (b *Bridge) HandleEvent(ev Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch ev.Type {
+	case EV_KEY:
+		switch ev.Code {
+		case BTN_LEFT:
+			b.handleButton(ev.Value, appflinger.MOUSE_BUTTON_LEFT, keymap.MOD_LEFT_MOUSE_BUTTON)
+		case BTN_RIGHT:
+			b.handleButton(ev.Value, appflinger.MOUSE_BUTTON_RIGHT, keymap.MOD_RIGHT_MOUSE_BUTTON)
+		case BTN_MIDDLE:
+			b.handleButton(ev.Value, appflinger.MOUSE_BUTTON_MIDDLE, keymap.MOD_MIDDLE_MOUSE_BUTTON)
+		default:
+			b.handleKey(ev.Code, ev.Value)
+		}
+	case EV_REL:
+		switch ev.Code {
+		case REL_X:
+			b.dx += int(ev.Value)
+		case REL_Y:
+			b.dy += int(ev.Value)
+		case REL_WHEEL:
+			b.wheelY += int(ev.Value)
+		case REL_HWHEEL:
+			b.wheelX += int(ev.Value)
+		}
+	case EV_SYN:
+		if ev.Code == SYN_REPORT {
+			b.flushMouse()
+		} else if ev.Code == SYN_DROPPED {
+			// Events were lost, discard the partial report
+			b.dx, b.dy, b.wheelX, b.wheelY = 0, 0, 0, 0
+		}
+	}
+}
+
+func (b *Bridge) handleKey(code uint16, value int32) {
+	switch value {
+	case KEY_PRESSED:
+		ev := b.translator.Translate(int(code), true)
+		if ev == nil {
+			return
+		}
+		b.sendEvent(ev)
+		b.startRepeat(code, ev.Code)
+	case KEY_REPEATED:
+		if b.config.RepeatDelay > 0 {
+			return
+		}
+		ev := b.translator.Translate(int(code), true)
+		if ev != nil {
+			b.sendEvent(ev)
+		}
+	case KEY_RELEASED:
+		if b.repeatTimer != nil && b.repeatCode == code {
+			b.stopRepeat()
+		}
+		ev := b.translator.Translate(int(code), false)
+		if ev != nil {
+			b.sendEvent(ev)
+		}
+	}
+}
+
+func (b *Bridge) handleButton(value int32, button int, mod int) {
+	ev := &appflinger.InputEvent{
+		X:      b.x,
+		Y:      b.y,
+		Button: button,
+	}
+	if value == KEY_PRESSED {
+		ev.Type = appflinger.INPUT_EVENT_MOUSEDOWN
+		b.buttons |= mod
+	} else if value == KEY_RELEASED {
+		ev.Type = appflinger.INPUT_EVENT_MOUSEUP
+		b.buttons &^= mod
+	} else {
+		return
+	}
+	ev.Mod = b.translator.Mod() | b.buttons
+	b.sendEvent(ev)
+}
+
+// flushMouse sends the motion and wheel accumulated since the previous report.
+func (b *Bridge) flushMouse() {
+	if b.dx != 0 || b.dy != 0 {
+		b.x = clamp(b.x+b.dx, 0, b.config.ScreenWidth-1)
+		b.y = clamp(b.y+b.dy, 0, b.config.ScreenHeight-1)
+		b.dx, b.dy = 0, 0
+		b.sendEvent(&appflinger.InputEvent{
+			Type: appflinger.INPUT_EVENT_MOUSEMOVE,
+			X:    b.x,
+			Y:    b.y,
+			Mod:  b.translator.Mod() | b.buttons,
+		})
+	}
+	if b.wheelX != 0 || b.wheelY != 0 {
+		// A positive REL_WHEEL scrolls up, while a positive wheel delta scrolls down
+		b.sendEvent(&appflinger.InputEvent{
+			Type:   appflinger.INPUT_EVENT_WHEEL,
+			X:      b.x,
+			Y:      b.y,
+			DeltaX: b.wheelX * b.config.WheelStep,
+			DeltaY: -b.wheelY * b.config.WheelStep,
+			Mod:    b.translator.Mod() | b.buttons,
+		})
+		b.wheelX, b.wheelY = 0, 0
+	}
+}
+
+// startRepeat starts the software autorepeat of the given key, if enabled.
+func (b *Bridge) startRepeat(code uint16, jsCode int) {
+	b.stopRepeat()
+	if b.config.RepeatDelay <= 0 {
+		return
+	}
+	switch jsCode {
+	case keymap.JSK_SHIFT, keymap.JSK_CTRL, keymap.JSK_ALT, keymap.JSK_LEFTWKEY, keymap.JSK_RIGHTWKEY,
+		keymap.JSK_CAPSLOCK, keymap.JSK_NUMLOCK:
+		// Modifiers are not repeated
+		return
+	}
+
+	b.repeatCode = code
+	var timer *time.Timer
+	timer = time.AfterFunc(b.config.RepeatDelay, func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.repeatTimer != timer {
+			// Stopped in the meantime
+			return
+		}
+		if ev := b.translator.Translate(int(code), true); ev != nil {
+			b.sendEvent(ev)
+		}
+		timer.Reset(b.config.RepeatInterval)
+	})
+	b.repeatTimer = timer
+}
+
+func (b *Bridge) stopRepeat() {
+	if b.repeatTimer != nil {
+		b.repeatTimer.Stop()
+		b.repeatTimer = nil
+	}
+}
+
+// sendEvent queues the event for injection into the session, it is called with the mutex locked. The events are sent
+// in order by a single go routine, without the mutex locked so that a slow request does not block the devices.
+func (b *Bridge) sendEvent(ev *appflinger.InputEvent) {
+	if b.send == nil && b.ctx == nil {
+		// No active session, drop the event
+		return
+	}
+	if len(b.queue) >= _MAX_QUEUED_EVENTS {
+		log.Println("Dropping input event, the session does not keep up")
+		return
+	}
+	b.queue = append(b.queue, queuedEvent{ev: ev, ctx: b.ctx, send: b.send})
+	if b.idle == nil {
+		b.idle = make(chan bool)
+		go b.sendQueued(b.idle)
+	}
+}
+
+// sendQueued sends the queued events until the queue is empty.
+func (b *Bridge) sendQueued(idle chan bool) {
+	defer close(idle)
+	for {
+		b.mutex.Lock()
+		if len(b.queue) == 0 {
+			b.queue = nil
+			b.idle = nil
+			b.mutex.Unlock()
+			return
+		}
+		q := b.queue[0]
+		b.queue[0] = queuedEvent{}
+		b.queue = b.queue[1:]
+		b.mutex.Unlock()
+
+		var err error
+		if q.send != nil {
+			err = q.send(q.ev)
+		} else {
+			err = appflinger.SessionSendInputEvent(q.ctx, q.ev)
+		}
+		if err != nil {
+			log.Println("Failed to forward input event: ", err)
+		}
+	}
+}
+
+func clamp(val int, min int, max int) int {
+	if val < min {
+		return min
+	}
+	if val > max {
+		return max
+	}
+	return val
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package evdev
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tversity/appflinger-go"
+	"github.com/tversity/appflinger-go/keymap"
+)
+
+const (
+	keyA         = 30
+	keyLeftShift = 42
+	keyLeftCtrl  = 29
+)
+
+// recorder collects the events sent by a bridge.
+type recorder struct {
+	mutex  sync.Mutex
+	events []appflinger.InputEvent
+}
+
+func (r *recorder) send(ev *appflinger.InputEvent) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, *ev)
+	return nil
+}
+
+func (r *recorder) get() []appflinger.InputEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]appflinger.InputEvent(nil), r.events...)
+}
+
+// run feeds the given events to a new bridge as input_event records and returns the events it sent.
+func run(t *testing.T, config *Config, events []Event) []appflinger.InputEvent {
+	var buf bytes.Buffer
+	for _, ev := range events {
+		if err := WriteEvent(&buf, ev); err != nil {
+			t.Fatalf("WriteEvent() failed: %v", err)
+		}
+	}
+	rec := &recorder{}
+	bridge := NewBridge(config)
+	bridge.SetSender(rec.send)
+	if err := bridge.Run(&buf); err != nil {
+		t.Fatalf("Run() failed: %v", err)
+	}
+	bridge.Close()
+	bridge.Flush()
+	return rec.get()
+}
+
+func key(code uint16, value int32) Event {
+	return Event{Type: EV_KEY, Code: code, Value: value}
+}
+
+func rel(code uint16, value int32) Event {
+	return Event{Type: EV_REL, Code: code, Value: value}
+}
+
+func syn() Event {
+	return Event{Type: EV_SYN, Code: SYN_REPORT}
+}
+
+func TestBridge(t *testing.T) {
+	down, up := appflinger.INPUT_EVENT_KEYDOWN, appflinger.INPUT_EVENT_KEYUP
+	tests := []struct {
+		name   string
+		config Config
+		events []Event
+		want   []appflinger.InputEvent
+	}{
+		{"key press and release", Config{}, []Event{
+			key(keyA, KEY_PRESSED), syn(), key(keyA, KEY_RELEASED), syn(),
+		}, []appflinger.InputEvent{
+			{Type: down, Code: keymap.JSK_a, Char: 'a'},
+			{Type: up, Code: keymap.JSK_a},
+		}},
+		{"shift modifier", Config{}, []Event{
+			key(keyLeftShift, KEY_PRESSED), key(keyA, KEY_PRESSED), key(keyA, KEY_RELEASED), key(keyLeftShift, KEY_RELEASED),
+		}, []appflinger.InputEvent{
+			{Type: down, Code: keymap.JSK_SHIFT, Mod: keymap.MOD_SHIFT | keymap.MOD_LEFT},
+			{Type: down, Code: keymap.JSK_a, Char: 'A', Mod: keymap.MOD_SHIFT},
+			{Type: up, Code: keymap.JSK_a, Mod: keymap.MOD_SHIFT},
+			{Type: up, Code: keymap.JSK_SHIFT, Mod: keymap.MOD_LEFT},
+		}},
+		{"kernel repeat forwarded", Config{}, []Event{
+			key(keyA, KEY_PRESSED), key(keyA, KEY_REPEATED), key(keyA, KEY_REPEATED), key(keyA, KEY_RELEASED),
+		}, []appflinger.InputEvent{
+			{Type: down, Code: keymap.JSK_a, Char: 'a'},
+			{Type: down, Code: keymap.JSK_a, Char: 'a'},
+			{Type: down, Code: keymap.JSK_a, Char: 'a'},
+			{Type: up, Code: keymap.JSK_a},
+		}},
+		{"kernel repeat ignored with software repeat", Config{RepeatDelay: time.Hour}, []Event{
+			key(keyA, KEY_PRESSED), key(keyA, KEY_REPEATED), key(keyA, KEY_RELEASED),
+		}, []appflinger.InputEvent{
+			{Type: down, Code: keymap.JSK_a, Char: 'a'},
+			{Type: up, Code: keymap.JSK_a},
+		}},
+		{"unmapped key", Config{}, []Event{
+			key(0xfff, KEY_PRESSED), key(0xfff, KEY_RELEASED),
+		}, nil},
+		{"mouse move clamped to screen", Config{ScreenWidth: 100, ScreenHeight: 50}, []Event{
+			rel(REL_X, 10), rel(REL_Y, -5), syn(), rel(REL_X, 1000), rel(REL_Y, 1000), syn(),
+		}, []appflinger.InputEvent{
+			{Type: appflinger.INPUT_EVENT_MOUSEMOVE, X: 60, Y: 20},
+			{Type: appflinger.INPUT_EVENT_MOUSEMOVE, X: 99, Y: 49},
+		}},
+		{"dropped report discarded", Config{}, []Event{
+			rel(REL_X, 10), {Type: EV_SYN, Code: SYN_DROPPED}, syn(),
+		}, nil},
+		{"buttons with modifiers", Config{}, []Event{
+			key(keyLeftCtrl, KEY_PRESSED), key(BTN_LEFT, KEY_PRESSED), syn(), rel(REL_X, 1), syn(),
+			key(BTN_LEFT, KEY_RELEASED), syn(),
+		}, []appflinger.InputEvent{
+			{Type: down, Code: keymap.JSK_CTRL, Mod: keymap.MOD_CTRL | keymap.MOD_LEFT},
+			{Type: appflinger.INPUT_EVENT_MOUSEDOWN, X: 640, Y: 360, Button: appflinger.MOUSE_BUTTON_LEFT,
+				Mod: keymap.MOD_CTRL | keymap.MOD_LEFT_MOUSE_BUTTON},
+			{Type: appflinger.INPUT_EVENT_MOUSEMOVE, X: 641, Y: 360, Mod: keymap.MOD_CTRL | keymap.MOD_LEFT_MOUSE_BUTTON},
+			{Type: appflinger.INPUT_EVENT_MOUSEUP, X: 641, Y: 360, Button: appflinger.MOUSE_BUTTON_LEFT,
+				Mod: keymap.MOD_CTRL},
+		}},
+		{"wheel", Config{WheelStep: 10}, []Event{
+			rel(REL_WHEEL, 2), rel(REL_HWHEEL, -1), syn(),
+		}, []appflinger.InputEvent{
+			{Type: appflinger.INPUT_EVENT_WHEEL, X: 640, Y: 360, DeltaX: -10, DeltaY: -20},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := run(t, &test.config, test.events)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBridgeSoftwareRepeat(t *testing.T) {
+	rec := &recorder{}
+	bridge := NewBridge(&Config{RepeatDelay: 20 * time.Millisecond, RepeatInterval: 10 * time.Millisecond})
+	bridge.SetSender(rec.send)
+	defer bridge.Close()
+
+	// Modifiers are not repeated
+	bridge.HandleEvent(key(keyLeftShift, KEY_PRESSED))
+	bridge.HandleEvent(key(keyA, KEY_PRESSED))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(rec.get()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	bridge.HandleEvent(key(keyA, KEY_RELEASED))
+	bridge.Flush()
+
+	events := rec.get()
+	if len(events) < 5 {
+		t.Fatalf("got %d events, want at least 5", len(events))
+	}
+	repeat := appflinger.InputEvent{Type: appflinger.INPUT_EVENT_KEYDOWN, Code: keymap.JSK_a, Char: 'A', Mod: keymap.MOD_SHIFT}
+	for i, ev := range events[1 : len(events)-1] {
+		if !reflect.DeepEqual(ev, repeat) {
+			t.Errorf("event %d: got %+v, want %+v", i+1, ev, repeat)
+		}
+	}
+	release := appflinger.InputEvent{Type: appflinger.INPUT_EVENT_KEYUP, Code: keymap.JSK_a, Mod: keymap.MOD_SHIFT}
+	if ev := events[len(events)-1]; !reflect.DeepEqual(ev, release) {
+		t.Errorf("last event: got %+v, want %+v", ev, release)
+	}
+
+	// No repeat after the release
+	time.Sleep(50 * time.Millisecond)
+	bridge.Flush()
+	if n := len(rec.get()); n != len(events) {
+		t.Errorf("got %d events after the release, want %d", n, len(events))
+	}
+}
+
+// A slow session must not block the handling of device events.
+func TestBridgeSlowSender(t *testing.T) {
+	release := make(chan bool)
+	rec := &recorder{}
+	bridge := NewBridge(nil)
+	bridge.SetSender(func(ev *appflinger.InputEvent) error {
+		<-release
+		return rec.send(ev)
+	})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			bridge.HandleEvent(key(keyA, KEY_PRESSED))
+			bridge.HandleEvent(key(keyA, KEY_RELEASED))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleEvent() blocked on the sender")
+	}
+	close(release)
+	bridge.Flush()
+
+	events := rec.get()
+	if len(events) != 20 {
+		t.Fatalf("got %d events, want 20", len(events))
+	}
+	for i, ev := range events {
+		want := appflinger.INPUT_EVENT_KEYDOWN
+		if i%2 == 1 {
+			want = appflinger.INPUT_EVENT_KEYUP
+		}
+		if ev.Type != want {
+			t.Errorf("event %d: got type %v, want %v", i, ev.Type, want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package evdev
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// EVIOCGRAB = _IOW('E', 0x90, int)
+const _EVIOCGRAB = 0x40044590
+
+// OpenDevice opens the given input device (e.g. /dev/input/event0) for reading. If grab is true, the device
+// is grabbed so that its events are not delivered to other readers (e.g. the console or a window system).
+func OpenDevice(path string, grab bool) (file *os.File, err error) {
+	file, err = os.Open(path)
+	if err != nil {
+		return
+	}
+
+	if grab {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), _EVIOCGRAB, 1)
+		if errno != 0 {
+			file.Close()
+			return nil, fmt.Errorf("Failed to grab input device %s: %v", path, errno)
+		}
+	}
+	return
+}
+
+// ListDevices returns the paths of all the input devices of the system.
+func ListDevices() ([]string, error) {
+	return filepath.Glob("/dev/input/event*")
+}
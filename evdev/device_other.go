@@ -0,0 +1,25 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package evdev
+
+import (
+	"errors"
+	"os"
+)
+
+var errNotSupported = errors.New("Input devices are only supported on Linux")
+
+// OpenDevice is only supported on Linux, elsewhere a Bridge can only be fed through a reader.
+func OpenDevice(path string, grab bool) (file *os.File, err error) {
+	return nil, errNotSupported
+}
+
+// ListDevices is only supported on Linux.
+func ListDevices() ([]string, error) {
+	return nil, errNotSupported
+}
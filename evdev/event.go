@@ -0,0 +1,129 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package evdev forwards the input of local Linux input devices (keyboards, remote control receivers, mice)
+// to an AppFlinger session.
+//
+// A Bridge reads the input_event structs of /dev/input/event* devices, translates key codes using a keymap.Translator,
+// keeps track of the modifier state, the mouse position and the pressed keys (for autorepeat) and injects the resulting
+// events into the active session. Since the bridge reads from an io.Reader, it can be fed with synthetic events
+// written with WriteEvent() instead of a real device.
+package evdev
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"time"
+)
+
+const (
+	// Event types (linux/input-event-codes.h)
+	EV_SYN = 0x00
+	EV_KEY = 0x01
+	EV_REL = 0x02
+	EV_ABS = 0x03
+	EV_MSC = 0x04
+
+	// Synchronization events
+	SYN_REPORT  = 0
+	SYN_DROPPED = 3
+
+	// Relative axes
+	REL_X      = 0x00
+	REL_Y      = 0x01
+	REL_HWHEEL = 0x06
+	REL_WHEEL  = 0x08
+
+	// Mouse buttons
+	BTN_LEFT   = 0x110
+	BTN_RIGHT  = 0x111
+	BTN_MIDDLE = 0x112
+
+	// Values of EV_KEY events
+	KEY_RELEASED = 0
+	KEY_PRESSED  = 1
+	KEY_REPEATED = 2
+)
+
+// Event is the Go representation of the Linux struct input_event.
+type Event struct {
+	Time  time.Time
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// The size of the fields of struct timeval in struct input_event, which is the size of a long on the platform
+var timeFieldSize = strconv.IntSize / 8
+
+// eventSize returns the size of struct input_event for the given size of the time fields.
+func eventSize(timeSize int) int {
+	return 2*timeSize + 8
+}
+
+// Reader decodes struct input_event records.
+type Reader struct {
+	reader   io.Reader
+	timeSize int
+	buf      []byte
+}
+
+// NewReader returns a reader of events as laid out by the kernel of the running platform.
+func NewReader(reader io.Reader) *Reader {
+	return NewReaderTimeSize(reader, timeFieldSize)
+}
+
+// NewReaderTimeSize returns a reader of events whose time fields are of the given size, i.e. 4 for 32 bit
+// platforms and 8 for 64 bit platforms. It is useful for reading events recorded on another platform.
+func NewReaderTimeSize(reader io.Reader, timeSize int) *Reader {
+	return &Reader{
+		reader:   reader,
+		timeSize: timeSize,
+		buf:      make([]byte, eventSize(timeSize)),
+	}
+}
+
+// Read returns the next event, it blocks until one is available.
+func (r *Reader) Read() (ev Event, err error) {
+	_, err = io.ReadFull(r.reader, r.buf)
+	if err != nil {
+		return
+	}
+
+	var sec, usec int64
+	if r.timeSize == 4 {
+		sec = int64(int32(binary.LittleEndian.Uint32(r.buf[0:])))
+		usec = int64(int32(binary.LittleEndian.Uint32(r.buf[4:])))
+	} else {
+		sec = int64(binary.LittleEndian.Uint64(r.buf[0:]))
+		usec = int64(binary.LittleEndian.Uint64(r.buf[8:]))
+	}
+	n := 2 * r.timeSize
+	ev.Time = time.Unix(sec, usec*1000)
+	ev.Type = binary.LittleEndian.Uint16(r.buf[n:])
+	ev.Code = binary.LittleEndian.Uint16(r.buf[n+2:])
+	ev.Value = int32(binary.LittleEndian.Uint32(r.buf[n+4:]))
+	return
+}
+
+// WriteEvent encodes the event as a struct input_event of the running platform, e.g. for feeding a Bridge with synthetic events.
+func WriteEvent(writer io.Writer, ev Event) (err error) {
+	buf := make([]byte, eventSize(timeFieldSize))
+	sec := ev.Time.Unix()
+	usec := int64(ev.Time.Nanosecond() / 1000)
+	if timeFieldSize == 4 {
+		binary.LittleEndian.PutUint32(buf[0:], uint32(sec))
+		binary.LittleEndian.PutUint32(buf[4:], uint32(usec))
+	} else {
+		binary.LittleEndian.PutUint64(buf[0:], uint64(sec))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(usec))
+	}
+	n := 2 * timeFieldSize
+	binary.LittleEndian.PutUint16(buf[n:], ev.Type)
+	binary.LittleEndian.PutUint16(buf[n+2:], ev.Code)
+	binary.LittleEndian.PutUint32(buf[n+4:], uint32(ev.Value))
+	_, err = writer.Write(buf)
+	return
+}
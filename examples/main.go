@@ -50,7 +50,12 @@ func initVars() {
 func StartSession() {
 	var err error
 	stub := NewAppflingerListenerStub()
-	sessionCtx, err = appflinger.SessionStart(serverProtocolHost, "", browserURL, true, true, "", "", stub)
+	sessionCtx, err = appflinger.SessionStartWithOptions(&appflinger.SessionOptions{
+		ServerProtocolHost: serverProtocolHost,
+		BrowserURL:         browserURL,
+		PullMode:           true,
+		VideoPassthru:      true,
+	}, stub)
 	if err != nil {
 		log.Fatal("Failed to start session: ", err)
 	}
@@ -74,7 +79,7 @@ func StopSession() {
 }
 
 func SendEvent(code int, delay time.Duration) {
-	err := appflinger.SessionSendEvent(sessionCtx, "key", code, 0, 0)
+	err := appflinger.SessionSendEvent(sessionCtx, appflinger.INPUT_EVENT_KEY, code, 0, 0, 0, 0)
 	if err != nil {
 		log.Fatal("Failed to send event: ", sessionCtx.SessionId, err)
 	}
@@ -106,6 +111,7 @@ func RunSession(shouldStop chan bool, done chan bool) {
 		// Check if need to abort in a non blocking way
 		select {
 		case <-shouldStop:
+			fmt.Println("Stopping session:", sessionCtx.SessionId)
 			StopSession()
 			done <- true
 			return
@@ -121,11 +127,6 @@ func RunSession(shouldStop chan bool, done chan bool) {
 		// Some delay representing a user reading/looking before continuing the interaction
 		time.Sleep(delayToView)
 	}
-
-	fmt.Println("Stopping session:", sessionCtx.SessionId)
-	StopSession()
-	done <- true
-	return
 }
 
 func main() {
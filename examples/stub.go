@@ -172,7 +172,7 @@ func (self *AppflingerListenerStub) SetVisible(sessionId string, instanceId stri
 	return
 }
 
-func (self *AppflingerListener) SetRate(sessionId string, instanceId string, rate float64) (err error) {
+func (self *AppflingerListenerStub) SetRate(sessionId string, instanceId string, rate float64) (err error) {
 	if self.loaded {
 		err = nil
 	} else {
@@ -181,7 +181,7 @@ func (self *AppflingerListener) SetRate(sessionId string, instanceId string, rat
 	return
 }
 
-func (self *AppflingerListener) SetVolume(sessionId string, instanceId string, volume float64) (err error) {
+func (self *AppflingerListenerStub) SetVolume(sessionId string, instanceId string, volume float64) (err error) {
 	if self.loaded {
 		err = nil
 	} else {
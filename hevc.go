@@ -0,0 +1,251 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import "errors"
+
+var errInvalidHEVCSPS = errors.New("Invalid HEVC SPS")
+
+// bitReader reads the RBSP of a NAL unit, i.e. without the emulation prevention bytes.
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+}
+
+func newBitReader(nalu []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 3 {
+			// Emulation prevention byte
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{data: rbsp}
+}
+
+func (r *bitReader) bits(n int) (v uint64, err error) {
+	if r.pos+n > len(r.data)*8 {
+		return 0, errInvalidHEVCSPS
+	}
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint64(r.data[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return
+}
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() (v uint64, err error) {
+	zeros := 0
+	for {
+		b, e := r.bits(1)
+		if e != nil {
+			return 0, e
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errInvalidHEVCSPS
+		}
+	}
+	v, err = r.bits(zeros)
+	return v + (1 << uint(zeros)) - 1, err
+}
+
+// hevcSPSInfo holds the fields of an HEVC SPS which are needed for the decoder configuration record.
+type hevcSPSInfo struct {
+	profileTierLevel     []byte // The general profile, tier and level (12 bytes)
+	maxSubLayersMinus1   int
+	temporalIdNesting    bool
+	chromaFormatIdc      int
+	bitDepthLumaMinus8   int
+	bitDepthChromaMinus8 int
+	width, height        int // The picture size after cropping
+}
+
+// parseHEVCSPS parses the fields of an HEVC SPS NAL unit (including its 2 bytes header) needed for the hvcC record.
+func parseHEVCSPS(nalu []byte) (info *hevcSPSInfo, err error) {
+	if len(nalu) < 2 {
+		return nil, errInvalidHEVCSPS
+	}
+	r := newBitReader(nalu[2:])
+	info = &hevcSPSInfo{}
+
+	// sps_video_parameter_set_id(4), sps_max_sub_layers_minus1(3), sps_temporal_id_nesting_flag(1)
+	v, err := r.bits(8)
+	if err != nil {
+		return
+	}
+	info.maxSubLayersMinus1 = int(v>>1) & 0x07
+	info.temporalIdNesting = v&1 != 0
+
+	// profile_tier_level(1, sps_max_sub_layers_minus1), starting with the general profile, tier and level
+	if len(r.data) < 13 {
+		return nil, errInvalidHEVCSPS
+	}
+	info.profileTierLevel = append([]byte(nil), r.data[1:13]...)
+	r.pos += 12 * 8
+	var profilePresent, levelPresent [8]bool
+	for i := 0; i < info.maxSubLayersMinus1; i++ {
+		if v, err = r.bits(2); err != nil {
+			return
+		}
+		profilePresent[i], levelPresent[i] = v&2 != 0, v&1 != 0
+	}
+	if info.maxSubLayersMinus1 > 0 {
+		// reserved_zero_2bits
+		r.pos += 2 * (8 - info.maxSubLayersMinus1)
+	}
+	for i := 0; i < info.maxSubLayersMinus1; i++ {
+		if profilePresent[i] {
+			r.pos += 88
+		}
+		if levelPresent[i] {
+			r.pos += 8
+		}
+	}
+
+	// sps_seq_parameter_set_id
+	if _, err = r.ue(); err != nil {
+		return
+	}
+	if v, err = r.ue(); err != nil {
+		return
+	}
+	info.chromaFormatIdc = int(v)
+	if info.chromaFormatIdc == 3 {
+		// separate_colour_plane_flag
+		r.pos++
+	}
+
+	// pic_width_in_luma_samples, pic_height_in_luma_samples
+	var size [2]uint64
+	for i := range size {
+		if size[i], err = r.ue(); err != nil {
+			return
+		}
+	}
+	if v, err = r.bits(1); err != nil {
+		return
+	}
+	if v == 1 {
+		// conf_win_left/right/top/bottom_offset, in chroma samples
+		var offsets [4]uint64
+		for i := range offsets {
+			if offsets[i], err = r.ue(); err != nil {
+				return
+			}
+		}
+		subWidth, subHeight := uint64(1), uint64(1)
+		if info.chromaFormatIdc == 1 || info.chromaFormatIdc == 2 {
+			subWidth = 2
+		}
+		if info.chromaFormatIdc == 1 {
+			subHeight = 2
+		}
+		size[0] -= subWidth * (offsets[0] + offsets[1])
+		size[1] -= subHeight * (offsets[2] + offsets[3])
+	}
+	info.width, info.height = int(size[0]), int(size[1])
+	if v, err = r.ue(); err != nil {
+		return
+	}
+	info.bitDepthLumaMinus8 = int(v)
+	if v, err = r.ue(); err != nil {
+		return
+	}
+	info.bitDepthChromaMinus8 = int(v)
+	return info, nil
+}
+
+// hevcDecoderConfRecord returns the HEVCDecoderConfigurationRecord (hvcC box payload, ISO/IEC 14496-15)
+// of the given parameter sets, with 4 bytes NAL unit lengths.
+func hevcDecoderConfRecord(vps []byte, sps []byte, pps []byte) (record []byte, err error) {
+	info, err := parseHEVCSPS(sps)
+	if err != nil {
+		return
+	}
+
+	record = append(record, 1) // configurationVersion
+	record = append(record, info.profileTierLevel...)
+	// reserved(4), min_spatial_segmentation_idc(12), reserved(6), parallelismType(2)
+	record = append(record, 0xf0, 0x00, 0xfc)
+	// reserved(6), chromaFormat(2), reserved(5), bitDepthLumaMinus8(3), reserved(5), bitDepthChromaMinus8(3)
+	record = append(record, 0xfc|byte(info.chromaFormatIdc&0x03), 0xf8|byte(info.bitDepthLumaMinus8&0x07),
+		0xf8|byte(info.bitDepthChromaMinus8&0x07))
+	// avgFrameRate(16)
+	record = append(record, 0x00, 0x00)
+	// constantFrameRate(2), numTemporalLayers(3), temporalIdNested(1), lengthSizeMinusOne(2)
+	b := byte(info.maxSubLayersMinus1+1)<<3 | 0x03
+	if info.temporalIdNesting {
+		b |= 0x04
+	}
+	record = append(record, b)
+
+	record = append(record, 3) // numOfArrays
+	for i, nalu := range [][]byte{vps, sps, pps} {
+		naluType := []byte{_HEVC_NALU_VPS, _HEVC_NALU_SPS, _HEVC_NALU_PPS}[i]
+		record = append(record,
+			0x80|naluType, // array_completeness(1), reserved(1), NAL_unit_type(6)
+			0, 1,          // numNalus
+			byte(len(nalu)>>8), byte(len(nalu)),
+		)
+		record = append(record, nalu...)
+	}
+	return record, nil
+}
+
+// parseHEVCDecoderConfRecord returns the parameter sets of an HEVCDecoderConfigurationRecord.
+func parseHEVCDecoderConfRecord(record []byte) (vps []byte, sps []byte, pps []byte, err error) {
+	err = errors.New("Invalid HEVC decoder configuration record")
+	if len(record) < 23 {
+		return
+	}
+	numArrays := int(record[22])
+	pos := 23
+	for i := 0; i < numArrays; i++ {
+		if pos+3 > len(record) {
+			return
+		}
+		naluType := record[pos] & 0x3f
+		numNalus := int(record[pos+1])<<8 | int(record[pos+2])
+		pos += 3
+		for j := 0; j < numNalus; j++ {
+			if pos+2 > len(record) {
+				return
+			}
+			n := int(record[pos])<<8 | int(record[pos+1])
+			pos += 2
+			if pos+n > len(record) {
+				return
+			}
+			nalu := record[pos : pos+n]
+			pos += n
+			// Only the first parameter set of each type is used
+			switch {
+			case naluType == _HEVC_NALU_VPS && vps == nil:
+				vps = nalu
+			case naluType == _HEVC_NALU_SPS && sps == nil:
+				sps = nalu
+			case naluType == _HEVC_NALU_PPS && pps == nil:
+				pps = nalu
+			}
+		}
+	}
+	if vps == nil || sps == nil || pps == nil {
+		return nil, nil, nil, err
+	}
+	return vps, sps, pps, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"math/bits"
+	"reflect"
+	"testing"
+)
+
+// testBitWriter writes the RBSP of a test NAL unit.
+type testBitWriter struct {
+	data []byte
+	n    int // In bits
+}
+
+func (w *testBitWriter) bits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[w.n/8] |= byte(v>>uint(i)&1) << (7 - uint(w.n%8))
+		w.n++
+	}
+}
+
+// ue writes an unsigned Exp-Golomb code.
+func (w *testBitWriter) ue(v uint64) {
+	n := bits.Len64(v + 1)
+	w.bits(0, n-1)
+	w.bits(v+1, n)
+}
+
+// nalu returns the NAL unit with the given header, with the RBSP trailing bits and the emulation prevention bytes.
+func (w *testBitWriter) nalu(header ...byte) []byte {
+	w.bits(1, 1)
+	nalu := append([]byte(nil), header...)
+	zeros := 0
+	for _, b := range w.data {
+		if zeros >= 2 && b <= 3 {
+			nalu = append(nalu, 3)
+			zeros = 0
+		}
+		nalu = append(nalu, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return nalu
+}
+
+// The general profile, tier and level of the test SPS: Main profile, progressive frames only, level 4
+var testHEVCProfileTierLevel = []byte{0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00, 0x00, 0x00, 0x00, 0x00, 0x78}
+
+// testHEVCSPSFields holds the fields of an HEVC test SPS.
+type testHEVCSPSFields struct {
+	maxSubLayersMinus1           int
+	chromaFormatIdc              int
+	codedWidth, codedHeight      int
+	confWindow                   []uint64 // The left, right, top and bottom offsets, nil for none
+	bitDepthLuma, bitDepthChroma int      // Minus 8
+}
+
+func (s *testHEVCSPSFields) nalu() []byte {
+	w := &testBitWriter{}
+	// sps_video_parameter_set_id, sps_max_sub_layers_minus1, sps_temporal_id_nesting_flag
+	w.bits(0, 4)
+	w.bits(uint64(s.maxSubLayersMinus1), 3)
+	w.bits(1, 1)
+	for _, b := range testHEVCProfileTierLevel {
+		w.bits(uint64(b), 8)
+	}
+	// The first sub-layer has a profile and a level, the others only a level
+	for i := 0; i < s.maxSubLayersMinus1; i++ {
+		if i == 0 {
+			w.bits(3, 2)
+		} else {
+			w.bits(1, 2)
+		}
+	}
+	if s.maxSubLayersMinus1 > 0 {
+		w.bits(0, 2*(8-s.maxSubLayersMinus1))
+	}
+	for i := 0; i < s.maxSubLayersMinus1; i++ {
+		if i == 0 {
+			for _, b := range testHEVCProfileTierLevel[:11] {
+				w.bits(uint64(b), 8)
+			}
+		}
+		w.bits(0x5a, 8)
+	}
+	w.ue(0) // sps_seq_parameter_set_id
+	w.ue(uint64(s.chromaFormatIdc))
+	if s.chromaFormatIdc == 3 {
+		w.bits(0, 1) // separate_colour_plane_flag
+	}
+	w.ue(uint64(s.codedWidth))
+	w.ue(uint64(s.codedHeight))
+	if s.confWindow == nil {
+		w.bits(0, 1)
+	} else {
+		w.bits(1, 1)
+		for _, offset := range s.confWindow {
+			w.ue(offset)
+		}
+	}
+	w.ue(uint64(s.bitDepthLuma))
+	w.ue(uint64(s.bitDepthChroma))
+	w.ue(4) // log2_max_pic_order_cnt_lsb_minus4, the remaining fields are not parsed
+	return w.nalu(_HEVC_NALU_SPS<<1, 0x01)
+}
+
+// HEVC test NAL units
+var (
+	testHEVCVPS = []byte{0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60}
+	testHEVCSPS = (&testHEVCSPSFields{chromaFormatIdc: 1, codedWidth: 1920, codedHeight: 1088,
+		confWindow: []uint64{0, 0, 0, 4}}).nalu()
+	testHEVCPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+	testHEVCIDR = []byte{0x26, 0x01, 0xaf, 0x20, 0x12}
+)
+
+func TestParseHEVCSPS(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  *testHEVCSPSFields
+		want hevcSPSInfo
+	}{
+		{"1080p with a conformance window", &testHEVCSPSFields{chromaFormatIdc: 1, codedWidth: 1920, codedHeight: 1088,
+			confWindow: []uint64{0, 0, 0, 4}},
+			hevcSPSInfo{testHEVCProfileTierLevel, 0, true, 1, 0, 0, 1920, 1080}},
+		{"4:4:4 10 bit", &testHEVCSPSFields{chromaFormatIdc: 3, codedWidth: 1280, codedHeight: 720, bitDepthLuma: 2,
+			bitDepthChroma: 2},
+			hevcSPSInfo{testHEVCProfileTierLevel, 0, true, 3, 2, 2, 1280, 720}},
+		{"4:2:2 cropped on all sides", &testHEVCSPSFields{chromaFormatIdc: 2, codedWidth: 1280, codedHeight: 720,
+			confWindow: []uint64{2, 2, 1, 1}},
+			hevcSPSInfo{testHEVCProfileTierLevel, 0, true, 2, 0, 0, 1272, 718}},
+		{"sub-layers", &testHEVCSPSFields{maxSubLayersMinus1: 2, chromaFormatIdc: 1, codedWidth: 640, codedHeight: 368,
+			confWindow: []uint64{0, 0, 0, 4}, bitDepthLuma: 1},
+			hevcSPSInfo{testHEVCProfileTierLevel, 2, true, 1, 1, 0, 640, 360}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, err := parseHEVCSPS(test.sps.nalu())
+			if err != nil {
+				t.Fatalf("parseHEVCSPS() failed: %v", err)
+			}
+			if !reflect.DeepEqual(*info, test.want) {
+				t.Errorf("got %+v, want %+v", *info, test.want)
+			}
+		})
+	}
+
+	// The emulation prevention bytes of the profile, tier and level are removed
+	if !bytes.Contains(testHEVCSPS, []byte{0, 0, 3, 0}) {
+		t.Error("the test SPS has no emulation prevention byte")
+	}
+	for _, n := range []int{0, 1, 8, 17} {
+		if _, err := parseHEVCSPS(testHEVCSPS[:n]); err != errInvalidHEVCSPS {
+			t.Errorf("parseHEVCSPS() of %d bytes returned %v, want errInvalidHEVCSPS", n, err)
+		}
+	}
+}
+
+func TestHEVCDecoderConfRecord(t *testing.T) {
+	sps := (&testHEVCSPSFields{maxSubLayersMinus1: 1, chromaFormatIdc: 1, codedWidth: 1280, codedHeight: 720,
+		bitDepthLuma: 2, bitDepthChroma: 2}).nalu()
+	record, err := hevcDecoderConfRecord(testHEVCVPS, sps, testHEVCPPS)
+	if err != nil {
+		t.Fatalf("hevcDecoderConfRecord() failed: %v", err)
+	}
+	want := append([]byte{1}, testHEVCProfileTierLevel...)
+	want = append(want,
+		0xf0, 0x00, 0xfc, // min_spatial_segmentation_idc, parallelismType
+		0xfd, 0xfa, 0xfa, // chromaFormat, bitDepthLumaMinus8, bitDepthChromaMinus8
+		0x00, 0x00, // avgFrameRate
+		0x17, // 2 temporal layers, nested, 4 bytes lengths
+		3,    // numOfArrays
+	)
+	for _, nalu := range [][]byte{testHEVCVPS, sps, testHEVCPPS} {
+		want = append(want, 0x80|nalu[0]>>1, 0, 1, byte(len(nalu)>>8), byte(len(nalu)))
+		want = append(want, nalu...)
+	}
+	if !bytes.Equal(record, want) {
+		t.Errorf("got %x, want %x", record, want)
+	}
+
+	vps, sps2, pps, err := parseHEVCDecoderConfRecord(record)
+	if err != nil {
+		t.Fatalf("parseHEVCDecoderConfRecord() failed: %v", err)
+	}
+	if !bytes.Equal(vps, testHEVCVPS) || !bytes.Equal(sps2, sps) || !bytes.Equal(pps, testHEVCPPS) {
+		t.Errorf("got %x, %x, %x, want %x, %x, %x", vps, sps2, pps, testHEVCVPS, sps, testHEVCPPS)
+	}
+
+	if _, err = hevcDecoderConfRecord(testHEVCVPS, testHEVCSPS[:8], testHEVCPPS); err == nil {
+		t.Error("hevcDecoderConfRecord() succeeded with an invalid SPS")
+	}
+	withoutPPS := append([]byte(nil), record...)
+	withoutPPS[22] = 2
+	for name, invalid := range map[string][]byte{
+		"too short":       record[:22],
+		"truncated":       record[:len(record)-1],
+		"missing the PPS": withoutPPS,
+	} {
+		if _, _, _, err = parseHEVCDecoderConfRecord(invalid); err == nil {
+			t.Errorf("parseHEVCDecoderConfRecord() succeeded with a record %s", name)
+		}
+	}
+}
+
+func TestUIFramerHEVC(t *testing.T) {
+	record, err := hevcDecoderConfRecord(testHEVCVPS, testHEVCSPS, testHEVCPPS)
+	if err != nil {
+		t.Fatalf("hevcDecoderConfRecord() failed: %v", err)
+	}
+	tests := []struct {
+		name      string
+		bitstream int
+		config    []byte
+		data      []byte
+	}{
+		{"annex b", UI_BITSTREAM_ANNEXB, annexB(testHEVCVPS, testHEVCSPS, testHEVCPPS),
+			annexB(testHEVCVPS, testHEVCSPS, testHEVCPPS, testHEVCIDR)},
+		{"hvcc", UI_BITSTREAM_AVCC, record, append(be32(uint32(len(testHEVCIDR))), testHEVCIDR...)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			framer := newUIFramer(test.bitstream, nil)
+			aud := []byte{_HEVC_NALU_AUD << 1, 0x01, 0x50}
+			frames := framer.frames(&uiPacket{codec: UI_CODEC_HEVC, isKeyFrame: true,
+				nalus: [][]byte{aud, testHEVCVPS, testHEVCSPS, testHEVCPPS, testHEVCIDR}})
+			want := []*UIFrame{
+				{Codec: UI_CODEC_HEVC, IsCodecConfig: true, Data: test.config},
+				{Codec: UI_CODEC_HEVC, IsKeyFrame: true, Data: test.data},
+			}
+			if !reflect.DeepEqual(frames, want) {
+				t.Errorf("got %d frames:", len(frames))
+				for _, f := range frames {
+					t.Errorf("  %+v", *f)
+				}
+			}
+
+			// No config frame until the VPS is received
+			framer = newUIFramer(test.bitstream, nil)
+			frames = framer.frames(&uiPacket{codec: UI_CODEC_HEVC, isKeyFrame: true,
+				nalus: [][]byte{testHEVCSPS, testHEVCPPS, testHEVCIDR}})
+			if len(frames) != 1 || frames[0].IsCodecConfig {
+				t.Errorf("got %d frames without the VPS, want a single frame", len(frames))
+			}
+		})
+	}
+}
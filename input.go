@@ -0,0 +1,208 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Input event types (used in InputEvent.Type)
+	INPUT_EVENT_KEY                = "key" // A key press, i.e. keydown immediately followed by keyup
+	INPUT_EVENT_KEYDOWN            = "keydown"
+	INPUT_EVENT_KEYUP              = "keyup"
+	INPUT_EVENT_CLICK              = "click" // A mouse click, i.e. mousedown immediately followed by mouseup
+	INPUT_EVENT_MOUSEMOVE          = "mousemove"
+	INPUT_EVENT_MOUSEDOWN          = "mousedown"
+	INPUT_EVENT_MOUSEUP            = "mouseup"
+	INPUT_EVENT_WHEEL              = "wheel"
+	INPUT_EVENT_TOUCHSTART         = "touchstart"
+	INPUT_EVENT_TOUCHMOVE          = "touchmove"
+	INPUT_EVENT_TOUCHEND           = "touchend"
+	INPUT_EVENT_TOUCHCANCEL        = "touchcancel"
+	INPUT_EVENT_TEXT               = "text" // Inserts a whole string at the focused element
+	INPUT_EVENT_COMPOSITION_START  = "compositionstart"
+	INPUT_EVENT_COMPOSITION_UPDATE = "compositionupdate"
+	INPUT_EVENT_COMPOSITION_END    = "compositionend" // Commits the composed text
+
+	// Mouse buttons (used in InputEvent.Button), as per the DOM MouseEvent.button
+	MOUSE_BUTTON_LEFT   = 0
+	MOUSE_BUTTON_MIDDLE = 1
+	MOUSE_BUTTON_RIGHT  = 2
+)
+
+// TouchPoint is a single point of contact in a touch event, Id identifies the point across touchstart, touchmove and touchend.
+type TouchPoint struct {
+	Id int `json:"id"`
+	X  int `json:"x"`
+	Y  int `json:"y"`
+}
+
+// InputEvent is an input event to be injected into a session using SessionSendInputEvent().
+// The fields that are relevant depend on the type of the event:
+//   - key, keydown, keyup: Code (javascript key code), Char and Mod
+//   - click, mousedown, mouseup: X, Y, Button and Mod
+//   - mousemove: X, Y and Mod (the pressed buttons are given by the MOD_*_MOUSE_BUTTON bits)
+//   - wheel: X, Y, DeltaX, DeltaY and Mod
+//   - touchstart, touchmove, touchend, touchcancel: Touches (all the current points of contact)
+//   - text, compositionstart, compositionupdate, compositionend: Text
+type InputEvent struct {
+	Type    string       `json:"type"` // One of INPUT_EVENT_*
+	Code    int          `json:"code"`
+	Char    rune         `json:"char,omitempty"`
+	Mod     int          `json:"mod,omitempty"`
+	X       int          `json:"x"`
+	Y       int          `json:"y"`
+	Button  int          `json:"button,omitempty"` // One of MOUSE_BUTTON_*
+	DeltaX  int          `json:"dx,omitempty"`     // Wheel delta in pixels
+	DeltaY  int          `json:"dy,omitempty"`     // Wheel delta in pixels
+	Touches []TouchPoint `json:"touches,omitempty"`
+	Text    string       `json:"text,omitempty"`
+}
+
+// Validate checks that the event type is known and that the fields required by the type are set.
+func (ev *InputEvent) Validate() error {
+	switch ev.Type {
+	case INPUT_EVENT_KEY, INPUT_EVENT_KEYDOWN, INPUT_EVENT_KEYUP:
+	case INPUT_EVENT_CLICK, INPUT_EVENT_MOUSEDOWN, INPUT_EVENT_MOUSEUP:
+		if ev.Button < MOUSE_BUTTON_LEFT || ev.Button > MOUSE_BUTTON_RIGHT {
+			return withClass(ErrInvalidArgument, errors.New("Invalid mouse button: "+strconv.Itoa(ev.Button)))
+		}
+	case INPUT_EVENT_MOUSEMOVE:
+	case INPUT_EVENT_WHEEL:
+		if ev.DeltaX == 0 && ev.DeltaY == 0 {
+			return withClass(ErrInvalidArgument, errors.New("Wheel event requires a delta"))
+		}
+	case INPUT_EVENT_TOUCHSTART, INPUT_EVENT_TOUCHMOVE:
+		if len(ev.Touches) == 0 {
+			return withClass(ErrInvalidArgument, errors.New("Touch event requires at least one touch point"))
+		}
+	case INPUT_EVENT_TOUCHEND, INPUT_EVENT_TOUCHCANCEL:
+	case INPUT_EVENT_TEXT:
+		if ev.Text == "" {
+			return withClass(ErrInvalidArgument, errors.New("Text event requires text"))
+		}
+	case INPUT_EVENT_COMPOSITION_START, INPUT_EVENT_COMPOSITION_UPDATE, INPUT_EVENT_COMPOSITION_END:
+	default:
+		return withClass(ErrInvalidArgument, errors.New("Invalid event type: "+ev.Type))
+	}
+	return nil
+}
+
+// The struct holding an input event, it is either sent as URL parameters of /osb/session/event or
+// as JSON over the input channel (see SessionInputChannelStart()).
+type sessionEvent struct {
+	Seq       uint64 `json:"seq,omitempty"` // Sequence number, only used over the input channel
+	Timestamp int64  `json:"ts,omitempty"`  // Client time in milliseconds, only used over the input channel
+	InputEvent
+}
+
+// touchesToStr encodes the touch points as "id,x,y" separated by ";".
+func touchesToStr(touches []TouchPoint) string {
+	points := make([]string, len(touches))
+	for i, t := range touches {
+		points[i] = strconv.Itoa(t.Id) + "," + strconv.Itoa(t.X) + "," + strconv.Itoa(t.Y)
+	}
+	return strings.Join(points, ";")
+}
+
+// eventURL returns the /osb/session/event URL for the given event.
+func eventURL(ctx *SessionContext, ev *sessionEvent) (uri string) {
+	uri = _SESSION_EVENT_URL
+	switch ev.Type {
+	case INPUT_EVENT_KEY, INPUT_EVENT_KEYDOWN, INPUT_EVENT_KEYUP:
+		uri += "&code=${KEYCODE}"
+		if ev.Char > 0 {
+			uri += "&char=${CHAR}"
+		}
+	case INPUT_EVENT_CLICK:
+		uri += "&x=${X}&y=${Y}"
+		if ev.Button != MOUSE_BUTTON_LEFT {
+			uri += "&button=${BUTTON}"
+		}
+	case INPUT_EVENT_MOUSEDOWN, INPUT_EVENT_MOUSEUP:
+		uri += "&x=${X}&y=${Y}&button=${BUTTON}"
+	case INPUT_EVENT_MOUSEMOVE:
+		uri += "&x=${X}&y=${Y}"
+	case INPUT_EVENT_WHEEL:
+		uri += "&x=${X}&y=${Y}&dx=${DX}&dy=${DY}"
+	case INPUT_EVENT_TOUCHSTART, INPUT_EVENT_TOUCHMOVE, INPUT_EVENT_TOUCHEND, INPUT_EVENT_TOUCHCANCEL:
+		uri += "&touches=${TOUCHES}"
+	default:
+		// Text and composition events
+		uri += "&text=${TEXT}"
+	}
+
+	if ev.Mod > 0 {
+		uri += "&mod=${MOD}"
+	}
+
+	uri = replaceVars(uri, []string{
+		"${PROTHOST}",
+		"${SID}",
+		"${TYPE}",
+		"${KEYCODE}",
+		"${CHAR}",
+		"${MOD}",
+		"${X}",
+		"${Y}",
+		"${BUTTON}",
+		"${DX}",
+		"${DY}",
+		"${TOUCHES}",
+		"${TEXT}",
+	}, []string{
+		ctx.ServerProtocolHost,
+		url.QueryEscape(ctx.SessionId),
+		ev.Type,
+		strconv.Itoa(ev.Code),
+		strconv.Itoa(int(ev.Char)),
+		strconv.Itoa(ev.Mod),
+		strconv.Itoa(ev.X),
+		strconv.Itoa(ev.Y),
+		strconv.Itoa(ev.Button),
+		strconv.Itoa(ev.DeltaX),
+		strconv.Itoa(ev.DeltaY),
+		url.QueryEscape(touchesToStr(ev.Touches)),
+		url.QueryEscape(ev.Text),
+	})
+	return
+}
+
+// sessionSendEventHTTP sends a single event using a request to /osb/session/event.
+func sessionSendEventHTTP(ctx *SessionContext, ev *sessionEvent) (err error) {
+	err = apiReq(ctx.httpClient, eventURL(ctx, ev), nil, ctx.shouldStopSession, nil)
+	return
+}
+
+// SessionSendInputEvent is used to inject any type of input into a session, see InputEvent for the supported types.
+// When the input channel is active (see SessionInputChannelStart()) the event is queued for sending over it and
+// this function returns without waiting for the server, otherwise a request is made to /osb/session/event.
+func SessionSendInputEvent(ctx *SessionContext, inputEvent *InputEvent) (err error) {
+	ev := &sessionEvent{InputEvent: *inputEvent}
+	ev.Type = strings.ToLower(ev.Type)
+	err = ev.Validate()
+	if err != nil {
+		return
+	}
+
+	if ic := ctx.getInputChannel(); ic != nil && ic.send(ev) {
+		return nil
+	}
+
+	// Make the request
+	err = sessionSendEventHTTP(ctx, ev)
+	return
+}
+
+// SessionSendText is used to insert a whole string at the focused element of the page, e.g. when the text
+// was entered using an on-screen keyboard or a voice remote.
+func SessionSendText(ctx *SessionContext, text string) (err error) {
+	err = SessionSendInputEvent(ctx, &InputEvent{Type: INPUT_EVENT_TEXT, Text: text})
+	return
+}
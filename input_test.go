@@ -0,0 +1,136 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInputEventValidate(t *testing.T) {
+	touches := []TouchPoint{{Id: 1, X: 10, Y: 20}}
+	tests := []struct {
+		name  string
+		event InputEvent
+		valid bool
+	}{
+		{"key", InputEvent{Type: INPUT_EVENT_KEY, Code: 13}, true},
+		{"key code 0", InputEvent{Type: INPUT_EVENT_KEYUP}, true},
+		{"click", InputEvent{Type: INPUT_EVENT_CLICK, X: 10, Y: 20}, true},
+		{"right mouse button", InputEvent{Type: INPUT_EVENT_MOUSEDOWN, Button: MOUSE_BUTTON_RIGHT}, true},
+		{"invalid mouse button", InputEvent{Type: INPUT_EVENT_MOUSEUP, Button: 3}, false},
+		{"negative mouse button", InputEvent{Type: INPUT_EVENT_CLICK, Button: -1}, false},
+		{"mousemove", InputEvent{Type: INPUT_EVENT_MOUSEMOVE}, true},
+		{"wheel", InputEvent{Type: INPUT_EVENT_WHEEL, DeltaY: -120}, true},
+		{"wheel without a delta", InputEvent{Type: INPUT_EVENT_WHEEL}, false},
+		{"touchstart", InputEvent{Type: INPUT_EVENT_TOUCHSTART, Touches: touches}, true},
+		{"touchmove without points", InputEvent{Type: INPUT_EVENT_TOUCHMOVE}, false},
+		{"touchend without points", InputEvent{Type: INPUT_EVENT_TOUCHEND}, true},
+		{"text", InputEvent{Type: INPUT_EVENT_TEXT, Text: "hello"}, true},
+		{"empty text", InputEvent{Type: INPUT_EVENT_TEXT}, false},
+		{"composition", InputEvent{Type: INPUT_EVENT_COMPOSITION_UPDATE, Text: "he"}, true},
+		{"empty composition end", InputEvent{Type: INPUT_EVENT_COMPOSITION_END}, true},
+		{"unknown type", InputEvent{Type: "scroll"}, false},
+		{"upper case type", InputEvent{Type: "KEY"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.event.Validate()
+			if test.valid && err != nil {
+				t.Errorf("Validate() failed: %v", err)
+			} else if !test.valid && !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("Validate() returned %v, want ErrInvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestSessionEventEncoding(t *testing.T) {
+	const prefix = "http://127.0.0.1/osb/session/event?session_id=event+session&type="
+	tests := []struct {
+		name  string
+		event sessionEvent
+		url   string
+		json  string
+	}{
+		{"key", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_KEY, Code: 65, Char: 'a', Mod: 1}},
+			"key&code=65&char=97&mod=1",
+			`{"type":"key","code":65,"char":97,"mod":1,"x":0,"y":0}`},
+		{"key code 0", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_KEYDOWN}},
+			"keydown&code=0",
+			`{"type":"keydown","code":0,"x":0,"y":0}`},
+		{"click at the origin", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_CLICK}},
+			"click&x=0&y=0",
+			`{"type":"click","code":0,"x":0,"y":0}`},
+		{"right click", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_CLICK, X: 5, Y: 6,
+			Button: MOUSE_BUTTON_RIGHT}},
+			"click&x=5&y=6&button=2",
+			`{"type":"click","code":0,"x":5,"y":6,"button":2}`},
+		{"mousedown", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_MOUSEDOWN, X: 5, Y: 6}},
+			"mousedown&x=5&y=6&button=0",
+			`{"type":"mousedown","code":0,"x":5,"y":6}`},
+		{"mousemove", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_MOUSEMOVE, X: 5, Y: 6, Mod: 16}},
+			"mousemove&x=5&y=6&mod=16",
+			`{"type":"mousemove","code":0,"mod":16,"x":5,"y":6}`},
+		{"wheel", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_WHEEL, X: 5, Y: 6, DeltaY: -120}},
+			"wheel&x=5&y=6&dx=0&dy=-120",
+			`{"type":"wheel","code":0,"x":5,"y":6,"dy":-120}`},
+		{"touch", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_TOUCHMOVE,
+			Touches: []TouchPoint{{Id: 1, X: 10, Y: 20}, {Id: 2, X: 30, Y: 40}}}},
+			"touchmove&touches=1%2C10%2C20%3B2%2C30%2C40",
+			`{"type":"touchmove","code":0,"x":0,"y":0,"touches":[{"id":1,"x":10,"y":20},{"id":2,"x":30,"y":40}]}`},
+		{"text", sessionEvent{InputEvent: InputEvent{Type: INPUT_EVENT_TEXT, Text: "a b&c"}},
+			"text&text=a+b%26c",
+			`{"type":"text","code":0,"x":0,"y":0,"text":"a b\u0026c"}`},
+		{"input channel", sessionEvent{Seq: 7, Timestamp: 1500, InputEvent: InputEvent{Type: INPUT_EVENT_KEYUP,
+			Code: 13}},
+			"keyup&code=13",
+			`{"seq":7,"ts":1500,"type":"keyup","code":13,"x":0,"y":0}`},
+	}
+	ctx := &SessionContext{ServerProtocolHost: "http://127.0.0.1", SessionId: "event session"}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := eventURL(ctx, &test.event); got != prefix+test.url {
+				t.Errorf("got URL %s, want %s", got, prefix+test.url)
+			}
+			data, err := json.Marshal(&test.event)
+			if err != nil {
+				t.Fatalf("json.Marshal() failed: %v", err)
+			}
+			if string(data) != test.json {
+				t.Errorf("got JSON %s, want %s", data, test.json)
+			}
+		})
+	}
+}
+
+func TestSessionSendInputEvent(t *testing.T) {
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.RawQuery)
+	}))
+	defer srv.Close()
+	jar, _ := newCookieJar()
+	ctx := newSessionContext(srv.URL, "send-session", jar, newHTTPTransports(nil), nil)
+	defer removeSessionContext(ctx)
+
+	// The type is case insensitive, invalid events are not sent
+	if err := SessionSendInputEvent(ctx, &InputEvent{Type: "KeyDown", Code: 13}); err != nil {
+		t.Fatalf("SessionSendInputEvent() failed: %v", err)
+	}
+	if err := SessionSendInputEvent(ctx, &InputEvent{Type: INPUT_EVENT_WHEEL}); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("SessionSendInputEvent() returned %v for an invalid event, want ErrInvalidArgument", err)
+	}
+	if err := SessionSendText(ctx, "hi"); err != nil {
+		t.Fatalf("SessionSendText() failed: %v", err)
+	}
+	want := []string{"session_id=send-session&type=keydown&code=13", "session_id=send-session&type=text&text=hi"}
+	if len(queries) != len(want) || queries[0] != want[0] || queries[1] != want[1] {
+		t.Errorf("got requests %q, want %q", queries, want)
+	}
+}
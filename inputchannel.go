@@ -0,0 +1,469 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// Maximum number of events waiting to be sent over the input channel
+	_INPUT_CHANNEL_QUEUE_SIZE = 1024
+
+	// Maximum number of events sent in a single WebSocket message
+	_INPUT_CHANNEL_MAX_BATCH = 64
+
+	// Maximum time to wait for the WebSocket handshake to complete
+	_INPUT_CHANNEL_DIAL_TIMEOUT = 5 * time.Second
+
+	// Maximum time to write a message, the channel is considered failed afterwards
+	_INPUT_CHANNEL_WRITE_TIMEOUT = 5 * time.Second
+)
+
+var ErrInputChannelNotSupported = errors.New("Input channel is not supported by the server")
+
+// The struct that is sent as a single WebSocket message over the input channel. Events that were queued while
+// the previous message was being sent are batched together, messages are pipelined without waiting for the server.
+type inputChannelMessage struct {
+	Events []*sessionEvent `json:"events"`
+}
+
+// inputChannel is a persistent WebSocket connection to the server over which input events are sent.
+type inputChannel struct {
+	ctx    *SessionContext
+	conn   *websocket.Conn
+	rwc    *countingConn // The connection under conn
+	events chan *sessionEvent
+	seq    uint64
+	stop   chan bool // Closed in order to flush the pending events and close the connection
+	done   chan bool // Closed when the sending go routine exits
+}
+
+// countingConn counts the bytes of the message being written to a connection, in order to tell whether a failed
+// message was written. The control frames written meanwhile by the WebSocket library (e.g. pongs) are not counted.
+type countingConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written *int64 // The bytes of the frame of the message being written, nil when none
+}
+
+func (c *countingConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	c.mutex.Lock()
+	// Frames are written one at a time, a control frame has the 0x08 bit of its opcode set
+	if c.written != nil && (*c.written > 0 || len(b) == 0 || b[0]&0x08 == 0) {
+		*c.written += int64(n)
+	}
+	c.mutex.Unlock()
+	return
+}
+
+// writeMessage writes a message to the WebSocket connection over the counting connection, it returns how many
+// bytes of its frame were written.
+func (c *countingConn) writeMessage(conn *websocket.Conn, data []byte) (written int64, err error) {
+	c.mutex.Lock()
+	c.written = &written
+	c.mutex.Unlock()
+	_, err = conn.Write(data)
+	c.mutex.Lock()
+	c.written = nil
+	c.mutex.Unlock()
+	return
+}
+
+// send queues the event for sending over the channel without blocking, the events are sent using
+// /osb/session/event once the channel failed. It returns false if the channel was stopped or its queue is full,
+// in which case the caller needs to send the event on its own.
+func (ic *inputChannel) send(ev *sessionEvent) bool {
+	// The session mutex keeps the sequence numbers in the same order as the queue
+	ic.ctx.mutex.Lock()
+	defer ic.ctx.mutex.Unlock()
+
+	if ic.ctx.inputChannel != ic {
+		// Stopped in the meantime
+		return false
+	}
+
+	ev.Seq = ic.seq + 1
+	ev.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	select {
+	case ic.events <- ev:
+		ic.seq++
+		return true
+	default:
+		log.Println("Input channel queue is full, sending the event using an HTTP request")
+		ev.Seq, ev.Timestamp = 0, 0
+		return false
+	}
+}
+
+// fallback sends the given events, which were not written to the connection, and the events queued until the queue
+// is empty using /osb/session/event. The channel is only removed from the session once its queue is empty, so that
+// the events sent meanwhile do not overtake the queued ones.
+func (ic *inputChannel) fallback(events []*sessionEvent) {
+	for {
+		for _, ev := range events {
+			err := sessionSendEventHTTP(ic.ctx, ev)
+			if err != nil {
+				log.Println("Failed to send event: ", err)
+			}
+		}
+
+		// The session mutex keeps send() from queueing an event once the queue is found empty
+		ic.ctx.mutex.Lock()
+		events = ic.queued()
+		if len(events) == 0 {
+			if ic.ctx.inputChannel == ic {
+				ic.ctx.inputChannel = nil
+			}
+			ic.ctx.mutex.Unlock()
+			return
+		}
+		ic.ctx.mutex.Unlock()
+	}
+}
+
+// queued returns the events in the queue without waiting.
+func (ic *inputChannel) queued() (events []*sessionEvent) {
+	for {
+		select {
+		case ev := <-ic.events:
+			events = append(events, ev)
+		default:
+			return
+		}
+	}
+}
+
+// nextBatch returns the events that are queued, waiting for at least one. It returns nil once stopped and the queue is empty.
+func (ic *inputChannel) nextBatch() (events []*sessionEvent) {
+	select {
+	case ev := <-ic.events:
+		events = append(events, ev)
+	case <-ic.stop:
+		select {
+		case ev := <-ic.events:
+			events = append(events, ev)
+		default:
+			return nil
+		}
+	}
+
+	for len(events) < _INPUT_CHANNEL_MAX_BATCH {
+		select {
+		case ev := <-ic.events:
+			events = append(events, ev)
+			continue
+		default:
+		}
+		break
+	}
+	return
+}
+
+func (ic *inputChannel) run() {
+	defer close(ic.done)
+	defer ic.conn.Close()
+
+	for {
+		events := ic.nextBatch()
+		if events == nil {
+			return
+		}
+
+		data, err := json.Marshal(&inputChannelMessage{Events: events})
+		if err != nil {
+			log.Println("Failed to encode input events: ", err)
+			continue
+		}
+		ic.conn.SetWriteDeadline(time.Now().Add(_INPUT_CHANNEL_WRITE_TIMEOUT))
+		written, err := ic.rwc.writeMessage(ic.conn, data)
+		if err != nil {
+			log.Println("Input channel failed, falling back to HTTP requests: ", err)
+			if written >= int64(wsFrameSize(len(data))) {
+				// The message was written before the failure, only the events queued after it are left
+				events = nil
+			}
+			ic.fallback(events)
+			return
+		}
+	}
+}
+
+// wsFrameSize returns the size of a masked client WebSocket frame with the given payload size.
+func wsFrameSize(payloadSize int) int {
+	size := 2 + 4 + payloadSize // Header and masking key
+	if payloadSize >= 65536 {
+		size += 8
+	} else if payloadSize > 125 {
+		size += 2
+	}
+	return size
+}
+
+// receive consumes the messages sent by the server (e.g. acknowledgements) and detects when the connection is closed.
+func (ic *inputChannel) receive() {
+	var msg []byte
+	for {
+		err := websocket.Message.Receive(ic.conn, &msg)
+		if err != nil {
+			// Closing the connection makes the next send fail and fall back to HTTP requests
+			ic.conn.Close()
+			return
+		}
+	}
+}
+
+func (ctx *SessionContext) getInputChannel() *inputChannel {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.inputChannel
+}
+
+// inputChannelURL returns the WebSocket URL of the input channel along with the equivalent HTTP URL.
+func inputChannelURL(ctx *SessionContext) (wsURL string, httpURL string) {
+	httpURL = replaceVars(_SESSION_EVENT_CHANNEL_URL, []string{
+		"${PROTHOST}",
+		"${SID}",
+	}, []string{
+		ctx.ServerProtocolHost,
+		url.QueryEscape(ctx.SessionId),
+	})
+
+	if strings.HasPrefix(httpURL, "https://") {
+		wsURL = "wss://" + strings.TrimPrefix(httpURL, "https://")
+	} else {
+		wsURL = "ws://" + strings.TrimPrefix(httpURL, "http://")
+	}
+	return
+}
+
+// SessionInputChannelStart opens a persistent WebSocket connection to the server over which SessionSendEvent()
+// sends the input events, rather than making a request per event. Events carry a sequence number and the client
+// time at which they were sent. ErrInputChannelNotSupported is returned when the server does not support it,
+// in which case SessionSendEvent() keeps making a request per event. The same happens when the connection fails later on.
+func SessionInputChannelStart(ctx *SessionContext) (err error) {
+	if ctx.getInputChannel() != nil {
+		return withClass(ErrInvalidState, errors.New("Input channel is already started"))
+	}
+
+	if caps := ctx.knownCapabilities(); caps != nil && caps.Reported && !caps.InputChannel {
+		return ErrInputChannelNotSupported
+	}
+
+	wsURL, httpURL := inputChannelURL(ctx)
+	config, err := websocket.NewConfig(wsURL, ctx.ServerProtocolHost)
+	if err != nil {
+		return fmt.Errorf("Failed to create input channel configuration: %v", err)
+	}
+	config.TlsConfig = ctx.transports.tr.TLSClientConfig.Clone()
+
+	// Pass the cookies of the session, they are needed for load balancing stickiness
+	if ctx.CookieJar != nil {
+		u, _ := url.Parse(httpURL)
+		for _, c := range ctx.CookieJar.Cookies(u) {
+			config.Header.Add("Cookie", (&http.Cookie{Name: c.Name, Value: c.Value}).String())
+		}
+	}
+
+	rwc, e := dialInputChannel(ctx.transports.tr, config, httpURL)
+	if e != nil {
+		return withClass(ErrNetwork, fmt.Errorf("Failed to open input channel: %v", e))
+	}
+	rwc.SetDeadline(time.Now().Add(_INPUT_CHANNEL_DIAL_TIMEOUT))
+	conn, e := websocket.NewClient(config, rwc)
+	if e != nil {
+		rwc.Close()
+		if e == websocket.ErrBadStatus {
+			log.Println("Failed to open input channel: ", e)
+			return ErrInputChannelNotSupported
+		}
+		return withClass(ErrNetwork, fmt.Errorf("Failed to open input channel: %v", e))
+	}
+	rwc.SetDeadline(time.Time{})
+
+	ic := &inputChannel{
+		ctx:    ctx,
+		conn:   conn,
+		rwc:    rwc,
+		events: make(chan *sessionEvent, _INPUT_CHANNEL_QUEUE_SIZE),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+
+	// Another input channel may have been started concurrently
+	ctx.mutex.Lock()
+	if ctx.inputChannel != nil {
+		ctx.mutex.Unlock()
+		conn.Close()
+		return withClass(ErrInvalidState, errors.New("Input channel is already started"))
+	}
+	ctx.inputChannel = ic
+	ctx.mutex.Unlock()
+
+	go ic.run()
+	go ic.receive()
+	return nil
+}
+
+// dialInputChannel opens the connection of the input channel, over which the WebSocket handshake is made. The
+// connection is made by the given transport of the session, through its proxy if any.
+func dialInputChannel(tr *http.Transport, config *websocket.Config, httpURL string) (rwc *countingConn, err error) {
+	host := config.Location.Host
+	secure := config.Location.Scheme == "wss"
+	if config.Location.Port() == "" {
+		if secure {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	var proxyURL *url.URL
+	if tr.Proxy != nil {
+		req, e := http.NewRequest(http.MethodGet, httpURL, nil)
+		if e != nil {
+			return nil, e
+		}
+		proxyURL, err = tr.Proxy(req)
+		if err != nil {
+			return
+		}
+	}
+
+	addr := host
+	if proxyURL != nil {
+		addr = proxyURL.Host
+		if proxyURL.Port() == "" {
+			if proxyURL.Scheme == "https" {
+				addr += ":443"
+			} else {
+				addr += ":80"
+			}
+		}
+	}
+	dial := tr.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	conn, err := dial(context.Background(), "tcp", addr)
+	if err != nil {
+		return
+	}
+	if proxyURL != nil {
+		conn, err = connectInputChannelProxy(tr, conn, proxyURL, host)
+		if err != nil {
+			return
+		}
+	}
+	if secure {
+		conn, err = tlsHandshake(tr, conn, config.TlsConfig, config.Location.Hostname())
+		if err != nil {
+			return
+		}
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+// tlsHandshake makes a TLS client connection over the given connection, which is closed on failure.
+func tlsHandshake(tr *http.Transport, conn net.Conn, tlsConfig *tls.Config, serverName string) (net.Conn, error) {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if tr.TLSHandshakeTimeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(tr.TLSHandshakeTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// connectInputChannelProxy opens a tunnel to the given host through an HTTP proxy, using the CONNECT method over
+// the connection to the proxy, which is closed on failure.
+func connectInputChannelProxy(tr *http.Transport, conn net.Conn, proxyURL *url.URL, host string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http":
+	case "https":
+		tlsConn, err := tlsHandshake(tr, conn, tr.TLSClientConfig, proxyURL.Hostname())
+		if err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("Unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: host},
+		Host:   host,
+		Header: http.Header{},
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	conn.SetDeadline(time.Now().Add(_INPUT_CHANNEL_DIAL_TIMEOUT))
+	err := req.Write(conn)
+	if err == nil {
+		var resp *http.Response
+		resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				err = fmt.Errorf("Proxy refused the connection: %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// SessionInputChannelStop sends any pending events and closes the input channel.
+// Subsequent calls to SessionSendEvent() make a request per event.
+func SessionInputChannelStop(ctx *SessionContext) (err error) {
+	ctx.mutex.Lock()
+	ic := ctx.inputChannel
+	ctx.inputChannel = nil
+	ctx.mutex.Unlock()
+
+	if ic == nil {
+		return withClass(ErrInvalidState, errors.New("Input channel is not started"))
+	}
+
+	close(ic.stop)
+	<-ic.done
+	return nil
+}
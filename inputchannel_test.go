@@ -0,0 +1,291 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// testInputServer is a server supporting the input channel, it logs the events it receives in order.
+type testInputServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	events   []*sessionEvent // The events received, with Seq set to 0 for those received using HTTP requests
+	received chan bool       // Signalled whenever an event is received
+	blocked  chan bool       // When non nil, an HTTP request waits for it to be closed before being logged
+	entered  chan bool       // Signalled when an HTTP request starts waiting
+}
+
+func newTestInputServer() *testInputServer {
+	srv := &testInputServer{received: make(chan bool, 1024), entered: make(chan bool, 1024)}
+	mux := http.NewServeMux()
+	mux.Handle("/osb/session/event/channel", websocket.Handler(func(ws *websocket.Conn) {
+		for {
+			var msg inputChannelMessage
+			if err := websocket.JSON.Receive(ws, &msg); err != nil {
+				return
+			}
+			srv.log(msg.Events...)
+		}
+	}))
+	mux.HandleFunc("/osb/session/event", func(w http.ResponseWriter, r *http.Request) {
+		srv.mutex.Lock()
+		blocked := srv.blocked
+		srv.mutex.Unlock()
+		if blocked != nil {
+			srv.entered <- true
+			<-blocked
+		}
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		srv.log(&sessionEvent{InputEvent: InputEvent{Type: r.URL.Query().Get("type"), Code: code}})
+	})
+	srv.Server = httptest.NewServer(mux)
+	return srv
+}
+
+func (srv *testInputServer) log(events ...*sessionEvent) {
+	srv.mutex.Lock()
+	srv.events = append(srv.events, events...)
+	srv.mutex.Unlock()
+	for range events {
+		srv.received <- true
+	}
+}
+
+// wait waits for n more events to be received.
+func (srv *testInputServer) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-srv.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %d events", n-i)
+		}
+	}
+}
+
+// codes returns the key codes of the events received, negated for those received using HTTP requests.
+func (srv *testInputServer) codes() (codes []int) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for _, ev := range srv.events {
+		if ev.Seq == 0 {
+			codes = append(codes, -ev.Code)
+		} else {
+			codes = append(codes, ev.Code)
+		}
+	}
+	return
+}
+
+func sendTestKey(t *testing.T, ctx *SessionContext, code int) {
+	if err := SessionSendInputEvent(ctx, &InputEvent{Type: INPUT_EVENT_KEYDOWN, Code: code}); err != nil {
+		t.Fatalf("SessionSendInputEvent() failed: %v", err)
+	}
+}
+
+func TestInputChannel(t *testing.T) {
+	srv := newTestInputServer()
+	defer srv.Close()
+	jar, _ := newCookieJar()
+	ctx := newSessionContext(srv.URL, "input-session", jar, newHTTPTransports(nil), nil)
+	defer removeSessionContext(ctx)
+
+	if err := SessionInputChannelStart(ctx); err != nil {
+		t.Fatalf("SessionInputChannelStart() failed: %v", err)
+	}
+	if err := SessionInputChannelStart(ctx); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("second SessionInputChannelStart() returned %v, want ErrInvalidState", err)
+	}
+	for code := 1; code <= 100; code++ {
+		sendTestKey(t, ctx, code)
+	}
+	if err := SessionInputChannelStop(ctx); err != nil {
+		t.Fatalf("SessionInputChannelStop() failed: %v", err)
+	}
+	srv.wait(t, 100)
+
+	// The pending events are flushed when stopped, in order and numbered
+	srv.mutex.Lock()
+	for i, ev := range srv.events {
+		if ev.Seq != uint64(i+1) || ev.Code != i+1 || ev.Type != INPUT_EVENT_KEYDOWN || ev.Timestamp == 0 {
+			t.Errorf("event %d: got %+v", i, *ev)
+		}
+	}
+	srv.mutex.Unlock()
+
+	if err := SessionInputChannelStop(ctx); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("second SessionInputChannelStop() returned %v, want ErrInvalidState", err)
+	}
+	sendTestKey(t, ctx, 101)
+	srv.wait(t, 1)
+	if codes := srv.codes(); codes[len(codes)-1] != -101 {
+		t.Errorf("the event after stopping was not sent using an HTTP request: %v", codes[len(codes)-1:])
+	}
+}
+
+func TestInputChannelBatch(t *testing.T) {
+	ic := &inputChannel{events: make(chan *sessionEvent, _INPUT_CHANNEL_QUEUE_SIZE), stop: make(chan bool)}
+	for i := 0; i < _INPUT_CHANNEL_MAX_BATCH+6; i++ {
+		ic.events <- &sessionEvent{Seq: uint64(i + 1)}
+	}
+	close(ic.stop)
+	for _, want := range []int{_INPUT_CHANNEL_MAX_BATCH, 6, 0} {
+		if events := ic.nextBatch(); len(events) != want {
+			t.Errorf("got a batch of %d events, want %d", len(events), want)
+		}
+	}
+}
+
+func TestInputChannelFallback(t *testing.T) {
+	srv := newTestInputServer()
+	defer srv.Close()
+	jar, _ := newCookieJar()
+	ctx := newSessionContext(srv.URL, "fallback-session", jar, newHTTPTransports(nil), nil)
+	defer removeSessionContext(ctx)
+
+	if err := SessionInputChannelStart(ctx); err != nil {
+		t.Fatalf("SessionInputChannelStart() failed: %v", err)
+	}
+	sendTestKey(t, ctx, 1)
+	srv.wait(t, 1)
+
+	// The connection fails, the event being sent is resent using an HTTP request, which is held by the server
+	blocked := make(chan bool)
+	srv.mutex.Lock()
+	srv.blocked = blocked
+	srv.mutex.Unlock()
+	ctx.getInputChannel().conn.Close()
+	sendTestKey(t, ctx, 2)
+	<-srv.entered
+
+	// The events sent meanwhile wait for the queued ones
+	sendTestKey(t, ctx, 3)
+	sendTestKey(t, ctx, 4)
+	srv.mutex.Lock()
+	srv.blocked = nil
+	srv.mutex.Unlock()
+	close(blocked)
+	srv.wait(t, 3)
+	for i := 0; i < 100 && ctx.getInputChannel() != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ctx.getInputChannel() != nil {
+		t.Fatal("the failed input channel was not removed")
+	}
+	sendTestKey(t, ctx, 5)
+	srv.wait(t, 1)
+
+	want := []int{1, -2, -3, -4, -5}
+	codes := srv.codes()
+	if len(codes) != len(want) {
+		t.Fatalf("got events %v, want %v", codes, want)
+	}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Fatalf("got events %v, want %v", codes, want)
+		}
+	}
+}
+
+func TestInputChannelProxy(t *testing.T) {
+	srv := newTestInputServer()
+	defer srv.Close()
+
+	// A proxy supporting the CONNECT method only
+	var mutex sync.Mutex
+	var tunnels []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "Only CONNECT is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		mutex.Lock()
+		tunnels = append(tunnels, r.Host)
+		mutex.Unlock()
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, buf, _ := w.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(target, buf)
+			target.Close()
+		}()
+		io.Copy(conn, target)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	config := DefaultHTTPConfig()
+	proxyURL, _ := url.Parse(proxy.URL)
+	config.Proxy = http.ProxyURL(proxyURL)
+	jar, _ := newCookieJar()
+	ctx := newSessionContext(srv.URL, "proxy-session", jar, newHTTPTransports(config), nil)
+	defer removeSessionContext(ctx)
+
+	if err := SessionInputChannelStart(ctx); err != nil {
+		t.Fatalf("SessionInputChannelStart() failed: %v", err)
+	}
+	sendTestKey(t, ctx, 1)
+	SessionInputChannelStop(ctx)
+	srv.wait(t, 1)
+	if codes := srv.codes(); len(codes) != 1 || codes[0] != 1 {
+		t.Errorf("got events %v, want [1]", codes)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(tunnels) != 1 || tunnels[0] != srv.Listener.Addr().String() {
+		t.Errorf("got tunnels %v, want one to %s", tunnels, srv.Listener.Addr())
+	}
+}
+
+func TestWsFrameSize(t *testing.T) {
+	tests := []struct {
+		payload int
+		want    int
+	}{
+		{0, 6},
+		{125, 131},
+		{126, 134},
+		{65535, 65543},
+		{65536, 65550},
+	}
+	for _, test := range tests {
+		if got := wsFrameSize(test.payload); got != test.want {
+			t.Errorf("wsFrameSize(%d) = %d, want %d", test.payload, got, test.want)
+		}
+	}
+}
+
+func TestCountingConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+	c := &countingConn{Conn: client}
+
+	var written int64
+	c.written = &written
+	c.Write([]byte{0x8a, 0x80, 1, 2, 3, 4}) // A pong written before the message
+	c.Write([]byte{0x81, 0x85, 1, 2, 3, 4})
+	c.Write([]byte{5, 6, 7, 8, 9})
+	c.written = nil
+	c.Write([]byte{0x89, 0x80, 1, 2, 3, 4}) // Not counted once the message is written
+	if written != 11 {
+		t.Errorf("counted %d bytes, want the 11 bytes of the message", written)
+	}
+}
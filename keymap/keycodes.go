@@ -0,0 +1,270 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package keymap
+
+import "strconv"
+
+// These are the constants used for modifiers when injecting input events via /osb/session/event.
+// They match appflinger_send_mod_t in libappflinger/appflinger.h.
+const (
+	MOD_NONE                = 0x0000
+	MOD_CAPSLOCK            = 0x0001
+	MOD_SHIFT               = 0x0002
+	MOD_CTRL                = 0x0004
+	MOD_ALT                 = 0x0008
+	MOD_LEFT_MOUSE_BUTTON   = 0x0010
+	MOD_MIDDLE_MOUSE_BUTTON = 0x0020
+	MOD_RIGHT_MOUSE_BUTTON  = 0x0040
+	MOD_COMMAND             = 0x0080
+	MOD_NUMLOCK             = 0x0100
+	MOD_KEYPAD              = 0x0200
+	MOD_LEFT                = 0x0400
+	MOD_RIGHT               = 0x0800
+)
+
+// These are the javascript key codes expected by the AppFlinger server. They match appflinger_js_key_code_t
+// in libappflinger/appflinger.h, followed by the codes of media and TV remote keys.
+const (
+	JSK_UNKNOWN = 0
+
+	JSK_BACKSPACE = 8
+	JSK_TAB       = 9
+
+	JSK_ENTER = 13
+
+	JSK_SHIFT      = 16
+	JSK_CTRL       = 17
+	JSK_ALT        = 18
+	JSK_PAUSEBREAK = 19
+	JSK_CAPSLOCK   = 20
+	JSK_ESCAPE     = 27
+
+	JSK_SPACEBAR   = 32
+	JSK_PAGEUP     = 33
+	JSK_PAGEDOWN   = 34
+	JSK_END        = 35
+	JSK_HOME       = 36
+	JSK_LEFTARROW  = 37
+	JSK_UPARROW    = 38
+	JSK_RIGHTARROW = 39
+	JSK_DOWNARROW  = 40
+
+	JSK_INSERT = 45
+	JSK_DELETE = 46
+
+	JSK_0 = 48
+	JSK_1 = 49
+	JSK_2 = 50
+	JSK_3 = 51
+	JSK_4 = 52
+	JSK_5 = 53
+	JSK_6 = 54
+	JSK_7 = 55
+	JSK_8 = 56
+	JSK_9 = 57
+
+	JSK_a            = 65
+	JSK_b            = 66
+	JSK_c            = 67
+	JSK_d            = 68
+	JSK_e            = 69
+	JSK_f            = 70
+	JSK_g            = 71
+	JSK_h            = 72
+	JSK_i            = 73
+	JSK_j            = 74
+	JSK_k            = 75
+	JSK_l            = 76
+	JSK_m            = 77
+	JSK_n            = 78
+	JSK_o            = 79
+	JSK_p            = 80
+	JSK_q            = 81
+	JSK_r            = 82
+	JSK_s            = 83
+	JSK_t            = 84
+	JSK_u            = 85
+	JSK_v            = 86
+	JSK_w            = 87
+	JSK_x            = 88
+	JSK_y            = 89
+	JSK_z            = 90
+	JSK_LEFTWKEY     = 91
+	JSK_RIGHTWKEY    = 92
+	JSK_SELECTKEY    = 93
+	JSK_NUMPAD_0     = 96
+	JSK_NUMPAD_1     = 97
+	JSK_NUMPAD_2     = 98
+	JSK_NUMPAD_3     = 99
+	JSK_NUMPAD_4     = 100
+	JSK_NUMPAD_5     = 101
+	JSK_NUMPAD_6     = 102
+	JSK_NUMPAD_7     = 103
+	JSK_NUMPAD_8     = 104
+	JSK_NUMPAD_9     = 105
+	JSK_MULTIPLY     = 106
+	JSK_ADD          = 107
+	JSK_SUBTRACT     = 109
+	JSK_DECIMALPOINT = 110
+	JSK_DIVIDE       = 111
+	JSK_F1           = 112
+	JSK_F2           = 113
+	JSK_F3           = 114
+	JSK_F4           = 115
+	JSK_F5           = 116
+	JSK_F6           = 117
+	JSK_F7           = 118
+	JSK_F8           = 119
+	JSK_F9           = 120
+	JSK_F10          = 121
+	JSK_F11          = 122
+	JSK_F12          = 123
+
+	JSK_NUMLOCK    = 144
+	JSK_SCROLLLOCK = 145
+
+	JSK_SEMICOLON   = 186
+	JSK_EQUALSIGN   = 187
+	JSK_COMMA       = 188
+	JSK_DASH        = 189
+	JSK_PERIOD      = 190
+	JSK_SLASH       = 191
+	JSK_GRAVEACCENT = 192
+
+	JSK_OPENBRACKET  = 219
+	JSK_BACKSLASH    = 220
+	JSK_CLOSEBRACKET = 221
+	JSK_SINGLEQUOTE  = 222
+
+	// Media keys of multimedia keyboards
+	JSK_VOLUME_MUTE      = 173
+	JSK_VOLUME_DOWN      = 174
+	JSK_VOLUME_UP        = 175
+	JSK_MEDIA_NEXT_TRACK = 176
+	JSK_MEDIA_PREV_TRACK = 177
+	JSK_MEDIA_STOP       = 178
+	JSK_MEDIA_PLAY_PAUSE = 179
+
+	// TV remote control keys (the VK_* key codes of HbbTV and CE-HTML)
+	JSK_PLAY_PAUSE   = 402
+	JSK_RED          = 403
+	JSK_GREEN        = 404
+	JSK_YELLOW       = 405
+	JSK_BLUE         = 406
+	JSK_REWIND       = 412
+	JSK_STOP         = 413
+	JSK_PLAY         = 415
+	JSK_RECORD       = 416
+	JSK_FAST_FWD     = 417
+	JSK_TRACK_PREV   = 424
+	JSK_TRACK_NEXT   = 425
+	JSK_CHANNEL_UP   = 427
+	JSK_CHANNEL_DOWN = 428
+	JSK_INFO         = 457
+	JSK_GUIDE        = 458
+	JSK_SUBTITLE     = 460
+	JSK_BACK         = 461
+
+	// VK_PAUSE shares its code with the pause/break key
+	JSK_PAUSE = JSK_PAUSEBREAK
+)
+
+// jskNames maps the names accepted in mapping files to javascript key codes, see Load().
+var jskNames = map[string]int{
+	"BACKSPACE":        JSK_BACKSPACE,
+	"TAB":              JSK_TAB,
+	"ENTER":            JSK_ENTER,
+	"SHIFT":            JSK_SHIFT,
+	"CTRL":             JSK_CTRL,
+	"ALT":              JSK_ALT,
+	"PAUSEBREAK":       JSK_PAUSEBREAK,
+	"CAPSLOCK":         JSK_CAPSLOCK,
+	"ESCAPE":           JSK_ESCAPE,
+	"SPACEBAR":         JSK_SPACEBAR,
+	"PAGEUP":           JSK_PAGEUP,
+	"PAGEDOWN":         JSK_PAGEDOWN,
+	"END":              JSK_END,
+	"HOME":             JSK_HOME,
+	"LEFTARROW":        JSK_LEFTARROW,
+	"UPARROW":          JSK_UPARROW,
+	"RIGHTARROW":       JSK_RIGHTARROW,
+	"DOWNARROW":        JSK_DOWNARROW,
+	"INSERT":           JSK_INSERT,
+	"DELETE":           JSK_DELETE,
+	"LEFTWKEY":         JSK_LEFTWKEY,
+	"RIGHTWKEY":        JSK_RIGHTWKEY,
+	"SELECTKEY":        JSK_SELECTKEY,
+	"MULTIPLY":         JSK_MULTIPLY,
+	"ADD":              JSK_ADD,
+	"SUBTRACT":         JSK_SUBTRACT,
+	"DECIMALPOINT":     JSK_DECIMALPOINT,
+	"DIVIDE":           JSK_DIVIDE,
+	"NUMLOCK":          JSK_NUMLOCK,
+	"SCROLLLOCK":       JSK_SCROLLLOCK,
+	"SEMICOLON":        JSK_SEMICOLON,
+	"EQUALSIGN":        JSK_EQUALSIGN,
+	"COMMA":            JSK_COMMA,
+	"DASH":             JSK_DASH,
+	"PERIOD":           JSK_PERIOD,
+	"SLASH":            JSK_SLASH,
+	"GRAVEACCENT":      JSK_GRAVEACCENT,
+	"OPENBRACKET":      JSK_OPENBRACKET,
+	"BACKSLASH":        JSK_BACKSLASH,
+	"CLOSEBRACKET":     JSK_CLOSEBRACKET,
+	"SINGLEQUOTE":      JSK_SINGLEQUOTE,
+	"VOLUME_MUTE":      JSK_VOLUME_MUTE,
+	"VOLUME_DOWN":      JSK_VOLUME_DOWN,
+	"VOLUME_UP":        JSK_VOLUME_UP,
+	"MEDIA_NEXT_TRACK": JSK_MEDIA_NEXT_TRACK,
+	"MEDIA_PREV_TRACK": JSK_MEDIA_PREV_TRACK,
+	"MEDIA_STOP":       JSK_MEDIA_STOP,
+	"MEDIA_PLAY_PAUSE": JSK_MEDIA_PLAY_PAUSE,
+	"PLAY_PAUSE":       JSK_PLAY_PAUSE,
+	"RED":              JSK_RED,
+	"GREEN":            JSK_GREEN,
+	"YELLOW":           JSK_YELLOW,
+	"BLUE":             JSK_BLUE,
+	"REWIND":           JSK_REWIND,
+	"STOP":             JSK_STOP,
+	"PLAY":             JSK_PLAY,
+	"PAUSE":            JSK_PAUSE,
+	"RECORD":           JSK_RECORD,
+	"FAST_FWD":         JSK_FAST_FWD,
+	"TRACK_PREV":       JSK_TRACK_PREV,
+	"TRACK_NEXT":       JSK_TRACK_NEXT,
+	"CHANNEL_UP":       JSK_CHANNEL_UP,
+	"CHANNEL_DOWN":     JSK_CHANNEL_DOWN,
+	"INFO":             JSK_INFO,
+	"GUIDE":            JSK_GUIDE,
+	"SUBTITLE":         JSK_SUBTITLE,
+	"BACK":             JSK_BACK,
+}
+
+// modNames maps the names accepted in mapping files to modifiers, see Load().
+var modNames = map[string]int{
+	"CAPSLOCK": MOD_CAPSLOCK,
+	"SHIFT":    MOD_SHIFT,
+	"CTRL":     MOD_CTRL,
+	"ALT":      MOD_ALT,
+	"COMMAND":  MOD_COMMAND,
+	"NUMLOCK":  MOD_NUMLOCK,
+	"KEYPAD":   MOD_KEYPAD,
+	"LEFT":     MOD_LEFT,
+	"RIGHT":    MOD_RIGHT,
+}
+
+func init() {
+	// Letters, digits, numpad digits and function keys follow a regular pattern
+	for i := 0; i < 26; i++ {
+		jskNames[string(rune('A'+i))] = JSK_a + i
+	}
+	for i := 0; i < 10; i++ {
+		jskNames[string(rune('0'+i))] = JSK_0 + i
+		jskNames["NUMPAD_"+string(rune('0'+i))] = JSK_NUMPAD_0 + i
+	}
+	for i := 0; i < 12; i++ {
+		jskNames["F"+strconv.Itoa(i+1)] = JSK_F1 + i
+	}
+}
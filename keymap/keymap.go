@@ -0,0 +1,343 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package keymap maps native key codes of input devices to the javascript key codes and modifiers
+// expected by the AppFlinger server.
+//
+// It includes built-in mapping tables for Linux evdev key codes, USB HID usages, HDMI-CEC user control codes
+// and LIRC key names (see the Evdev, HID, CEC and LIRC variables), as well as a loader of custom tables (see Load()).
+// A Translator uses a table in order to turn key presses and releases into input events which
+// can be passed to appflinger.SessionSendInputEvent(), while keeping track of the modifier state.
+package keymap
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/tversity/appflinger-go"
+)
+
+// Key is the result of mapping a native key code.
+type Key struct {
+	Code int // One of JSK_*
+	Mod  int // Modifiers which are always sent with this key (e.g. MOD_KEYPAD for numpad keys), see MOD_*
+}
+
+// Table maps the native key codes of a given kind of input device to javascript key codes.
+// Native keys are identified either by a number (e.g. an evdev key code) or by a name (e.g. a LIRC key name).
+type Table struct {
+	Name  string
+	codes map[int]Key
+	names map[string]Key
+}
+
+// NewTable returns an empty table.
+func NewTable(name string) *Table {
+	return &Table{
+		Name:  name,
+		codes: make(map[int]Key),
+		names: make(map[string]Key),
+	}
+}
+
+// Set maps the given native key code.
+func (table *Table) Set(nativeCode int, key Key) {
+	table.codes[nativeCode] = key
+}
+
+// SetName maps the given native key name.
+func (table *Table) SetName(nativeName string, key Key) {
+	table.names[nativeName] = key
+}
+
+// Lookup returns the mapping of the given native key code.
+func (table *Table) Lookup(nativeCode int) (key Key, ok bool) {
+	key, ok = table.codes[nativeCode]
+	return
+}
+
+// LookupName returns the mapping of the given native key name.
+func (table *Table) LookupName(nativeName string) (key Key, ok bool) {
+	key, ok = table.names[nativeName]
+	return
+}
+
+// Merge copies all the mappings of other into table, overriding existing mappings of the same native keys.
+func (table *Table) Merge(other *Table) {
+	for code, key := range other.codes {
+		table.codes[code] = key
+	}
+	for name, key := range other.names {
+		table.names[name] = key
+	}
+}
+
+// parseJSKey parses a javascript key code given as a name with or without the JSK_ prefix or as a number. Names are
+// looked up first, hence the digits "0" to "9" are the digit keys JSK_0 to JSK_9 rather than numeric codes.
+func parseJSKey(str string) (int, error) {
+	if code, ok := jskNames[strings.ToUpper(strings.TrimPrefix(str, "JSK_"))]; ok {
+		return code, nil
+	}
+	if code, err := strconv.ParseInt(str, 0, 0); err == nil {
+		return int(code), nil
+	}
+	return 0, fmt.Errorf("Unknown key: %s", str)
+}
+
+// parseMod parses a modifier given as a number or as a name with or without the MOD_ prefix.
+func parseMod(str string) (int, error) {
+	if mod, err := strconv.ParseInt(str, 0, 0); err == nil {
+		return int(mod), nil
+	}
+	if mod, ok := modNames[strings.ToUpper(strings.TrimPrefix(str, "MOD_"))]; ok {
+		return mod, nil
+	}
+	return 0, fmt.Errorf("Unknown modifier: %s", str)
+}
+
+// Load reads a mapping table from a text file. Each line has the following format:
+//
+//	<native key> <javascript key> [<modifier> ...]
+//
+// The native key is either a number (decimal or 0x prefixed hex) or a name. The javascript key is either a
+// number or one of the JSK_* names (the prefix is optional, e.g. "ENTER" or "JSK_ENTER"), a single digit being
+// the digit key (e.g. "5" is JSK_5). The modifiers are optional and are either numbers or MOD_* names.
+// Empty lines and lines starting with # are ignored.
+func Load(name string, reader io.Reader) (table *Table, err error) {
+	table = NewTable(name)
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("Invalid mapping at line %d: %s", lineNum, line)
+		}
+
+		var key Key
+		key.Code, err = parseJSKey(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid mapping at line %d: %v", lineNum, err)
+		}
+		for _, field := range fields[2:] {
+			var mod int
+			mod, err = parseMod(field)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid mapping at line %d: %v", lineNum, err)
+			}
+			key.Mod |= mod
+		}
+
+		if nativeCode, e := strconv.ParseInt(fields[0], 0, 0); e == nil {
+			table.Set(int(nativeCode), key)
+		} else {
+			table.SetName(fields[0], key)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read mapping table %s: %v", name, err)
+	}
+	return
+}
+
+// LoadFile reads a mapping table from the given file, see Load() for the file format.
+func LoadFile(path string) (table *Table, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	return Load(path, file)
+}
+
+// Translator turns native key presses and releases into input events, keeping track of the modifier state.
+// It is not safe for concurrent use.
+type Translator struct {
+	table *Table
+	mod   int
+}
+
+// NewTranslator returns a translator which uses the given table.
+func NewTranslator(table *Table) *Translator {
+	return &Translator{table: table}
+}
+
+// Mod returns the current state of the modifiers, see MOD_*.
+func (t *Translator) Mod() int {
+	return t.mod
+}
+
+// Reset clears the modifier state, e.g. when the input device is reopened.
+func (t *Translator) Reset() {
+	t.mod = MOD_NONE
+}
+
+// modifierOf returns the modifier bit that is held while the given key is pressed.
+func modifierOf(code int) int {
+	switch code {
+	case JSK_SHIFT:
+		return MOD_SHIFT
+	case JSK_CTRL:
+		return MOD_CTRL
+	case JSK_ALT:
+		return MOD_ALT
+	case JSK_LEFTWKEY, JSK_RIGHTWKEY:
+		return MOD_COMMAND
+	}
+	return MOD_NONE
+}
+
+// update updates the modifier state and returns the event for the given key.
+func (t *Translator) update(key Key, eventType string) *appflinger.InputEvent {
+	pressed := eventType != appflinger.INPUT_EVENT_KEYUP
+	if mod := modifierOf(key.Code); mod != MOD_NONE {
+		if eventType == appflinger.INPUT_EVENT_KEYDOWN {
+			t.mod |= mod
+		} else if eventType == appflinger.INPUT_EVENT_KEYUP {
+			t.mod &^= mod
+		}
+	} else if pressed && key.Code == JSK_CAPSLOCK {
+		t.mod ^= MOD_CAPSLOCK
+	} else if pressed && key.Code == JSK_NUMLOCK {
+		t.mod ^= MOD_NUMLOCK
+	}
+
+	ev := &appflinger.InputEvent{
+		Type: eventType,
+		Code: key.Code,
+		Mod:  t.mod | key.Mod,
+	}
+	if pressed {
+		ev.Char = charOf(key.Code, ev.Mod)
+	}
+	return ev
+}
+
+// Translate returns the keydown (pressed is true) or keyup event of the given native key code.
+// It returns nil if the key is not mapped.
+func (t *Translator) Translate(nativeCode int, pressed bool) *appflinger.InputEvent {
+	key, ok := t.table.Lookup(nativeCode)
+	if !ok {
+		return nil
+	}
+	return t.update(key, keyEventType(pressed))
+}
+
+// TranslateName returns the keydown (pressed is true) or keyup event of the given native key name.
+// It returns nil if the key is not mapped.
+func (t *Translator) TranslateName(nativeName string, pressed bool) *appflinger.InputEvent {
+	key, ok := t.table.LookupName(nativeName)
+	if !ok {
+		return nil
+	}
+	return t.update(key, keyEventType(pressed))
+}
+
+// TranslatePress returns a key event (keydown immediately followed by keyup) of the given native key code.
+// This is meant for devices which do not report key releases, such as HDMI-CEC and most IR remotes.
+// It returns nil if the key is not mapped.
+func (t *Translator) TranslatePress(nativeCode int) *appflinger.InputEvent {
+	key, ok := t.table.Lookup(nativeCode)
+	if !ok {
+		return nil
+	}
+	return t.update(key, appflinger.INPUT_EVENT_KEY)
+}
+
+// TranslatePressName is the same as TranslatePress() for devices which identify keys by name (e.g. LIRC).
+func (t *Translator) TranslatePressName(nativeName string) *appflinger.InputEvent {
+	key, ok := t.table.LookupName(nativeName)
+	if !ok {
+		return nil
+	}
+	return t.update(key, appflinger.INPUT_EVENT_KEY)
+}
+
+// Send translates the given native key code and injects it into the session. Unmapped keys are ignored.
+func (t *Translator) Send(ctx *appflinger.SessionContext, nativeCode int, pressed bool) (err error) {
+	ev := t.Translate(nativeCode, pressed)
+	if ev == nil {
+		return nil
+	}
+	return appflinger.SessionSendInputEvent(ctx, ev)
+}
+
+func keyEventType(pressed bool) string {
+	if pressed {
+		return appflinger.INPUT_EVENT_KEYDOWN
+	}
+	return appflinger.INPUT_EVENT_KEYUP
+}
+
+// The characters produced by the punctuation keys of a US keyboard, without and with shift
+var punctuationChars = map[int][2]rune{
+	JSK_SPACEBAR:     {' ', ' '},
+	JSK_SEMICOLON:    {';', ':'},
+	JSK_EQUALSIGN:    {'=', '+'},
+	JSK_COMMA:        {',', '<'},
+	JSK_DASH:         {'-', '_'},
+	JSK_PERIOD:       {'.', '>'},
+	JSK_SLASH:        {'/', '?'},
+	JSK_GRAVEACCENT:  {'`', '~'},
+	JSK_OPENBRACKET:  {'[', '{'},
+	JSK_BACKSLASH:    {'\\', '|'},
+	JSK_CLOSEBRACKET: {']', '}'},
+	JSK_SINGLEQUOTE:  {'\'', '"'},
+	JSK_MULTIPLY:     {'*', '*'},
+	JSK_ADD:          {'+', '+'},
+	JSK_SUBTRACT:     {'-', '-'},
+	JSK_DIVIDE:       {'/', '/'},
+}
+
+// The characters produced by the digit keys of a US keyboard with shift
+var shiftedDigits = []rune(")!@#$%^&*(")
+
+// charOf returns the character produced by the given key with the given modifiers, zero if none.
+// It assumes a US keyboard layout.
+func charOf(code int, mod int) rune {
+	if mod&(MOD_CTRL|MOD_ALT|MOD_COMMAND) != 0 {
+		return 0
+	}
+	shift := mod&MOD_SHIFT != 0
+	switch {
+	case code >= JSK_a && code <= JSK_z:
+		if shift != (mod&MOD_CAPSLOCK != 0) {
+			return rune('A' + code - JSK_a)
+		}
+		return rune('a' + code - JSK_a)
+	case code >= JSK_0 && code <= JSK_9:
+		if shift {
+			return shiftedDigits[code-JSK_0]
+		}
+		return rune('0' + code - JSK_0)
+	case code >= JSK_NUMPAD_0 && code <= JSK_NUMPAD_9:
+		if mod&MOD_NUMLOCK == 0 {
+			return 0
+		}
+		return rune('0' + code - JSK_NUMPAD_0)
+	case code == JSK_DECIMALPOINT:
+		if mod&MOD_NUMLOCK == 0 {
+			return 0
+		}
+		return '.'
+	}
+	if chars, ok := punctuationChars[code]; ok {
+		if shift {
+			return chars[1]
+		}
+		return chars[0]
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package keymap
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tversity/appflinger-go"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		native interface{} // int for a code, string for a name
+		key    Key
+	}{
+		{"decimal code and name", "28 ENTER", 28, Key{JSK_ENTER, MOD_NONE}},
+		{"hex code and prefixed name", "0x160 JSK_ENTER", 0x160, Key{JSK_ENTER, MOD_NONE}},
+		{"lowercase name", "1 enter", 1, Key{JSK_ENTER, MOD_NONE}},
+		{"digit name", "6 5", 6, Key{JSK_5, MOD_NONE}},
+		{"digit zero name", "11 0", 11, Key{JSK_0, MOD_NONE}},
+		{"numeric key code", "7 53", 7, Key{JSK_5, MOD_NONE}},
+		{"hex key code", "8 0x0d", 8, Key{JSK_ENTER, MOD_NONE}},
+		{"letter name", "30 A", 30, Key{JSK_a, MOD_NONE}},
+		{"native name", "KEY_OK ENTER", "KEY_OK", Key{JSK_ENTER, MOD_NONE}},
+		{"modifier names", "79 NUMPAD_1 KEYPAD MOD_SHIFT", 79, Key{JSK_NUMPAD_1, MOD_KEYPAD | MOD_SHIFT}},
+		{"numeric modifier", "79 NUMPAD_1 0x200", 79, Key{JSK_NUMPAD_1, MOD_KEYPAD}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table, err := Load("test", strings.NewReader("# comment\n\n"+test.line+"\n"))
+			if err != nil {
+				t.Fatalf("Load() failed: %v", err)
+			}
+			var key Key
+			var ok bool
+			if code, isCode := test.native.(int); isCode {
+				key, ok = table.Lookup(code)
+			} else {
+				key, ok = table.LookupName(test.native.(string))
+			}
+			if !ok || key != test.key {
+				t.Errorf("got %v (found %v), want %v", key, ok, test.key)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"missing javascript key", "28\n"},
+		{"unknown key name", "28 NOSUCHKEY\n"},
+		{"unknown modifier", "28 ENTER NOSUCHMOD\n"},
+		{"error after valid lines", "28 ENTER\n29 CTRL\nbad\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Load("test", strings.NewReader(test.data)); err == nil {
+				t.Error("Load() succeeded")
+			}
+		})
+	}
+}
+
+func TestTranslator(t *testing.T) {
+	const (
+		keyA         = 30
+		keyLeftShift = 42
+		keyLeftCtrl  = 29
+		keyCapsLock  = 58
+		keyNumLock   = 69
+		keyKP1       = 79
+		key5         = 6
+		unmapped     = 0xfff
+	)
+	type step struct {
+		code    int
+		pressed bool
+		want    *appflinger.InputEvent // Nil for an unmapped key
+	}
+	down, up := appflinger.INPUT_EVENT_KEYDOWN, appflinger.INPUT_EVENT_KEYUP
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"plain letter", []step{
+			{keyA, true, &appflinger.InputEvent{Type: down, Code: JSK_a, Char: 'a'}},
+			{keyA, false, &appflinger.InputEvent{Type: up, Code: JSK_a}},
+		}},
+		{"shifted letter and digit", []step{
+			{keyLeftShift, true, &appflinger.InputEvent{Type: down, Code: JSK_SHIFT, Mod: MOD_SHIFT | MOD_LEFT}},
+			{keyA, true, &appflinger.InputEvent{Type: down, Code: JSK_a, Char: 'A', Mod: MOD_SHIFT}},
+			{key5, true, &appflinger.InputEvent{Type: down, Code: JSK_5, Char: '%', Mod: MOD_SHIFT}},
+			{keyLeftShift, false, &appflinger.InputEvent{Type: up, Code: JSK_SHIFT, Mod: MOD_LEFT}},
+			{keyA, true, &appflinger.InputEvent{Type: down, Code: JSK_a, Char: 'a'}},
+		}},
+		{"control produces no character", []step{
+			{keyLeftCtrl, true, &appflinger.InputEvent{Type: down, Code: JSK_CTRL, Mod: MOD_CTRL | MOD_LEFT}},
+			{keyA, true, &appflinger.InputEvent{Type: down, Code: JSK_a, Mod: MOD_CTRL}},
+		}},
+		{"caps lock toggles on press", []step{
+			{keyCapsLock, true, &appflinger.InputEvent{Type: down, Code: JSK_CAPSLOCK, Mod: MOD_CAPSLOCK}},
+			{keyCapsLock, false, &appflinger.InputEvent{Type: up, Code: JSK_CAPSLOCK, Mod: MOD_CAPSLOCK}},
+			{keyA, true, &appflinger.InputEvent{Type: down, Code: JSK_a, Char: 'A', Mod: MOD_CAPSLOCK}},
+			{keyCapsLock, true, &appflinger.InputEvent{Type: down, Code: JSK_CAPSLOCK}},
+		}},
+		{"keypad digit needs num lock", []step{
+			{keyKP1, true, &appflinger.InputEvent{Type: down, Code: JSK_NUMPAD_1, Mod: MOD_KEYPAD}},
+			{keyNumLock, true, &appflinger.InputEvent{Type: down, Code: JSK_NUMLOCK, Mod: MOD_NUMLOCK}},
+			{keyKP1, true, &appflinger.InputEvent{Type: down, Code: JSK_NUMPAD_1, Char: '1', Mod: MOD_NUMLOCK | MOD_KEYPAD}},
+		}},
+		{"unmapped key", []step{
+			{unmapped, true, nil},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			translator := NewTranslator(Evdev)
+			for i, step := range test.steps {
+				got := translator.Translate(step.code, step.pressed)
+				if (got == nil) != (step.want == nil) || (got != nil && !reflect.DeepEqual(got, step.want)) {
+					t.Fatalf("step %d: got %+v, want %+v", i, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTranslatorPressAndReset(t *testing.T) {
+	translator := NewTranslator(LIRC)
+	ev := translator.TranslatePressName("KEY_OK")
+	if ev == nil || ev.Type != appflinger.INPUT_EVENT_KEY || ev.Code != JSK_ENTER {
+		t.Fatalf("TranslatePressName(KEY_OK) = %+v", ev)
+	}
+	if ev := translator.TranslatePressName("KEY_NOSUCHKEY"); ev != nil {
+		t.Errorf("TranslatePressName() of an unmapped key = %+v", ev)
+	}
+
+	translator = NewTranslator(Evdev)
+	translator.Translate(42, true)
+	if translator.Mod() != MOD_SHIFT {
+		t.Fatalf("Mod() = %#x after shift", translator.Mod())
+	}
+	translator.Reset()
+	if translator.Mod() != MOD_NONE {
+		t.Errorf("Mod() = %#x after Reset()", translator.Mod())
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package keymap
+
+// Built-in mapping tables
+var (
+	// Evdev maps Linux input key codes (KEY_* in linux/input-event-codes.h), as reported by /dev/input/event* devices.
+	Evdev = NewTable("evdev")
+
+	// HID maps USB HID usages, given as HIDUsage(page, id), of the keyboard page (0x07) and the consumer page (0x0C).
+	HID = NewTable("hid")
+
+	// CEC maps HDMI-CEC user control codes, as received in <User Control Pressed> messages.
+	CEC = NewTable("cec")
+
+	// LIRC maps LIRC key names, which follow the Linux input key names (e.g. KEY_OK).
+	LIRC = NewTable("lirc")
+)
+
+// Evdev key codes along with their names
+type evdevKey struct {
+	name string
+	code int
+	key  Key
+}
+
+var evdevKeys = []evdevKey{
+	{"KEY_ESC", 1, Key{JSK_ESCAPE, MOD_NONE}},
+	{"KEY_1", 2, Key{JSK_1, MOD_NONE}},
+	{"KEY_2", 3, Key{JSK_2, MOD_NONE}},
+	{"KEY_3", 4, Key{JSK_3, MOD_NONE}},
+	{"KEY_4", 5, Key{JSK_4, MOD_NONE}},
+	{"KEY_5", 6, Key{JSK_5, MOD_NONE}},
+	{"KEY_6", 7, Key{JSK_6, MOD_NONE}},
+	{"KEY_7", 8, Key{JSK_7, MOD_NONE}},
+	{"KEY_8", 9, Key{JSK_8, MOD_NONE}},
+	{"KEY_9", 10, Key{JSK_9, MOD_NONE}},
+	{"KEY_0", 11, Key{JSK_0, MOD_NONE}},
+	{"KEY_MINUS", 12, Key{JSK_DASH, MOD_NONE}},
+	{"KEY_EQUAL", 13, Key{JSK_EQUALSIGN, MOD_NONE}},
+	{"KEY_BACKSPACE", 14, Key{JSK_BACKSPACE, MOD_NONE}},
+	{"KEY_TAB", 15, Key{JSK_TAB, MOD_NONE}},
+	{"KEY_Q", 16, Key{JSK_q, MOD_NONE}},
+	{"KEY_W", 17, Key{JSK_w, MOD_NONE}},
+	{"KEY_E", 18, Key{JSK_e, MOD_NONE}},
+	{"KEY_R", 19, Key{JSK_r, MOD_NONE}},
+	{"KEY_T", 20, Key{JSK_t, MOD_NONE}},
+	{"KEY_Y", 21, Key{JSK_y, MOD_NONE}},
+	{"KEY_U", 22, Key{JSK_u, MOD_NONE}},
+	{"KEY_I", 23, Key{JSK_i, MOD_NONE}},
+	{"KEY_O", 24, Key{JSK_o, MOD_NONE}},
+	{"KEY_P", 25, Key{JSK_p, MOD_NONE}},
+	{"KEY_LEFTBRACE", 26, Key{JSK_OPENBRACKET, MOD_NONE}},
+	{"KEY_RIGHTBRACE", 27, Key{JSK_CLOSEBRACKET, MOD_NONE}},
+	{"KEY_ENTER", 28, Key{JSK_ENTER, MOD_NONE}},
+	{"KEY_LEFTCTRL", 29, Key{JSK_CTRL, MOD_LEFT}},
+	{"KEY_A", 30, Key{JSK_a, MOD_NONE}},
+	{"KEY_S", 31, Key{JSK_s, MOD_NONE}},
+	{"KEY_D", 32, Key{JSK_d, MOD_NONE}},
+	{"KEY_F", 33, Key{JSK_f, MOD_NONE}},
+	{"KEY_G", 34, Key{JSK_g, MOD_NONE}},
+	{"KEY_H", 35, Key{JSK_h, MOD_NONE}},
+	{"KEY_J", 36, Key{JSK_j, MOD_NONE}},
+	{"KEY_K", 37, Key{JSK_k, MOD_NONE}},
+	{"KEY_L", 38, Key{JSK_l, MOD_NONE}},
+	{"KEY_SEMICOLON", 39, Key{JSK_SEMICOLON, MOD_NONE}},
+	{"KEY_APOSTROPHE", 40, Key{JSK_SINGLEQUOTE, MOD_NONE}},
+	{"KEY_GRAVE", 41, Key{JSK_GRAVEACCENT, MOD_NONE}},
+	{"KEY_LEFTSHIFT", 42, Key{JSK_SHIFT, MOD_LEFT}},
+	{"KEY_BACKSLASH", 43, Key{JSK_BACKSLASH, MOD_NONE}},
+	{"KEY_Z", 44, Key{JSK_z, MOD_NONE}},
+	{"KEY_X", 45, Key{JSK_x, MOD_NONE}},
+	{"KEY_C", 46, Key{JSK_c, MOD_NONE}},
+	{"KEY_V", 47, Key{JSK_v, MOD_NONE}},
+	{"KEY_B", 48, Key{JSK_b, MOD_NONE}},
+	{"KEY_N", 49, Key{JSK_n, MOD_NONE}},
+	{"KEY_M", 50, Key{JSK_m, MOD_NONE}},
+	{"KEY_COMMA", 51, Key{JSK_COMMA, MOD_NONE}},
+	{"KEY_DOT", 52, Key{JSK_PERIOD, MOD_NONE}},
+	{"KEY_SLASH", 53, Key{JSK_SLASH, MOD_NONE}},
+	{"KEY_RIGHTSHIFT", 54, Key{JSK_SHIFT, MOD_RIGHT}},
+	{"KEY_KPASTERISK", 55, Key{JSK_MULTIPLY, MOD_KEYPAD}},
+	{"KEY_LEFTALT", 56, Key{JSK_ALT, MOD_LEFT}},
+	{"KEY_SPACE", 57, Key{JSK_SPACEBAR, MOD_NONE}},
+	{"KEY_CAPSLOCK", 58, Key{JSK_CAPSLOCK, MOD_NONE}},
+	{"KEY_F1", 59, Key{JSK_F1, MOD_NONE}},
+	{"KEY_F2", 60, Key{JSK_F2, MOD_NONE}},
+	{"KEY_F3", 61, Key{JSK_F3, MOD_NONE}},
+	{"KEY_F4", 62, Key{JSK_F4, MOD_NONE}},
+	{"KEY_F5", 63, Key{JSK_F5, MOD_NONE}},
+	{"KEY_F6", 64, Key{JSK_F6, MOD_NONE}},
+	{"KEY_F7", 65, Key{JSK_F7, MOD_NONE}},
+	{"KEY_F8", 66, Key{JSK_F8, MOD_NONE}},
+	{"KEY_F9", 67, Key{JSK_F9, MOD_NONE}},
+	{"KEY_F10", 68, Key{JSK_F10, MOD_NONE}},
+	{"KEY_NUMLOCK", 69, Key{JSK_NUMLOCK, MOD_NONE}},
+	{"KEY_SCROLLLOCK", 70, Key{JSK_SCROLLLOCK, MOD_NONE}},
+	{"KEY_KP7", 71, Key{JSK_NUMPAD_7, MOD_KEYPAD}},
+	{"KEY_KP8", 72, Key{JSK_NUMPAD_8, MOD_KEYPAD}},
+	{"KEY_KP9", 73, Key{JSK_NUMPAD_9, MOD_KEYPAD}},
+	{"KEY_KPMINUS", 74, Key{JSK_SUBTRACT, MOD_KEYPAD}},
+	{"KEY_KP4", 75, Key{JSK_NUMPAD_4, MOD_KEYPAD}},
+	{"KEY_KP5", 76, Key{JSK_NUMPAD_5, MOD_KEYPAD}},
+	{"KEY_KP6", 77, Key{JSK_NUMPAD_6, MOD_KEYPAD}},
+	{"KEY_KPPLUS", 78, Key{JSK_ADD, MOD_KEYPAD}},
+	{"KEY_KP1", 79, Key{JSK_NUMPAD_1, MOD_KEYPAD}},
+	{"KEY_KP2", 80, Key{JSK_NUMPAD_2, MOD_KEYPAD}},
+	{"KEY_KP3", 81, Key{JSK_NUMPAD_3, MOD_KEYPAD}},
+	{"KEY_KP0", 82, Key{JSK_NUMPAD_0, MOD_KEYPAD}},
+	{"KEY_KPDOT", 83, Key{JSK_DECIMALPOINT, MOD_KEYPAD}},
+	{"KEY_F11", 87, Key{JSK_F11, MOD_NONE}},
+	{"KEY_F12", 88, Key{JSK_F12, MOD_NONE}},
+	{"KEY_KPENTER", 96, Key{JSK_ENTER, MOD_KEYPAD}},
+	{"KEY_RIGHTCTRL", 97, Key{JSK_CTRL, MOD_RIGHT}},
+	{"KEY_KPSLASH", 98, Key{JSK_DIVIDE, MOD_KEYPAD}},
+	{"KEY_RIGHTALT", 100, Key{JSK_ALT, MOD_RIGHT}},
+	{"KEY_HOME", 102, Key{JSK_HOME, MOD_NONE}},
+	{"KEY_UP", 103, Key{JSK_UPARROW, MOD_NONE}},
+	{"KEY_PAGEUP", 104, Key{JSK_PAGEUP, MOD_NONE}},
+	{"KEY_LEFT", 105, Key{JSK_LEFTARROW, MOD_NONE}},
+	{"KEY_RIGHT", 106, Key{JSK_RIGHTARROW, MOD_NONE}},
+	{"KEY_END", 107, Key{JSK_END, MOD_NONE}},
+	{"KEY_DOWN", 108, Key{JSK_DOWNARROW, MOD_NONE}},
+	{"KEY_PAGEDOWN", 109, Key{JSK_PAGEDOWN, MOD_NONE}},
+	{"KEY_INSERT", 110, Key{JSK_INSERT, MOD_NONE}},
+	{"KEY_DELETE", 111, Key{JSK_DELETE, MOD_NONE}},
+	{"KEY_MUTE", 113, Key{JSK_VOLUME_MUTE, MOD_NONE}},
+	{"KEY_VOLUMEDOWN", 114, Key{JSK_VOLUME_DOWN, MOD_NONE}},
+	{"KEY_VOLUMEUP", 115, Key{JSK_VOLUME_UP, MOD_NONE}},
+	{"KEY_PAUSE", 119, Key{JSK_PAUSE, MOD_NONE}},
+	{"KEY_LEFTMETA", 125, Key{JSK_LEFTWKEY, MOD_LEFT}},
+	{"KEY_RIGHTMETA", 126, Key{JSK_RIGHTWKEY, MOD_RIGHT}},
+	{"KEY_COMPOSE", 127, Key{JSK_SELECTKEY, MOD_NONE}},
+	{"KEY_STOP", 128, Key{JSK_STOP, MOD_NONE}},
+	{"KEY_MENU", 139, Key{JSK_SELECTKEY, MOD_NONE}},
+	{"KEY_BACK", 158, Key{JSK_BACK, MOD_NONE}},
+	{"KEY_NEXTSONG", 163, Key{JSK_MEDIA_NEXT_TRACK, MOD_NONE}},
+	{"KEY_PLAYPAUSE", 164, Key{JSK_MEDIA_PLAY_PAUSE, MOD_NONE}},
+	{"KEY_PREVIOUSSONG", 165, Key{JSK_MEDIA_PREV_TRACK, MOD_NONE}},
+	{"KEY_STOPCD", 166, Key{JSK_MEDIA_STOP, MOD_NONE}},
+	{"KEY_RECORD", 167, Key{JSK_RECORD, MOD_NONE}},
+	{"KEY_REWIND", 168, Key{JSK_REWIND, MOD_NONE}},
+	{"KEY_HOMEPAGE", 172, Key{JSK_HOME, MOD_NONE}},
+	{"KEY_EXIT", 174, Key{JSK_BACK, MOD_NONE}},
+	{"KEY_PLAYCD", 200, Key{JSK_PLAY, MOD_NONE}},
+	{"KEY_PAUSECD", 201, Key{JSK_PAUSE, MOD_NONE}},
+	{"KEY_PLAY", 207, Key{JSK_PLAY, MOD_NONE}},
+	{"KEY_FASTFORWARD", 208, Key{JSK_FAST_FWD, MOD_NONE}},
+	{"KEY_OK", 0x160, Key{JSK_ENTER, MOD_NONE}},
+	{"KEY_SELECT", 0x161, Key{JSK_ENTER, MOD_NONE}},
+	{"KEY_INFO", 0x166, Key{JSK_INFO, MOD_NONE}},
+	{"KEY_EPG", 0x16d, Key{JSK_GUIDE, MOD_NONE}},
+	{"KEY_SUBTITLE", 0x172, Key{JSK_SUBTITLE, MOD_NONE}},
+	{"KEY_RED", 0x18e, Key{JSK_RED, MOD_NONE}},
+	{"KEY_GREEN", 0x18f, Key{JSK_GREEN, MOD_NONE}},
+	{"KEY_YELLOW", 0x190, Key{JSK_YELLOW, MOD_NONE}},
+	{"KEY_BLUE", 0x191, Key{JSK_BLUE, MOD_NONE}},
+	{"KEY_CHANNELUP", 0x192, Key{JSK_CHANNEL_UP, MOD_NONE}},
+	{"KEY_CHANNELDOWN", 0x193, Key{JSK_CHANNEL_DOWN, MOD_NONE}},
+	{"KEY_NEXT", 0x197, Key{JSK_TRACK_NEXT, MOD_NONE}},
+	{"KEY_PREVIOUS", 0x19c, Key{JSK_TRACK_PREV, MOD_NONE}},
+	{"KEY_NUMERIC_0", 0x200, Key{JSK_0, MOD_NONE}},
+	{"KEY_NUMERIC_1", 0x201, Key{JSK_1, MOD_NONE}},
+	{"KEY_NUMERIC_2", 0x202, Key{JSK_2, MOD_NONE}},
+	{"KEY_NUMERIC_3", 0x203, Key{JSK_3, MOD_NONE}},
+	{"KEY_NUMERIC_4", 0x204, Key{JSK_4, MOD_NONE}},
+	{"KEY_NUMERIC_5", 0x205, Key{JSK_5, MOD_NONE}},
+	{"KEY_NUMERIC_6", 0x206, Key{JSK_6, MOD_NONE}},
+	{"KEY_NUMERIC_7", 0x207, Key{JSK_7, MOD_NONE}},
+	{"KEY_NUMERIC_8", 0x208, Key{JSK_8, MOD_NONE}},
+	{"KEY_NUMERIC_9", 0x209, Key{JSK_9, MOD_NONE}},
+}
+
+// HIDUsage combines a HID usage page and usage id into the native key code used by the HID table.
+func HIDUsage(page int, id int) int {
+	return page<<16 | id
+}
+
+const (
+	hidPageKeyboard = 0x07
+	hidPageConsumer = 0x0C
+)
+
+var hidKeyboardKeys = map[int]Key{
+	0x28: {JSK_ENTER, MOD_NONE},
+	0x29: {JSK_ESCAPE, MOD_NONE},
+	0x2A: {JSK_BACKSPACE, MOD_NONE},
+	0x2B: {JSK_TAB, MOD_NONE},
+	0x2C: {JSK_SPACEBAR, MOD_NONE},
+	0x2D: {JSK_DASH, MOD_NONE},
+	0x2E: {JSK_EQUALSIGN, MOD_NONE},
+	0x2F: {JSK_OPENBRACKET, MOD_NONE},
+	0x30: {JSK_CLOSEBRACKET, MOD_NONE},
+	0x31: {JSK_BACKSLASH, MOD_NONE},
+	0x33: {JSK_SEMICOLON, MOD_NONE},
+	0x34: {JSK_SINGLEQUOTE, MOD_NONE},
+	0x35: {JSK_GRAVEACCENT, MOD_NONE},
+	0x36: {JSK_COMMA, MOD_NONE},
+	0x37: {JSK_PERIOD, MOD_NONE},
+	0x38: {JSK_SLASH, MOD_NONE},
+	0x39: {JSK_CAPSLOCK, MOD_NONE},
+	0x47: {JSK_SCROLLLOCK, MOD_NONE},
+	0x48: {JSK_PAUSEBREAK, MOD_NONE},
+	0x49: {JSK_INSERT, MOD_NONE},
+	0x4A: {JSK_HOME, MOD_NONE},
+	0x4B: {JSK_PAGEUP, MOD_NONE},
+	0x4C: {JSK_DELETE, MOD_NONE},
+	0x4D: {JSK_END, MOD_NONE},
+	0x4E: {JSK_PAGEDOWN, MOD_NONE},
+	0x4F: {JSK_RIGHTARROW, MOD_NONE},
+	0x50: {JSK_LEFTARROW, MOD_NONE},
+	0x51: {JSK_DOWNARROW, MOD_NONE},
+	0x52: {JSK_UPARROW, MOD_NONE},
+	0x53: {JSK_NUMLOCK, MOD_NONE},
+	0x54: {JSK_DIVIDE, MOD_KEYPAD},
+	0x55: {JSK_MULTIPLY, MOD_KEYPAD},
+	0x56: {JSK_SUBTRACT, MOD_KEYPAD},
+	0x57: {JSK_ADD, MOD_KEYPAD},
+	0x58: {JSK_ENTER, MOD_KEYPAD},
+	0x62: {JSK_NUMPAD_0, MOD_KEYPAD},
+	0x63: {JSK_DECIMALPOINT, MOD_KEYPAD},
+	0x65: {JSK_SELECTKEY, MOD_NONE},
+	0x7F: {JSK_VOLUME_MUTE, MOD_NONE},
+	0x80: {JSK_VOLUME_UP, MOD_NONE},
+	0x81: {JSK_VOLUME_DOWN, MOD_NONE},
+	0xE0: {JSK_CTRL, MOD_LEFT},
+	0xE1: {JSK_SHIFT, MOD_LEFT},
+	0xE2: {JSK_ALT, MOD_LEFT},
+	0xE3: {JSK_LEFTWKEY, MOD_LEFT},
+	0xE4: {JSK_CTRL, MOD_RIGHT},
+	0xE5: {JSK_SHIFT, MOD_RIGHT},
+	0xE6: {JSK_ALT, MOD_RIGHT},
+	0xE7: {JSK_RIGHTWKEY, MOD_RIGHT},
+}
+
+var hidConsumerKeys = map[int]Key{
+	0x040: {JSK_SELECTKEY, MOD_NONE}, // Menu
+	0x09C: {JSK_CHANNEL_UP, MOD_NONE},
+	0x09D: {JSK_CHANNEL_DOWN, MOD_NONE},
+	0x0B0: {JSK_PLAY, MOD_NONE},
+	0x0B1: {JSK_PAUSE, MOD_NONE},
+	0x0B2: {JSK_RECORD, MOD_NONE},
+	0x0B3: {JSK_FAST_FWD, MOD_NONE},
+	0x0B4: {JSK_REWIND, MOD_NONE},
+	0x0B5: {JSK_MEDIA_NEXT_TRACK, MOD_NONE},
+	0x0B6: {JSK_MEDIA_PREV_TRACK, MOD_NONE},
+	0x0B7: {JSK_MEDIA_STOP, MOD_NONE},
+	0x0CD: {JSK_MEDIA_PLAY_PAUSE, MOD_NONE},
+	0x0E2: {JSK_VOLUME_MUTE, MOD_NONE},
+	0x0E9: {JSK_VOLUME_UP, MOD_NONE},
+	0x0EA: {JSK_VOLUME_DOWN, MOD_NONE},
+	0x1BD: {JSK_INFO, MOD_NONE},
+	0x223: {JSK_HOME, MOD_NONE}, // AC Home
+	0x224: {JSK_BACK, MOD_NONE}, // AC Back
+}
+
+var cecKeys = map[int]Key{
+	0x00: {JSK_ENTER, MOD_NONE}, // Select
+	0x01: {JSK_UPARROW, MOD_NONE},
+	0x02: {JSK_DOWNARROW, MOD_NONE},
+	0x03: {JSK_LEFTARROW, MOD_NONE},
+	0x04: {JSK_RIGHTARROW, MOD_NONE},
+	0x09: {JSK_HOME, MOD_NONE},      // Root Menu
+	0x0A: {JSK_SELECTKEY, MOD_NONE}, // Setup Menu
+	0x0B: {JSK_SELECTKEY, MOD_NONE}, // Contents Menu
+	0x0D: {JSK_BACK, MOD_NONE},      // Exit
+	0x2A: {JSK_PERIOD, MOD_NONE},    // Dot
+	0x2B: {JSK_ENTER, MOD_NONE},
+	0x30: {JSK_CHANNEL_UP, MOD_NONE},
+	0x31: {JSK_CHANNEL_DOWN, MOD_NONE},
+	0x35: {JSK_INFO, MOD_NONE}, // Display Information
+	0x37: {JSK_PAGEUP, MOD_NONE},
+	0x38: {JSK_PAGEDOWN, MOD_NONE},
+	0x41: {JSK_VOLUME_UP, MOD_NONE},
+	0x42: {JSK_VOLUME_DOWN, MOD_NONE},
+	0x43: {JSK_VOLUME_MUTE, MOD_NONE},
+	0x44: {JSK_PLAY, MOD_NONE},
+	0x45: {JSK_STOP, MOD_NONE},
+	0x46: {JSK_PAUSE, MOD_NONE},
+	0x47: {JSK_RECORD, MOD_NONE},
+	0x48: {JSK_REWIND, MOD_NONE},
+	0x49: {JSK_FAST_FWD, MOD_NONE},
+	0x4B: {JSK_TRACK_NEXT, MOD_NONE}, // Forward
+	0x4C: {JSK_TRACK_PREV, MOD_NONE}, // Backward
+	0x53: {JSK_GUIDE, MOD_NONE},      // Electronic Program Guide
+	0x60: {JSK_PLAY, MOD_NONE},       // Play Function
+	0x61: {JSK_PLAY_PAUSE, MOD_NONE}, // Pause-Play Function
+	0x71: {JSK_BLUE, MOD_NONE},       // F1 (Blue)
+	0x72: {JSK_RED, MOD_NONE},        // F2 (Red)
+	0x73: {JSK_GREEN, MOD_NONE},      // F3 (Green)
+	0x74: {JSK_YELLOW, MOD_NONE},     // F4 (Yellow)
+}
+
+func init() {
+	for _, k := range evdevKeys {
+		Evdev.Set(k.code, k.key)
+		LIRC.SetName(k.name, k.key)
+	}
+
+	// Letters, digits and numpad digits follow a regular pattern in the HID keyboard page
+	for i := 0; i < 26; i++ {
+		HID.Set(HIDUsage(hidPageKeyboard, 0x04+i), Key{JSK_a + i, MOD_NONE})
+	}
+	for i := 0; i < 9; i++ {
+		HID.Set(HIDUsage(hidPageKeyboard, 0x1E+i), Key{JSK_1 + i, MOD_NONE})
+		HID.Set(HIDUsage(hidPageKeyboard, 0x59+i), Key{JSK_NUMPAD_1 + i, MOD_KEYPAD})
+	}
+	HID.Set(HIDUsage(hidPageKeyboard, 0x27), Key{JSK_0, MOD_NONE})
+	for i := 0; i < 12; i++ {
+		HID.Set(HIDUsage(hidPageKeyboard, 0x3A+i), Key{JSK_F1 + i, MOD_NONE})
+	}
+	for id, key := range hidKeyboardKeys {
+		HID.Set(HIDUsage(hidPageKeyboard, id), key)
+	}
+	for id, key := range hidConsumerKeys {
+		HID.Set(HIDUsage(hidPageConsumer, id), key)
+	}
+
+	for i := 0; i < 10; i++ {
+		CEC.Set(0x20+i, Key{JSK_0 + i, MOD_NONE})
+	}
+	for code, key := range cecKeys {
+		CEC.Set(code, key)
+	}
+}
@@ -1,6 +1,6 @@
 // file appflinger.h
 
-#include "libappflinger.h"
+#include "appflinger_exports.h"
 
 // These are the constants used for modifiers when injecting input events via /osb/session/event.
 typedef enum
@@ -0,0 +1,49 @@
+// file appflinger_exports.h
+
+// The functions exported by the library. This header is maintained by hand rather than generated by cgo, since the
+// generated header only builds on the architecture it was generated on (e.g. it fails on 32 bit ARM when generated
+// on x86-64). The functions only use C types, build.sh checks that they match the generated declarations.
+
+#ifndef APPFLINGER_EXPORTS_H
+#define APPFLINGER_EXPORTS_H
+
+#include "callbacks.h"
+#include "errors.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Session lifecycle. The functions which return an int return a session handle or APPFLINGER_OK on success,
+// or an appflinger_err_t on failure.
+extern int SessionStart(char* serverProtocolHost, char* sessionId, char* browserURL, int pullMode, int isVideoPassthru, char* browserUIOutputURL, char* videoStreamURL, int width, int height, appflinger_callbacks_t* cb);
+extern int SessionStop(int ctxHandle);
+extern int SessionRelease(int ctxHandle);
+extern char* SessionGetSessionId(int ctxHandle);
+extern int SessionGetSessionContext(char* sessionId);
+
+// UI streaming
+extern int SessionUIStreamStart(int ctxHandle, char* format, int tsDiscon, int bitrate);
+extern int SessionUIStreamStop(int ctxHandle);
+extern int SessionSetFrameOptions(int ctxHandle, int flags);
+extern int SessionSetUIBitstreamFormat(int ctxHandle, int format);
+extern char* SessionGetUIURL(int ctxHandle, char* format, int tsDiscon, int bitrate);
+extern char* SessionGetURLCookies(int ctxHandle, char* uri);
+extern void appflinger_frame_release(void* data);
+
+// Input and notifications
+extern int SessionSendEvent(int ctxHandle, char* eventType, int code, int ch, int mod, int x, int y);
+extern int SessionSendNotificationVideoStateChange(int ctxHandle, char* instanceId, int readyState, int networkState, int paused, int seeking, double duration, double time, int videoWidth, int videoHeight);
+extern int SessionSendNotification(int ctxHandle, char* instanceId, void* payload, unsigned int payloadLen);
+
+// Errors of the calling thread, see errors.h. The strings returned by the library are allocated using malloc()
+// and are freed by the caller, e.g. using FreeErr().
+extern int GetErrCode(void);
+extern char* GetErr(void);
+extern void FreeErr(char* msg);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
@@ -1 +1,11 @@
-go build -buildmode c-shared -o libappflinger.so
+# Builds libappflinger.so. C clients include appflinger.h, which includes the hand-written appflinger_exports.h
+# along with callbacks.h, rather than the header generated by cgo (libappflinger.h), which is not portable.
+go build -buildmode c-shared -o libappflinger.so || exit 1
+
+# Check that the hand-written declarations match the exported functions
+grep '^extern' libappflinger.h | grep -v '_GoString' | while read -r decl; do
+    if ! grep -qxF "$decl" appflinger_exports.h; then
+        echo "Missing from appflinger_exports.h: $decl"
+        exit 1
+    fi
+done || exit 1
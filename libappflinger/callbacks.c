@@ -1,9 +1,9 @@
 #include "callbacks.h"
 
-int invoke_on_ui_frame(on_ui_frame_cb_t *cb, const char *session_id, int is_codec_config, int is_key_frame, int idx, long long pts,
-    long long dts, void *data, unsigned data_len)
+int invoke_on_ui_frame(on_ui_frame_cb_t *cb, const char *session_id, int is_codec_config, int is_key_frame, int is_discontinuity, int idx,
+    long long pts, long long dts, void *data, unsigned data_len)
 {
-    return cb(session_id, is_codec_config, is_key_frame, idx, pts, dts, data, data_len);
+    return cb(session_id, is_codec_config, is_key_frame, is_discontinuity, idx, pts, dts, data, data_len);
 }
 
 int invoke_load(load_cb_t *cb, const char *session_id, const char *instance_id, const char *url)
@@ -64,4 +64,163 @@ int invoke_get_ready_state(get_ready_state_cb_t *cb, const char *session_id, con
 int invoke_set_rect(set_rect_cb_t *cb, const char *session_id, const char *instance_id, int x, int y, int width , int height)
 {
     return cb(session_id, instance_id, x, y, width, height);
-}
\ No newline at end of file
+}
+
+void *invoke_get_frame_buffer(get_frame_buffer_cb_t *cb, const char *session_id, unsigned size)
+{
+    return cb(session_id, size);
+}
+
+int invoke_get_seekable(get_seekable_cb_t *cb, const char *session_id, const char *instance_id, appflinger_time_ranges_t *result)
+{
+    return cb(session_id, instance_id, result);
+}
+
+int invoke_get_buffered(get_buffered_cb_t *cb, const char *session_id, const char *instance_id, appflinger_time_ranges_t *result)
+{
+    return cb(session_id, instance_id, result);
+}
+
+int invoke_set_visible(set_visible_cb_t *cb, const char *session_id, const char *instance_id, int visible)
+{
+    return cb(session_id, instance_id, visible);
+}
+
+int invoke_set_rate(set_rate_cb_t *cb, const char *session_id, const char *instance_id, double rate)
+{
+    return cb(session_id, instance_id, rate);
+}
+
+int invoke_set_volume(set_volume_cb_t *cb, const char *session_id, const char *instance_id, double volume)
+{
+    return cb(session_id, instance_id, volume);
+}
+
+int invoke_add_source_buffer(add_source_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, const char *mime_type)
+{
+    return cb(session_id, instance_id, source_id, mime_type);
+}
+
+int invoke_remove_source_buffer(remove_source_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id)
+{
+    return cb(session_id, instance_id, source_id);
+}
+
+int invoke_abort_source_buffer(abort_source_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id)
+{
+    return cb(session_id, instance_id, source_id);
+}
+
+int invoke_append_buffer(append_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, double append_window_start,
+    double append_window_end, const char *buffer_id, int buffer_offset, int buffer_length, const void *payload, unsigned payload_len,
+    appflinger_time_ranges_t *result)
+{
+    return cb(session_id, instance_id, source_id, append_window_start, append_window_end, buffer_id, buffer_offset, buffer_length, payload, payload_len, result);
+}
+
+int invoke_set_append_mode(set_append_mode_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, int mode)
+{
+    return cb(session_id, instance_id, source_id, mode);
+}
+
+int invoke_set_append_timestamp_offset(set_append_timestamp_offset_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, double timestamp_offset)
+{
+    return cb(session_id, instance_id, source_id, timestamp_offset);
+}
+
+int invoke_remove_buffer_range(remove_buffer_range_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, double start, double end)
+{
+    return cb(session_id, instance_id, source_id, start, end);
+}
+
+int invoke_change_source_buffer_type(change_source_buffer_type_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, const char *mime_type)
+{
+    return cb(session_id, instance_id, source_id, mime_type);
+}
+
+int invoke_load_resource(load_resource_cb_t *cb, const char *session_id, const char *url, const char *method, const char *headers, const char *resource_id,
+    int byte_range_start, int byte_range_end, int sequence_number, const void *payload, unsigned payload_len,
+    appflinger_load_resource_result_t *result)
+{
+    return cb(session_id, url, method, headers, resource_id, byte_range_start, byte_range_end, sequence_number, payload, payload_len, result);
+}
+
+int invoke_delete_resource(delete_resource_cb_t *cb, const char *session_id, const char *buffer_id)
+{
+    return cb(session_id, buffer_id);
+}
+
+int invoke_request_key_system(request_key_system_cb_t *cb, const char *session_id, const char *key_system, const char *supported_configurations,
+    char **result)
+{
+    return cb(session_id, key_system, supported_configurations, result);
+}
+
+int invoke_cdm_create(cdm_create_cb_t *cb, const char *session_id, const char *key_system, const char *security_origin, int allow_distinctive_identifier,
+    int allow_persistent_state, char **cdm_id)
+{
+    return cb(session_id, key_system, security_origin, allow_distinctive_identifier, allow_persistent_state, cdm_id);
+}
+
+int invoke_cdm_set_server_certificate(cdm_set_server_certificate_cb_t *cb, const char *session_id, const char *cdm_id, const void *payload, unsigned payload_len)
+{
+    return cb(session_id, cdm_id, payload, payload_len);
+}
+
+int invoke_cdm_session_create(cdm_session_create_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *session_type,
+    const char *init_data_type, const void *payload, unsigned payload_len, char **cdm_session_id, double *expiration)
+{
+    return cb(session_id, event_instance_id, cdm_id, session_type, init_data_type, payload, payload_len, cdm_session_id, expiration);
+}
+
+int invoke_cdm_session_update(cdm_session_update_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id,
+    const void *payload, unsigned payload_len)
+{
+    return cb(session_id, event_instance_id, cdm_id, cdm_session_id, payload, payload_len);
+}
+
+int invoke_cdm_session_load(cdm_session_load_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id,
+    int *loaded, double *expiration)
+{
+    return cb(session_id, event_instance_id, cdm_id, cdm_session_id, loaded, expiration);
+}
+
+int invoke_cdm_session_remove(cdm_session_remove_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id)
+{
+    return cb(session_id, event_instance_id, cdm_id, cdm_session_id);
+}
+
+int invoke_cdm_session_close(cdm_session_close_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id)
+{
+    return cb(session_id, event_instance_id, cdm_id, cdm_session_id);
+}
+
+int invoke_set_cdm(set_cdm_cb_t *cb, const char *session_id, const char *instance_id, const char *cdm_id)
+{
+    return cb(session_id, instance_id, cdm_id);
+}
+
+int invoke_send_message(send_message_cb_t *cb, const char *session_id, const char *message, char **result)
+{
+    return cb(session_id, message, result);
+}
+
+int invoke_on_page_load(on_page_load_cb_t *cb, const char *session_id)
+{
+    return cb(session_id);
+}
+
+int invoke_on_address_bar_changed(on_address_bar_changed_cb_t *cb, const char *session_id, const char *url)
+{
+    return cb(session_id, url);
+}
+
+int invoke_on_title_changed(on_title_changed_cb_t *cb, const char *session_id, const char *title)
+{
+    return cb(session_id, title);
+}
+
+int invoke_on_page_close(on_page_close_cb_t *cb, const char *session_id)
+{
+    return cb(session_id);
+}
@@ -7,8 +7,34 @@ extern "C" {
 #endif
 
 
-typedef int on_ui_frame_cb_t(const char *session_id, int is_codec_config, int is_key_frame, int idx, long long pts, long long dts,
-    void *data, unsigned data_len);
+// The frame data is owned by the library and is only valid for the duration of the callback, unless the frames
+// are retained (see APPFLINGER_FRAME_RETAIN) or the buffer was provided by get_frame_buffer_cb.
+// A codec config frame (is_codec_config) holds the H.264 SPS and PPS, it is passed before the first frame, after a
+// discontinuity and whenever they change. The timestamps are in 90 kHz units, they start at zero and increase
+// monotonically across discontinuities. is_discontinuity is set on the first frame following a discontinuity (e.g. a
+// reconnection of the UI stream), which is a codec config frame, so that the decoder can be reset.
+typedef int on_ui_frame_cb_t(const char *session_id, int is_codec_config, int is_key_frame, int is_discontinuity, int idx, long long pts,
+    long long dts, void *data, unsigned data_len);
+
+// Optional, returns a buffer of at least the given size into which the next frame is written before it is passed to on_ui_frame_cb,
+// e.g. an input buffer of the decoder. The video frames are assembled directly in the buffer, without an intermediate copy.
+// The buffer is owned by the client. When it returns NULL a buffer of the library is used.
+typedef void *get_frame_buffer_cb_t(const char *session_id, unsigned size);
+
+// Flags for SessionSetFrameOptions()
+typedef enum
+{
+    APPFLINGER_FRAME_INLINE = 0x0, // Frames are delivered on the thread which receives the UI stream (the default)
+    APPFLINGER_FRAME_THREAD = 0x1, // Frames are delivered in order on a dedicated thread, so that the UI stream is read meanwhile
+    APPFLINGER_FRAME_RETAIN = 0x2, // The client keeps the frame data after on_ui_frame_cb returns and releases it using appflinger_frame_release()
+} appflinger_frame_flags_t;
+
+// Bitstream formats for SessionSetUIBitstreamFormat()
+typedef enum
+{
+    APPFLINGER_BITSTREAM_ANNEXB = 0x0, // NAL units with start codes, the parameter sets are repeated before each key frame (the default)
+    APPFLINGER_BITSTREAM_AVCC   = 0x1, // NAL units with 4 bytes length prefixes, the codec config frames hold an avcC or hvcC record
+} appflinger_bitstream_format_t;
 
 typedef int load_cb_t(const char *session_id, const char *instance_id, const char *url);
 
@@ -34,6 +60,100 @@ typedef int get_ready_state_cb_t(const char *session_id, const char *instance_id
 
 typedef int set_rect_cb_t(const char *session_id, const char *instance_id, int x, int y, int width , int height);
 
+// Time ranges filled by get_seekable_cb, get_buffered_cb and append_buffer_cb. The library provides the start and end
+// arrays with room for APPFLINGER_MAX_TIME_RANGES entries, the callback sets length to the number of entries it filled.
+#define APPFLINGER_MAX_TIME_RANGES 64
+
+typedef struct appflinger_time_ranges_struct
+{
+    double *start;
+    double *end;
+    unsigned length;
+} appflinger_time_ranges_t;
+
+// Result filled by load_resource_cb. All the pointers are either NULL or allocated with malloc() by the callback,
+// the library frees them once the result is sent to the server.
+typedef struct appflinger_load_resource_result_struct
+{
+    char *code;
+    char *headers;
+    char *buffer_id;
+    unsigned buffer_length;
+    void *payload;
+    unsigned payload_len;
+} appflinger_load_resource_result_t;
+
+// Note - payload buffers passed to the callbacks below are only valid for the duration of the callback.
+// Strings returned through char ** arguments must be allocated with malloc(), the library frees them.
+
+typedef int get_seekable_cb_t(const char *session_id, const char *instance_id, appflinger_time_ranges_t *result);
+
+typedef int get_buffered_cb_t(const char *session_id, const char *instance_id, appflinger_time_ranges_t *result);
+
+typedef int set_visible_cb_t(const char *session_id, const char *instance_id, int visible);
+
+typedef int set_rate_cb_t(const char *session_id, const char *instance_id, double rate);
+
+typedef int set_volume_cb_t(const char *session_id, const char *instance_id, double volume);
+
+typedef int add_source_buffer_cb_t(const char *session_id, const char *instance_id, const char *source_id, const char *mime_type);
+
+typedef int remove_source_buffer_cb_t(const char *session_id, const char *instance_id, const char *source_id);
+
+typedef int abort_source_buffer_cb_t(const char *session_id, const char *instance_id, const char *source_id);
+
+typedef int append_buffer_cb_t(const char *session_id, const char *instance_id, const char *source_id, double append_window_start,
+    double append_window_end, const char *buffer_id, int buffer_offset, int buffer_length, const void *payload, unsigned payload_len,
+    appflinger_time_ranges_t *result);
+
+typedef int set_append_mode_cb_t(const char *session_id, const char *instance_id, const char *source_id, int mode);
+
+typedef int set_append_timestamp_offset_cb_t(const char *session_id, const char *instance_id, const char *source_id, double timestamp_offset);
+
+typedef int remove_buffer_range_cb_t(const char *session_id, const char *instance_id, const char *source_id, double start, double end);
+
+typedef int change_source_buffer_type_cb_t(const char *session_id, const char *instance_id, const char *source_id, const char *mime_type);
+
+typedef int load_resource_cb_t(const char *session_id, const char *url, const char *method, const char *headers, const char *resource_id,
+    int byte_range_start, int byte_range_end, int sequence_number, const void *payload, unsigned payload_len,
+    appflinger_load_resource_result_t *result);
+
+typedef int delete_resource_cb_t(const char *session_id, const char *buffer_id);
+
+// The supported configurations and the result are JSON encoded arrays/objects of MediaKeySystemConfiguration as per the EME spec
+typedef int request_key_system_cb_t(const char *session_id, const char *key_system, const char *supported_configurations,
+    char **result);
+
+typedef int cdm_create_cb_t(const char *session_id, const char *key_system, const char *security_origin, int allow_distinctive_identifier,
+    int allow_persistent_state, char **cdm_id);
+
+typedef int cdm_set_server_certificate_cb_t(const char *session_id, const char *cdm_id, const void *payload, unsigned payload_len);
+
+typedef int cdm_session_create_cb_t(const char *session_id, const char *event_instance_id, const char *cdm_id, const char *session_type,
+    const char *init_data_type, const void *payload, unsigned payload_len, char **cdm_session_id, double *expiration);
+
+typedef int cdm_session_update_cb_t(const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id,
+    const void *payload, unsigned payload_len);
+
+typedef int cdm_session_load_cb_t(const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id,
+    int *loaded, double *expiration);
+
+typedef int cdm_session_remove_cb_t(const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id);
+
+typedef int cdm_session_close_cb_t(const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id);
+
+typedef int set_cdm_cb_t(const char *session_id, const char *instance_id, const char *cdm_id);
+
+typedef int send_message_cb_t(const char *session_id, const char *message, char **result);
+
+typedef int on_page_load_cb_t(const char *session_id);
+
+typedef int on_address_bar_changed_cb_t(const char *session_id, const char *url);
+
+typedef int on_title_changed_cb_t(const char *session_id, const char *title);
+
+typedef int on_page_close_cb_t(const char *session_id);
+
 typedef struct appflinger_callbacks_struct
 {
     on_ui_frame_cb_t *on_ui_frame_cb;
@@ -49,11 +169,44 @@ typedef struct appflinger_callbacks_struct
     get_current_time_cb_t *get_current_time_cb;
     get_network_state_cb_t *get_network_state_cb;
     get_ready_state_cb_t *get_ready_state_cb;
+
+    // The callbacks below are optional, when NULL the library responds with success (or with a 404 for load_resource_cb).
+    // get_seekable_cb and get_buffered_cb default to the range [0, duration].
+    get_seekable_cb_t *get_seekable_cb;
+    get_buffered_cb_t *get_buffered_cb;
+    set_visible_cb_t *set_visible_cb;
+    set_rate_cb_t *set_rate_cb;
+    set_volume_cb_t *set_volume_cb;
+    add_source_buffer_cb_t *add_source_buffer_cb;
+    remove_source_buffer_cb_t *remove_source_buffer_cb;
+    abort_source_buffer_cb_t *abort_source_buffer_cb;
+    append_buffer_cb_t *append_buffer_cb;
+    set_append_mode_cb_t *set_append_mode_cb;
+    set_append_timestamp_offset_cb_t *set_append_timestamp_offset_cb;
+    remove_buffer_range_cb_t *remove_buffer_range_cb;
+    change_source_buffer_type_cb_t *change_source_buffer_type_cb;
+    load_resource_cb_t *load_resource_cb;
+    delete_resource_cb_t *delete_resource_cb;
+    request_key_system_cb_t *request_key_system_cb;
+    cdm_create_cb_t *cdm_create_cb;
+    cdm_set_server_certificate_cb_t *cdm_set_server_certificate_cb;
+    cdm_session_create_cb_t *cdm_session_create_cb;
+    cdm_session_update_cb_t *cdm_session_update_cb;
+    cdm_session_load_cb_t *cdm_session_load_cb;
+    cdm_session_remove_cb_t *cdm_session_remove_cb;
+    cdm_session_close_cb_t *cdm_session_close_cb;
+    set_cdm_cb_t *set_cdm_cb;
+    send_message_cb_t *send_message_cb;
+    on_page_load_cb_t *on_page_load_cb;
+    on_address_bar_changed_cb_t *on_address_bar_changed_cb;
+    on_title_changed_cb_t *on_title_changed_cb;
+    on_page_close_cb_t *on_page_close_cb;
+    get_frame_buffer_cb_t *get_frame_buffer_cb;
 } appflinger_callbacks_t;
 
 // Helper functions to invoke the above CBs from Go
-int invoke_on_ui_frame(on_ui_frame_cb_t *cb, const char *session_id, int is_codec_config, int is_key_frame, int idx, long long pts,
-    long long dts, void *data, unsigned data_len);
+int invoke_on_ui_frame(on_ui_frame_cb_t *cb, const char *session_id, int is_codec_config, int is_key_frame, int is_discontinuity, int idx,
+    long long pts, long long dts, void *data, unsigned data_len);
 
 int invoke_load(load_cb_t *cb, const char *session_id, const char *instance_id, const char *url);
 
@@ -79,6 +232,75 @@ int invoke_get_ready_state(get_ready_state_cb_t *cb, const char *session_id, con
 
 int invoke_set_rect(set_rect_cb_t *cb, const char *session_id, const char *instance_id, int x, int y, int width , int height);
 
+void *invoke_get_frame_buffer(get_frame_buffer_cb_t *cb, const char *session_id, unsigned size);
+
+int invoke_get_seekable(get_seekable_cb_t *cb, const char *session_id, const char *instance_id, appflinger_time_ranges_t *result);
+
+int invoke_get_buffered(get_buffered_cb_t *cb, const char *session_id, const char *instance_id, appflinger_time_ranges_t *result);
+
+int invoke_set_visible(set_visible_cb_t *cb, const char *session_id, const char *instance_id, int visible);
+
+int invoke_set_rate(set_rate_cb_t *cb, const char *session_id, const char *instance_id, double rate);
+
+int invoke_set_volume(set_volume_cb_t *cb, const char *session_id, const char *instance_id, double volume);
+
+int invoke_add_source_buffer(add_source_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, const char *mime_type);
+
+int invoke_remove_source_buffer(remove_source_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id);
+
+int invoke_abort_source_buffer(abort_source_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id);
+
+int invoke_append_buffer(append_buffer_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, double append_window_start,
+    double append_window_end, const char *buffer_id, int buffer_offset, int buffer_length, const void *payload, unsigned payload_len,
+    appflinger_time_ranges_t *result);
+
+int invoke_set_append_mode(set_append_mode_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, int mode);
+
+int invoke_set_append_timestamp_offset(set_append_timestamp_offset_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, double timestamp_offset);
+
+int invoke_remove_buffer_range(remove_buffer_range_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, double start, double end);
+
+int invoke_change_source_buffer_type(change_source_buffer_type_cb_t *cb, const char *session_id, const char *instance_id, const char *source_id, const char *mime_type);
+
+int invoke_load_resource(load_resource_cb_t *cb, const char *session_id, const char *url, const char *method, const char *headers, const char *resource_id,
+    int byte_range_start, int byte_range_end, int sequence_number, const void *payload, unsigned payload_len,
+    appflinger_load_resource_result_t *result);
+
+int invoke_delete_resource(delete_resource_cb_t *cb, const char *session_id, const char *buffer_id);
+
+int invoke_request_key_system(request_key_system_cb_t *cb, const char *session_id, const char *key_system, const char *supported_configurations,
+    char **result);
+
+int invoke_cdm_create(cdm_create_cb_t *cb, const char *session_id, const char *key_system, const char *security_origin, int allow_distinctive_identifier,
+    int allow_persistent_state, char **cdm_id);
+
+int invoke_cdm_set_server_certificate(cdm_set_server_certificate_cb_t *cb, const char *session_id, const char *cdm_id, const void *payload, unsigned payload_len);
+
+int invoke_cdm_session_create(cdm_session_create_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *session_type,
+    const char *init_data_type, const void *payload, unsigned payload_len, char **cdm_session_id, double *expiration);
+
+int invoke_cdm_session_update(cdm_session_update_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id,
+    const void *payload, unsigned payload_len);
+
+int invoke_cdm_session_load(cdm_session_load_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id,
+    int *loaded, double *expiration);
+
+int invoke_cdm_session_remove(cdm_session_remove_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id);
+
+int invoke_cdm_session_close(cdm_session_close_cb_t *cb, const char *session_id, const char *event_instance_id, const char *cdm_id, const char *cdm_session_id);
+
+int invoke_set_cdm(set_cdm_cb_t *cb, const char *session_id, const char *instance_id, const char *cdm_id);
+
+int invoke_send_message(send_message_cb_t *cb, const char *session_id, const char *message, char **result);
+
+int invoke_on_page_load(on_page_load_cb_t *cb, const char *session_id);
+
+int invoke_on_address_bar_changed(on_address_bar_changed_cb_t *cb, const char *session_id, const char *url);
+
+int invoke_on_title_changed(on_title_changed_cb_t *cb, const char *session_id, const char *title);
+
+int invoke_on_page_close(on_page_close_cb_t *cb, const char *session_id);
+
 
 #ifdef __cplusplus
 }
@@ -0,0 +1,23 @@
+#include <stdlib.h>
+#include <string.h>
+#include "errors.h"
+
+static __thread int last_error_code = APPFLINGER_OK;
+static __thread char *last_error_msg = NULL;
+
+void appflinger_set_last_error(int code, const char *msg)
+{
+    free(last_error_msg);
+    last_error_msg = msg ? strdup(msg) : NULL;
+    last_error_code = code;
+}
+
+int appflinger_get_last_error_code()
+{
+    return last_error_code;
+}
+
+const char *appflinger_get_last_error_msg()
+{
+    return last_error_msg;
+}
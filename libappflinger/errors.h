@@ -0,0 +1,28 @@
+// file errors.h
+
+#ifndef APPFLINGER_ERRORS_H
+#define APPFLINGER_ERRORS_H
+
+// Error codes returned by the functions of the library which return an int. Functions which return a pointer
+// return NULL on failure. In both cases GetErrCode() and GetErr() return the details of the error.
+typedef enum
+{
+    APPFLINGER_OK                    = 0,
+    APPFLINGER_ERR_GENERIC           = -1,
+    APPFLINGER_ERR_INVALID_HANDLE    = -2, // The session handle is invalid or was released
+    APPFLINGER_ERR_INVALID_ARGUMENT  = -3,
+    APPFLINGER_ERR_INVALID_STATE     = -4, // E.g. starting UI streaming while the UI is already streaming
+    APPFLINGER_ERR_NETWORK           = -5, // Failed to reach the server
+    APPFLINGER_ERR_SERVER            = -6, // The server responded with an error status
+    APPFLINGER_ERR_SESSION_NOT_FOUND = -7,
+    APPFLINGER_ERR_NOT_SUPPORTED     = -8, // The server does not support the requested feature
+    APPFLINGER_ERR_INTERRUPTED       = -9, // The operation was interrupted since the session was stopped
+} appflinger_err_t;
+
+// The error state is kept per thread, i.e. GetErrCode() and GetErr() return the error of the last failed call
+// made by the calling thread.
+void appflinger_set_last_error(int code, const char *msg);
+int appflinger_get_last_error_code();
+const char *appflinger_get_last_error_msg();
+
+#endif
@@ -0,0 +1,304 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	// #include <stdlib.h>
+	// #include <string.h>
+	// #include "callbacks.h"
+	"C"
+)
+import (
+	"log"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	appflinger "github.com/tversity/appflinger-go"
+)
+
+const (
+	_FRAME_POOL_MAX_BUFFERS  = 32         // Released buffers beyond this number are freed
+	_FRAME_BUFFER_SIZE_ALIGN = 64 * 1024  // Buffer sizes are rounded up to this size, so that they fit subsequent frames
+	_FRAME_BUFFER_HEADER     = 16         // The header before the data of a buffer holds its capacity, it keeps the data aligned
+	_FRAME_BUFFER_MAGIC      = 0x41465246 // The magic of a buffer in use
+	_FRAME_BUFFER_POOLED     = 0x41465250 // The magic of a buffer in the pool, so that a second release is caught
+	_FRAME_QUEUE_SIZE        = 32         // Frames waiting for the delivery thread
+	_FRAME_BUFFER_MAX_SIZE   = 1 << 30
+)
+
+// The pool of the C buffers into which the UI frames are copied. It is shared by all sessions since
+// appflinger_frame_release() only gets the data pointer.
+var (
+	framePoolMutex sync.Mutex
+	framePool      []unsafe.Pointer // Released buffers (pointers to the headers)
+)
+
+type frameBufferHeader struct {
+	magic    C.uint
+	capacity C.uint
+}
+
+func frameHeader(data unsafe.Pointer) *frameBufferHeader {
+	return (*frameBufferHeader)(unsafe.Pointer(uintptr(data) - _FRAME_BUFFER_HEADER))
+}
+
+// frameBufferGet returns the data pointer of a buffer of at least the given size, reusing a released buffer if possible.
+func frameBufferGet(size int) unsafe.Pointer {
+	framePoolMutex.Lock()
+	best := -1
+	for i, buf := range framePool {
+		capacity := int((*frameBufferHeader)(buf).capacity)
+		if capacity >= size && (best < 0 || capacity < int((*frameBufferHeader)(framePool[best]).capacity)) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		buf := framePool[best]
+		framePool[best] = framePool[len(framePool)-1]
+		framePool = framePool[:len(framePool)-1]
+		(*frameBufferHeader)(buf).magic = _FRAME_BUFFER_MAGIC
+		framePoolMutex.Unlock()
+		return unsafe.Pointer(uintptr(buf) + _FRAME_BUFFER_HEADER)
+	}
+	framePoolMutex.Unlock()
+
+	capacity := (size + _FRAME_BUFFER_SIZE_ALIGN - 1) / _FRAME_BUFFER_SIZE_ALIGN * _FRAME_BUFFER_SIZE_ALIGN
+	if capacity == 0 {
+		capacity = _FRAME_BUFFER_SIZE_ALIGN
+	}
+	buf := C.malloc(C.size_t(capacity + _FRAME_BUFFER_HEADER))
+	header := (*frameBufferHeader)(buf)
+	header.magic = _FRAME_BUFFER_MAGIC
+	header.capacity = C.uint(capacity)
+	return unsafe.Pointer(uintptr(buf) + _FRAME_BUFFER_HEADER)
+}
+
+// frameBufferPut returns a buffer to the pool, or frees it when the pool is full.
+func frameBufferPut(data unsafe.Pointer) {
+	header := frameHeader(data)
+	framePoolMutex.Lock()
+	defer framePoolMutex.Unlock()
+	switch header.magic {
+	case _FRAME_BUFFER_MAGIC:
+	case _FRAME_BUFFER_POOLED:
+		log.Println("Releasing a frame buffer which was already released")
+		return
+	default:
+		log.Println("Releasing an invalid frame buffer")
+		return
+	}
+
+	if len(framePool) < _FRAME_POOL_MAX_BUFFERS {
+		header.magic = _FRAME_BUFFER_POOLED
+		framePool = append(framePool, unsafe.Pointer(header))
+		return
+	}
+	header.magic = 0
+	C.free(unsafe.Pointer(header))
+}
+
+// appflinger_frame_release releases the data of a frame which was retained by the client, see APPFLINGER_FRAME_RETAIN.
+//
+//export appflinger_frame_release
+func appflinger_frame_release(data unsafe.Pointer) {
+	if data != nil {
+		frameBufferPut(data)
+	}
+}
+
+// uiFrame is a frame which awaits delivery to on_ui_frame_cb.
+type uiFrame struct {
+	cSessionId                               *C.char // Referenced by the frame, see AppflingerListener.acquire()
+	isCodecConfig, isKeyFrame, discontinuity bool
+	idx                                      int
+	pts, dts                                 int64
+	data                                     unsafe.Pointer
+	dataLen                                  int
+	pooled                                   bool // The data is a buffer of the pool rather than a buffer of the client or Go memory
+}
+
+// GetUIFrameBuffer implements appflinger.UIFrameBufferAllocator so that the video frames are written directly into
+// the buffers returned by get_frame_buffer_cb, rather than copied into them.
+func (self *AppflingerListener) GetUIFrameBuffer(sessionId string, size int) []byte {
+	if self.cb.get_frame_buffer_cb == nil || size <= 0 || size > _FRAME_BUFFER_MAX_SIZE {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return nil
+	}
+	defer self.done()
+	data := C.invoke_get_frame_buffer(self.cb.get_frame_buffer_cb, cSessionId, C.uint(size))
+	if data == nil {
+		return nil
+	}
+	self.mutex.Lock()
+	self.frameBuffer = data
+	self.mutex.Unlock()
+	return (*[_FRAME_BUFFER_MAX_SIZE]byte)(data)[:size:size]
+}
+
+// takeFrameBuffer checks whether the given data is in the last buffer returned by GetUIFrameBuffer().
+func (self *AppflingerListener) takeFrameBuffer(data unsafe.Pointer) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	buf := self.frameBuffer
+	self.frameBuffer = nil
+	return buf != nil && buf == data
+}
+
+// newUIFrame returns a frame whose data is in a buffer of the client (see get_frame_buffer_cb), either since it was
+// written there by the library or by copying it, or otherwise in a buffer of the pool. When the frame is delivered
+// inline and is not retained (i.e. keep is false) the data is passed as is rather than copied into the pool.
+func (self *AppflingerListener) newUIFrame(cSessionId *C.char, f *appflinger.UIFrame, keep bool) *uiFrame {
+	data := f.Data
+	frame := &uiFrame{
+		cSessionId:    cSessionId,
+		isCodecConfig: f.IsCodecConfig,
+		isKeyFrame:    f.IsKeyFrame,
+		discontinuity: f.Discontinuity,
+		idx:           f.Idx,
+		pts:           f.PTS,
+		dts:           f.DTS,
+		dataLen:       len(data),
+	}
+	if len(data) == 0 {
+		return frame
+	}
+	if self.takeFrameBuffer(unsafe.Pointer(&data[0])) {
+		frame.data = unsafe.Pointer(&data[0])
+		return frame
+	}
+	if self.cb.get_frame_buffer_cb != nil {
+		frame.data = C.invoke_get_frame_buffer(self.cb.get_frame_buffer_cb, cSessionId, C.uint(len(data)))
+	}
+	if frame.data == nil {
+		if !keep {
+			frame.data = unsafe.Pointer(&data[0])
+			return frame
+		}
+		frame.data = frameBufferGet(len(data))
+		frame.pooled = true
+	}
+	C.memcpy(frame.data, unsafe.Pointer(&data[0]), C.size_t(len(data)))
+	return frame
+}
+
+// deliverFrame passes the frame to on_ui_frame_cb and releases its buffer unless the client retains it.
+func (self *AppflingerListener) deliverFrame(frame *uiFrame, retain bool) C.int {
+	rc := C.invoke_on_ui_frame(self.cb.on_ui_frame_cb, frame.cSessionId, CBool(frame.isCodecConfig), CBool(frame.isKeyFrame),
+		CBool(frame.discontinuity), C.int(frame.idx), C.longlong(frame.pts), C.longlong(frame.dts), frame.data, C.uint(frame.dataLen))
+	if frame.pooled && !retain {
+		frameBufferPut(frame.data)
+	}
+	return rc
+}
+
+// dropFrame releases the buffer of a frame which is not delivered.
+func (self *AppflingerListener) dropFrame(frame *uiFrame) {
+	if frame.pooled {
+		frameBufferPut(frame.data)
+	}
+}
+
+// frameQueue holds the frames which await delivery on the frame thread.
+type frameQueue struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	frames  []*uiFrame
+	stopped bool
+}
+
+func newFrameQueue() *frameQueue {
+	q := &frameQueue{}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push queues the frame, waiting while the queue is full. It fails once the queue is stopped.
+func (q *frameQueue) push(frame *uiFrame) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.stopped && len(q.frames) >= _FRAME_QUEUE_SIZE {
+		q.cond.Wait()
+	}
+	if q.stopped {
+		return false
+	}
+	q.frames = append(q.frames, frame)
+	q.cond.Broadcast()
+	return true
+}
+
+// pop returns the next frame, waiting while the queue is empty. It fails once the queue is stopped and empty.
+func (q *frameQueue) pop() (*uiFrame, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.stopped && len(q.frames) == 0 {
+		q.cond.Wait()
+	}
+	if len(q.frames) == 0 {
+		return nil, false
+	}
+	frame := q.frames[0]
+	q.frames[0] = nil
+	q.frames = q.frames[1:]
+	q.cond.Broadcast()
+	return frame, true
+}
+
+// stop makes push() fail, the frames which are already queued are still returned by pop().
+func (q *frameQueue) stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.stopped = true
+	q.cond.Broadcast()
+}
+
+// frameThread delivers the queued frames on a dedicated OS thread until the queue is stopped, or drops them
+// once the handle of the session is released.
+func (self *AppflingerListener) frameThread(frames *frameQueue, retain bool, done chan bool) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	for {
+		frame, ok := frames.pop()
+		if !ok {
+			break
+		}
+		if self.isReleased() {
+			self.dropFrame(frame)
+		} else if rc := self.deliverFrame(frame, retain); rc != 0 {
+			log.Println("Failed to process frame")
+		}
+		self.done()
+	}
+	done <- true
+}
+
+// setFrameOptions applies the given appflinger_frame_flags_t, after the delivery of the queued frames.
+// It must not be called from a callback.
+func (self *AppflingerListener) setFrameOptions(flags int) {
+	self.mutex.Lock()
+	frames, framesDone := self.frames, self.framesDone
+	self.frames = nil
+	self.mutex.Unlock()
+	if frames != nil {
+		frames.stop()
+		<-framesDone
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.released {
+		return
+	}
+	self.frameRetain = flags&C.APPFLINGER_FRAME_RETAIN != 0
+	if flags&C.APPFLINGER_FRAME_THREAD != 0 {
+		self.frames = newFrameQueue()
+		self.framesDone = make(chan bool, 1)
+		go self.frameThread(self.frames, self.frameRetain, self.framesDone)
+	}
+}
@@ -13,7 +13,10 @@ import (
 	appflinger "github.com/tversity/appflinger-go"
 )
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
 	"unsafe"
 )
 
@@ -26,18 +29,151 @@ type AppflingerListener struct {
 	// Note - we cannot invoke C function pointers from Go so we use a helper C function to do it
 	// e.g. to invoke the on_ui_frame_cb function pointer we use C.invoke_on_ui_frame()
 	cb *C.appflinger_callbacks_t
+
+	// The mutex is never held while a callback runs, so that the callbacks can stop or release the session.
+	// Instead each running callback and each queued frame holds a reference to cSessionId, which is freed
+	// once the handle is released and the last reference is dropped.
+	mutex         sync.Mutex
+	released      bool
+	refs          int
+	sessionIdOnce sync.Once
+	cSessionId    *C.char // The session id passed to all the callbacks, allocated once
+
+	// UI frame delivery, see setFrameOptions()
+	frameRetain bool
+	frames      *frameQueue // Non nil when frames are delivered on a dedicated thread
+	framesDone  chan bool
+	frameBuffer unsafe.Pointer // The last buffer returned by GetUIFrameBuffer()
 }
 
+var errListenerReleased = errors.New("Session handle was released")
+
 func NewAppflingerListener(cb *C.appflinger_callbacks_t) (self *AppflingerListener) {
 	self = &AppflingerListener{}
 	self.cb = cb
 	return
 }
 
+// acquire returns the C string of the session id along with a reference to it, which is dropped using done()
+// when the callback returns. It fails once the handle of the session was released, in which case the callbacks
+// are no longer invoked.
+func (self *AppflingerListener) acquire(sessionId string) (cSessionId *C.char, err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.released {
+		return nil, errListenerReleased
+	}
+	self.sessionIdOnce.Do(func() {
+		self.cSessionId = C.CString(sessionId)
+	})
+	self.refs++
+	return self.cSessionId, nil
+}
+
+// done drops a reference which was returned by acquire().
+func (self *AppflingerListener) done() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.refs--
+	if self.released && self.refs == 0 {
+		self.freeSessionId()
+	}
+}
+
+// isReleased returns whether the handle of the session was released.
+func (self *AppflingerListener) isReleased() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.released
+}
+
+// release stops invoking the callbacks, it may be called from a callback. It does not wait for the callbacks which
+// are running, the memory of the listener is freed when the last one returns. Queued frames are dropped.
+func (self *AppflingerListener) release() {
+	self.mutex.Lock()
+	if self.released {
+		self.mutex.Unlock()
+		return
+	}
+	self.released = true
+	frames := self.frames
+	self.frames = nil
+	if self.refs == 0 {
+		self.freeSessionId()
+	}
+	self.mutex.Unlock()
+
+	if frames != nil {
+		frames.stop()
+	}
+}
+
+// freeSessionId frees the C string of the session id, it is called with the mutex locked.
+func (self *AppflingerListener) freeSessionId() {
+	if self.cSessionId != nil {
+		C.free(unsafe.Pointer(self.cSessionId))
+		self.cSessionId = nil
+	}
+}
+
+// Helpers for passing data to and from the C callbacks
+
+// cBytes returns a pointer to the given payload which can be passed to a callback without copying it.
+// The callback must not retain the pointer after it returns.
+func cBytes(payload []byte) (unsafe.Pointer, C.uint) {
+	if len(payload) == 0 {
+		return nil, 0
+	}
+	return unsafe.Pointer(&payload[0]), C.uint(len(payload))
+}
+
+// goString returns the Go string of a string which is returned by a callback, nil is an empty string.
+// The caller still needs to free the C string.
+func goString(str *C.char) string {
+	if str == nil {
+		return ""
+	}
+	return C.GoString(str)
+}
+
+// newCTimeRanges allocates the arrays into which a callback returns time ranges, see freeCTimeRanges().
+func newCTimeRanges() (ranges C.appflinger_time_ranges_t) {
+	ranges.start = (*C.double)(C.malloc(C.APPFLINGER_MAX_TIME_RANGES * C.sizeof_double))
+	ranges.end = (*C.double)(C.malloc(C.APPFLINGER_MAX_TIME_RANGES * C.sizeof_double))
+	ranges.length = 0
+	return
+}
+
+func freeCTimeRanges(ranges *C.appflinger_time_ranges_t) {
+	C.free(unsafe.Pointer(ranges.start))
+	C.free(unsafe.Pointer(ranges.end))
+}
+
+// goTimeRanges copies the time ranges returned by a callback.
+func goTimeRanges(ranges *C.appflinger_time_ranges_t) (start []float64, end []float64) {
+	length := int(ranges.length)
+	if length > C.APPFLINGER_MAX_TIME_RANGES {
+		length = C.APPFLINGER_MAX_TIME_RANGES
+	}
+	cStart := (*[C.APPFLINGER_MAX_TIME_RANGES]C.double)(unsafe.Pointer(ranges.start))
+	cEnd := (*[C.APPFLINGER_MAX_TIME_RANGES]C.double)(unsafe.Pointer(ranges.end))
+	start = make([]float64, length)
+	end = make([]float64, length)
+	for i := 0; i < length; i++ {
+		start[i] = float64(cStart[i])
+		end[i] = float64(cEnd[i])
+	}
+	return
+}
+
 // Implementation of appflinger.AppFlinger interface that just delegates to C Callbacks
 
 func (self *AppflingerListener) Load(sessionId string, instanceId string, url string) (err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	cUrl := C.CString(url)
 	rc := C.invoke_load(self.cb.load_cb, cSessionId, cInstanceId, cUrl)
@@ -46,14 +182,17 @@ func (self *AppflingerListener) Load(sessionId string, instanceId string, url st
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	C.free(unsafe.Pointer(cUrl))
 	return
 }
 
 func (self *AppflingerListener) CancelLoad(sessionId string, instanceId string) (err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	rc := C.invoke_cancel_load(self.cb.cancel_load_cb, cSessionId, cInstanceId)
 	if rc != 0 {
@@ -61,13 +200,16 @@ func (self *AppflingerListener) CancelLoad(sessionId string, instanceId string)
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) Pause(sessionId string, instanceId string) (err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	rc := C.invoke_pause(self.cb.pause_cb, cSessionId, cInstanceId)
 	if rc != 0 {
@@ -75,13 +217,16 @@ func (self *AppflingerListener) Pause(sessionId string, instanceId string) (err
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) Play(sessionId string, instanceId string) (err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	rc := C.invoke_play(self.cb.play_cb, cSessionId, cInstanceId)
 	if rc != 0 {
@@ -89,13 +234,16 @@ func (self *AppflingerListener) Play(sessionId string, instanceId string) (err e
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) Seek(sessionId string, instanceId string, time float64) (err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	rc := C.invoke_seek(self.cb.seek_cb, cSessionId, cInstanceId, C.double(time))
 	if rc != 0 {
@@ -103,13 +251,16 @@ func (self *AppflingerListener) Seek(sessionId string, instanceId string, time f
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetPaused(sessionId string, instanceId string) (paused bool, err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	var cPaused C.int
 	rc := C.invoke_get_paused(self.cb.get_paused_cb, cSessionId, cInstanceId, &cPaused)
@@ -119,13 +270,16 @@ func (self *AppflingerListener) GetPaused(sessionId string, instanceId string) (
 		paused = GoBool(cPaused)
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetSeeking(sessionId string, instanceId string) (seeking bool, err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	var cSeeking C.int
 	rc := C.invoke_get_seeking(self.cb.get_seeking_cb, cSessionId, cInstanceId, &cSeeking)
@@ -135,13 +289,16 @@ func (self *AppflingerListener) GetSeeking(sessionId string, instanceId string)
 		seeking = GoBool(cSeeking)
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetDuration(sessionId string, instanceId string) (duration float64, err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	var cDuration C.double
 	rc := C.invoke_get_duration(self.cb.get_duration_cb, cSessionId, cInstanceId, &cDuration)
@@ -151,13 +308,16 @@ func (self *AppflingerListener) GetDuration(sessionId string, instanceId string)
 		duration = float64(cDuration)
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetCurrentTime(sessionId string, instanceId string) (time float64, err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	var cTime C.double
 	rc := C.invoke_get_current_time(self.cb.get_current_time_cb, cSessionId, cInstanceId, &cTime)
@@ -167,13 +327,16 @@ func (self *AppflingerListener) GetCurrentTime(sessionId string, instanceId stri
 		time = float64(cTime)
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetNetworkState(sessionId string, instanceId string) (networkState int, err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	var cNetworkState C.int
 	rc := C.invoke_get_network_state(self.cb.get_network_state_cb, cSessionId, cInstanceId, &cNetworkState)
@@ -183,13 +346,16 @@ func (self *AppflingerListener) GetNetworkState(sessionId string, instanceId str
 		networkState = int(cNetworkState)
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetReadyState(sessionId string, instanceId string) (readyState int, err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	var cReadyState C.int
 	rc := C.invoke_get_ready_state(self.cb.get_ready_state_cb, cSessionId, cInstanceId, &cReadyState)
@@ -199,39 +365,82 @@ func (self *AppflingerListener) GetReadyState(sessionId string, instanceId strin
 		readyState = int(cReadyState)
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetSeekable(sessionId string, instanceId string, result *appflinger.GetSeekableResult) (err error) {
-	var duration float64
-	duration, err = self.GetDuration(sessionId, instanceId)
-	if err != nil {
+	if self.cb.get_seekable_cb == nil {
+		var duration float64
+		duration, err = self.GetDuration(sessionId, instanceId)
+		if err != nil {
+			return
+		}
+
+		result.Start = []float64{0}
+		result.End = []float64{duration}
+		err = nil
 		return
 	}
 
-	result.Start = []float64{0}
-	result.End = []float64{duration}
-	err = nil
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cRanges := newCTimeRanges()
+	rc := C.invoke_get_seekable(self.cb.get_seekable_cb, cSessionId, cInstanceId, &cRanges)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to get seekable time ranges")
+	} else {
+		result.Start, result.End = goTimeRanges(&cRanges)
+		err = nil
+	}
+	freeCTimeRanges(&cRanges)
+	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) GetBuffered(sessionId string, instanceId string, result *appflinger.GetBufferedResult) (err error) {
-	var duration float64
-	duration, err = self.GetDuration(sessionId, instanceId)
-	if err != nil {
+	if self.cb.get_buffered_cb == nil {
+		var duration float64
+		duration, err = self.GetDuration(sessionId, instanceId)
+		if err != nil {
+			return
+		}
+
+		result.Start = []float64{0}
+		result.End = []float64{duration}
+		err = nil
 		return
 	}
 
-	result.Start = []float64{0}
-	result.End = []float64{duration}
-	err = nil
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cRanges := newCTimeRanges()
+	rc := C.invoke_get_buffered(self.cb.get_buffered_cb, cSessionId, cInstanceId, &cRanges)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to get buffered time ranges")
+	} else {
+		result.Start, result.End = goTimeRanges(&cRanges)
+		err = nil
+	}
+	freeCTimeRanges(&cRanges)
+	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) SetRect(sessionId string, instanceId string, x int, y int, width int, height int) (err error) {
-	cSessionId := C.CString(sessionId)
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
 	cInstanceId := C.CString(instanceId)
 	rc := C.invoke_set_rect(self.cb.set_rect_cb, cSessionId, cInstanceId, C.int(x), C.int(y), C.int(width), C.int(height))
 	if rc != 0 {
@@ -239,165 +448,702 @@ func (self *AppflingerListener) SetRect(sessionId string, instanceId string, x i
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) SetVisible(sessionId string, instanceId string, visible bool) (err error) {
-	err = nil
+	if self.cb.set_visible_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	rc := C.invoke_set_visible(self.cb.set_visible_cb, cSessionId, cInstanceId, CBool(visible))
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set media visibility")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) SetRate(sessionId string, instanceId string, rate float64) (err error) {
-	err = nil
+	if self.cb.set_rate_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	rc := C.invoke_set_rate(self.cb.set_rate_cb, cSessionId, cInstanceId, C.double(rate))
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set media playback rate")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) SetVolume(sessionId string, instanceId string, volume float64) (err error) {
-	err = nil
+	if self.cb.set_volume_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	rc := C.invoke_set_volume(self.cb.set_volume_cb, cSessionId, cInstanceId, C.double(volume))
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set media volume")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
 	return
 }
 
 func (self *AppflingerListener) AddSourceBuffer(sessionId string, instanceId string, sourceId string, mimeType string) (err error) {
-	err = nil
+	if self.cb.add_source_buffer_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	cMimeType := C.CString(mimeType)
+	rc := C.invoke_add_source_buffer(self.cb.add_source_buffer_cb, cSessionId, cInstanceId, cSourceId, cMimeType)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to add source buffer")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
+	C.free(unsafe.Pointer(cMimeType))
 	return
 }
 
 func (self *AppflingerListener) RemoveSourceBuffer(sessionId string, instanceId string, sourceId string) (err error) {
-	err = nil
+	if self.cb.remove_source_buffer_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	rc := C.invoke_remove_source_buffer(self.cb.remove_source_buffer_cb, cSessionId, cInstanceId, cSourceId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to remove source buffer")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
 	return
 }
 
 func (self *AppflingerListener) AbortSourceBuffer(sessionId string, instanceId string, sourceId string) (err error) {
-	err = nil
+	if self.cb.abort_source_buffer_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	rc := C.invoke_abort_source_buffer(self.cb.abort_source_buffer_cb, cSessionId, cInstanceId, cSourceId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to abort source buffer")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
 	return
 }
 
 func (self *AppflingerListener) AppendBuffer(sessionId string, instanceId string, sourceId string, appendWindowStart float64, appendWindowEnd float64,
 	bufferId string, bufferOffset int, bufferLength int, payload []byte, result *appflinger.GetBufferedResult) (err error) {
-	result.Start = nil
-	result.End = nil
-	err = nil
+	if self.cb.append_buffer_cb == nil {
+		result.Start = nil
+		result.End = nil
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	cBufferId := C.CString(bufferId)
+	cPayload, cPayloadLen := cBytes(payload)
+	cRanges := newCTimeRanges()
+	rc := C.invoke_append_buffer(self.cb.append_buffer_cb, cSessionId, cInstanceId, cSourceId, C.double(appendWindowStart), C.double(appendWindowEnd),
+		cBufferId, C.int(bufferOffset), C.int(bufferLength), cPayload, cPayloadLen, &cRanges)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to append buffer")
+	} else {
+		result.Start, result.End = goTimeRanges(&cRanges)
+		err = nil
+	}
+	freeCTimeRanges(&cRanges)
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
+	C.free(unsafe.Pointer(cBufferId))
 	return
 }
 
 func (self *AppflingerListener) SetAppendMode(sessionId string, instanceId string, sourceId string, mode int) (err error) {
-	err = nil
+	if self.cb.set_append_mode_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	rc := C.invoke_set_append_mode(self.cb.set_append_mode_cb, cSessionId, cInstanceId, cSourceId, C.int(mode))
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set append mode")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
 	return
 }
 
 func (self *AppflingerListener) SetAppendTimestampOffset(sessionId string, instanceId string, sourceId string, timestampOffset float64) (err error) {
-	err = nil
+	if self.cb.set_append_timestamp_offset_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	rc := C.invoke_set_append_timestamp_offset(self.cb.set_append_timestamp_offset_cb, cSessionId, cInstanceId, cSourceId, C.double(timestampOffset))
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set append timestamp offset")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
 	return
 }
 
 func (self *AppflingerListener) RemoveBufferRange(sessionId string, instanceId string, sourceId string, start float64, end float64) (err error) {
-	err = nil
+	if self.cb.remove_buffer_range_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	rc := C.invoke_remove_buffer_range(self.cb.remove_buffer_range_cb, cSessionId, cInstanceId, cSourceId, C.double(start), C.double(end))
+	if rc != 0 {
+		err = fmt.Errorf("Failed to remove buffer range")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
 	return
 }
 
 func (self *AppflingerListener) ChangeSourceBufferType(sessionId string, instanceId string, sourceId string, mimeType string) (err error) {
-	err = nil
+	if self.cb.change_source_buffer_type_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cSourceId := C.CString(sourceId)
+	cMimeType := C.CString(mimeType)
+	rc := C.invoke_change_source_buffer_type(self.cb.change_source_buffer_type_cb, cSessionId, cInstanceId, cSourceId, cMimeType)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to change source buffer type")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cSourceId))
+	C.free(unsafe.Pointer(cMimeType))
 	return
 }
 
 func (self *AppflingerListener) LoadResource(sessionId string, url string, method string, headers string, resourceId string,
 	byteRangeStart int, byteRangeEnd int, sequenceNumber int, payload []byte, result *appflinger.LoadResourceResult) (err error) {
-	err = nil
-	result.Code = "404"
-	result.Headers = ""
-	result.BufferId = ""
-	result.BufferLength = 0
-	result.Payload = nil
+	if self.cb.load_resource_cb == nil {
+		err = nil
+		result.Code = "404"
+		result.Headers = ""
+		result.BufferId = ""
+		result.BufferLength = 0
+		result.Payload = nil
+		return
+	}
+
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cUrl := C.CString(url)
+	cMethod := C.CString(method)
+	cHeaders := C.CString(headers)
+	cResourceId := C.CString(resourceId)
+	cPayload, cPayloadLen := cBytes(payload)
+	var cResult C.appflinger_load_resource_result_t
+	rc := C.invoke_load_resource(self.cb.load_resource_cb, cSessionId, cUrl, cMethod, cHeaders, cResourceId, C.int(byteRangeStart),
+		C.int(byteRangeEnd), C.int(sequenceNumber), cPayload, cPayloadLen, &cResult)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to load resource")
+	} else {
+		result.Code = goString(cResult.code)
+		result.Headers = goString(cResult.headers)
+		result.BufferId = goString(cResult.buffer_id)
+		result.BufferLength = int(cResult.buffer_length)
+		result.Payload = nil
+		if cResult.payload != nil {
+			result.Payload = C.GoBytes(cResult.payload, C.int(cResult.payload_len))
+		}
+		err = nil
+	}
+	C.free(unsafe.Pointer(cResult.code))
+	C.free(unsafe.Pointer(cResult.headers))
+	C.free(unsafe.Pointer(cResult.buffer_id))
+	C.free(cResult.payload)
+	C.free(unsafe.Pointer(cUrl))
+	C.free(unsafe.Pointer(cMethod))
+	C.free(unsafe.Pointer(cHeaders))
+	C.free(unsafe.Pointer(cResourceId))
 	return
 }
 
 func (self *AppflingerListener) DeleteResource(sessionId string, BufferId string) (err error) {
-	err = nil
+	if self.cb.delete_resource_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cBufferId := C.CString(BufferId)
+	rc := C.invoke_delete_resource(self.cb.delete_resource_cb, cSessionId, cBufferId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to delete resource")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cBufferId))
 	return
 }
 
 func (self *AppflingerListener) RequestKeySystem(sessionId string, keySystem string, supportedConfigurations []appflinger.EMEMediaKeySystemConfiguration, result *appflinger.RequestKeySystemResult) (err error) {
-	err = nil
+	if self.cb.request_key_system_cb == nil {
+		return nil
+	}
+	configurations, err := json.Marshal(supportedConfigurations)
+	if err != nil {
+		return fmt.Errorf("Failed to encode key system configurations: %v", err)
+	}
+
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cKeySystem := C.CString(keySystem)
+	cConfigurations := C.CString(string(configurations))
+	var cResult *C.char
+	rc := C.invoke_request_key_system(self.cb.request_key_system_cb, cSessionId, cKeySystem, cConfigurations, &cResult)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to request key system")
+	} else if cResult != nil {
+		err = json.Unmarshal([]byte(C.GoString(cResult)), result)
+		if err != nil {
+			err = fmt.Errorf("Failed to decode key system configuration: %v", err)
+		}
+	}
+	C.free(unsafe.Pointer(cResult))
+	C.free(unsafe.Pointer(cKeySystem))
+	C.free(unsafe.Pointer(cConfigurations))
 	return
 }
 
 func (self *AppflingerListener) CdmCreate(sessionId string, keySystem string, securityOrigin string, allowDistinctiveIdentifier bool, allowPersistentState bool) (cdmId string, err error) {
-	err = nil
+	if self.cb.cdm_create_cb == nil {
+		return "", nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cKeySystem := C.CString(keySystem)
+	cSecurityOrigin := C.CString(securityOrigin)
+	var cCdmId *C.char
+	rc := C.invoke_cdm_create(self.cb.cdm_create_cb, cSessionId, cKeySystem, cSecurityOrigin, CBool(allowDistinctiveIdentifier),
+		CBool(allowPersistentState), &cCdmId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to create CDM")
+	} else {
+		cdmId = goString(cCdmId)
+		err = nil
+	}
+	C.free(unsafe.Pointer(cCdmId))
+	C.free(unsafe.Pointer(cKeySystem))
+	C.free(unsafe.Pointer(cSecurityOrigin))
 	return
 }
 
 func (self *AppflingerListener) CdmSetServerCertificate(sessionId string, cdmId string, payload []byte) (err error) {
-	err = nil
+	if self.cb.cdm_set_server_certificate_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cCdmId := C.CString(cdmId)
+	cPayload, cPayloadLen := cBytes(payload)
+	rc := C.invoke_cdm_set_server_certificate(self.cb.cdm_set_server_certificate_cb, cSessionId, cCdmId, cPayload, cPayloadLen)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set CDM server certificate")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cCdmId))
 	return
 }
 
 func (self *AppflingerListener) CdmSessionCreate(sessionId string, eventInstanceId string, cdmId string, sessionType string, initDataType string, payload []byte) (cdmSessionId string, expiration float64, err error) {
-	err = nil
+	if self.cb.cdm_session_create_cb == nil {
+		return "", 0, nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cEventInstanceId := C.CString(eventInstanceId)
+	cCdmId := C.CString(cdmId)
+	cSessionType := C.CString(sessionType)
+	cInitDataType := C.CString(initDataType)
+	cPayload, cPayloadLen := cBytes(payload)
+	var cCdmSessionId *C.char
+	var cExpiration C.double
+	rc := C.invoke_cdm_session_create(self.cb.cdm_session_create_cb, cSessionId, cEventInstanceId, cCdmId, cSessionType, cInitDataType,
+		cPayload, cPayloadLen, &cCdmSessionId, &cExpiration)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to create CDM session")
+	} else {
+		cdmSessionId = goString(cCdmSessionId)
+		expiration = float64(cExpiration)
+		err = nil
+	}
+	C.free(unsafe.Pointer(cCdmSessionId))
+	C.free(unsafe.Pointer(cEventInstanceId))
+	C.free(unsafe.Pointer(cCdmId))
+	C.free(unsafe.Pointer(cSessionType))
+	C.free(unsafe.Pointer(cInitDataType))
 	return
 }
 
 func (self *AppflingerListener) CdmSessionUpdate(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string, payload []byte) (err error) {
-	err = nil
+	if self.cb.cdm_session_update_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cEventInstanceId := C.CString(eventInstanceId)
+	cCdmId := C.CString(cdmId)
+	cCdmSessionId := C.CString(cdmSessionId)
+	cPayload, cPayloadLen := cBytes(payload)
+	rc := C.invoke_cdm_session_update(self.cb.cdm_session_update_cb, cSessionId, cEventInstanceId, cCdmId, cCdmSessionId, cPayload, cPayloadLen)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to update CDM session")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cEventInstanceId))
+	C.free(unsafe.Pointer(cCdmId))
+	C.free(unsafe.Pointer(cCdmSessionId))
 	return
 }
 
 func (self *AppflingerListener) CdmSessionLoad(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (loaded bool, expiration float64, err error) {
-	err = nil
+	if self.cb.cdm_session_load_cb == nil {
+		return false, 0, nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cEventInstanceId := C.CString(eventInstanceId)
+	cCdmId := C.CString(cdmId)
+	cCdmSessionId := C.CString(cdmSessionId)
+	var cLoaded C.int
+	var cExpiration C.double
+	rc := C.invoke_cdm_session_load(self.cb.cdm_session_load_cb, cSessionId, cEventInstanceId, cCdmId, cCdmSessionId, &cLoaded, &cExpiration)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to load CDM session")
+	} else {
+		loaded = GoBool(cLoaded)
+		expiration = float64(cExpiration)
+		err = nil
+	}
+	C.free(unsafe.Pointer(cEventInstanceId))
+	C.free(unsafe.Pointer(cCdmId))
+	C.free(unsafe.Pointer(cCdmSessionId))
 	return
 }
 
 func (self *AppflingerListener) CdmSessionRemove(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (err error) {
-	err = nil
+	if self.cb.cdm_session_remove_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cEventInstanceId := C.CString(eventInstanceId)
+	cCdmId := C.CString(cdmId)
+	cCdmSessionId := C.CString(cdmSessionId)
+	rc := C.invoke_cdm_session_remove(self.cb.cdm_session_remove_cb, cSessionId, cEventInstanceId, cCdmId, cCdmSessionId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to remove CDM session")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cEventInstanceId))
+	C.free(unsafe.Pointer(cCdmId))
+	C.free(unsafe.Pointer(cCdmSessionId))
 	return
 }
 
 func (self *AppflingerListener) CdmSessionClose(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (err error) {
-	err = nil
+	if self.cb.cdm_session_close_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cEventInstanceId := C.CString(eventInstanceId)
+	cCdmId := C.CString(cdmId)
+	cCdmSessionId := C.CString(cdmSessionId)
+	rc := C.invoke_cdm_session_close(self.cb.cdm_session_close_cb, cSessionId, cEventInstanceId, cCdmId, cCdmSessionId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to close CDM session")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cEventInstanceId))
+	C.free(unsafe.Pointer(cCdmId))
+	C.free(unsafe.Pointer(cCdmSessionId))
 	return
 }
 
 func (self *AppflingerListener) SetCdm(sessionId string, instanceId string, cdmId string) (err error) {
-	err = nil
+	if self.cb.set_cdm_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cInstanceId := C.CString(instanceId)
+	cCdmId := C.CString(cdmId)
+	rc := C.invoke_set_cdm(self.cb.set_cdm_cb, cSessionId, cInstanceId, cCdmId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to set CDM")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cInstanceId))
+	C.free(unsafe.Pointer(cCdmId))
 	return
 }
 
 func (self *AppflingerListener) SendMessage(sessionId string, message string) (result string, err error) {
-	err = nil
-	result = ""
+	if self.cb.send_message_cb == nil {
+		return "", nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cMessage := C.CString(message)
+	var cResult *C.char
+	rc := C.invoke_send_message(self.cb.send_message_cb, cSessionId, cMessage, &cResult)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to send message")
+	} else {
+		result = goString(cResult)
+		err = nil
+	}
+	C.free(unsafe.Pointer(cResult))
+	C.free(unsafe.Pointer(cMessage))
 	return
 }
 
 func (self *AppflingerListener) OnPageLoad(sessionId string) (err error) {
-	err = nil
+	if self.cb.on_page_load_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	rc := C.invoke_on_page_load(self.cb.on_page_load_cb, cSessionId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to process page load")
+	} else {
+		err = nil
+	}
 	return
 }
 
 func (self *AppflingerListener) OnAddressBarChanged(sessionId string, url string) (err error) {
-	err = nil
+	if self.cb.on_address_bar_changed_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cUrl := C.CString(url)
+	rc := C.invoke_on_address_bar_changed(self.cb.on_address_bar_changed_cb, cSessionId, cUrl)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to process address bar change")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cUrl))
 	return
 }
 
 func (self *AppflingerListener) OnTitleChanged(sessionId string, title string) (err error) {
-	err = nil
+	if self.cb.on_title_changed_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	cTitle := C.CString(title)
+	rc := C.invoke_on_title_changed(self.cb.on_title_changed_cb, cSessionId, cTitle)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to process title change")
+	} else {
+		err = nil
+	}
+	C.free(unsafe.Pointer(cTitle))
 	return
 }
 
 func (self *AppflingerListener) OnPageClose(sessionId string) (err error) {
-	err = nil
+	if self.cb.on_page_close_cb == nil {
+		return nil
+	}
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+	defer self.done()
+	rc := C.invoke_on_page_close(self.cb.on_page_close_cb, cSessionId)
+	if rc != 0 {
+		err = fmt.Errorf("Failed to process page close")
+	} else {
+		err = nil
+	}
 	return
 }
 
 func (self *AppflingerListener) OnUIFrame(sessionId string, isCodecConfig bool, isKeyFrame bool, idx int, pts int, dts int, data []byte) (err error) {
-	cSessionId := C.CString(sessionId)
-	rc := C.invoke_on_ui_frame(self.cb.on_ui_frame_cb, cSessionId, CBool(isCodecConfig), CBool(isKeyFrame), C.int(idx), C.longlong(pts),
-		C.longlong(dts), C.CBytes(data), C.uint(len(data)))
+	return self.OnUIFrameData(sessionId, &appflinger.UIFrame{
+		IsCodecConfig: isCodecConfig,
+		IsKeyFrame:    isKeyFrame,
+		Idx:           idx,
+		PTS:           int64(pts),
+		DTS:           int64(dts),
+		Data:          data,
+	})
+}
+
+// OnUIFrameData implements appflinger.UIFrameListener so that the timestamps are not truncated where int is 32 bit
+// and the discontinuity flag is passed.
+func (self *AppflingerListener) OnUIFrameData(sessionId string, frame *appflinger.UIFrame) (err error) {
+	cSessionId, err := self.acquire(sessionId)
+	if err != nil {
+		return
+	}
+
+	self.mutex.Lock()
+	frames, retain := self.frames, self.frameRetain
+	self.mutex.Unlock()
+
+	cFrame := self.newUIFrame(cSessionId, frame, frames != nil || retain)
+	if frames != nil && frames.push(cFrame) {
+		// The frame thread drops the reference after the delivery
+		return nil
+	}
+	defer self.done()
+	if self.isReleased() {
+		// Released meanwhile by another callback
+		self.dropFrame(cFrame)
+		return nil
+	}
+	rc := self.deliverFrame(cFrame, retain)
 	if rc != 0 {
 		err = fmt.Errorf("Failed to process frame")
 	} else {
 		err = nil
 	}
-	C.free(unsafe.Pointer(cSessionId))
 	return
 }
@@ -1,16 +1,30 @@
 package main
 
 import (
+	// #include <stdlib.h>
 	// #include "callbacks.h"
+	// #include "errors.h"
 	"C"
 
 	appflinger "github.com/tversity/appflinger-go"
 )
-import "log"
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"unsafe"
+)
 
 var (
-	err        error
-	ctxHandles []*appflinger.SessionContext
+	// Sessions are identified in the C API by their index in ctxHandles. Released slots are set to nil
+	// and are reused by subsequent sessions.
+	ctxHandles     []*ctxHandleEntry
+	freeCtxHandles []int
+	ctxMutex       sync.Mutex
+
+	errInvalidHandle = errors.New("Invalid session handle")
 )
 
 func GoBool(val C.int) bool {
@@ -27,40 +41,181 @@ func CBool(val bool) C.int {
 	return 0
 }
 
+type ctxHandleEntry struct {
+	ctx      *appflinger.SessionContext
+	listener *AppflingerListener
+}
+
+// addCtxHandle returns a handle to the given session context, reusing a released slot if possible.
+func addCtxHandle(ctx *appflinger.SessionContext, listener *AppflingerListener) C.int {
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
+	entry := &ctxHandleEntry{ctx: ctx, listener: listener}
+	if len(freeCtxHandles) > 0 {
+		idx := freeCtxHandles[len(freeCtxHandles)-1]
+		freeCtxHandles = freeCtxHandles[:len(freeCtxHandles)-1]
+		ctxHandles[idx] = entry
+		return C.int(idx)
+	}
+	ctxHandles = append(ctxHandles, entry)
+	return C.int(len(ctxHandles) - 1)
+}
+
+// getCtxHandle returns the session context of the given handle, it fails if the handle was released.
+func getCtxHandle(ctxHandle C.int) (ctx *appflinger.SessionContext, err error) {
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
+	if ctxHandle < 0 || int(ctxHandle) >= len(ctxHandles) || ctxHandles[ctxHandle] == nil {
+		return nil, errInvalidHandle
+	}
+	return ctxHandles[ctxHandle].ctx, nil
+}
+
+// getCtxListener returns the listener of the session of the given handle.
+func getCtxListener(ctxHandle C.int) (listener *AppflingerListener, err error) {
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
+	if ctxHandle < 0 || int(ctxHandle) >= len(ctxHandles) || ctxHandles[ctxHandle] == nil {
+		return nil, errInvalidHandle
+	}
+	return ctxHandles[ctxHandle].listener, nil
+}
+
+// releaseCtxHandle frees the slot of the given handle so that it can be reused, along with the memory of its listener.
+// Callbacks are no longer invoked for the session afterwards, except for those which are already running. It may be
+// called from a callback.
+func releaseCtxHandle(ctxHandle C.int) (err error) {
+	ctxMutex.Lock()
+	if ctxHandle < 0 || int(ctxHandle) >= len(ctxHandles) || ctxHandles[ctxHandle] == nil {
+		ctxMutex.Unlock()
+		return errInvalidHandle
+	}
+	listener := ctxHandles[ctxHandle].listener
+	ctxHandles[ctxHandle] = nil
+	freeCtxHandles = append(freeCtxHandles, int(ctxHandle))
+	ctxMutex.Unlock()
+
+	listener.release()
+	return nil
+}
+
 //export SessionStart
 func SessionStart(serverProtocolHost *C.char, sessionId *C.char, browserURL *C.char, pullMode C.int,
 	isVideoPassthru C.int, browserUIOutputURL *C.char, videoStreamURL *C.char, width C.int, height C.int,
 	cb *C.appflinger_callbacks_t) C.int {
 	listener := NewAppflingerListener(cb)
-	var ctx *appflinger.SessionContext
-	ctx, err = appflinger.SessionStart(C.GoString(serverProtocolHost), C.GoString(sessionId),
-		C.GoString(browserURL), GoBool(pullMode), GoBool(isVideoPassthru),
-		C.GoString(browserUIOutputURL), C.GoString(videoStreamURL), int(width), int(height), listener)
+	ctx, err := appflinger.SessionStartWithOptions(&appflinger.SessionOptions{
+		ServerProtocolHost: C.GoString(serverProtocolHost),
+		SessionId:          C.GoString(sessionId),
+		BrowserURL:         C.GoString(browserURL),
+		PullMode:           GoBool(pullMode),
+		VideoPassthru:      GoBool(isVideoPassthru),
+		BrowserUIOutputURL: C.GoString(browserUIOutputURL),
+		VideoStreamURL:     C.GoString(videoStreamURL),
+		Width:              int(width),
+		Height:             int(height),
+	}, listener)
 	if err != nil {
-		log.Println(err)
-		return -1
+		return setErr(err)
 	}
-	ctxHandles = append(ctxHandles, ctx)
-	return C.int(len(ctxHandles) - 1)
+	return addCtxHandle(ctx, listener)
+}
+
+// SessionStop stops the session and releases its handle, which must not be used afterwards.
+//
+//export SessionStop
+func SessionStop(ctxHandle C.int) C.int {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	err = appflinger.SessionStop(ctx)
+	releaseCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	return C.APPFLINGER_OK
+}
+
+// SessionRelease releases the handle of a session without stopping it, e.g. after the session was terminated
+// by the server. The handle must not be used afterwards.
+//
+//export SessionRelease
+func SessionRelease(ctxHandle C.int) C.int {
+	err := releaseCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	return C.APPFLINGER_OK
 }
 
 //export SessionUIStreamStart
 func SessionUIStreamStart(ctxHandle C.int, format *C.char, tsDiscon C.int, bitrate C.int) C.int {
-	err = appflinger.SessionUIStreamStart(ctxHandles[ctxHandle], C.GoString(format),
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	err = appflinger.SessionUIStreamStart(ctx, C.GoString(format),
 		GoBool(tsDiscon), int(bitrate))
 	if err != nil {
-		log.Println(err)
-		return -1
+		return setErr(err)
 	}
-	return 0
+	return C.APPFLINGER_OK
+}
+
+//export SessionUIStreamStop
+func SessionUIStreamStop(ctxHandle C.int) C.int {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	err = appflinger.SessionUIStreamStop(ctx)
+	if err != nil {
+		return setErr(err)
+	}
+	return C.APPFLINGER_OK
+}
+
+// SessionSetFrameOptions sets how UI frames are passed to on_ui_frame_cb, see appflinger_frame_flags_t.
+// It is meant to be called before the UI streaming is started, frames which are queued for delivery when it is called are delivered first.
+//
+//export SessionSetFrameOptions
+func SessionSetFrameOptions(ctxHandle C.int, flags C.int) C.int {
+	listener, err := getCtxListener(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	listener.setFrameOptions(int(flags))
+	return C.APPFLINGER_OK
+}
+
+// SessionSetUIBitstreamFormat sets the bitstream format of the frames passed to on_ui_frame_cb, see appflinger_bitstream_format_t.
+// It takes effect on the next SessionUIStreamStart().
+//
+//export SessionSetUIBitstreamFormat
+func SessionSetUIBitstreamFormat(ctxHandle C.int, format C.int) C.int {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	err = appflinger.SessionSetUIBitstreamFormat(ctx, int(format))
+	if err != nil {
+		return setErr(err)
+	}
+	return C.APPFLINGER_OK
 }
 
 //export SessionGetSessionId
 func SessionGetSessionId(ctxHandle C.int) *C.char {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		setErr(err)
+		return nil
+	}
 	var sessionId string
-	sessionId, err = appflinger.SessionGetSessionId(ctxHandles[ctxHandle])
+	sessionId, err = appflinger.SessionGetSessionId(ctx)
 	if err != nil {
-		log.Println(err)
+		setErr(err)
 		return nil
 	}
 
@@ -69,58 +224,160 @@ func SessionGetSessionId(ctxHandle C.int) *C.char {
 
 //export SessionGetSessionContext
 func SessionGetSessionContext(sessionId *C.char) C.int {
-	var ctx *appflinger.SessionContext
-	ctx, err = appflinger.SessionGetSessionContext(C.GoString(sessionId))
+	ctx, err := appflinger.SessionGetSessionContext(C.GoString(sessionId))
 	if err != nil {
-		log.Println(err)
-		return -1
+		return setErr(err)
 	}
+	ctxMutex.Lock()
+	defer ctxMutex.Unlock()
 	for idx, val := range ctxHandles {
-		if val == ctx {
+		if val != nil && val.ctx == ctx {
 			return C.int(idx)
 		}
 	}
-	return -1
+	return setErr(errInvalidHandle)
 }
 
 //export SessionGetUIURL
 func SessionGetUIURL(ctxHandle C.int, format *C.char, tsDiscon C.int, bitrate C.int) *C.char {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		setErr(err)
+		return nil
+	}
 	var uri string
-	uri, err = appflinger.SessionGetUIURL(ctxHandles[ctxHandle], C.GoString(format), GoBool(tsDiscon), int(bitrate))
+	uri, err = appflinger.SessionGetUIURL(ctx, C.GoString(format), GoBool(tsDiscon), int(bitrate))
 	if err != nil {
-		log.Println(err)
+		setErr(err)
 		return nil
 	}
 
 	return C.CString(uri) // Needs to be freed by caller
 }
 
+// SessionGetURLCookies returns the cookies which need to be sent when fetching the given URL (e.g. the UI URL),
+// formatted as the value of a Cookie header.
+//
+//export SessionGetURLCookies
+func SessionGetURLCookies(ctxHandle C.int, uri *C.char) *C.char {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		setErr(err)
+		return nil
+	}
+	var cookies []*http.Cookie
+	cookies, err = appflinger.SessionGetURLCookies(ctx, C.GoString(uri))
+	if err != nil {
+		setErr(err)
+		return nil
+	}
+
+	values := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		values[i] = cookie.Name + "=" + cookie.Value
+	}
+	return C.CString(strings.Join(values, "; ")) // Needs to be freed by caller
+}
+
 //export SessionSendEvent
 func SessionSendEvent(ctxHandle C.int, eventType *C.char, code C.int, ch C.int, mod C.int, x C.int, y C.int) C.int {
-	err = appflinger.SessionSendEvent(ctxHandles[ctxHandle], C.GoString(eventType), int(code), rune(ch), int(mod), int(x), int(y))
+	ctx, err := getCtxHandle(ctxHandle)
 	if err != nil {
-		log.Println(err)
-		return -1
+		return setErr(err)
 	}
-	return 0
+	err = appflinger.SessionSendEvent(ctx, C.GoString(eventType), int(code), rune(ch), int(mod), int(x), int(y))
+	if err != nil {
+		return setErr(err)
+	}
+	return C.APPFLINGER_OK
 }
 
 //export SessionSendNotificationVideoStateChange
 func SessionSendNotificationVideoStateChange(ctxHandle C.int, instanceId *C.char, readyState C.int,
 	networkState C.int, paused C.int, seeking C.int, duration C.double, time C.double, videoWidth C.int, videoHeight C.int) C.int {
-	err = appflinger.SessionSendNotificationVideoStateChange(ctxHandles[ctxHandle], C.GoString(instanceId),
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	err = appflinger.SessionSendNotificationVideoStateChange(ctx, C.GoString(instanceId),
 		int(readyState), int(networkState), GoBool(paused), GoBool(seeking), float64(duration), float64(time),
 		int(videoWidth), int(videoHeight))
 	if err != nil {
-		log.Println(err)
-		return -1
+		return setErr(err)
 	}
-	return 0
+	return C.APPFLINGER_OK
+}
+
+// SessionSendNotification sends an arbitrary notification (a JSON payload) to the server on behalf of the given media instance.
+//
+//export SessionSendNotification
+func SessionSendNotification(ctxHandle C.int, instanceId *C.char, payload unsafe.Pointer, payloadLen C.uint) C.int {
+	ctx, err := getCtxHandle(ctxHandle)
+	if err != nil {
+		return setErr(err)
+	}
+	err = appflinger.SessionSendNotification(ctx, C.GoString(instanceId), C.GoBytes(payload, C.int(payloadLen)))
+	if err != nil {
+		return setErr(err)
+	}
+	return C.APPFLINGER_OK
 }
 
+// setErr records the error as the last error of the calling thread and returns its code, see appflinger_err_t.
+func setErr(err error) C.int {
+	log.Println(err)
+	var code C.int
+	switch {
+	case err == errInvalidHandle:
+		code = C.APPFLINGER_ERR_INVALID_HANDLE
+	case errors.Is(err, appflinger.ErrInvalidArgument):
+		code = C.APPFLINGER_ERR_INVALID_ARGUMENT
+	case errors.Is(err, appflinger.ErrInvalidState):
+		code = C.APPFLINGER_ERR_INVALID_STATE
+	case errors.Is(err, appflinger.ErrNetwork):
+		code = C.APPFLINGER_ERR_NETWORK
+	case errors.Is(err, appflinger.ErrServer):
+		code = C.APPFLINGER_ERR_SERVER
+	case errors.Is(err, appflinger.ErrSessionNotFound):
+		code = C.APPFLINGER_ERR_SESSION_NOT_FOUND
+	case errors.Is(err, appflinger.ErrInputChannelNotSupported), errors.Is(err, appflinger.ErrTabsNotSupported):
+		code = C.APPFLINGER_ERR_NOT_SUPPORTED
+	case errors.Is(err, appflinger.ErrInterrupted):
+		code = C.APPFLINGER_ERR_INTERRUPTED
+	default:
+		code = C.APPFLINGER_ERR_GENERIC
+	}
+
+	// Exported functions run on the thread of the C caller so the error is stored in its thread local state
+	cMsg := C.CString(err.Error())
+	C.appflinger_set_last_error(code, cMsg)
+	C.free(unsafe.Pointer(cMsg))
+	return code
+}
+
+// GetErrCode returns the code of the last error of the calling thread, APPFLINGER_OK if none.
+//
+//export GetErrCode
+func GetErrCode() C.int {
+	return C.appflinger_get_last_error_code()
+}
+
+// GetErr returns the message of the last error of the calling thread, NULL if none. The message needs to be freed using FreeErr().
+//
 //export GetErr
 func GetErr() *C.char {
-	return C.CString(err.Error())
+	msg := C.appflinger_get_last_error_msg()
+	if msg == nil {
+		return nil
+	}
+	return C.CString(C.GoString(msg))
+}
+
+// FreeErr frees a message returned by GetErr().
+//
+//export FreeErr
+func FreeErr(msg *C.char) {
+	C.free(unsafe.Pointer(msg))
 }
 
 func main() {}
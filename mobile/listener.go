@@ -0,0 +1,301 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package mobile
+
+import (
+	"github.com/tversity/appflinger-go"
+)
+
+// Listener is the gomobile compatible counterpart of appflinger.AppflingerListener, implemented in Java/Kotlin or Objective-C/Swift.
+// Results which consist of more than one value are returned through result objects.
+type Listener interface {
+
+	// Control Channel functions - media related
+
+	Load(sessionId string, instanceId string, url string) error
+	CancelLoad(sessionId string, instanceId string) error
+	Pause(sessionId string, instanceId string) error
+	Play(sessionId string, instanceId string) error
+	Seek(sessionId string, instanceId string, time float64) error
+	GetPaused(sessionId string, instanceId string) (bool, error)
+	GetSeeking(sessionId string, instanceId string) (bool, error)
+	GetDuration(sessionId string, instanceId string) (float64, error)
+	GetCurrentTime(sessionId string, instanceId string) (float64, error)
+	GetNetworkState(sessionId string, instanceId string) (int, error)
+	GetReadyState(sessionId string, instanceId string) (int, error)
+	GetSeekable(sessionId string, instanceId string, result *TimeRanges) error
+	GetBuffered(sessionId string, instanceId string, result *TimeRanges) error
+	SetRect(sessionId string, instanceId string, x int, y int, width int, height int) error
+	SetVisible(sessionId string, instanceId string, visible bool) error
+	SetRate(sessionId string, instanceId string, rate float64) error
+	SetVolume(sessionId string, instanceId string, volume float64) error
+
+	// Control Channel functions - MSE related
+
+	AddSourceBuffer(sessionId string, instanceId string, sourceId string, mimeType string) error
+	RemoveSourceBuffer(sessionId string, instanceId string, sourceId string) error
+	AbortSourceBuffer(sessionId string, instanceId string, sourceId string) error
+	AppendBuffer(sessionId string, instanceId string, sourceId string, appendWindowStart float64, appendWindowEnd float64, bufferId string,
+		bufferOffset int, bufferLength int, payload []byte, result *TimeRanges) error
+	SetAppendMode(sessionId string, instanceId string, sourceId string, mode int) error
+	SetAppendTimestampOffset(sessionId string, instanceId string, sourceId string, timestampOffset float64) error
+	RemoveBufferRange(sessionId string, instanceId string, sourceId string, start float64, end float64) error
+	ChangeSourceBufferType(sessionId string, instanceId string, sourceId string, mimeType string) error
+
+	// Control Channel functions - client side XHR
+
+	LoadResource(sessionId string, url string, method string, headers string, resourceId string, byteRangeStart int, byteRangeEnd int,
+		sequenceNumber int, payload []byte, result *LoadResourceResult) error
+	DeleteResource(sessionId string, bufferId string) error
+
+	// Control Channel functions - EME related, see appflinger.AppflingerListener
+
+	RequestKeySystem(sessionId string, keySystem string, supportedConfigurations *KeySystemConfigurationList, result *KeySystemConfiguration) error
+	CdmCreate(sessionId string, keySystem string, securityOrigin string, allowDistinctiveIdentifier bool, allowPersistentState bool) (string, error)
+	CdmSetServerCertificate(sessionId string, cdmId string, payload []byte) error
+	CdmSessionCreate(sessionId string, eventInstanceId string, cdmId string, sessionType string, initDataType string, payload []byte) (*CdmSessionResult, error)
+	CdmSessionUpdate(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string, payload []byte) error
+	CdmSessionLoad(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (*CdmSessionLoadResult, error)
+	CdmSessionRemove(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) error
+	CdmSessionClose(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) error
+	SetCdm(sessionId string, instanceId string, cdmId string) error
+
+	// Control Channel functions - General
+
+	SendMessage(sessionId string, message string) (string, error)
+	OnPageLoad(sessionId string) error
+	OnAddressBarChanged(sessionId string, url string) error
+	OnTitleChanged(sessionId string, title string) error
+	OnPageClose(sessionId string) error
+
+	// UI frames, data is only valid for the duration of the call, timestamps are in appflinger.UI_TIMESCALE units
+
+	OnUIFrame(sessionId string, isCodecConfig bool, isKeyFrame bool, idx int, pts int64, dts int64, data []byte) error
+
+	// Called before the first frame following a discontinuity of the UI stream, see appflinger.UIDiscontinuityListener
+	OnUIDiscontinuity(sessionId string) error
+}
+
+// listenerAdapter implements appflinger.AppflingerListener on top of a Listener.
+type listenerAdapter struct {
+	listener Listener
+}
+
+func (self *listenerAdapter) Load(sessionId string, instanceId string, url string) (err error) {
+	return self.listener.Load(sessionId, instanceId, url)
+}
+
+func (self *listenerAdapter) CancelLoad(sessionId string, instanceId string) (err error) {
+	return self.listener.CancelLoad(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) Pause(sessionId string, instanceId string) (err error) {
+	return self.listener.Pause(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) Play(sessionId string, instanceId string) (err error) {
+	return self.listener.Play(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) Seek(sessionId string, instanceId string, time float64) (err error) {
+	return self.listener.Seek(sessionId, instanceId, time)
+}
+
+func (self *listenerAdapter) GetPaused(sessionId string, instanceId string) (paused bool, err error) {
+	return self.listener.GetPaused(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) GetSeeking(sessionId string, instanceId string) (seeking bool, err error) {
+	return self.listener.GetSeeking(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) GetDuration(sessionId string, instanceId string) (duration float64, err error) {
+	return self.listener.GetDuration(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) GetCurrentTime(sessionId string, instanceId string) (time float64, err error) {
+	return self.listener.GetCurrentTime(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) GetNetworkState(sessionId string, instanceId string) (networkState int, err error) {
+	return self.listener.GetNetworkState(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) GetReadyState(sessionId string, instanceId string) (readyState int, err error) {
+	return self.listener.GetReadyState(sessionId, instanceId)
+}
+
+func (self *listenerAdapter) GetSeekable(sessionId string, instanceId string, result *appflinger.GetSeekableResult) (err error) {
+	ranges := NewTimeRanges()
+	err = self.listener.GetSeekable(sessionId, instanceId, ranges)
+	result.Start, result.End = ranges.start, ranges.end
+	return
+}
+
+func (self *listenerAdapter) GetBuffered(sessionId string, instanceId string, result *appflinger.GetBufferedResult) (err error) {
+	ranges := NewTimeRanges()
+	err = self.listener.GetBuffered(sessionId, instanceId, ranges)
+	result.Start, result.End = ranges.start, ranges.end
+	return
+}
+
+func (self *listenerAdapter) SetRect(sessionId string, instanceId string, x int, y int, width int, height int) (err error) {
+	return self.listener.SetRect(sessionId, instanceId, x, y, width, height)
+}
+
+func (self *listenerAdapter) SetVisible(sessionId string, instanceId string, visible bool) (err error) {
+	return self.listener.SetVisible(sessionId, instanceId, visible)
+}
+
+func (self *listenerAdapter) SetRate(sessionId string, instanceId string, rate float64) (err error) {
+	return self.listener.SetRate(sessionId, instanceId, rate)
+}
+
+func (self *listenerAdapter) SetVolume(sessionId string, instanceId string, volume float64) (err error) {
+	return self.listener.SetVolume(sessionId, instanceId, volume)
+}
+
+func (self *listenerAdapter) AddSourceBuffer(sessionId string, instanceId string, sourceId string, mimeType string) (err error) {
+	return self.listener.AddSourceBuffer(sessionId, instanceId, sourceId, mimeType)
+}
+
+func (self *listenerAdapter) RemoveSourceBuffer(sessionId string, instanceId string, sourceId string) (err error) {
+	return self.listener.RemoveSourceBuffer(sessionId, instanceId, sourceId)
+}
+
+func (self *listenerAdapter) AbortSourceBuffer(sessionId string, instanceId string, sourceId string) (err error) {
+	return self.listener.AbortSourceBuffer(sessionId, instanceId, sourceId)
+}
+
+func (self *listenerAdapter) AppendBuffer(sessionId string, instanceId string, sourceId string, appendWindowStart float64, appendWindowEnd float64,
+	bufferId string, bufferOffset int, bufferLength int, payload []byte, result *appflinger.GetBufferedResult) (err error) {
+	ranges := NewTimeRanges()
+	err = self.listener.AppendBuffer(sessionId, instanceId, sourceId, appendWindowStart, appendWindowEnd, bufferId, bufferOffset, bufferLength,
+		payload, ranges)
+	result.Start, result.End = ranges.start, ranges.end
+	return
+}
+
+func (self *listenerAdapter) SetAppendMode(sessionId string, instanceId string, sourceId string, mode int) (err error) {
+	return self.listener.SetAppendMode(sessionId, instanceId, sourceId, mode)
+}
+
+func (self *listenerAdapter) SetAppendTimestampOffset(sessionId string, instanceId string, sourceId string, timestampOffset float64) (err error) {
+	return self.listener.SetAppendTimestampOffset(sessionId, instanceId, sourceId, timestampOffset)
+}
+
+func (self *listenerAdapter) RemoveBufferRange(sessionId string, instanceId string, sourceId string, start float64, end float64) (err error) {
+	return self.listener.RemoveBufferRange(sessionId, instanceId, sourceId, start, end)
+}
+
+func (self *listenerAdapter) ChangeSourceBufferType(sessionId string, instanceId string, sourceId string, mimeType string) (err error) {
+	return self.listener.ChangeSourceBufferType(sessionId, instanceId, sourceId, mimeType)
+}
+
+func (self *listenerAdapter) LoadResource(sessionId string, url string, method string, headers string, resourceId string,
+	byteRangeStart int, byteRangeEnd int, sequenceNumber int, payload []byte, result *appflinger.LoadResourceResult) (err error) {
+	res := &LoadResourceResult{}
+	err = self.listener.LoadResource(sessionId, url, method, headers, resourceId, byteRangeStart, byteRangeEnd, sequenceNumber, payload, res)
+	result.Code = res.Code
+	result.Headers = res.Headers
+	result.BufferId = res.BufferId
+	result.BufferLength = res.BufferLength
+	result.Payload = res.Payload
+	return
+}
+
+func (self *listenerAdapter) DeleteResource(sessionId string, BufferId string) (err error) {
+	return self.listener.DeleteResource(sessionId, BufferId)
+}
+
+func (self *listenerAdapter) RequestKeySystem(sessionId string, keySystem string, supportedConfigurations []appflinger.EMEMediaKeySystemConfiguration,
+	result *appflinger.RequestKeySystemResult) (err error) {
+	configs := NewKeySystemConfigurationList()
+	for i := range supportedConfigurations {
+		configs.Add(newKeySystemConfiguration(&supportedConfigurations[i]))
+	}
+	res := NewKeySystemConfiguration()
+	err = self.listener.RequestKeySystem(sessionId, keySystem, configs, res)
+	if err != nil {
+		return
+	}
+	res.copyTo(result)
+	return
+}
+
+func (self *listenerAdapter) CdmCreate(sessionId string, keySystem string, securityOrigin string, allowDistinctiveIdentifier bool,
+	allowPersistentState bool) (cdmId string, err error) {
+	return self.listener.CdmCreate(sessionId, keySystem, securityOrigin, allowDistinctiveIdentifier, allowPersistentState)
+}
+
+func (self *listenerAdapter) CdmSetServerCertificate(sessionId string, cdmId string, payload []byte) (err error) {
+	return self.listener.CdmSetServerCertificate(sessionId, cdmId, payload)
+}
+
+func (self *listenerAdapter) CdmSessionCreate(sessionId string, eventInstanceId string, cdmId string, sessionType string, initDataType string,
+	payload []byte) (cdmSessionId string, expiration float64, err error) {
+	res, err := self.listener.CdmSessionCreate(sessionId, eventInstanceId, cdmId, sessionType, initDataType, payload)
+	if err != nil || res == nil {
+		return
+	}
+	return res.CdmSessionId, res.Expiration, nil
+}
+
+func (self *listenerAdapter) CdmSessionUpdate(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string, payload []byte) (err error) {
+	return self.listener.CdmSessionUpdate(sessionId, eventInstanceId, cdmId, cdmSessionId, payload)
+}
+
+func (self *listenerAdapter) CdmSessionLoad(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (loaded bool,
+	expiration float64, err error) {
+	res, err := self.listener.CdmSessionLoad(sessionId, eventInstanceId, cdmId, cdmSessionId)
+	if err != nil || res == nil {
+		return
+	}
+	return res.Loaded, res.Expiration, nil
+}
+
+func (self *listenerAdapter) CdmSessionRemove(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (err error) {
+	return self.listener.CdmSessionRemove(sessionId, eventInstanceId, cdmId, cdmSessionId)
+}
+
+func (self *listenerAdapter) CdmSessionClose(sessionId string, eventInstanceId string, cdmId string, cdmSessionId string) (err error) {
+	return self.listener.CdmSessionClose(sessionId, eventInstanceId, cdmId, cdmSessionId)
+}
+
+func (self *listenerAdapter) SetCdm(sessionId string, instanceId string, cdmId string) (err error) {
+	return self.listener.SetCdm(sessionId, instanceId, cdmId)
+}
+
+func (self *listenerAdapter) SendMessage(sessionId string, message string) (result string, err error) {
+	return self.listener.SendMessage(sessionId, message)
+}
+
+func (self *listenerAdapter) OnPageLoad(sessionId string) (err error) {
+	return self.listener.OnPageLoad(sessionId)
+}
+
+func (self *listenerAdapter) OnAddressBarChanged(sessionId string, url string) (err error) {
+	return self.listener.OnAddressBarChanged(sessionId, url)
+}
+
+func (self *listenerAdapter) OnTitleChanged(sessionId string, title string) (err error) {
+	return self.listener.OnTitleChanged(sessionId, title)
+}
+
+func (self *listenerAdapter) OnPageClose(sessionId string) (err error) {
+	return self.listener.OnPageClose(sessionId)
+}
+
+func (self *listenerAdapter) OnUIFrame(sessionId string, isCodecConfig bool, isKeyFrame bool, idx int, pts int, dts int, data []byte) (err error) {
+	return self.listener.OnUIFrame(sessionId, isCodecConfig, isKeyFrame, idx, int64(pts), int64(dts), data)
+}
+
+func (self *listenerAdapter) OnUIFrameData(sessionId string, frame *appflinger.UIFrame) (err error) {
+	return self.listener.OnUIFrame(sessionId, frame.IsCodecConfig, frame.IsKeyFrame, frame.Idx, frame.PTS, frame.DTS, frame.Data)
+}
+
+func (self *listenerAdapter) OnUIDiscontinuity(sessionId string) (err error) {
+	return self.listener.OnUIDiscontinuity(sessionId)
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package mobile is a binding layer of the SDK for Android and iOS clients.
+//
+// Its exported API only uses types which gomobile can bind (no slices other than []byte and no functions with
+// more than one result besides an error), so that the following produce a usable AAR and XCFramework:
+//
+//	gomobile bind -target=android github.com/tversity/appflinger-go/mobile
+//	gomobile bind -target=ios github.com/tversity/appflinger-go/mobile
+//
+// The client implements the Listener interface and starts a session using StartSession().
+package mobile
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tversity/appflinger-go"
+)
+
+const (
+	// Media formats supported for UI stream
+	UI_FMT_TS_H264 = appflinger.UI_FMT_TS_H264
+	UI_FMT_TS_HEVC = appflinger.UI_FMT_TS_HEVC
+
+	// Bitstream formats of the UI frames (see SetUIBitstreamFormat())
+	UI_BITSTREAM_ANNEXB = appflinger.UI_BITSTREAM_ANNEXB
+	UI_BITSTREAM_AVCC   = appflinger.UI_BITSTREAM_AVCC
+
+	// Container formats of the UI recording (see UIRecordStart())
+	UI_RECORD_FMT_TS   = appflinger.UI_RECORD_FMT_TS
+	UI_RECORD_FMT_FMP4 = appflinger.UI_RECORD_FMT_FMP4
+
+	// Paths served by the UI proxy (see UIProxyStart())
+	UI_PROXY_PATH_TS       = appflinger.UI_PROXY_PATH_TS
+	UI_PROXY_PATH_HLS_TS   = appflinger.UI_PROXY_PATH_HLS_TS
+	UI_PROXY_PATH_HLS_FMP4 = appflinger.UI_PROXY_PATH_HLS_FMP4
+
+	// Network state constants (returned by GetNetworkState())
+	NETWORK_STATE_EMPTY         = appflinger.NETWORK_STATE_EMPTY
+	NETWORK_STATE_IDLE          = appflinger.NETWORK_STATE_IDLE
+	NETWORK_STATE_LOADING       = appflinger.NETWORK_STATE_LOADING
+	NETWORK_STATE_LOADED        = appflinger.NETWORK_STATE_LOADED
+	NETWORK_STATE_FORMAT_ERROR  = appflinger.NETWORK_STATE_FORMAT_ERROR
+	NETWORK_STATE_NETWORK_ERROR = appflinger.NETWORK_STATE_NETWORK_ERROR
+	NETWORK_STATE_DECODE_ERROR  = appflinger.NETWORK_STATE_DECODE_ERROR
+
+	// Ready state constants (returned by GetReadyState())
+	READY_STATE_HAVE_NOTHING      = appflinger.READY_STATE_HAVE_NOTHING
+	READY_STATE_HAVE_METADATA     = appflinger.READY_STATE_HAVE_METADATA
+	READY_STATE_HAVE_CURRENT_DATA = appflinger.READY_STATE_HAVE_CURRENT_DATA
+	READY_STATE_HAVE_FUTURE_DATA  = appflinger.READY_STATE_HAVE_FUTURE_DATA
+	READY_STATE_HAVE_ENOUGH_DATA  = appflinger.READY_STATE_HAVE_ENOUGH_DATA
+
+	// MSE AppendMode enum
+	MSE_APPEND_MODE_SEGMENTS = appflinger.MSE_APPEND_MODE_SEGMENTS
+	MSE_APPEND_MODE_SEQUENCE = appflinger.MSE_APPEND_MODE_SEQUENCE
+
+	// EME MediaKeysRequirement enum
+	EME_MEDIA_KEYS_REQUIRED    = appflinger.EME_MEDIA_KEYS_REQUIRED
+	EME_MEDIA_KEYS_OPTIONAL    = appflinger.EME_MEDIA_KEYS_OPTIONAL
+	EME_MEDIA_KEYS_NOT_ALLOWED = appflinger.EME_MEDIA_KEYS_NOT_ALLOWED
+
+	// EME MediaKeySessionType enum
+	EME_MEDIA_KEYS_SESSION_TEMPORARY          = appflinger.EME_MEDIA_KEYS_SESSION_TEMPORARY
+	EME_MEDIA_KEYS_SESSION_PERSISTENT_LICENSE = appflinger.EME_MEDIA_KEYS_SESSION_PERSISTENT_LICENSE
+
+	// Keyboard codes for injecting events
+	KEY_UP        = appflinger.KEY_UP
+	KEY_DOWN      = appflinger.KEY_DOWN
+	KEY_LEFT      = appflinger.KEY_LEFT
+	KEY_RIGHT     = appflinger.KEY_RIGHT
+	KEY_ENTER     = appflinger.KEY_ENTER
+	KEY_BACKSPACE = appflinger.KEY_BACKSPACE
+	KEY_ESCAPE    = appflinger.KEY_ESCAPE
+)
+
+// Session is a session of the AppFlinger server.
+type Session struct {
+	ctx *appflinger.SessionContext
+}
+
+// StartSession starts a session, see appflinger.SessionOptions for the arguments.
+func StartSession(serverProtocolHost string, sessionId string, browserURL string, pullMode bool, isVideoPassthru bool, browserUIOutputURL string,
+	videoStreamURL string, width int, height int, listener Listener) (*Session, error) {
+	ctx, err := appflinger.SessionStartWithOptions(&appflinger.SessionOptions{
+		ServerProtocolHost: serverProtocolHost,
+		SessionId:          sessionId,
+		BrowserURL:         browserURL,
+		PullMode:           pullMode,
+		VideoPassthru:      isVideoPassthru,
+		BrowserUIOutputURL: browserUIOutputURL,
+		VideoStreamURL:     videoStreamURL,
+		Width:              width,
+		Height:             height,
+	}, &listenerAdapter{listener: listener})
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ctx: ctx}, nil
+}
+
+// AttachSession re-attaches to a running session using a handle returned by GetHandle(), see appflinger.SessionAttach().
+func AttachSession(handle string, listener Listener) (*Session, error) {
+	h := &appflinger.SessionHandle{}
+	err := json.Unmarshal([]byte(handle), h)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err := appflinger.SessionAttach(h, &listenerAdapter{listener: listener})
+	if err != nil {
+		return nil, err
+	}
+	return &Session{ctx: ctx}, nil
+}
+
+// GetHandle returns the handle of the session as JSON, the application should store it in a private location.
+func (session *Session) GetHandle() (string, error) {
+	h, err := appflinger.SessionGetHandle(session.ctx)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(h)
+	return string(data), err
+}
+
+// Detach stops the session locally and keeps it running on the server, see AttachSession().
+func (session *Session) Detach() error {
+	return appflinger.SessionDetach(session.ctx)
+}
+
+// Stop stops the session, it can be called more than once.
+func (session *Session) Stop() error {
+	return appflinger.SessionStop(session.ctx)
+}
+
+// Wait blocks until the session ends and returns its terminal error, nil if it was stopped by Stop().
+func (session *Session) Wait() error {
+	return appflinger.SessionWait(session.ctx)
+}
+
+// GetSessionId returns the id of the session.
+func (session *Session) GetSessionId() string {
+	return session.ctx.SessionId
+}
+
+// UIStreamStart starts streaming the UI, frames are passed to OnUIFrame() of the listener.
+func (session *Session) UIStreamStart(format string, tsDiscon bool, bitrate int) error {
+	return appflinger.SessionUIStreamStart(session.ctx, format, tsDiscon, bitrate)
+}
+
+// UIStreamStartAdaptive starts streaming the UI with a bitrate adapted to the available bandwidth within the given range.
+func (session *Session) UIStreamStartAdaptive(format string, minBitrate int, maxBitrate int) error {
+	return appflinger.SessionUIStreamStartAdaptive(session.ctx, format, &appflinger.AdaptiveBitrateConfig{
+		MinBitrate: minBitrate,
+		MaxBitrate: maxBitrate,
+	})
+}
+
+// SetUIBitstreamFormat sets the bitstream format of the UI frames, it takes effect on the next UIStreamStart().
+func (session *Session) SetUIBitstreamFormat(format int) error {
+	return appflinger.SessionSetUIBitstreamFormat(session.ctx, format)
+}
+
+// UIStreamStop stops streaming the UI.
+func (session *Session) UIStreamStop() error {
+	return appflinger.SessionUIStreamStop(session.ctx)
+}
+
+// UIRecordStart starts recording the UI to the given file, with a new file every maxSegmentSeconds if not zero. In ring
+// buffer mode (ringSeconds not zero) only the files covering the last ringSeconds are kept, see UIRecordSave().
+func (session *Session) UIRecordStart(path string, format string, maxSegmentSeconds int, ringSeconds int) error {
+	_, err := appflinger.SessionUIRecordStart(session.ctx, &appflinger.UIRecorderConfig{
+		Format:             format,
+		Path:               path,
+		MaxSegmentDuration: time.Duration(maxSegmentSeconds) * time.Second,
+		RingDuration:       time.Duration(ringSeconds) * time.Second,
+	})
+	return err
+}
+
+// UIRecordSave saves the recording to a single file, e.g. the last ringSeconds in ring buffer mode.
+func (session *Session) UIRecordSave(path string) error {
+	return appflinger.SessionUIRecordSave(session.ctx, path)
+}
+
+// UIRecordStop stops recording the UI.
+func (session *Session) UIRecordStop() error {
+	return appflinger.SessionUIRecordStop(session.ctx)
+}
+
+// UIProxyStart serves the UI to local players over HTTP on the given address (a random loopback port if empty) and
+// returns the base URL of the proxy, to which the UI_PROXY_PATH_* paths are appended.
+func (session *Session) UIProxyStart(addr string) (string, error) {
+	proxy, err := appflinger.SessionUIProxyStart(session.ctx, &appflinger.UIProxyConfig{Addr: addr})
+	if err != nil {
+		return "", err
+	}
+	return proxy.URL(), nil
+}
+
+// UIProxyStop stops serving the UI to local players.
+func (session *Session) UIProxyStop() error {
+	return appflinger.SessionUIProxyStop(session.ctx)
+}
+
+// Navigate navigates the active tab of the session to the given address.
+func (session *Session) Navigate(browserURL string) error {
+	return appflinger.SessionNavigate(session.ctx, browserURL)
+}
+
+// Back navigates the active tab to the previous entry of its history.
+func (session *Session) Back() error {
+	return appflinger.SessionBack(session.ctx)
+}
+
+// Forward navigates the active tab to the next entry of its history.
+func (session *Session) Forward() error {
+	return appflinger.SessionForward(session.ctx)
+}
+
+// Reload reloads the page of the active tab.
+func (session *Session) Reload() error {
+	return appflinger.SessionReload(session.ctx)
+}
+
+// GetUIURL returns the URL from which the UI can be streamed by the platform player, see GetURLCookies().
+func (session *Session) GetUIURL(format string, tsDiscon bool, bitrate int) (string, error) {
+	return appflinger.SessionGetUIURL(session.ctx, format, tsDiscon, bitrate)
+}
+
+// GetURLCookies returns the value of the Cookie header which needs to be sent when fetching the given URL.
+func (session *Session) GetURLCookies(uri string) (string, error) {
+	cookies, err := appflinger.SessionGetURLCookies(session.ctx, uri)
+	if err != nil {
+		return "", err
+	}
+	values := make([]string, len(cookies))
+	for i, cookie := range cookies {
+		values[i] = (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String()
+	}
+	return strings.Join(values, "; "), nil
+}
+
+// SendEvent injects a key or click event, see appflinger.SessionSendEvent().
+func (session *Session) SendEvent(eventType string, code int, char int32, mod int, x int, y int) error {
+	return appflinger.SessionSendEvent(session.ctx, eventType, code, rune(char), mod, x, y)
+}
+
+// SendText injects a string as text input.
+func (session *Session) SendText(text string) error {
+	return appflinger.SessionSendText(session.ctx, text)
+}
+
+// SendNotification sends a notification (a JSON payload) on behalf of the given media instance.
+func (session *Session) SendNotification(instanceId string, payload []byte) error {
+	return appflinger.SessionSendNotification(session.ctx, instanceId, payload)
+}
+
+// SendNotificationVideoStateChange notifies the server of a change in the state of the given media instance.
+func (session *Session) SendNotificationVideoStateChange(instanceId string, readyState int, networkState int, paused bool, seeking bool,
+	duration float64, time float64, videoWidth int, videoHeight int) error {
+	return appflinger.SessionSendNotificationVideoStateChange(session.ctx, instanceId, readyState, networkState, paused, seeking, duration, time,
+		videoWidth, videoHeight)
+}
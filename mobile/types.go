@@ -0,0 +1,209 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package mobile
+
+import (
+	"github.com/tversity/appflinger-go"
+)
+
+// Since gomobile cannot generate bindings to slices (other than []byte), lists are wrapped by types
+// with Length(), Get() and Add() methods.
+
+// StringList is a list of strings.
+type StringList struct {
+	items []string
+}
+
+func NewStringList() *StringList {
+	return &StringList{}
+}
+
+func (list *StringList) Length() int {
+	return len(list.items)
+}
+
+func (list *StringList) Get(index int) string {
+	return list.items[index]
+}
+
+func (list *StringList) Add(item string) {
+	list.items = append(list.items, item)
+}
+
+// TimeRanges is a list of time ranges, returned by GetSeekable(), GetBuffered() and AppendBuffer().
+type TimeRanges struct {
+	start []float64
+	end   []float64
+}
+
+func NewTimeRanges() *TimeRanges {
+	return &TimeRanges{}
+}
+
+func (ranges *TimeRanges) Length() int {
+	return len(ranges.start)
+}
+
+func (ranges *TimeRanges) GetStart(index int) float64 {
+	return ranges.start[index]
+}
+
+func (ranges *TimeRanges) GetEnd(index int) float64 {
+	return ranges.end[index]
+}
+
+func (ranges *TimeRanges) Add(start float64, end float64) {
+	ranges.start = append(ranges.start, start)
+	ranges.end = append(ranges.end, end)
+}
+
+// Clear removes all the ranges.
+func (ranges *TimeRanges) Clear() {
+	ranges.start = nil
+	ranges.end = nil
+}
+
+// MediaCapability is MediaKeySystemMediaCapability as per EME spec
+type MediaCapability struct {
+	ContentType string
+	Robustness  string
+}
+
+// MediaCapabilityList is a list of media capabilities.
+type MediaCapabilityList struct {
+	items []*MediaCapability
+}
+
+func NewMediaCapabilityList() *MediaCapabilityList {
+	return &MediaCapabilityList{}
+}
+
+func (list *MediaCapabilityList) Length() int {
+	return len(list.items)
+}
+
+func (list *MediaCapabilityList) Get(index int) *MediaCapability {
+	return list.items[index]
+}
+
+func (list *MediaCapabilityList) Add(item *MediaCapability) {
+	list.items = append(list.items, item)
+}
+
+// KeySystemConfiguration is MediaKeySystemConfiguration as per EME spec
+type KeySystemConfiguration struct {
+	Label                 string
+	InitDataTypes         *StringList
+	AudioCapabilities     *MediaCapabilityList
+	VideoCapabilities     *MediaCapabilityList
+	DistinctiveIdentifier string      // One of EME_MEDIA_KEYS_REQUIRED, EME_MEDIA_KEYS_OPTIONAL, EME_MEDIA_KEYS_NOT_ALLOWED
+	PersistentState       string      // One of EME_MEDIA_KEYS_REQUIRED, EME_MEDIA_KEYS_OPTIONAL, EME_MEDIA_KEYS_NOT_ALLOWED
+	SessionTypes          *StringList // Values are one of EME_MEDIA_KEYS_SESSION_TEMPORARY, EME_MEDIA_KEYS_SESSION_PERSISTENT_LICENSE
+}
+
+func NewKeySystemConfiguration() *KeySystemConfiguration {
+	return &KeySystemConfiguration{
+		InitDataTypes:     NewStringList(),
+		AudioCapabilities: NewMediaCapabilityList(),
+		VideoCapabilities: NewMediaCapabilityList(),
+		SessionTypes:      NewStringList(),
+	}
+}
+
+// KeySystemConfigurationList is a list of key system configurations.
+type KeySystemConfigurationList struct {
+	items []*KeySystemConfiguration
+}
+
+func NewKeySystemConfigurationList() *KeySystemConfigurationList {
+	return &KeySystemConfigurationList{}
+}
+
+func (list *KeySystemConfigurationList) Length() int {
+	return len(list.items)
+}
+
+func (list *KeySystemConfigurationList) Get(index int) *KeySystemConfiguration {
+	return list.items[index]
+}
+
+func (list *KeySystemConfigurationList) Add(item *KeySystemConfiguration) {
+	list.items = append(list.items, item)
+}
+
+// LoadResourceResult is the result of LoadResource() in the Listener interface
+type LoadResourceResult struct {
+	Code         string
+	Headers      string
+	BufferId     string
+	BufferLength int
+	Payload      []byte
+}
+
+// CdmSessionResult is the result of CdmSessionCreate() in the Listener interface
+type CdmSessionResult struct {
+	CdmSessionId string
+	Expiration   float64
+}
+
+// CdmSessionLoadResult is the result of CdmSessionLoad() in the Listener interface
+type CdmSessionLoadResult struct {
+	Loaded     bool
+	Expiration float64
+}
+
+// Conversions to and from the types of the SDK
+
+func newStringList(items []string) *StringList {
+	return &StringList{items: append([]string(nil), items...)}
+}
+
+func (list *StringList) slice() []string {
+	if list == nil {
+		return nil
+	}
+	return append([]string(nil), list.items...)
+}
+
+func newMediaCapabilityList(items []appflinger.EMEMediaKeySystemMediaCapability) *MediaCapabilityList {
+	list := NewMediaCapabilityList()
+	for _, item := range items {
+		list.Add(&MediaCapability{ContentType: item.ContentType, Robustness: item.Robustness})
+	}
+	return list
+}
+
+func (list *MediaCapabilityList) slice() []appflinger.EMEMediaKeySystemMediaCapability {
+	if list == nil {
+		return nil
+	}
+	items := make([]appflinger.EMEMediaKeySystemMediaCapability, 0, len(list.items))
+	for _, item := range list.items {
+		items = append(items, appflinger.EMEMediaKeySystemMediaCapability{ContentType: item.ContentType, Robustness: item.Robustness})
+	}
+	return items
+}
+
+func newKeySystemConfiguration(config *appflinger.EMEMediaKeySystemConfiguration) *KeySystemConfiguration {
+	return &KeySystemConfiguration{
+		Label:                 config.Label,
+		InitDataTypes:         newStringList(config.InitDataTypes),
+		AudioCapabilities:     newMediaCapabilityList(config.AudioCapabilities),
+		VideoCapabilities:     newMediaCapabilityList(config.VideoCapabilities),
+		DistinctiveIdentifier: config.DistinctiveIdentifier,
+		PersistentState:       config.PersistentState,
+		SessionTypes:          newStringList(config.SessionTypes),
+	}
+}
+
+func (config *KeySystemConfiguration) copyTo(result *appflinger.RequestKeySystemResult) {
+	result.Label = config.Label
+	result.InitDataTypes = config.InitDataTypes.slice()
+	result.AudioCapabilities = config.AudioCapabilities.slice()
+	result.VideoCapabilities = config.VideoCapabilities.slice()
+	result.DistinctiveIdentifier = config.DistinctiveIdentifier
+	result.PersistentState = config.PersistentState
+	result.SessionTypes = config.SessionTypes.slice()
+}
@@ -0,0 +1,321 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// ErrTabsNotSupported is returned by the tab functions when the server does not support multiple tabs.
+var ErrTabsNotSupported = errors.New("Tabs are not supported by the server")
+
+const (
+	// The history of a tab keeps at most this number of entries, the oldest ones are dropped
+	_HISTORY_MAX_ENTRIES = 100
+
+	// The id of the tab in which the session was started
+	_INITIAL_TAB_ID = ""
+
+	// Actions of the /osb/session/tab API. It is only used with servers which report the Tabs capability, the
+	// request is GET /osb/session/tab?session_id=<id>&action=<action> with the following additional parameters:
+	//  - open: browser_url, the address of the new tab, returns {"TabId": "<id>"}
+	//  - switch, close: tab_id, returns {}
+	//  - list: returns {"Tabs": [{"TabId": "<id>", "URL": "<url>", "Title": "<title>", "Active": true}, ...]}
+	_TAB_ACTION_OPEN   = "open"
+	_TAB_ACTION_SWITCH = "switch"
+	_TAB_ACTION_CLOSE  = "close"
+	_TAB_ACTION_LIST   = "list"
+)
+
+// HistoryEntry is an entry of the local history model of a tab, see SessionGetHistory().
+type HistoryEntry struct {
+	URL   string
+	Title string
+}
+
+// Tab describes a browser tab of the session, see SessionTabList().
+type Tab struct {
+	TabId  string
+	URL    string
+	Title  string
+	Active bool
+}
+
+// The structs to which the JSON returned by the /osb/session/tab API is parsed.
+type tabOpenResp struct {
+	TabId string
+}
+
+type tabListResp struct {
+	Tabs []Tab
+}
+
+// history is the history model of a single tab. It is built from the onAddressBarChanged() and onTitleChanged()
+// control channel commands. The server does not report history navigation, so an address is only taken as going
+// back or forward when SessionBack() or SessionForward() is pending, any other address is a new entry.
+type history struct {
+	entries []HistoryEntry
+	index   int // The current entry, -1 when empty
+	pending int // -1 after SessionBack(), 1 after SessionForward(), 0 otherwise
+}
+
+func newHistory() *history {
+	return &history{index: -1}
+}
+
+func (h *history) onAddressBarChanged(uri string) {
+	pending := h.pending
+	h.pending = 0
+	if i := h.index + pending; pending != 0 && i >= 0 && i < len(h.entries) && h.entries[i].URL == uri {
+		h.index = i
+		return
+	}
+	if h.index >= 0 && h.entries[h.index].URL == uri {
+		// Reload or a change of the fragment only
+		return
+	}
+
+	// A new address, drop the forward history
+	h.entries = append(h.entries[:h.index+1], HistoryEntry{URL: uri})
+	if len(h.entries) > _HISTORY_MAX_ENTRIES {
+		h.entries = h.entries[len(h.entries)-_HISTORY_MAX_ENTRIES:]
+	}
+	h.index = len(h.entries) - 1
+}
+
+func (h *history) onTitleChanged(title string) {
+	if h.index >= 0 {
+		h.entries[h.index].Title = title
+	}
+}
+
+// navigation holds the history models of the tabs of a session.
+type navigation struct {
+	mutex     sync.Mutex
+	histories map[string]*history
+	activeTab string
+}
+
+// active returns the history of the active tab, it is called with the mutex locked.
+func (nav *navigation) active() *history {
+	if nav.histories == nil {
+		nav.histories = make(map[string]*history)
+	}
+	h := nav.histories[nav.activeTab]
+	if h == nil {
+		h = newHistory()
+		nav.histories[nav.activeTab] = h
+	}
+	return h
+}
+
+func (nav *navigation) onAddressBarChanged(uri string) {
+	nav.mutex.Lock()
+	defer nav.mutex.Unlock()
+	nav.active().onAddressBarChanged(uri)
+}
+
+func (nav *navigation) onTitleChanged(title string) {
+	nav.mutex.Lock()
+	defer nav.mutex.Unlock()
+	nav.active().onTitleChanged(title)
+}
+
+// startNavigation returns the address of the entry at the given offset from the current one of the active tab
+// (-1 back, 1 forward, 0 reload) and marks the navigation as pending.
+func (nav *navigation) startNavigation(offset int) (uri string, err error) {
+	nav.mutex.Lock()
+	defer nav.mutex.Unlock()
+	h := nav.active()
+	i := h.index + offset
+	if h.index < 0 || i < 0 || i >= len(h.entries) {
+		return "", withClass(ErrInvalidState, errors.New("No history entry to navigate to"))
+	}
+	h.pending = offset
+	return h.entries[i].URL, nil
+}
+
+// cancelNavigation clears the pending navigation of the active tab.
+func (nav *navigation) cancelNavigation() {
+	nav.mutex.Lock()
+	defer nav.mutex.Unlock()
+	nav.active().pending = 0
+}
+
+func (nav *navigation) setActiveTab(tabId string) {
+	nav.mutex.Lock()
+	defer nav.mutex.Unlock()
+	nav.activeTab = tabId
+}
+
+func (nav *navigation) removeTab(tabId string) {
+	nav.mutex.Lock()
+	defer nav.mutex.Unlock()
+	delete(nav.histories, tabId)
+}
+
+// SessionNavigate navigates the active tab of an existing session to the given address. Unlike calling SessionStart()
+// with the id of the session, the session context and its control channel are kept.
+func SessionNavigate(ctx *SessionContext, browserURL string) (err error) {
+	if browserURL == "" {
+		return withClass(ErrInvalidArgument, errors.New("Empty browser URL"))
+	}
+	ctx.nav.cancelNavigation()
+	return navigate(ctx, browserURL)
+}
+
+// navigate makes the request of SessionNavigate().
+func navigate(ctx *SessionContext, browserURL string) (err error) {
+
+	// Construct the URL
+	uri := replaceVars(_SESSION_START_URL+ctx.startParams+"&session_id=${SID}", []string{
+		"${PROTHOST}",
+		"${BURL}",
+		"${SID}",
+	}, []string{
+		ctx.ServerProtocolHost,
+		url.QueryEscape(browserURL),
+		url.QueryEscape(ctx.SessionId),
+	})
+
+	// Make the request
+	resp := &sessionStartResp{}
+	err = apiReq(ctx.httpClient, uri, nil, ctx.shouldStopSession, resp)
+	return
+}
+
+// navigateHistory navigates the active tab to the entry of its history at the given offset from the current one.
+func navigateHistory(ctx *SessionContext, offset int) (err error) {
+	uri, err := ctx.nav.startNavigation(offset)
+	if err != nil {
+		return
+	}
+	err = navigate(ctx, uri)
+	if err != nil {
+		ctx.nav.cancelNavigation()
+	}
+	return
+}
+
+// SessionBack navigates the active tab to the previous entry of its local history model.
+// ErrInvalidState is returned when there is no previous entry.
+func SessionBack(ctx *SessionContext) (err error) {
+	return navigateHistory(ctx, -1)
+}
+
+// SessionForward navigates the active tab to the next entry of its local history model.
+// ErrInvalidState is returned when there is no next entry.
+func SessionForward(ctx *SessionContext) (err error) {
+	return navigateHistory(ctx, 1)
+}
+
+// SessionReload reloads the current entry of the local history model of the active tab.
+// ErrInvalidState is returned when the history is empty.
+func SessionReload(ctx *SessionContext) (err error) {
+	return navigateHistory(ctx, 0)
+}
+
+// SessionGetHistory returns a copy of the local history model of the active tab and the index of its current entry
+// (-1 if the history is empty). The model is updated when the address or the title of the page change, i.e. along
+// with the OnAddressBarChanged() and OnTitleChanged() calls of the listener.
+func SessionGetHistory(ctx *SessionContext) (entries []HistoryEntry, index int) {
+	ctx.nav.mutex.Lock()
+	defer ctx.nav.mutex.Unlock()
+	h := ctx.nav.active()
+	entries = append([]HistoryEntry(nil), h.entries...)
+	return entries, h.index
+}
+
+// tabReq makes a request to the /osb/session/tab API with the given action and additional parameters.
+func tabReq(ctx *SessionContext, action string, params url.Values, resp interface{}) (err error) {
+	caps, err := SessionGetCapabilities(ctx)
+	if err != nil {
+		return
+	}
+	if !caps.Reported || !caps.Tabs {
+		return ErrTabsNotSupported
+	}
+
+	uri := replaceVars(_SESSION_TAB_URL, []string{
+		"${PROTHOST}",
+		"${SID}",
+		"${ACTION}",
+	}, []string{
+		ctx.ServerProtocolHost,
+		url.QueryEscape(ctx.SessionId),
+		action,
+	})
+	if len(params) > 0 {
+		uri += "&" + params.Encode()
+	}
+
+	err = apiReq(ctx.httpClient, uri, nil, ctx.shouldStopSession, resp)
+	if isHTTPStatus(err, http.StatusNotFound) {
+		return ErrTabsNotSupported
+	}
+	return
+}
+
+// SessionTabOpen opens a new tab with the given address and makes it the active tab.
+// ErrTabsNotSupported is returned by the tab functions unless the server reports the Tabs capability.
+func SessionTabOpen(ctx *SessionContext, browserURL string) (tabId string, err error) {
+	if browserURL == "" {
+		return "", withClass(ErrInvalidArgument, errors.New("Empty browser URL"))
+	}
+	resp := &tabOpenResp{}
+	err = tabReq(ctx, _TAB_ACTION_OPEN, url.Values{"browser_url": {browserURL}}, resp)
+	if err != nil {
+		return
+	}
+	tabId = resp.TabId
+	ctx.nav.setActiveTab(tabId)
+	return
+}
+
+// SessionTabSwitch makes the given tab the active tab, i.e. the one which is streamed and receives the input.
+func SessionTabSwitch(ctx *SessionContext, tabId string) (err error) {
+	err = tabReq(ctx, _TAB_ACTION_SWITCH, url.Values{"tab_id": {tabId}}, nil)
+	if err != nil {
+		return
+	}
+	ctx.nav.setActiveTab(tabId)
+	return
+}
+
+// SessionTabClose closes the given tab, the server chooses the next active tab when closing the active one.
+func SessionTabClose(ctx *SessionContext, tabId string) (err error) {
+	err = tabReq(ctx, _TAB_ACTION_CLOSE, url.Values{"tab_id": {tabId}}, nil)
+	if err != nil {
+		return
+	}
+	ctx.nav.removeTab(tabId)
+
+	// Find out which tab became active
+	tabs, e := SessionTabList(ctx)
+	if e != nil {
+		return
+	}
+	for _, tab := range tabs {
+		if tab.Active {
+			ctx.nav.setActiveTab(tab.TabId)
+			break
+		}
+	}
+	return
+}
+
+// SessionTabList returns the tabs of the session.
+func SessionTabList(ctx *SessionContext) (tabs []Tab, err error) {
+	resp := &tabListResp{}
+	err = tabReq(ctx, _TAB_ACTION_LIST, nil, resp)
+	if err != nil {
+		return
+	}
+	tabs = resp.Tabs
+	return
+}
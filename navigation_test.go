@@ -0,0 +1,177 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	type step struct {
+		uri     string // Passed to onAddressBarChanged() unless empty
+		title   string // Passed to onTitleChanged() unless empty
+		pending int    // The pending navigation set before the step
+	}
+	tests := []struct {
+		name    string
+		steps   []step
+		entries []HistoryEntry
+		index   int
+	}{
+		{"empty", nil, nil, -1},
+		{"title without an entry", []step{{"", "Title", 0}}, nil, -1},
+		{"new addresses", []step{{"a", "", 0}, {"", "A", 0}, {"b", "", 0}, {"", "B", 0}}, []HistoryEntry{
+			{"a", "A"}, {"b", "B"},
+		}, 1},
+		{"reload keeps the entry", []step{{"a", "A", 0}, {"a", "", 0}}, []HistoryEntry{
+			{"a", "A"},
+		}, 0},
+		{"back", []step{{"a", "", 0}, {"b", "", 0}, {"c", "", 0}, {"b", "", -1}}, []HistoryEntry{
+			{"a", ""}, {"b", ""}, {"c", ""},
+		}, 1},
+		{"back and forward", []step{{"a", "", 0}, {"b", "", 0}, {"c", "", 0}, {"b", "", -1}, {"a", "", -1},
+			{"b", "", 1}}, []HistoryEntry{
+			{"a", ""}, {"b", ""}, {"c", ""},
+		}, 1},
+		{"link to the previous address", []step{{"a", "", 0}, {"b", "", 0}, {"a", "", 0}}, []HistoryEntry{
+			{"a", ""}, {"b", ""}, {"a", ""},
+		}, 2},
+		{"link to the next address", []step{{"a", "", 0}, {"b", "", 0}, {"a", "", -1}, {"b", "", 0}},
+			[]HistoryEntry{{"a", ""}, {"b", ""}}, 1},
+		{"back to another address", []step{{"a", "", 0}, {"b", "", 0}, {"c", "", -1}}, []HistoryEntry{
+			{"a", ""}, {"b", ""}, {"c", ""},
+		}, 2},
+		{"pending navigation is used once", []step{{"a", "", 0}, {"b", "", 0}, {"c", "", -1}, {"b", "", 0}},
+			[]HistoryEntry{{"a", ""}, {"b", ""}, {"c", ""}, {"b", ""}}, 3},
+		{"title of a previous entry", []step{{"a", "", 0}, {"b", "", 0}, {"a", "", -1}, {"", "A", 0}},
+			[]HistoryEntry{{"a", "A"}, {"b", ""}}, 0},
+		{"new address drops the forward history", []step{{"a", "", 0}, {"b", "", 0}, {"c", "", 0}, {"b", "", -1},
+			{"d", "", 0}}, []HistoryEntry{{"a", ""}, {"b", ""}, {"d", ""}}, 2},
+		{"address of an older entry is new", []step{{"a", "", 0}, {"b", "", 0}, {"c", "", 0}, {"a", "", -1}},
+			[]HistoryEntry{{"a", ""}, {"b", ""}, {"c", ""}, {"a", ""}}, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHistory()
+			for _, step := range test.steps {
+				if step.pending != 0 {
+					h.pending = step.pending
+				}
+				if step.uri != "" {
+					h.onAddressBarChanged(step.uri)
+				}
+				if step.title != "" {
+					h.onTitleChanged(step.title)
+				}
+			}
+			if !reflect.DeepEqual(h.entries, test.entries) || h.index != test.index {
+				t.Errorf("got %v at %d, want %v at %d", h.entries, h.index, test.entries, test.index)
+			}
+		})
+	}
+}
+
+func TestHistoryMaxEntries(t *testing.T) {
+	h := newHistory()
+	for i := 0; i < _HISTORY_MAX_ENTRIES+10; i++ {
+		h.onAddressBarChanged(fmt.Sprint(i))
+	}
+	if len(h.entries) != _HISTORY_MAX_ENTRIES || h.index != _HISTORY_MAX_ENTRIES-1 {
+		t.Fatalf("got %d entries at %d, want %d at %d", len(h.entries), h.index, _HISTORY_MAX_ENTRIES, _HISTORY_MAX_ENTRIES-1)
+	}
+	if h.entries[0].URL != "10" {
+		t.Errorf("oldest entry %q, want %q", h.entries[0].URL, "10")
+	}
+}
+
+func TestNavigationTabs(t *testing.T) {
+	nav := &navigation{}
+	nav.onAddressBarChanged("a")
+	nav.setActiveTab("tab1")
+	nav.onAddressBarChanged("b")
+	nav.onTitleChanged("B")
+
+	nav.mutex.Lock()
+	got := nav.active().entries
+	nav.mutex.Unlock()
+	if want := []HistoryEntry{{"b", "B"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tab1: got %v, want %v", got, want)
+	}
+
+	nav.removeTab("tab1")
+	nav.setActiveTab(_INITIAL_TAB_ID)
+	nav.mutex.Lock()
+	got = nav.active().entries
+	_, found := nav.histories["tab1"]
+	nav.mutex.Unlock()
+	if want := []HistoryEntry{{"a", ""}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("initial tab: got %v, want %v", got, want)
+	}
+	if found {
+		t.Error("history of the closed tab was kept")
+	}
+}
+
+func TestSessionHistoryNavigation(t *testing.T) {
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Query().Get("browser_url"))
+		w.Write([]byte(`{"SessionID": "nav-session"}`))
+	}))
+	defer srv.Close()
+	jar, _ := newCookieJar()
+	ctx := newSessionContext(srv.URL, "nav-session", jar, newHTTPTransports(nil), nil)
+	defer removeSessionContext(ctx)
+
+	for name, f := range map[string]func(*SessionContext) error{
+		"SessionBack": SessionBack, "SessionForward": SessionForward, "SessionReload": SessionReload,
+	} {
+		if err := f(ctx); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("%s() returned %v with an empty history, want ErrInvalidState", name, err)
+		}
+	}
+
+	// The server reports the addresses it navigates to
+	ctx.nav.onAddressBarChanged("a")
+	ctx.nav.onAddressBarChanged("b")
+	steps := []struct {
+		f     func(*SessionContext) error
+		uri   string
+		index int
+	}{
+		{SessionBack, "a", 0},
+		{SessionForward, "b", 1},
+		{SessionReload, "b", 1},
+	}
+	for _, step := range steps {
+		if err := step.f(ctx); err != nil {
+			t.Fatalf("navigation to %s failed: %v", step.uri, err)
+		}
+		ctx.nav.onAddressBarChanged(step.uri)
+		if entries, index := SessionGetHistory(ctx); len(entries) != 2 || index != step.index {
+			t.Errorf("after navigating to %s: got %v at %d, want 2 entries at %d", step.uri, entries, index, step.index)
+		}
+	}
+	if err := SessionForward(ctx); !errors.Is(err, ErrInvalidState) {
+		t.Errorf("SessionForward() returned %v at the last entry, want ErrInvalidState", err)
+	}
+
+	// Navigating to the previous address is a new entry
+	if err := SessionNavigate(ctx, "a"); err != nil {
+		t.Fatalf("SessionNavigate() failed: %v", err)
+	}
+	ctx.nav.onAddressBarChanged("a")
+	if entries, index := SessionGetHistory(ctx); len(entries) != 3 || index != 2 {
+		t.Errorf("after SessionNavigate(): got %v at %d, want 3 entries at 2", entries, index)
+	}
+	if want := []string{"a", "b", "b", "a"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("got browser URLs %q, want %q", requested, want)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	// Maximum UI resolution supported by the server
+	MAX_UI_WIDTH  = 3840
+	MAX_UI_HEIGHT = 2160
+)
+
+// The /osb/session/start parameters set by the SDK, they cannot be overridden by SessionOptions.ExtraParams
+var _SESSION_START_PARAMS = map[string]bool{
+	"browser_url":           true,
+	"session_id":            true,
+	"video_stream_uri":      true,
+	"browser_ui_video_pull": true,
+	"browser_ui_output_url": true,
+	"width":                 true,
+	"height":                true,
+}
+
+// SessionOptions holds the settings of a session, see SessionStartWithOptions(). The fields are as per the description
+// of the /osb/session/start API in the "AppFlinger API and Client Integration Guide".
+type SessionOptions struct {
+	ServerProtocolHost string // The server, e.g. "http://host:port", ignored when ServerPool is set
+	SessionId          string // Optional, the id of the session to start or of an existing session to navigate
+	BrowserURL         string // The address of the page to load
+
+	// In pull mode the UI is streamed by the client (see SessionUIStreamStart()), otherwise it is pushed by the
+	// server to BrowserUIOutputURL, which is then required.
+	PullMode           bool
+	BrowserUIOutputURL string
+
+	// In video passthru mode the video is played by the client (see the AppflingerListener), otherwise the server
+	// composites it and sends it to VideoStreamURL, which is then required.
+	VideoPassthru  bool
+	VideoStreamURL string
+
+	Width  int // The UI width, up to MAX_UI_WIDTH, zero for the server default
+	Height int // The UI height, up to MAX_UI_HEIGHT, zero for the server default
+
+	// Additional /osb/session/start parameters, e.g. ones supported by newer servers
+	ExtraParams url.Values
+
+	// The store of the cookies of the session, an in-memory jar private to the session is used if nil.
+	// A FileCookieStore keeps the load balancer cookies across restarts and shares them between processes.
+	CookieStore CookieStore
+
+	// The servers among which the session is started, in which case ServerProtocolHost is ignored.
+	// The chosen server is recorded in SessionContext.ServerProtocolHost and used by all the subsequent requests.
+	ServerPool *ServerPool
+
+	// The configuration of the HTTP transports of the session, the one set by SetHTTPConfig() if nil
+	HTTPConfig *HTTPConfig
+
+	// Functions subscribed to the lifecycle events of the session (see SessionSubscribe()) before its control
+	// channel is started, so that they are passed all the events including the first SESSION_EVENT_CONTROL_CHANNEL_UP
+	Subscribers []func(ev *SessionEvent)
+}
+
+// Validate checks the options, the returned errors are of class ErrInvalidArgument.
+func (options *SessionOptions) Validate() (err error) {
+	invalid := func(format string, a ...interface{}) error {
+		return withClass(ErrInvalidArgument, fmt.Errorf(format, a...))
+	}
+
+	if options.ServerPool == nil {
+		if options.ServerProtocolHost == "" {
+			return invalid("Missing server, either ServerProtocolHost or ServerPool is required")
+		}
+		u, e := url.Parse(options.ServerProtocolHost)
+		if e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return invalid("Invalid server: %s", options.ServerProtocolHost)
+		}
+	}
+	if options.BrowserURL == "" {
+		return invalid("Missing browser URL")
+	}
+
+	if options.PullMode && options.BrowserUIOutputURL != "" {
+		return invalid("A UI output URL cannot be given in pull mode")
+	}
+	if !options.PullMode && options.BrowserUIOutputURL == "" {
+		return invalid("A UI output URL is required in push mode")
+	}
+	if options.VideoPassthru && options.VideoStreamURL != "" {
+		return invalid("A video stream URL cannot be given in video passthru mode")
+	}
+	if !options.VideoPassthru && options.VideoStreamURL == "" {
+		return invalid("A video stream URL is required unless in video passthru mode")
+	}
+
+	if options.Width < 0 || options.Width > MAX_UI_WIDTH {
+		return invalid("Invalid width %d, the maximum is %d", options.Width, MAX_UI_WIDTH)
+	}
+	if options.Height < 0 || options.Height > MAX_UI_HEIGHT {
+		return invalid("Invalid height %d, the maximum is %d", options.Height, MAX_UI_HEIGHT)
+	}
+
+	for _, subscriber := range options.Subscribers {
+		if subscriber == nil {
+			return invalid("Nil subscriber")
+		}
+	}
+
+	for name := range options.ExtraParams {
+		if name == "" {
+			return invalid("Empty extra parameter name")
+		}
+		if _SESSION_START_PARAMS[name] {
+			return invalid("Extra parameter %s is set by the SDK", name)
+		}
+	}
+	return nil
+}
+
+// startParams returns the /osb/session/start parameters other than the address and the session id,
+// they are kept for SessionNavigate().
+func (options *SessionOptions) startParams() string {
+	params := url.Values{}
+	for name, vals := range options.ExtraParams {
+		params[name] = vals
+	}
+	if !options.VideoPassthru {
+		params.Set("video_stream_uri", options.VideoStreamURL)
+	}
+	if options.PullMode {
+		params.Set("browser_ui_video_pull", "yes")
+	} else {
+		params.Set("browser_ui_output_url", options.BrowserUIOutputURL)
+	}
+	if options.Width > 0 {
+		params.Set("width", fmt.Sprint(options.Width))
+	}
+	if options.Height > 0 {
+		params.Set("height", fmt.Sprint(options.Height))
+	}
+	return "&" + params.Encode()
+}
+
+var errNoOptions = withClass(ErrInvalidArgument, errors.New("Missing session options"))
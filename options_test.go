@@ -0,0 +1,95 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestSessionOptionsValidate(t *testing.T) {
+	// valid returns options which pass the validation after applying the given change.
+	valid := func(change func(options *SessionOptions)) *SessionOptions {
+		options := &SessionOptions{
+			ServerProtocolHost: "http://127.0.0.1:8080",
+			BrowserURL:         "http://www.example.com/",
+			PullMode:           true,
+			VideoPassthru:      true,
+		}
+		if change != nil {
+			change(options)
+		}
+		return options
+	}
+	tests := []struct {
+		name    string
+		options *SessionOptions
+		valid   bool
+	}{
+		{"pull mode and video passthru", valid(nil), true},
+		{"push mode", valid(func(o *SessionOptions) {
+			o.PullMode, o.BrowserUIOutputURL = false, "udp://127.0.0.1:1234"
+		}), true},
+		{"push mode without an output URL", valid(func(o *SessionOptions) { o.PullMode = false }), false},
+		{"pull mode with an output URL", valid(func(o *SessionOptions) { o.BrowserUIOutputURL = "udp://127.0.0.1:1234" }), false},
+		{"composited video", valid(func(o *SessionOptions) {
+			o.VideoPassthru, o.VideoStreamURL = false, "udp://127.0.0.1:1235"
+		}), true},
+		{"composited video without a stream URL", valid(func(o *SessionOptions) { o.VideoPassthru = false }), false},
+		{"video passthru with a stream URL", valid(func(o *SessionOptions) { o.VideoStreamURL = "udp://127.0.0.1:1235" }), false},
+		{"missing server", valid(func(o *SessionOptions) { o.ServerProtocolHost = "" }), false},
+		{"server without a scheme", valid(func(o *SessionOptions) { o.ServerProtocolHost = "127.0.0.1:8080" }), false},
+		{"server with another scheme", valid(func(o *SessionOptions) { o.ServerProtocolHost = "ftp://127.0.0.1" }), false},
+		{"https server", valid(func(o *SessionOptions) { o.ServerProtocolHost = "https://appflinger.example.com" }), true},
+		{"server pool instead of a server", valid(func(o *SessionOptions) {
+			o.ServerProtocolHost, o.ServerPool = "", NewServerPool(nil)
+		}), true},
+		{"missing browser URL", valid(func(o *SessionOptions) { o.BrowserURL = "" }), false},
+		{"maximum resolution", valid(func(o *SessionOptions) { o.Width, o.Height = MAX_UI_WIDTH, MAX_UI_HEIGHT }), true},
+		{"negative width", valid(func(o *SessionOptions) { o.Width = -1 }), false},
+		{"width too large", valid(func(o *SessionOptions) { o.Width = MAX_UI_WIDTH + 1 }), false},
+		{"height too large", valid(func(o *SessionOptions) { o.Height = MAX_UI_HEIGHT + 1 }), false},
+		{"extra parameter", valid(func(o *SessionOptions) { o.ExtraParams = url.Values{"lang": {"en"}} }), true},
+		{"empty extra parameter name", valid(func(o *SessionOptions) { o.ExtraParams = url.Values{"": {"en"}} }), false},
+		{"extra parameter set by the SDK", valid(func(o *SessionOptions) {
+			o.ExtraParams = url.Values{"session_id": {"other"}}
+		}), false},
+		{"subscriber", valid(func(o *SessionOptions) { o.Subscribers = []func(ev *SessionEvent){func(*SessionEvent) {}} }), true},
+		{"nil subscriber", valid(func(o *SessionOptions) { o.Subscribers = []func(ev *SessionEvent){nil} }), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.options.Validate()
+			if test.valid && err != nil {
+				t.Errorf("Validate() failed: %v", err)
+			} else if !test.valid && !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("Validate() returned %v, want ErrInvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestSessionOptionsStartParams(t *testing.T) {
+	options := &SessionOptions{
+		BrowserUIOutputURL: "udp://127.0.0.1:1234",
+		VideoStreamURL:     "udp://127.0.0.1:1235",
+		Width:              1280,
+		ExtraParams:        url.Values{"lang": {"en"}},
+	}
+	params, err := url.ParseQuery(options.startParams()[1:])
+	if err != nil {
+		t.Fatalf("Invalid parameters: %v", err)
+	}
+	want := url.Values{
+		"browser_ui_output_url": {"udp://127.0.0.1:1234"},
+		"video_stream_uri":      {"udp://127.0.0.1:1235"},
+		"width":                 {"1280"},
+		"lang":                  {"en"},
+	}
+	if params.Encode() != want.Encode() {
+		t.Errorf("got %v, want %v", params, want)
+	}
+}
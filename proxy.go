@@ -0,0 +1,532 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Paths served by a UIProxy, see UIProxy.URL()
+	UI_PROXY_PATH_TS       = "/ui.ts"              // Continuous MPEG-TS
+	UI_PROXY_PATH_HLS_TS   = "/ts/playlist.m3u8"   // Live HLS with MPEG-TS segments
+	UI_PROXY_PATH_HLS_FMP4 = "/fmp4/playlist.m3u8" // Live HLS with fragmented MP4 segments
+
+	_PROXY_ADDR             = "127.0.0.1:0"
+	_PROXY_SEGMENT_DURATION = 2 * time.Second
+	_PROXY_PLAYLIST_SIZE    = 6
+	_PROXY_SEGMENTS_KEPT    = 2                // Segments kept after leaving the playlist, for the players lagging behind
+	_PROXY_PLAYLIST_WAIT    = 10 * time.Second // How long a playlist request waits for the first segment
+	_PROXY_CLIENT_QUEUE     = 1024             // Chunks queued for an MPEG-TS viewer before it is dropped as too slow
+	_PROXY_TOKEN_SIZE       = 16               // Random bytes of the token in the URL of the proxy
+)
+
+// UIProxyConfig holds the settings of a UIProxy.
+type UIProxyConfig struct {
+	Addr string // The address to listen on, a random port of the loopback interface if empty
+
+	// The format used to start the UI stream when it is not streaming yet, UI_FMT_AUTO if empty
+	Format string
+
+	SegmentDuration time.Duration // The target duration of the HLS segments, 2 seconds if zero
+	PlaylistSize    int           // The number of segments in the HLS playlists, 6 if zero
+}
+
+// UIProxy serves the UI stream of a session over HTTP to local players, as live HLS (see UI_PROXY_PATH_HLS_TS and
+// UI_PROXY_PATH_HLS_FMP4) and as continuous MPEG-TS (see UI_PROXY_PATH_TS). All the viewers share the UI stream of
+// the session, which carries the cookies of the session, hence the players need no cookies. The paths start with a
+// random token, so that only the players given the URL of the proxy can access it. Each format is only remuxed once
+// it is first requested. It is started by SessionUIProxyStart().
+type UIProxy struct {
+	config       UIProxyConfig
+	ctx          *SessionContext
+	sinkId       int
+	startedUI    bool   // Whether the UI stream was started by the proxy, in which case it is stopped with it
+	token        string // The first element of the paths
+	listener     net.Listener
+	server       *http.Server
+	mutex        sync.Mutex
+	ts, fmp4     *uiHLSOutput
+	configFrames [2]*UIFrame             // The last codec config frames of each stream, to start the outputs with
+	clients      map[*uiProxyClient]bool // The viewers of the continuous MPEG-TS
+	changed      chan struct{}           // Closed and replaced whenever a segment is complete
+	done         chan struct{}           // Closed when the proxy is stopped
+}
+
+// uiProxyClient is a viewer of the continuous MPEG-TS.
+type uiProxyClient struct {
+	synced bool        // Whether the viewer started receiving, at a video key frame
+	data   chan []byte // Closed when the viewer is dropped
+}
+
+// uiHLSOutput builds the segments of a live HLS stream, it implements uiSegmentOutput. It is guarded by the mutex of
+// the proxy.
+type uiHLSOutput struct {
+	proxy    *UIProxy
+	fmp4     bool
+	enabled  bool // Whether the output was requested, the UI stream is remuxed from then on
+	remuxer  *uiRemuxer
+	segments []*uiHLSSegment // The segments which are kept, the last one being built
+	nextSeq  int
+	inits    map[int][]byte // The fMP4 initialization segments of the segments which are kept
+	nextInit int
+	discSeq  int  // The number of discontinuities which were dropped with their segments
+	keyFrame bool // Whether the next data starts with a video key frame
+}
+
+// uiHLSSegment is a segment of a live HLS stream.
+type uiHLSSegment struct {
+	seq           int
+	init          int // The fMP4 initialization segment
+	startDTS      int64
+	duration      int64 // Known once complete
+	complete      bool
+	discontinuity bool
+	data          []byte
+}
+
+// uiFrameListenerFunc adapts a function to UIFrameListener.
+type uiFrameListenerFunc func(sessionId string, frame *UIFrame) (err error)
+
+func (f uiFrameListenerFunc) OnUIFrameData(sessionId string, frame *UIFrame) (err error) {
+	return f(sessionId, frame)
+}
+
+// SessionUIProxyStart starts serving the UI stream of the session to local players, the UI stream is started if it
+// is not streaming yet. The proxy lasts until SessionUIProxyStop() or the end of the session.
+func SessionUIProxyStart(ctx *SessionContext, config *UIProxyConfig) (proxy *UIProxy, err error) {
+	proxy = &UIProxy{
+		ctx:     ctx,
+		clients: map[*uiProxyClient]bool{},
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if config != nil {
+		proxy.config = *config
+	}
+	if proxy.config.SegmentDuration < 0 || proxy.config.PlaylistSize < 0 {
+		return nil, withClass(ErrInvalidArgument, errors.New("Invalid UI proxy playlist settings"))
+	}
+	if proxy.config.Addr == "" {
+		proxy.config.Addr = _PROXY_ADDR
+	}
+	if proxy.config.Format == "" {
+		proxy.config.Format = UI_FMT_AUTO
+	}
+	if proxy.config.SegmentDuration == 0 {
+		proxy.config.SegmentDuration = _PROXY_SEGMENT_DURATION
+	}
+	if proxy.config.PlaylistSize == 0 {
+		proxy.config.PlaylistSize = _PROXY_PLAYLIST_SIZE
+	}
+	proxy.ts = newUIHLSOutput(proxy, false)
+	proxy.fmp4 = newUIHLSOutput(proxy, true)
+	token := make([]byte, _PROXY_TOKEN_SIZE)
+	if _, err = rand.Read(token); err != nil {
+		return nil, fmt.Errorf("Failed to create the UI proxy token: %w", err)
+	}
+	proxy.token = hex.EncodeToString(token)
+
+	proxy.listener, err = net.Listen("tcp", proxy.config.Addr)
+	if err != nil {
+		return nil, withClass(ErrInvalidArgument, fmt.Errorf("Failed to listen for the UI proxy: %w", err))
+	}
+	proxy.server = &http.Server{Handler: proxy.handler()}
+
+	ctx.mutex.Lock()
+	if ctx.uiProxy != nil {
+		ctx.mutex.Unlock()
+		proxy.listener.Close()
+		return nil, withClass(ErrInvalidState, errors.New("UI proxy is already running"))
+	}
+	ctx.uiProxy = proxy
+	proxy.sinkId = ctx.addUIFrameSink(uiFrameListenerFunc(proxy.onUIFrame))
+	streaming := ctx.uiDone != nil
+	ctx.mutex.Unlock()
+
+	if !streaming {
+		err = uiStreamStart(ctx, proxy.config.Format, false, 0, nil)
+		if err != nil && !errors.Is(err, ErrInvalidState) {
+			SessionUIProxyStop(ctx)
+			return nil, err
+		}
+		proxy.startedUI = err == nil
+	}
+	go func() {
+		if err := proxy.server.Serve(proxy.listener); err != http.ErrServerClosed {
+			log.Println("UI proxy failed: ", err)
+		}
+	}()
+	return proxy, nil
+}
+
+// SessionUIProxyStop stops the proxy started by SessionUIProxyStart(), as well as the UI stream if it was started
+// by the proxy.
+func SessionUIProxyStop(ctx *SessionContext) (err error) {
+	ctx.mutex.Lock()
+	proxy := ctx.uiProxy
+	if proxy != nil {
+		ctx.removeUIFrameSink(proxy.sinkId)
+		ctx.uiProxy = nil
+	}
+	ctx.mutex.Unlock()
+	if proxy == nil {
+		return withClass(ErrInvalidState, errors.New("UI proxy is not running"))
+	}
+
+	proxy.server.Close()
+	proxy.listener.Close()
+	proxy.mutex.Lock()
+	close(proxy.done)
+	for client := range proxy.clients {
+		proxy.dropClient(client)
+	}
+	proxy.mutex.Unlock()
+	if proxy.startedUI {
+		if err := SessionUIStreamStop(ctx); err != nil && !errors.Is(err, ErrInvalidState) {
+			log.Println("Failed to stop the UI stream of the proxy: ", err)
+		}
+	}
+	return nil
+}
+
+// URL returns the base URL of the proxy, including its token, to which the UI_PROXY_PATH_* paths are appended.
+func (proxy *UIProxy) URL() string {
+	return "http://" + proxy.listener.Addr().String() + "/" + proxy.token
+}
+
+// handler returns the handler of the requests, the paths without the token are not found.
+func (proxy *UIProxy) handler() http.Handler {
+	prefix := "/" + proxy.token
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+UI_PROXY_PATH_TS, proxy.serveTS)
+	mux.HandleFunc(prefix+"/ts/", func(w http.ResponseWriter, r *http.Request) { proxy.serveHLS(w, r, proxy.ts) })
+	mux.HandleFunc(prefix+"/fmp4/", func(w http.ResponseWriter, r *http.Request) { proxy.serveHLS(w, r, proxy.fmp4) })
+	return mux
+}
+
+// onUIFrame remuxes a frame of the UI stream for the outputs which were requested.
+func (proxy *UIProxy) onUIFrame(sessionId string, frame *UIFrame) (err error) {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	select {
+	case <-proxy.done:
+		return nil
+	default:
+	}
+	if frame.IsCodecConfig {
+		proxy.configFrames[frame.Idx] = frame
+	}
+	// The outputs are in memory and never fail
+	for _, output := range []*uiHLSOutput{proxy.ts, proxy.fmp4} {
+		if output.enabled {
+			output.remuxer.writeFrame(frame)
+		}
+	}
+	return nil
+}
+
+// broadcast sends MPEG-TS data to the viewers, the new viewers start receiving at a video key frame. It is called
+// with the mutex locked.
+func (proxy *UIProxy) broadcast(data []byte, keyFrame bool) {
+	if len(proxy.clients) == 0 {
+		return
+	}
+	data = append([]byte(nil), data...)
+	for client := range proxy.clients {
+		if !client.synced {
+			if !keyFrame {
+				continue
+			}
+			client.synced = true
+		}
+		select {
+		case client.data <- data:
+		default:
+			log.Println("Dropping a UI proxy viewer which is too slow")
+			proxy.dropClient(client)
+		}
+	}
+}
+
+// dropClient is called with the mutex locked.
+func (proxy *UIProxy) dropClient(client *uiProxyClient) {
+	delete(proxy.clients, client)
+	close(client.data)
+}
+
+// notify wakes up the playlist requests waiting for a segment, it is called with the mutex locked.
+func (proxy *UIProxy) notify() {
+	close(proxy.changed)
+	proxy.changed = make(chan struct{})
+}
+
+// serveTS serves the continuous MPEG-TS.
+func (proxy *UIProxy) serveTS(w http.ResponseWriter, r *http.Request) {
+	client := &uiProxyClient{data: make(chan []byte, _PROXY_CLIENT_QUEUE)}
+	proxy.mutex.Lock()
+	proxy.clients[client] = true
+	proxy.ts.enable()
+	proxy.mutex.Unlock()
+	defer func() {
+		proxy.mutex.Lock()
+		if proxy.clients[client] {
+			proxy.dropClient(client)
+		}
+		proxy.mutex.Unlock()
+	}()
+
+	setProxyHeaders(w, "video/mp2t")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		select {
+		case data, ok := <-client.data:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(data); err != nil {
+				return
+			}
+			if flusher != nil && len(client.data) == 0 {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// serveHLS serves the playlist and the segments of a live HLS stream.
+func (proxy *UIProxy) serveHLS(w http.ResponseWriter, r *http.Request, output *uiHLSOutput) {
+	name := path.Base(r.URL.Path)
+	if name == "playlist.m3u8" {
+		proxy.servePlaylist(w, r, output)
+		return
+	}
+
+	var data []byte
+	contentType := "video/mp2t"
+	proxy.mutex.Lock()
+	output.enable()
+	switch {
+	case output.fmp4 && strings.HasPrefix(name, "init-") && strings.HasSuffix(name, ".mp4"):
+		contentType = "video/mp4"
+		if n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "init-"), ".mp4")); err == nil {
+			data = output.inits[n]
+		}
+	case output.fmp4 && strings.HasSuffix(name, ".m4s"):
+		contentType = "video/iso.segment"
+		data = output.segmentData(strings.TrimSuffix(name, ".m4s"))
+	case !output.fmp4 && strings.HasSuffix(name, ".ts"):
+		data = output.segmentData(strings.TrimSuffix(name, ".ts"))
+	}
+	proxy.mutex.Unlock()
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	setProxyHeaders(w, contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// servePlaylist serves the playlist of a live HLS stream, once it has a complete segment.
+func (proxy *UIProxy) servePlaylist(w http.ResponseWriter, r *http.Request, output *uiHLSOutput) {
+	deadline := time.NewTimer(_PROXY_PLAYLIST_WAIT)
+	defer deadline.Stop()
+	for {
+		proxy.mutex.Lock()
+		output.enable()
+		playlist := output.playlist()
+		changed := proxy.changed
+		proxy.mutex.Unlock()
+		if playlist != "" {
+			setProxyHeaders(w, "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Write([]byte(playlist))
+			return
+		}
+		select {
+		case <-changed:
+		case <-deadline.C:
+			http.Error(w, "The UI stream is not available", http.StatusServiceUnavailable)
+			return
+		case <-proxy.done:
+			http.Error(w, "The UI proxy is stopped", http.StatusServiceUnavailable)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// setProxyHeaders sets the headers of the responses of the proxy, which can be played from any web page given its
+// URL, the token being the access control.
+func setProxyHeaders(w http.ResponseWriter, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+}
+
+func newUIHLSOutput(proxy *UIProxy, fmp4 bool) (output *uiHLSOutput) {
+	output = &uiHLSOutput{proxy: proxy, fmp4: fmp4, inits: map[int][]byte{}}
+	if fmp4 {
+		output.remuxer = newUIRemuxer(newUIFMP4Writer(), output)
+	} else {
+		output.remuxer = newUIRemuxer(newUITsWriter(), output)
+	}
+	return
+}
+
+// enable starts remuxing the UI stream for the output, starting with the last codec config frames so that the
+// remuxing can start at the next video key frame. It is called with the mutex of the proxy locked.
+func (output *uiHLSOutput) enable() {
+	if output.enabled {
+		return
+	}
+	output.enabled = true
+	for _, frame := range output.proxy.configFrames {
+		if frame != nil {
+			output.remuxer.writeFrame(frame)
+		}
+	}
+}
+
+// cutSegment implements uiSegmentOutput.
+func (output *uiHLSOutput) cutSegment(dts int64) bool {
+	// The viewers of the continuous MPEG-TS may start at any key frame
+	output.keyFrame = true
+	segment := output.segments[len(output.segments)-1]
+	return dts-segment.startDTS >= durationToUITime(output.proxy.config.SegmentDuration)
+}
+
+// startSegment implements uiSegmentOutput.
+func (output *uiHLSOutput) startSegment(header []byte, dts int64, discontinuity bool) (err error) {
+	segment := &uiHLSSegment{seq: output.nextSeq, startDTS: dts}
+	output.nextSeq++
+	if n := len(output.segments); n > 0 {
+		last := output.segments[n-1]
+		last.complete = true
+		if discontinuity {
+			last.duration = output.remuxer.lastDTS - last.startDTS
+		} else {
+			last.duration = dts - last.startDTS
+		}
+		segment.init = last.init
+		segment.discontinuity = discontinuity
+		output.proxy.notify()
+	}
+	if output.fmp4 {
+		if init, ok := output.inits[segment.init]; !ok || string(init) != string(header) {
+			// The codec configuration changed
+			segment.init = output.nextInit
+			output.nextInit++
+			output.inits[segment.init] = append([]byte(nil), header...)
+			segment.discontinuity = len(output.segments) > 0
+		}
+	}
+	output.segments = append(output.segments, segment)
+
+	// Drop the segments which left the playlist a while ago, along with their initialization segments
+	for len(output.segments) > output.proxy.config.PlaylistSize+_PROXY_SEGMENTS_KEPT+1 {
+		if output.segments[1].discontinuity {
+			output.discSeq++
+		}
+		if output.segments[1].init != output.segments[0].init {
+			delete(output.inits, output.segments[0].init)
+		}
+		output.segments = output.segments[1:]
+	}
+	output.keyFrame = true
+	return nil
+}
+
+// writeData implements uiSegmentOutput.
+func (output *uiHLSOutput) writeData(data []byte) (err error) {
+	if len(data) == 0 {
+		return nil
+	}
+	segment := output.segments[len(output.segments)-1]
+	segment.data = append(segment.data, data...)
+	if !output.fmp4 {
+		output.proxy.broadcast(data, output.keyFrame)
+	}
+	output.keyFrame = false
+	return nil
+}
+
+// segmentData returns the data of a complete segment given its sequence number, or nil.
+func (output *uiHLSOutput) segmentData(seq string) []byte {
+	n, err := strconv.Atoi(seq)
+	if err != nil {
+		return nil
+	}
+	for _, segment := range output.segments {
+		if segment.seq == n && segment.complete {
+			return segment.data
+		}
+	}
+	return nil
+}
+
+// playlist returns the live playlist of the last complete segments, or an empty string when there is none.
+func (output *uiHLSOutput) playlist() string {
+	end := len(output.segments)
+	if end > 0 && !output.segments[end-1].complete {
+		end--
+	}
+	if end == 0 {
+		return ""
+	}
+	start := end - output.proxy.config.PlaylistSize
+	if start < 0 {
+		start = 0
+	}
+
+	discSeq := output.discSeq
+	for _, segment := range output.segments[:start] {
+		if segment.discontinuity {
+			discSeq++
+		}
+	}
+	target, version, ext := 1, 3, "ts"
+	if output.fmp4 {
+		version, ext = 7, "m4s"
+	}
+	for _, segment := range output.segments[start:end] {
+		if d := int(math.Round(float64(segment.duration) / UI_TIMESCALE)); d > target {
+			target = d
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%d\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:%d\n",
+		version, target, output.segments[start].seq)
+	if discSeq > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", discSeq)
+	}
+	for i, segment := range output.segments[start:end] {
+		if segment.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if output.fmp4 && (i == 0 || segment.init != output.segments[start+i-1].init) {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%d.mp4\"\n", segment.init)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.%s\n", float64(segment.duration)/UI_TIMESCALE, segment.seq, ext)
+	}
+	return b.String()
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestUIProxy returns a proxy which is not attached to a session nor listening.
+func newTestUIProxy(playlistSize int) *UIProxy {
+	proxy := &UIProxy{
+		config:  UIProxyConfig{SegmentDuration: 800 * time.Millisecond, PlaylistSize: playlistSize},
+		token:   "token",
+		clients: map[*uiProxyClient]bool{},
+		changed: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	proxy.ts = newUIHLSOutput(proxy, false)
+	proxy.fmp4 = newUIHLSOutput(proxy, true)
+	return proxy
+}
+
+// testHLSSegment is a call to uiHLSOutput.startSegment().
+type testHLSSegment struct {
+	header        string
+	dts           int64
+	discontinuity bool
+	lastDTS       int64 // The DTS of the last video sample before a discontinuity
+}
+
+func TestUIHLSPlaylist(t *testing.T) {
+	tests := []struct {
+		name         string
+		fmp4         bool
+		playlistSize int
+		segments     []testHLSSegment
+		want         string
+	}{
+		{"no segment", false, 3, nil, ""},
+		{"incomplete segment", false, 3, []testHLSSegment{{dts: 0}}, ""},
+		{"sliding window", false, 3,
+			[]testHLSSegment{{dts: 0}, {dts: 180000}, {dts: 414000}, {dts: 594000}, {dts: 774000}},
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:3\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXTINF:2.600,\n1.ts\n#EXTINF:2.000,\n2.ts\n#EXTINF:2.000,\n3.ts\n"},
+		{"discontinuity", false, 2,
+			[]testHLSSegment{{dts: 0}, {dts: 180000}, {dts: 0, discontinuity: true, lastDTS: 342000}, {dts: 180000},
+				{dts: 360000}},
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:2\n" +
+				"#EXT-X-DISCONTINUITY\n#EXTINF:2.000,\n2.ts\n#EXTINF:2.000,\n3.ts\n"},
+		{"discontinuity sequence", false, 2,
+			[]testHLSSegment{{dts: 0}, {dts: 180000}, {dts: 0, discontinuity: true, lastDTS: 342000}, {dts: 180000},
+				{dts: 360000}, {dts: 540000}},
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:3\n" +
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXTINF:2.000,\n3.ts\n#EXTINF:2.000,\n4.ts\n"},
+		{"discontinuity dropped", false, 1,
+			[]testHLSSegment{{dts: 0}, {dts: 180000}, {dts: 0, discontinuity: true, lastDTS: 342000}, {dts: 180000},
+				{dts: 360000}, {dts: 540000}, {dts: 720000}, {dts: 900000}},
+			"#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:6\n" +
+				"#EXT-X-DISCONTINUITY-SEQUENCE:1\n#EXTINF:2.000,\n6.ts\n"},
+		{"fmp4 initialization segments", true, 3,
+			[]testHLSSegment{{header: "a", dts: 0}, {header: "a", dts: 180000}, {header: "b", dts: 360000},
+				{header: "b", dts: 540000}},
+			"#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+				"#EXT-X-MAP:URI=\"init-0.mp4\"\n#EXTINF:2.000,\n0.m4s\n#EXTINF:2.000,\n1.m4s\n" +
+				"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init-1.mp4\"\n#EXTINF:2.000,\n2.m4s\n"},
+		{"fmp4 sliding window", true, 2,
+			[]testHLSSegment{{header: "a", dts: 0}, {header: "a", dts: 180000}, {header: "a", dts: 360000},
+				{header: "a", dts: 540000}},
+			"#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:1\n" +
+				"#EXT-X-MAP:URI=\"init-0.mp4\"\n#EXTINF:2.000,\n1.m4s\n#EXTINF:2.000,\n2.m4s\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := newTestUIProxy(test.playlistSize).ts
+			if test.fmp4 {
+				output = output.proxy.fmp4
+			}
+			for _, segment := range test.segments {
+				output.remuxer.lastDTS = segment.lastDTS
+				output.startSegment([]byte(segment.header), segment.dts, segment.discontinuity)
+			}
+			if got := output.playlist(); got != test.want {
+				t.Errorf("got playlist:\n%s\nwant:\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUIHLSInitSegments(t *testing.T) {
+	output := newTestUIProxy(1).fmp4
+	for i, header := range []string{"a", "a", "b", "b", "b", "b", "b"} {
+		output.startSegment([]byte(header), int64(i)*180000, false)
+	}
+	// The first initialization segment is dropped along with the last segment using it
+	if _, ok := output.inits[0]; ok || string(output.inits[1]) != "b" {
+		t.Errorf("got initialization segments %q, want only init-1", output.inits)
+	}
+}
+
+// serveTestRequest returns the response of the proxy to a GET request.
+func serveTestRequest(proxy *UIProxy, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	proxy.handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	return w
+}
+
+func TestUIProxyHandler(t *testing.T) {
+	proxy := newTestUIProxy(3)
+	frames := testUIFrames(0, 60, true)
+
+	// The paths without the token are not found
+	for _, path := range []string{UI_PROXY_PATH_TS, UI_PROXY_PATH_HLS_TS, UI_PROXY_PATH_HLS_FMP4, "/other" +
+		UI_PROXY_PATH_HLS_FMP4} {
+		if w := serveTestRequest(proxy, path); w.Code != http.StatusNotFound {
+			t.Errorf("%s returned %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+
+	// The outputs are not remuxed until they are requested
+	for _, frame := range frames[:22] {
+		proxy.onUIFrame("proxy-session", frame)
+	}
+	if len(proxy.ts.segments) != 0 || len(proxy.fmp4.segments) != 0 {
+		t.Fatal("the outputs are remuxed before they are requested")
+	}
+	if w := serveTestRequest(proxy, "/token/fmp4/0.m4s"); w.Code != http.StatusNotFound {
+		t.Errorf("missing segment returned %d, want %d", w.Code, http.StatusNotFound)
+	}
+	for _, frame := range frames[22:] {
+		proxy.onUIFrame("proxy-session", frame)
+	}
+	if len(proxy.ts.segments) != 0 {
+		t.Error("the MPEG-TS output is remuxed before it is requested")
+	}
+
+	// The remuxing starts at the next key frame, with the codec configuration received before
+	w := serveTestRequest(proxy, "/token"+UI_PROXY_PATH_HLS_FMP4)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "#EXT-X-MAP:URI=\"init-0.mp4\"\n") {
+		t.Fatalf("playlist returned %d:\n%s", w.Code, w.Body.String())
+	}
+	if start := proxy.fmp4.segments[0].startDTS; start != 10*testVideoInterval {
+		t.Errorf("the first segment starts at %d, want %d", start, 10*testVideoInterval)
+	}
+	for path, contentType := range map[string]string{
+		"/token/fmp4/init-0.mp4": "video/mp4",
+		"/token/fmp4/0.m4s":      "video/iso.segment",
+	} {
+		w = serveTestRequest(proxy, path)
+		if w.Code != http.StatusOK || w.Body.Len() == 0 || w.Header().Get("Content-Type") != contentType {
+			t.Errorf("%s returned %d with %d bytes of %s", path, w.Code, w.Body.Len(), w.Header().Get("Content-Type"))
+		}
+	}
+}
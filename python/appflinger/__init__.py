@@ -0,0 +1,32 @@
+# Copyright 2015 TVersity Inc. All rights reserved.
+# Use of this source code is governed by an Apache 2.0
+# license that can be found in the LICENSE file.
+
+"""Python bindings of libappflinger, the C build of the AppFlinger client SDK.
+
+The bindings use ctypes, so no compiled extension is needed. The library is loaded from $APPFLINGER_LIB,
+from the directory of this package or from the system library path. Build it using libappflinger/build.sh.
+
+Example:
+
+    import appflinger
+
+    class MyListener(appflinger.Listener):
+        def on_title_changed(self, session_id, title):
+            print("Title:", title)
+
+    with appflinger.Session.start("http://localhost:8080", "http://www.example.com", MyListener()) as session:
+        session.send_key(appflinger.KEY_DOWN)
+"""
+
+from .listener import *  # noqa: F401,F403
+from .session import *  # noqa: F401,F403
+
+# Keyboard codes for injecting events
+KEY_UP = 0x26
+KEY_DOWN = 0x28
+KEY_LEFT = 0x25
+KEY_RIGHT = 0x27
+KEY_ENTER = 0xd
+KEY_BACKSPACE = 0x8
+KEY_ESCAPE = 0x1b
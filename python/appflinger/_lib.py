@@ -0,0 +1,170 @@
+# Copyright 2015 TVersity Inc. All rights reserved.
+# Use of this source code is governed by an Apache 2.0
+# license that can be found in the LICENSE file.
+
+"""ctypes declarations of libappflinger, see libappflinger/callbacks.h and libappflinger/appflinger_exports.h."""
+
+import ctypes
+import ctypes.util
+import os
+import sys
+
+from ctypes import (CFUNCTYPE, POINTER, Structure, c_char_p, c_double, c_int, c_longlong, c_uint, c_void_p)
+
+# Mirrors APPFLINGER_MAX_TIME_RANGES in callbacks.h
+MAX_TIME_RANGES = 64
+
+
+class TimeRanges(Structure):
+    _fields_ = [
+        ("start", POINTER(c_double)),
+        ("end", POINTER(c_double)),
+        ("length", c_uint),
+    ]
+
+
+class LoadResourceResult(Structure):
+    _fields_ = [
+        ("code", c_void_p),
+        ("headers", c_void_p),
+        ("buffer_id", c_void_p),
+        ("buffer_length", c_uint),
+        ("payload", c_void_p),
+        ("payload_len", c_uint),
+    ]
+
+
+# Callback types, in the order of the fields of appflinger_callbacks_t. Strings are declared as c_void_p where
+# the library passes NULL, or where the callback returns a string which the library frees (char **).
+_P = c_char_p  # const char *
+CALLBACK_TYPES = [
+    ("on_ui_frame_cb", CFUNCTYPE(c_int, _P, c_int, c_int, c_int, c_int, c_longlong, c_longlong, c_void_p, c_uint)),
+    ("load_cb", CFUNCTYPE(c_int, _P, _P, _P)),
+    ("set_rect_cb", CFUNCTYPE(c_int, _P, _P, c_int, c_int, c_int, c_int)),
+    ("cancel_load_cb", CFUNCTYPE(c_int, _P, _P)),
+    ("pause_cb", CFUNCTYPE(c_int, _P, _P)),
+    ("play_cb", CFUNCTYPE(c_int, _P, _P)),
+    ("seek_cb", CFUNCTYPE(c_int, _P, _P, c_double)),
+    ("get_paused_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_int))),
+    ("get_seeking_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_int))),
+    ("get_duration_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_double))),
+    ("get_current_time_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_double))),
+    ("get_network_state_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_int))),
+    ("get_ready_state_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_int))),
+    ("get_seekable_cb", CFUNCTYPE(c_int, _P, _P, POINTER(TimeRanges))),
+    ("get_buffered_cb", CFUNCTYPE(c_int, _P, _P, POINTER(TimeRanges))),
+    ("set_visible_cb", CFUNCTYPE(c_int, _P, _P, c_int)),
+    ("set_rate_cb", CFUNCTYPE(c_int, _P, _P, c_double)),
+    ("set_volume_cb", CFUNCTYPE(c_int, _P, _P, c_double)),
+    ("add_source_buffer_cb", CFUNCTYPE(c_int, _P, _P, _P, _P)),
+    ("remove_source_buffer_cb", CFUNCTYPE(c_int, _P, _P, _P)),
+    ("abort_source_buffer_cb", CFUNCTYPE(c_int, _P, _P, _P)),
+    ("append_buffer_cb", CFUNCTYPE(c_int, _P, _P, _P, c_double, c_double, _P, c_int, c_int, c_void_p, c_uint,
+                                   POINTER(TimeRanges))),
+    ("set_append_mode_cb", CFUNCTYPE(c_int, _P, _P, _P, c_int)),
+    ("set_append_timestamp_offset_cb", CFUNCTYPE(c_int, _P, _P, _P, c_double)),
+    ("remove_buffer_range_cb", CFUNCTYPE(c_int, _P, _P, _P, c_double, c_double)),
+    ("change_source_buffer_type_cb", CFUNCTYPE(c_int, _P, _P, _P, _P)),
+    ("load_resource_cb", CFUNCTYPE(c_int, _P, _P, _P, _P, _P, c_int, c_int, c_int, c_void_p, c_uint,
+                                   POINTER(LoadResourceResult))),
+    ("delete_resource_cb", CFUNCTYPE(c_int, _P, _P)),
+    ("request_key_system_cb", CFUNCTYPE(c_int, _P, _P, _P, POINTER(c_void_p))),
+    ("cdm_create_cb", CFUNCTYPE(c_int, _P, _P, _P, c_int, c_int, POINTER(c_void_p))),
+    ("cdm_set_server_certificate_cb", CFUNCTYPE(c_int, _P, _P, c_void_p, c_uint)),
+    ("cdm_session_create_cb", CFUNCTYPE(c_int, _P, _P, _P, _P, _P, c_void_p, c_uint, POINTER(c_void_p),
+                                        POINTER(c_double))),
+    ("cdm_session_update_cb", CFUNCTYPE(c_int, _P, _P, _P, _P, c_void_p, c_uint)),
+    ("cdm_session_load_cb", CFUNCTYPE(c_int, _P, _P, _P, _P, POINTER(c_int), POINTER(c_double))),
+    ("cdm_session_remove_cb", CFUNCTYPE(c_int, _P, _P, _P, _P)),
+    ("cdm_session_close_cb", CFUNCTYPE(c_int, _P, _P, _P, _P)),
+    ("set_cdm_cb", CFUNCTYPE(c_int, _P, _P, _P)),
+    ("send_message_cb", CFUNCTYPE(c_int, _P, _P, POINTER(c_void_p))),
+    ("on_page_load_cb", CFUNCTYPE(c_int, _P)),
+    ("on_address_bar_changed_cb", CFUNCTYPE(c_int, _P, _P)),
+    ("on_title_changed_cb", CFUNCTYPE(c_int, _P, _P)),
+    ("on_page_close_cb", CFUNCTYPE(c_int, _P)),
+    ("get_frame_buffer_cb", CFUNCTYPE(c_void_p, _P, c_uint)),
+]
+CALLBACK_TYPE = dict(CALLBACK_TYPES)
+
+
+class Callbacks(Structure):
+    _fields_ = CALLBACK_TYPES
+
+
+def _load():
+    """Loads the library from $APPFLINGER_LIB, from the directory of the package or from the system library path."""
+    name = "libappflinger.dylib" if sys.platform == "darwin" else "libappflinger.so"
+    candidates = [
+        os.environ.get("APPFLINGER_LIB"),
+        os.path.join(os.path.dirname(os.path.abspath(__file__)), name),
+        name,
+    ]
+    err = None
+    for path in candidates:
+        if not path:
+            continue
+        try:
+            return ctypes.CDLL(path)
+        except OSError as e:
+            err = e
+    raise OSError("Failed to load libappflinger, set APPFLINGER_LIB to its path: %s" % err)
+
+
+def _declare(lib):
+    def fn(name, restype, *argtypes):
+        f = getattr(lib, name)
+        f.restype = restype
+        f.argtypes = list(argtypes)
+
+    # Strings returned by the library are declared as c_void_p so that they can be freed
+    fn("SessionStart", c_int, c_char_p, c_char_p, c_char_p, c_int, c_int, c_char_p, c_char_p, c_int, c_int,
+       POINTER(Callbacks))
+    fn("SessionStop", c_int, c_int)
+    fn("SessionRelease", c_int, c_int)
+    fn("SessionUIStreamStart", c_int, c_int, c_char_p, c_int, c_int)
+    fn("SessionUIStreamStop", c_int, c_int)
+    fn("SessionSetFrameOptions", c_int, c_int, c_int)
+    fn("SessionSetUIBitstreamFormat", c_int, c_int, c_int)
+    fn("SessionGetSessionId", c_void_p, c_int)
+    fn("SessionGetSessionContext", c_int, c_char_p)
+    fn("SessionGetUIURL", c_void_p, c_int, c_char_p, c_int, c_int)
+    fn("SessionGetURLCookies", c_void_p, c_int, c_char_p)
+    fn("SessionSendEvent", c_int, c_int, c_char_p, c_int, c_int, c_int, c_int, c_int)
+    fn("SessionSendNotificationVideoStateChange", c_int, c_int, c_char_p, c_int, c_int, c_int, c_int, c_double,
+       c_double, c_int, c_int)
+    fn("SessionSendNotification", c_int, c_int, c_char_p, c_void_p, c_uint)
+    fn("GetErrCode", c_int)
+    fn("GetErr", c_void_p)
+    fn("FreeErr", None, c_void_p)
+    fn("appflinger_frame_release", None, c_void_p)
+    return lib
+
+
+lib = _declare(_load())
+
+# Strings returned by callbacks through char ** arguments are freed by the library, hence they need to be
+# allocated by the C allocator which the library uses.
+_libc = ctypes.CDLL(ctypes.util.find_library("c"))
+_libc.malloc.restype = c_void_p
+_libc.malloc.argtypes = [ctypes.c_size_t]
+
+
+def c_malloc_bytes(data):
+    """Returns a copy of the given bytes in memory allocated with malloc(), NUL terminated."""
+    ptr = _libc.malloc(len(data) + 1)
+    if not ptr:
+        raise MemoryError()
+    ctypes.memmove(ptr, data + b"\0", len(data) + 1)
+    return ptr
+
+
+def take_string(ptr):
+    """Returns the string at the given pointer which was returned by the library and frees it, None for NULL."""
+    if not ptr:
+        return None
+    try:
+        return ctypes.string_at(ptr).decode("utf-8")
+    finally:
+        # FreeErr() just calls free(), so it frees any string returned by the library
+        lib.FreeErr(ptr)
@@ -0,0 +1,372 @@
+# Copyright 2015 TVersity Inc. All rights reserved.
+# Use of this source code is governed by an Apache 2.0
+# license that can be found in the LICENSE file.
+
+"""The listener of the control channel commands and of the UI frames of a session."""
+
+import ctypes
+import json
+import logging
+
+from . import _lib
+
+log = logging.getLogger("appflinger")
+
+# Network state constants (used by get_network_state())
+NETWORK_STATE_EMPTY = 0
+NETWORK_STATE_IDLE = 1
+NETWORK_STATE_LOADING = 2
+NETWORK_STATE_LOADED = 3
+NETWORK_STATE_FORMAT_ERROR = 4
+NETWORK_STATE_NETWORK_ERROR = 5
+NETWORK_STATE_DECODE_ERROR = 6
+
+# Ready state constants (used by get_ready_state())
+READY_STATE_HAVE_NOTHING = 0
+READY_STATE_HAVE_METADATA = 1
+READY_STATE_HAVE_CURRENT_DATA = 2
+READY_STATE_HAVE_FUTURE_DATA = 3
+READY_STATE_HAVE_ENOUGH_DATA = 4
+
+
+class LoadResourceResult(object):
+    """The result of Listener.load_resource()."""
+
+    def __init__(self, code="404", headers="", buffer_id="", buffer_length=0, payload=b""):
+        self.code = code
+        self.headers = headers
+        self.buffer_id = buffer_id
+        self.buffer_length = buffer_length
+        self.payload = payload
+
+
+class Listener(object):
+    """Receives the control channel commands and the UI frames of a session.
+
+    Subclass it and override the methods of interest, or assign callables to the attributes of an instance, e.g.
+    listener.load = lambda session_id, instance_id, url: print(url). A method fails by raising an exception.
+    The methods are called on threads of the library, hence they need to be thread safe.
+
+    The media methods below the getters are optional, when they are not overridden the library responds
+    on behalf of the client as if they succeeded. The defaults of the required methods do the same.
+    """
+
+    # Required callbacks
+
+    def on_ui_frame(self, session_id, is_codec_config, is_key_frame, idx, pts, dts, data):
+        pass
+
+    def on_ui_discontinuity(self, session_id):
+        """Called before the first frame following a discontinuity of the UI stream (e.g. a reconnection), which
+        is a codec config frame, so that the decoder can be reset. The timestamps are not continuous across it."""
+        pass
+
+    def load(self, session_id, instance_id, url):
+        pass
+
+    def set_rect(self, session_id, instance_id, x, y, width, height):
+        pass
+
+    def cancel_load(self, session_id, instance_id):
+        pass
+
+    def pause(self, session_id, instance_id):
+        pass
+
+    def play(self, session_id, instance_id):
+        pass
+
+    def seek(self, session_id, instance_id, time):
+        pass
+
+    def get_paused(self, session_id, instance_id):
+        return True
+
+    def get_seeking(self, session_id, instance_id):
+        return False
+
+    def get_duration(self, session_id, instance_id):
+        return 0.0
+
+    def get_current_time(self, session_id, instance_id):
+        return 0.0
+
+    def get_network_state(self, session_id, instance_id):
+        return NETWORK_STATE_EMPTY
+
+    def get_ready_state(self, session_id, instance_id):
+        return READY_STATE_HAVE_NOTHING
+
+    # Optional callbacks
+
+    def get_seekable(self, session_id, instance_id):
+        """Returns a list of (start, end) tuples."""
+        return []
+
+    def get_buffered(self, session_id, instance_id):
+        """Returns a list of (start, end) tuples."""
+        return []
+
+    def set_visible(self, session_id, instance_id, visible):
+        pass
+
+    def set_rate(self, session_id, instance_id, rate):
+        pass
+
+    def set_volume(self, session_id, instance_id, volume):
+        pass
+
+    def add_source_buffer(self, session_id, instance_id, source_id, mime_type):
+        pass
+
+    def remove_source_buffer(self, session_id, instance_id, source_id):
+        pass
+
+    def abort_source_buffer(self, session_id, instance_id, source_id):
+        pass
+
+    def append_buffer(self, session_id, instance_id, source_id, append_window_start, append_window_end, buffer_id,
+                      buffer_offset, buffer_length, payload):
+        """Returns the buffered time ranges as a list of (start, end) tuples."""
+        return []
+
+    def set_append_mode(self, session_id, instance_id, source_id, mode):
+        pass
+
+    def set_append_timestamp_offset(self, session_id, instance_id, source_id, timestamp_offset):
+        pass
+
+    def remove_buffer_range(self, session_id, instance_id, source_id, start, end):
+        pass
+
+    def change_source_buffer_type(self, session_id, instance_id, source_id, mime_type):
+        pass
+
+    def load_resource(self, session_id, url, method, headers, resource_id, byte_range_start, byte_range_end,
+                      sequence_number, payload):
+        """Returns a LoadResourceResult."""
+        return LoadResourceResult()
+
+    def delete_resource(self, session_id, buffer_id):
+        pass
+
+    def request_key_system(self, session_id, key_system, supported_configurations):
+        """Gets and returns EME MediaKeySystemConfiguration dicts, the result is a single configuration."""
+        return {}
+
+    def cdm_create(self, session_id, key_system, security_origin, allow_distinctive_identifier,
+                   allow_persistent_state):
+        """Returns the CDM id."""
+        return ""
+
+    def cdm_set_server_certificate(self, session_id, cdm_id, payload):
+        pass
+
+    def cdm_session_create(self, session_id, event_instance_id, cdm_id, session_type, init_data_type, payload):
+        """Returns a (cdm_session_id, expiration) tuple."""
+        return "", 0.0
+
+    def cdm_session_update(self, session_id, event_instance_id, cdm_id, cdm_session_id, payload):
+        pass
+
+    def cdm_session_load(self, session_id, event_instance_id, cdm_id, cdm_session_id):
+        """Returns a (loaded, expiration) tuple."""
+        return False, 0.0
+
+    def cdm_session_remove(self, session_id, event_instance_id, cdm_id, cdm_session_id):
+        pass
+
+    def cdm_session_close(self, session_id, event_instance_id, cdm_id, cdm_session_id):
+        pass
+
+    def set_cdm(self, session_id, instance_id, cdm_id):
+        pass
+
+    def send_message(self, session_id, message):
+        """Returns the response to the message."""
+        return ""
+
+    def on_page_load(self, session_id):
+        pass
+
+    def on_address_bar_changed(self, session_id, url):
+        pass
+
+    def on_title_changed(self, session_id, title):
+        pass
+
+    def on_page_close(self, session_id):
+        pass
+
+
+# The callbacks which are always registered, the library does not check them for NULL
+_REQUIRED = set([
+    "on_ui_frame", "load", "set_rect", "cancel_load", "pause", "play", "seek", "get_paused", "get_seeking",
+    "get_duration", "get_current_time", "get_network_state", "get_ready_state",
+])
+
+
+def _overridden(listener, name):
+    attr = getattr(listener, name)
+    return getattr(attr, "__func__", attr) is not getattr(Listener, name)
+
+
+def _str(val):
+    return val.decode("utf-8") if val is not None else ""
+
+
+def _bytes(ptr, length):
+    return ctypes.string_at(ptr, length) if ptr and length else b""
+
+
+def _fill_ranges(result, ranges):
+    ranges = list(ranges)[:_lib.MAX_TIME_RANGES]
+    for i, (start, end) in enumerate(ranges):
+        result.contents.start[i] = start
+        result.contents.end[i] = end
+    result.contents.length = len(ranges)
+
+
+def _make_adapters(listener):
+    """Returns the functions which convert the C arguments of each callback to Python and invoke the listener."""
+    l = listener
+
+    def on_ui_frame(sid, is_codec_config, is_key_frame, is_discontinuity, idx, pts, dts, data, data_len):
+        if is_discontinuity:
+            l.on_ui_discontinuity(_str(sid))
+        l.on_ui_frame(_str(sid), bool(is_codec_config), bool(is_key_frame), idx, pts, dts, _bytes(data, data_len))
+
+    def get_paused(sid, iid, paused):
+        paused[0] = int(bool(l.get_paused(_str(sid), _str(iid))))
+
+    def get_seeking(sid, iid, seeking):
+        seeking[0] = int(bool(l.get_seeking(_str(sid), _str(iid))))
+
+    def get_duration(sid, iid, duration):
+        duration[0] = float(l.get_duration(_str(sid), _str(iid)))
+
+    def get_current_time(sid, iid, current_time):
+        current_time[0] = float(l.get_current_time(_str(sid), _str(iid)))
+
+    def get_network_state(sid, iid, network_state):
+        network_state[0] = int(l.get_network_state(_str(sid), _str(iid)))
+
+    def get_ready_state(sid, iid, ready_state):
+        ready_state[0] = int(l.get_ready_state(_str(sid), _str(iid)))
+
+    def get_seekable(sid, iid, result):
+        _fill_ranges(result, l.get_seekable(_str(sid), _str(iid)))
+
+    def get_buffered(sid, iid, result):
+        _fill_ranges(result, l.get_buffered(_str(sid), _str(iid)))
+
+    def append_buffer(sid, iid, source_id, window_start, window_end, buffer_id, buffer_offset, buffer_length,
+                      payload, payload_len, result):
+        _fill_ranges(result, l.append_buffer(_str(sid), _str(iid), _str(source_id), window_start, window_end,
+                                             _str(buffer_id), buffer_offset, buffer_length,
+                                             _bytes(payload, payload_len)))
+
+    def load_resource(sid, url, method, headers, resource_id, range_start, range_end, sequence_number, payload,
+                      payload_len, result):
+        res = l.load_resource(_str(sid), _str(url), _str(method), _str(headers), _str(resource_id), range_start,
+                              range_end, sequence_number, _bytes(payload, payload_len))
+        r = result.contents
+        r.code = _lib.c_malloc_bytes(str(res.code).encode("utf-8"))
+        r.headers = _lib.c_malloc_bytes(res.headers.encode("utf-8"))
+        r.buffer_id = _lib.c_malloc_bytes(res.buffer_id.encode("utf-8"))
+        r.buffer_length = res.buffer_length
+        if res.payload:
+            r.payload = _lib.c_malloc_bytes(res.payload)
+            r.payload_len = len(res.payload)
+
+    def request_key_system(sid, key_system, configurations, result):
+        res = l.request_key_system(_str(sid), _str(key_system), json.loads(_str(configurations) or "[]"))
+        result[0] = _lib.c_malloc_bytes(json.dumps(res).encode("utf-8"))
+
+    def cdm_create(sid, key_system, security_origin, allow_distinctive_identifier, allow_persistent_state, cdm_id):
+        res = l.cdm_create(_str(sid), _str(key_system), _str(security_origin), bool(allow_distinctive_identifier),
+                           bool(allow_persistent_state))
+        cdm_id[0] = _lib.c_malloc_bytes(res.encode("utf-8"))
+
+    def cdm_set_server_certificate(sid, cdm_id, payload, payload_len):
+        l.cdm_set_server_certificate(_str(sid), _str(cdm_id), _bytes(payload, payload_len))
+
+    def cdm_session_create(sid, eiid, cdm_id, session_type, init_data_type, payload, payload_len, cdm_session_id,
+                           expiration):
+        res_id, res_expiration = l.cdm_session_create(_str(sid), _str(eiid), _str(cdm_id), _str(session_type),
+                                                      _str(init_data_type), _bytes(payload, payload_len))
+        cdm_session_id[0] = _lib.c_malloc_bytes(res_id.encode("utf-8"))
+        expiration[0] = float(res_expiration)
+
+    def cdm_session_update(sid, eiid, cdm_id, cdm_session_id, payload, payload_len):
+        l.cdm_session_update(_str(sid), _str(eiid), _str(cdm_id), _str(cdm_session_id), _bytes(payload, payload_len))
+
+    def cdm_session_load(sid, eiid, cdm_id, cdm_session_id, loaded, expiration):
+        res_loaded, res_expiration = l.cdm_session_load(_str(sid), _str(eiid), _str(cdm_id), _str(cdm_session_id))
+        loaded[0] = int(bool(res_loaded))
+        expiration[0] = float(res_expiration)
+
+    def send_message(sid, message, result):
+        res = l.send_message(_str(sid), _str(message))
+        result[0] = _lib.c_malloc_bytes((res or "").encode("utf-8"))
+
+    def simple(name):
+        # Callbacks whose arguments are all strings and numbers and which return nothing
+        def adapter(*args):
+            getattr(l, name)(*[_str(a) if isinstance(a, bytes) or a is None else a for a in args])
+        return adapter
+
+    adapters = dict(
+        on_ui_frame=on_ui_frame,
+        get_paused=get_paused,
+        get_seeking=get_seeking,
+        get_duration=get_duration,
+        get_current_time=get_current_time,
+        get_network_state=get_network_state,
+        get_ready_state=get_ready_state,
+        get_seekable=get_seekable,
+        get_buffered=get_buffered,
+        append_buffer=append_buffer,
+        load_resource=load_resource,
+        request_key_system=request_key_system,
+        cdm_create=cdm_create,
+        cdm_set_server_certificate=cdm_set_server_certificate,
+        cdm_session_create=cdm_session_create,
+        cdm_session_update=cdm_session_update,
+        cdm_session_load=cdm_session_load,
+        send_message=send_message,
+    )
+    adapters["set_visible"] = lambda sid, iid, visible: l.set_visible(_str(sid), _str(iid), bool(visible))
+    for name in ("load", "set_rect", "cancel_load", "pause", "play", "seek", "set_rate", "set_volume",
+                 "add_source_buffer", "remove_source_buffer", "abort_source_buffer", "set_append_mode",
+                 "set_append_timestamp_offset", "remove_buffer_range", "change_source_buffer_type",
+                 "delete_resource", "cdm_session_remove", "cdm_session_close", "set_cdm", "on_page_load",
+                 "on_address_bar_changed", "on_title_changed", "on_page_close"):
+        adapters[name] = simple(name)
+    return adapters
+
+
+def _guard(name, adapter):
+    """Wraps an adapter so that exceptions are logged and reported to the library as a failure."""
+    def callback(*args):
+        try:
+            adapter(*args)
+            return 0
+        except Exception:
+            log.exception("Listener callback %s failed", name)
+            return -1
+    return callback
+
+
+def make_callbacks(listener):
+    """Returns the appflinger_callbacks_t struct of the listener along with the function objects it references,
+    which need to be kept alive for as long as the session handle exists."""
+    callbacks = _lib.Callbacks()
+    refs = []
+    for name, adapter in _make_adapters(listener).items():
+        if name not in _REQUIRED and not _overridden(listener, name):
+            continue
+        fn = _lib.CALLBACK_TYPE[name + "_cb"](_guard(name, adapter))
+        refs.append(fn)
+        setattr(callbacks, name + "_cb", fn)
+    return callbacks, refs
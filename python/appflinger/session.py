@@ -0,0 +1,168 @@
+# Copyright 2015 TVersity Inc. All rights reserved.
+# Use of this source code is governed by an Apache 2.0
+# license that can be found in the LICENSE file.
+
+"""Sessions of libappflinger."""
+
+import json
+import threading
+
+from . import _lib
+from .listener import Listener, make_callbacks
+
+lib = _lib.lib
+
+# Error codes, see appflinger_err_t in libappflinger/errors.h
+ERR_GENERIC = -1
+ERR_INVALID_HANDLE = -2
+ERR_INVALID_ARGUMENT = -3
+ERR_INVALID_STATE = -4
+ERR_NETWORK = -5
+ERR_SERVER = -6
+ERR_SESSION_NOT_FOUND = -7
+ERR_NOT_SUPPORTED = -8
+ERR_INTERRUPTED = -9
+
+# Frame delivery flags, see appflinger_frame_flags_t in libappflinger/callbacks.h
+FRAME_INLINE = 0x0
+FRAME_THREAD = 0x1
+FRAME_RETAIN = 0x2
+
+# Bitstream formats of the frames, see appflinger_bitstream_format_t in libappflinger/callbacks.h
+BITSTREAM_ANNEXB = 0x0
+BITSTREAM_AVCC = 0x1
+
+# Media formats supported for UI stream
+UI_FMT_TS_H264 = "mp2t;h264"
+UI_FMT_TS_HEVC = "mp2t;hevc"
+
+# Event types
+EVENT_KEY = "key"
+EVENT_KEYDOWN = "keydown"
+EVENT_KEYUP = "keyup"
+EVENT_CLICK = "click"
+
+
+class AppflingerError(Exception):
+    """Raised when a call to the library fails, code is one of ERR_*."""
+
+    def __init__(self, code, message):
+        Exception.__init__(self, message)
+        self.code = code
+
+
+def _check(rc):
+    """Raises the error of the calling thread if the return code of the library indicates a failure."""
+    if rc < 0:
+        raise AppflingerError(rc, _lib.take_string(lib.GetErr()) or "Unknown error")
+    return rc
+
+
+def _check_str(ptr):
+    if not ptr:
+        _check(lib.GetErrCode() or ERR_GENERIC)
+    return _lib.take_string(ptr)
+
+
+def _enc(val):
+    return (val or "").encode("utf-8")
+
+
+class Session(object):
+    """A session of the AppFlinger server, created with Session.start()."""
+
+    def __init__(self, handle, listener, callbacks, refs):
+        self._handle = handle
+        self._mutex = threading.Lock()
+        # The library keeps pointers to the callbacks struct and to the functions it references
+        self.listener = listener
+        self._callbacks = callbacks
+        self._refs = refs
+
+    @classmethod
+    def start(cls, server_protocol_host, browser_url, listener=None, session_id="", pull_mode=True,
+              is_video_passthru=True, browser_ui_output_url="", video_stream_url="", width=1280, height=720):
+        """Starts a session (or connects to the existing session with the given id) and returns it."""
+        listener = listener or Listener()
+        callbacks, refs = make_callbacks(listener)
+        handle = _check(lib.SessionStart(_enc(server_protocol_host), _enc(session_id), _enc(browser_url),
+                                         int(pull_mode), int(is_video_passthru), _enc(browser_ui_output_url),
+                                         _enc(video_stream_url), width, height, callbacks))
+        return cls(handle, listener, callbacks, refs)
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *exc):
+        if self._handle is not None:
+            self.stop()
+
+    @property
+    def handle(self):
+        if self._handle is None:
+            raise AppflingerError(ERR_INVALID_HANDLE, "Session was stopped or released")
+        return self._handle
+
+    @property
+    def session_id(self):
+        return _check_str(lib.SessionGetSessionId(self.handle))
+
+    def stop(self):
+        """Stops the session, the session cannot be used afterwards."""
+        with self._mutex:
+            handle, self._handle = self.handle, None
+        _check(lib.SessionStop(handle))
+
+    def release(self):
+        """Releases the session handle without stopping the session."""
+        with self._mutex:
+            handle, self._handle = self.handle, None
+        _check(lib.SessionRelease(handle))
+
+    def ui_stream_start(self, fmt=UI_FMT_TS_H264, ts_discon=False, bitrate=0):
+        """Starts streaming the UI, frames are passed to Listener.on_ui_frame()."""
+        _check(lib.SessionUIStreamStart(self.handle, _enc(fmt), int(ts_discon), bitrate))
+
+    def ui_stream_stop(self):
+        _check(lib.SessionUIStreamStop(self.handle))
+
+    def set_frame_options(self, flags):
+        """Sets how frames are passed to Listener.on_ui_frame(), see FRAME_*. Since the data of each frame is
+        copied to a bytes object, FRAME_RETAIN is of no use here."""
+        _check(lib.SessionSetFrameOptions(self.handle, flags & ~FRAME_RETAIN))
+
+    def set_ui_bitstream_format(self, fmt):
+        """Sets the bitstream format of the frames passed to Listener.on_ui_frame(), see BITSTREAM_*.
+        It takes effect on the next ui_stream_start()."""
+        _check(lib.SessionSetUIBitstreamFormat(self.handle, fmt))
+
+    def get_ui_url(self, fmt=UI_FMT_TS_H264, ts_discon=False, bitrate=0):
+        """Returns the URL from which the UI can be streamed, see get_url_cookies()."""
+        return _check_str(lib.SessionGetUIURL(self.handle, _enc(fmt), int(ts_discon), bitrate))
+
+    def get_url_cookies(self, uri):
+        """Returns the value of the Cookie header which needs to be sent when fetching the given URL."""
+        return _check_str(lib.SessionGetURLCookies(self.handle, _enc(uri)))
+
+    def send_event(self, event_type, code=0, char="", mod=0, x=0, y=0):
+        """Injects an input event, see EVENT_*."""
+        _check(lib.SessionSendEvent(self.handle, _enc(event_type), code, ord(char) if char else 0, mod, x, y))
+
+    def send_key(self, code, char="", mod=0):
+        """Injects a key press, i.e. keydown followed by keyup."""
+        self.send_event(EVENT_KEY, code=code, char=char, mod=mod)
+
+    def send_click(self, x, y, mod=0):
+        self.send_event(EVENT_CLICK, x=x, y=y, mod=mod)
+
+    def send_notification(self, instance_id, payload):
+        """Sends a notification on behalf of a media instance, the payload is either bytes or JSON serializable."""
+        if not isinstance(payload, bytes):
+            payload = json.dumps(payload).encode("utf-8")
+        _check(lib.SessionSendNotification(self.handle, _enc(instance_id), payload, len(payload)))
+
+    def send_video_state_change(self, instance_id, ready_state, network_state, paused, seeking, duration, time,
+                                video_width, video_height):
+        _check(lib.SessionSendNotificationVideoStateChange(self.handle, _enc(instance_id), ready_state,
+                                                           network_state, int(paused), int(seeking), duration, time,
+                                                           video_width, video_height))
@@ -0,0 +1,248 @@
+# Copyright 2015 TVersity Inc. All rights reserved.
+# Use of this source code is governed by an Apache 2.0
+# license that can be found in the LICENSE file.
+
+"""Fixtures of the tests of the bindings: the library, built with the Go toolchain unless $APPFLINGER_LIB is set,
+and a fake AppFlinger server."""
+
+import json
+import os
+import shutil
+import subprocess
+import sys
+import tempfile
+import threading
+import time
+
+try:
+    from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+except ImportError:  # Python < 3.7
+    from http.server import BaseHTTPRequestHandler, HTTPServer
+    from socketserver import ThreadingMixIn
+
+    class ThreadingHTTPServer(ThreadingMixIn, HTTPServer):
+        daemon_threads = True
+
+try:
+    from urllib.parse import parse_qs, urlparse
+except ImportError:
+    from urlparse import parse_qs, urlparse
+
+import pytest
+
+ROOT = os.path.dirname(os.path.dirname(os.path.dirname(os.path.abspath(__file__))))
+sys.path.insert(0, os.path.join(ROOT, "python"))
+
+SESSION_ID = "test-session"
+
+
+def _build_lib():
+    """Builds the library into a temporary directory, the bindings load it from $APPFLINGER_LIB."""
+    if os.environ.get("APPFLINGER_LIB"):
+        return
+    if not shutil.which("go"):
+        pytest.exit("Set APPFLINGER_LIB to the path of libappflinger.so or install the Go toolchain to build it")
+    out = os.path.join(tempfile.mkdtemp(prefix="appflinger"), "libappflinger.so")
+    subprocess.check_call(["go", "build", "-buildmode", "c-shared", "-o", out, "."],
+                          cwd=os.path.join(ROOT, "libappflinger"))
+    os.environ["APPFLINGER_LIB"] = out
+
+
+def pytest_configure(config):
+    # Before the test modules import the bindings, which load the library
+    _build_lib()
+
+
+class FakeServer(object):
+    """A minimal AppFlinger server. The control channel returns the queued requests, one per poll, the UI stream
+    returns ui_stream and every request is recorded as a (path, query, body) tuple."""
+
+    def __init__(self):
+        self.requests = []
+        self.control = []
+        self.ui_stream = b""
+        self.cond = threading.Condition()
+
+        server = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def log_message(self, *args):
+                pass
+
+            def do_GET(self):
+                self.handle_request(b"")
+
+            def do_POST(self):
+                length = int(self.headers.get("Content-Length") or 0)
+                self.handle_request(self.rfile.read(length))
+
+            def handle_request(self, body):
+                url = urlparse(self.path)
+                with server.cond:
+                    server.requests.append((url.path, parse_qs(url.query), body))
+                    server.cond.notify_all()
+                status, data = server.respond(url.path)
+                try:
+                    self.send_response(status)
+                    self.send_header("Content-Type", "text/json")
+                    self.send_header("Content-Length", str(len(data)))
+                    self.end_headers()
+                    self.wfile.write(data)
+                except (BrokenPipeError, ConnectionResetError):
+                    # The library cancels the pending requests when the session stops
+                    pass
+
+        self.httpd = ThreadingHTTPServer(("127.0.0.1", 0), Handler)
+        self.url = "http://127.0.0.1:%d" % self.httpd.server_address[1]
+        self.thread = threading.Thread(target=self.httpd.serve_forever)
+        self.thread.daemon = True
+        self.thread.start()
+
+    def respond(self, path):
+        if path == "/osb/session/start":
+            return 200, json.dumps({"SessionID": SESSION_ID}).encode("utf-8")
+        if path == "/osb/session/control":
+            with self.cond:
+                if not self.control:
+                    # Long poll
+                    self.cond.wait(0.2)
+                if self.control:
+                    return 200, (json.dumps(self.control.pop(0)) + "\n\n").encode("utf-8")
+            return 200, b"\n\n"
+        if path == "/osb/session/ui":
+            return 200, self.ui_stream
+        if path in ("/osb/session/stop", "/osb/session/event", "/osb/session/control/response"):
+            return 200, b"{}"
+        return 404, b""
+
+    def send_control(self, service, **params):
+        """Queues a control channel request and returns its id."""
+        with self.cond:
+            request_id = str(len(self.requests) + len(self.control) + 1)
+            req = dict(sessionId=SESSION_ID, requestId=request_id, service=service)
+            req.update(params)
+            self.control.append(req)
+            self.cond.notify_all()
+        return request_id
+
+    def wait_request(self, match, timeout=10):
+        """Waits for a request for which match(path, query, body) is true and returns it."""
+        deadline = time.time() + timeout
+        with self.cond:
+            while True:
+                for req in self.requests:
+                    if match(*req):
+                        return req
+                remaining = deadline - time.time()
+                if remaining <= 0:
+                    raise AssertionError("Request not received, got %s" % [r[0] for r in self.requests])
+                self.cond.wait(remaining)
+
+    def wait_response(self, request_id, timeout=10):
+        """Waits for the response of the library to a control channel request and returns it as a dict."""
+        def match(path, query, body):
+            return body.startswith(b"{") and json.loads(body.split(b"\n\n")[0]).get("requestId") == request_id
+        _, _, body = self.wait_request(match, timeout)
+        return json.loads(body.split(b"\n\n")[0])
+
+    def close(self):
+        self.httpd.shutdown()
+        self.httpd.server_close()
+
+
+@pytest.fixture
+def server():
+    srv = FakeServer()
+    yield srv
+    srv.close()
+
+
+# A minimal MPEG-TS muxer for the UI stream, a single H.264 stream
+
+_PMT_PID = 0x1000
+_VIDEO_PID = 0x100
+
+
+def _crc32(data):
+    crc = 0xffffffff
+    for b in bytearray(data):
+        crc ^= b << 24
+        for _ in range(8):
+            crc = ((crc << 1) ^ 0x04c11db7 if crc & 0x80000000 else crc << 1) & 0xffffffff
+    return crc
+
+
+def _section(table_id, table_ext, body):
+    length = 5 + len(body) + 4
+    data = bytearray([table_id, 0xb0 | length >> 8, length & 0xff, table_ext >> 8, table_ext & 0xff, 0xc1, 0, 0])
+    data += body
+    crc = _crc32(data)
+    return bytes(data) + bytes(bytearray([crc >> 24, (crc >> 16) & 0xff, (crc >> 8) & 0xff, crc & 0xff]))
+
+
+def _ts_packets(pid, payload, counters, pcr=None, random_access=False):
+    """Splits the payload into TS packets, the first one has the payload unit start indicator set and the PCR."""
+    packets = b""
+    first = True
+    while first or payload:
+        adaptation = None
+        if first and pcr is not None:
+            adaptation = bytearray([0x50 if random_access else 0x10, pcr >> 25 & 0xff, pcr >> 17 & 0xff,
+                                    pcr >> 9 & 0xff, pcr >> 1 & 0xff, (pcr & 1) << 7 | 0x7e, 0])
+        room = 184 - (1 + len(adaptation) if adaptation is not None else 0)
+        if len(payload) < room:
+            # Stuffing in the adaptation field
+            stuffing = room - len(payload)
+            if adaptation is None:
+                adaptation = bytearray()
+                stuffing -= 1  # The length of the adaptation field
+                if stuffing > 0:
+                    adaptation.append(0)  # The flags
+                    stuffing -= 1
+            adaptation += b"\xff" * stuffing
+            room = len(payload)
+        chunk, payload = payload[:room], payload[room:]
+        counters[pid] = (counters.get(pid, -1) + 1) & 0xf
+        header = bytearray([0x47, (0x40 if first else 0) | pid >> 8, pid & 0xff, counters[pid]])
+        if adaptation is not None:
+            header[3] |= 0x30
+            header += bytearray([len(adaptation)]) + adaptation
+        else:
+            header[3] |= 0x10
+        packets += bytes(header) + chunk
+        first = False
+    return packets
+
+
+def _timestamp(prefix, ts):
+    return bytearray([prefix << 4 | (ts >> 29 & 0xe) | 1, ts >> 22 & 0xff, (ts >> 14 & 0xfe) | 1, ts >> 7 & 0xff,
+                      (ts << 1 & 0xfe) | 1])
+
+
+SPS = b"\x67\x42\xc0\x1e\xda\x02\x80\xbf\xe5\x84\x00\x00\x03\x00\x04\x00\x00\x03\x00\xf0\x3c\x58\xb9\x20"
+PPS = b"\x68\xce\x3c\x80"
+FRAME_INTERVAL = 3000  # 30 fps in 90 kHz units
+
+
+def slice_nalu(i):
+    """The NAL unit of the i-th frame, an IDR slice for the first one. It does not end with a zero byte, which
+    would be taken as part of the next start code."""
+    return (b"\x65" if i == 0 else b"\x41") + bytes(bytearray([0x88, (i & 0x7f) + 1])) * 50
+
+
+def make_ts(frames, start=90000):
+    """Returns an MPEG-TS stream of the given number of H.264 frames, the first one is a key frame."""
+    counters = {}
+    pat = _section(0x00, 1, bytearray([0, 1, 0xe0 | _PMT_PID >> 8, _PMT_PID & 0xff]))
+    pmt = _section(0x02, 1, bytearray([0xe0 | _VIDEO_PID >> 8, _VIDEO_PID & 0xff, 0xf0, 0,
+                                       0x1b, 0xe0 | _VIDEO_PID >> 8, _VIDEO_PID & 0xff, 0xf0, 0]))
+    out = _ts_packets(0, b"\x00" + pat, counters) + _ts_packets(_PMT_PID, b"\x00" + pmt, counters)
+    for i in range(frames):
+        ts = start + i * FRAME_INTERVAL
+        es = b"\x00\x00\x00\x01\x09\xf0"
+        if i == 0:
+            es += b"\x00\x00\x00\x01" + SPS + b"\x00\x00\x00\x01" + PPS
+        es += b"\x00\x00\x00\x01" + slice_nalu(i)
+        pes = bytearray([0, 0, 1, 0xe0, 0, 0, 0x80, 0xc0, 10]) + _timestamp(3, ts) + _timestamp(1, ts) + es
+        out += _ts_packets(_VIDEO_PID, bytes(pes), counters, pcr=ts, random_access=i == 0)
+    return out
@@ -0,0 +1,204 @@
+# Copyright 2015 TVersity Inc. All rights reserved.
+# Use of this source code is governed by an Apache 2.0
+# license that can be found in the LICENSE file.
+
+import threading
+
+import pytest
+
+import appflinger
+from appflinger import _lib
+from appflinger.session import _check
+
+from conftest import FRAME_INTERVAL, PPS, SESSION_ID, SPS, make_ts, slice_nalu
+
+TIMEOUT = 10
+
+
+def test_start_send_stop(server):
+    session = appflinger.Session.start(server.url, "http://www.example.com/")
+    try:
+        assert session.session_id == SESSION_ID
+        _, query, _ = server.wait_request(lambda path, query, body: path == "/osb/session/start")
+        assert query["browser_url"] == ["http://www.example.com/"]
+
+        session.send_key(appflinger.KEY_DOWN)
+        _, query, _ = server.wait_request(lambda path, query, body: path == "/osb/session/event")
+        assert query["session_id"] == [SESSION_ID]
+        assert query["type"] == [appflinger.EVENT_KEY]
+        assert query["code"] == [str(appflinger.KEY_DOWN)]
+
+        session.send_notification("instance1", {"type": "custom"})
+        server.wait_request(lambda path, query, body: path == "/osb/session/control/response" and b"custom" in body)
+    finally:
+        session.stop()
+    server.wait_request(lambda path, query, body: path == "/osb/session/stop" and query["session_id"] == [SESSION_ID])
+
+    with pytest.raises(appflinger.AppflingerError) as err:
+        session.send_key(appflinger.KEY_UP)
+    assert err.value.code == appflinger.ERR_INVALID_HANDLE
+
+
+def test_start_failure():
+    # Nothing listens on the port
+    with pytest.raises(appflinger.AppflingerError) as err:
+        appflinger.Session.start("http://127.0.0.1:1", "http://www.example.com/")
+    assert err.value.code == appflinger.ERR_NETWORK
+    assert str(err.value)
+
+
+class RecordingListener(appflinger.Listener):
+    def __init__(self):
+        self.titles = []
+        self.frames = []
+        self.discontinuities = []  # The number of frames received before each discontinuity
+        self.cond = threading.Condition()
+
+    def on_title_changed(self, session_id, title):
+        with self.cond:
+            self.titles.append((session_id, title))
+            self.cond.notify_all()
+
+    def get_paused(self, session_id, instance_id):
+        if instance_id == "broken":
+            raise ValueError("Broken instance")
+        return False
+
+    def get_duration(self, session_id, instance_id):
+        return 12.5
+
+    def send_message(self, session_id, message):
+        return "pong:" + message
+
+    def on_ui_frame(self, session_id, is_codec_config, is_key_frame, idx, pts, dts, data):
+        with self.cond:
+            self.frames.append((is_codec_config, is_key_frame, idx, pts, dts, data))
+            self.cond.notify_all()
+
+    def on_ui_discontinuity(self, session_id):
+        with self.cond:
+            self.discontinuities.append(len(self.frames))
+            self.cond.notify_all()
+
+    def wait(self, predicate):
+        with self.cond:
+            assert self.cond.wait_for(predicate, TIMEOUT)
+
+
+def test_callbacks(server):
+    listener = RecordingListener()
+    with appflinger.Session.start(server.url, "http://www.example.com/", listener):
+        server.send_control("onTitleChanged", title="Hello")
+        listener.wait(lambda: listener.titles)
+        assert listener.titles == [(SESSION_ID, "Hello")]
+
+        resp = server.wait_response(server.send_control("getPaused", instanceId="instance1"))
+        assert resp["result"] == "OK"
+        assert resp["paused"] == "0"
+
+        resp = server.wait_response(server.send_control("getDuration", instanceId="instance1"))
+        assert resp["result"] == "OK"
+        assert resp["duration"] == "12.5"
+
+        # The string returned by the callback is freed by the library
+        resp = server.wait_response(server.send_control("sendMessage", message="ping"))
+        assert resp["result"] == "OK"
+        assert resp["message"] == "pong:ping"
+
+        # An exception fails the callback
+        resp = server.wait_response(server.send_control("getPaused", instanceId="broken"))
+        assert resp["result"] == "ERROR"
+
+
+def test_release_from_callback(server):
+    released = threading.Event()
+
+    class ReleasingListener(appflinger.Listener):
+        def on_title_changed(self, session_id, title):
+            session.release()
+            released.set()
+
+    session = appflinger.Session.start(server.url, "http://www.example.com/", ReleasingListener())
+    server.send_control("onTitleChanged", title="Hello")
+    # Releasing the handle must not wait for the callback which releases it
+    assert released.wait(TIMEOUT)
+    with pytest.raises(appflinger.AppflingerError) as err:
+        session.send_key(appflinger.KEY_UP)
+    assert err.value.code == appflinger.ERR_INVALID_HANDLE
+
+
+@pytest.mark.parametrize("flags", [appflinger.FRAME_INLINE, appflinger.FRAME_THREAD])
+def test_ui_frames(server, flags):
+    server.ui_stream = make_ts(10)
+    listener = RecordingListener()
+    with appflinger.Session.start(server.url, "http://www.example.com/", listener) as session:
+        session.set_frame_options(flags)
+        session.ui_stream_start()
+        listener.wait(lambda: len(listener.frames) >= 3)
+        session.ui_stream_stop()
+
+    config, key, delta = listener.frames[:3]
+    assert config == (True, False, 0, 0, 0, b"\0\0\1" + SPS + b"\0\0\1" + PPS)
+    # In Annex B format the parameter sets are repeated before each key frame
+    assert key == (False, True, 0, 0, 0, b"\0\0\1" + SPS + b"\0\0\1" + PPS + b"\0\0\1" + slice_nalu(0))
+    assert delta == (False, False, 0, FRAME_INTERVAL, FRAME_INTERVAL, b"\0\0\1" + slice_nalu(1))
+    assert listener.discontinuities == []
+
+
+def test_ui_discontinuity(server):
+    server.ui_stream = make_ts(10)
+    listener = RecordingListener()
+    with appflinger.Session.start(server.url, "http://www.example.com/", listener) as session:
+        session.ui_stream_start()
+        # The stream ends after 10 frames, the library reconnects and the stream starts over
+        listener.wait(lambda: listener.discontinuities and len(listener.frames) > listener.discontinuities[0] + 1)
+        session.ui_stream_stop()
+
+    first = listener.discontinuities[0]
+    # The 10 frames and the codec config frame were received before the reconnection
+    assert first == 11
+    config, key = listener.frames[first:first + 2]
+    assert config[:2] == (True, False)
+    assert key[:2] == (False, True)
+    # The timestamps keep increasing across the discontinuity
+    assert key[3] > listener.frames[first - 1][3]
+
+
+@pytest.fixture
+def freed(monkeypatch):
+    """Records the pointers freed using FreeErr()."""
+    pointers = []
+    free = _lib.lib.FreeErr
+
+    def record(ptr):
+        pointers.append(ptr)
+        free(ptr)
+    monkeypatch.setattr(_lib.lib, "FreeErr", record)
+    return pointers
+
+
+def test_errors(freed):
+    with pytest.raises(appflinger.AppflingerError) as err:
+        _check(_lib.lib.SessionStop(12345))
+    assert err.value.code == appflinger.ERR_INVALID_HANDLE
+    assert str(err.value) == "Invalid session handle"
+    # The message was copied and freed once, while the error of the thread is kept
+    assert len(freed) == 1
+    assert _lib.lib.GetErrCode() == appflinger.ERR_INVALID_HANDLE
+    assert _lib.take_string(_lib.lib.GetErr()) == "Invalid session handle"
+    assert len(freed) == 2
+
+
+def test_take_string(server, freed):
+    assert _lib.take_string(None) is None
+    assert freed == []
+
+    with appflinger.Session.start(server.url, "http://www.example.com/") as session:
+        assert session.session_id == SESSION_ID
+        assert session.session_id == SESSION_ID
+        # Each call returns a new string which is freed once
+        assert len(freed) == 2
+
+        url = session.get_ui_url()
+        assert url.startswith(server.url + "/osb/session/ui?")
+        assert len(freed) == 3
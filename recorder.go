@@ -0,0 +1,376 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Container formats of a UIRecorder
+	UI_RECORD_FMT_TS   = "ts"   // MPEG-TS
+	UI_RECORD_FMT_FMP4 = "fmp4" // Fragmented MP4
+
+	// In ring buffer mode without a maximum segment duration, the ring buffer is split in this many segments
+	_RECORD_RING_SEGMENTS = 6
+)
+
+// UIRecorderConfig holds the settings of a UIRecorder.
+type UIRecorderConfig struct {
+	Format string // One of the UI_RECORD_FMT_* constants, UI_RECORD_FMT_TS if empty
+
+	// The file of the first segment, the following segments are named after it with a sequence number before the
+	// extension, e.g. ui.ts, ui-1.ts, ui-2.ts
+	Path string
+
+	// A new segment is started at the first video key frame after the current segment reached either limit,
+	// zero for no limit. In UI_RECORD_FMT_FMP4 format a new segment is also started when the codec configuration
+	// changes, e.g. when the audio starts.
+	MaxSegmentSize     int64
+	MaxSegmentDuration time.Duration
+
+	// In ring buffer mode only the segments covering the last RingDuration are kept, the older ones are deleted, see
+	// UIRecorder.Save(). Zero to keep all the segments.
+	RingDuration time.Duration
+}
+
+// UIRecorder records the UI stream, video and audio, to MPEG-TS or fragmented MP4 files. It is passed the frames
+// either by SessionAddUIFrameSink() (see also SessionUIRecordStart()), which includes the audio, or by forwarding the
+// calls to OnUIFrame() or OnUIFrameData() of the AppflingerListener. The recording starts at the first video key
+// frame and keeps the timestamps of the frames, each segment starts with a video key frame. When the UI stream is
+// restarted its timestamps start over, which is signalled by the discontinuity_indicator in MPEG-TS, whereas in
+// fragmented MP4 the timestamps are shifted to follow the previous ones.
+type UIRecorder struct {
+	config   UIRecorderConfig
+	mutex    sync.Mutex
+	remuxer  *uiRemuxer
+	file     *os.File
+	writer   *bufio.Writer
+	segments []*uiRecordSegment // The segments which are kept, the last one being recorded
+	next     int                // The sequence number of the next segment
+	err      error              // The error which stopped the recording
+	closed   bool
+}
+
+// uiRecordSegment is a file of a UIRecorder.
+type uiRecordSegment struct {
+	path     string
+	header   []byte // The fMP4 initialization segment, empty in MPEG-TS
+	size     int64
+	startDTS int64
+}
+
+// NewUIRecorder creates a recorder, the files are created once the first video key frame is received.
+func NewUIRecorder(config *UIRecorderConfig) (rec *UIRecorder, err error) {
+	if config == nil || config.Path == "" {
+		return nil, withClass(ErrInvalidArgument, errors.New("Missing UI recording path"))
+	}
+	rec = &UIRecorder{config: *config}
+	var writer uiContainerWriter
+	switch config.Format {
+	case "", UI_RECORD_FMT_TS:
+		rec.config.Format = UI_RECORD_FMT_TS
+		writer = newUITsWriter()
+	case UI_RECORD_FMT_FMP4:
+		writer = newUIFMP4Writer()
+	default:
+		return nil, withClass(ErrInvalidArgument, fmt.Errorf("Invalid UI recording format: %s", config.Format))
+	}
+	if config.MaxSegmentSize < 0 || config.MaxSegmentDuration < 0 || config.RingDuration < 0 {
+		return nil, withClass(ErrInvalidArgument, errors.New("Invalid UI recording limits"))
+	}
+	if rec.config.RingDuration > 0 && rec.config.MaxSegmentDuration == 0 {
+		rec.config.MaxSegmentDuration = rec.config.RingDuration / _RECORD_RING_SEGMENTS
+	}
+	rec.remuxer = newUIRemuxer(writer, rec)
+	return rec, nil
+}
+
+// OnUIFrame records a frame passed to AppflingerListener.OnUIFrame(), the data must not be modified afterwards.
+func (rec *UIRecorder) OnUIFrame(sessionId string, isCodecConfig bool, isKeyFrame bool, idx int, pts int, dts int, data []byte) (err error) {
+	return rec.OnUIFrameData(sessionId, &UIFrame{
+		IsCodecConfig: isCodecConfig,
+		IsKeyFrame:    isKeyFrame,
+		Idx:           idx,
+		PTS:           int64(pts),
+		DTS:           int64(dts),
+		Data:          data,
+	})
+}
+
+// OnUIFrameData records a frame, it implements UIFrameListener. Once writing fails the recording stops, the error is
+// returned once and then by Close().
+func (rec *UIRecorder) OnUIFrameData(sessionId string, frame *UIFrame) (err error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.closed || rec.err != nil {
+		return nil
+	}
+	return rec.fail(rec.remuxer.writeFrame(frame))
+}
+
+// fail stops the recording on error, it is called with the mutex locked.
+func (rec *UIRecorder) fail(err error) error {
+	if err != nil && rec.err == nil {
+		rec.err = fmt.Errorf("UI recording failed: %w", err)
+		rec.closeFile()
+		return rec.err
+	}
+	return err
+}
+
+// Segments returns the files of the recording which are kept, the last one being recorded.
+func (rec *UIRecorder) Segments() (paths []string) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	for _, segment := range rec.segments {
+		paths = append(paths, segment.path)
+	}
+	return
+}
+
+// Save writes the segments which are kept to a single file, e.g. the last minute in ring buffer mode. In
+// UI_RECORD_FMT_FMP4 format only the segments following the last change of the codec configuration are saved. The
+// recording goes on while the segments are copied.
+func (rec *UIRecorder) Save(path string) (err error) {
+	segments, err := rec.snapshot()
+	if err != nil {
+		return
+	}
+	defer func() {
+		for _, segment := range segments {
+			segment.file.Close()
+		}
+	}()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	for _, segment := range segments {
+		if _, err = io.Copy(file, io.NewSectionReader(segment.file, segment.offset, segment.size-segment.offset)); err != nil {
+			break
+		}
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return
+}
+
+// uiSavedSegment is the part of a segment file which is copied by UIRecorder.Save().
+type uiSavedSegment struct {
+	file   *os.File
+	offset int64 // The length of the header when it is skipped
+	size   int64 // The size of the segment when it was opened, the last segment grows afterwards
+}
+
+// snapshot flushes the recording and opens the segments to be saved, so that they can be copied without holding the
+// mutex. Once open they remain readable if the ring buffer deletes them meanwhile.
+func (rec *UIRecorder) snapshot() (segments []uiSavedSegment, err error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.err != nil {
+		return nil, rec.err
+	}
+	if len(rec.segments) == 0 {
+		return nil, withClass(ErrInvalidState, errors.New("Nothing was recorded yet"))
+	}
+	if !rec.closed {
+		// Write the buffered samples so that the last segment is complete
+		if err = rec.fail(rec.remuxer.flush()); err != nil {
+			return
+		}
+		if err = rec.fail(rec.writer.Flush()); err != nil {
+			return
+		}
+	}
+
+	kept := rec.segments[rec.ringStart(rec.remuxer.lastDTS):]
+	if rec.config.Format == UI_RECORD_FMT_FMP4 {
+		// The segments are concatenated under the initialization segment of the first one
+		first := len(kept) - 1
+		for first > 0 && bytes.Equal(kept[first-1].header, kept[first].header) {
+			first--
+		}
+		kept = kept[first:]
+	}
+	for i, segment := range kept {
+		file, e := os.Open(segment.path)
+		if e != nil {
+			for _, saved := range segments {
+				saved.file.Close()
+			}
+			return nil, e
+		}
+		saved := uiSavedSegment{file: file, size: segment.size}
+		if i > 0 && rec.config.Format == UI_RECORD_FMT_FMP4 {
+			saved.offset = int64(len(segment.header))
+		}
+		segments = append(segments, saved)
+	}
+	return segments, nil
+}
+
+// Close ends the recording and returns the error which stopped it, if any.
+func (rec *UIRecorder) Close() (err error) {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.closed {
+		return rec.err
+	}
+	if rec.err == nil && rec.file != nil {
+		rec.fail(rec.remuxer.flush())
+		rec.fail(rec.closeFile())
+	}
+	rec.closed = true
+	return rec.err
+}
+
+// closeFile closes the file of the current segment, it is called with the mutex locked.
+func (rec *UIRecorder) closeFile() (err error) {
+	if rec.file == nil {
+		return nil
+	}
+	err = rec.writer.Flush()
+	if e := rec.file.Close(); err == nil {
+		err = e
+	}
+	rec.file, rec.writer = nil, nil
+	return
+}
+
+// segmentPath returns the file name of a segment given its sequence number.
+func (rec *UIRecorder) segmentPath(n int) string {
+	if n == 0 {
+		return rec.config.Path
+	}
+	ext := filepath.Ext(rec.config.Path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(rec.config.Path, ext), n, ext)
+}
+
+// cutSegment implements uiSegmentOutput.
+func (rec *UIRecorder) cutSegment(dts int64) bool {
+	segment := rec.segments[len(rec.segments)-1]
+	return (rec.config.MaxSegmentSize > 0 && segment.size >= rec.config.MaxSegmentSize) ||
+		(rec.config.MaxSegmentDuration > 0 && dts-segment.startDTS >= durationToUITime(rec.config.MaxSegmentDuration))
+}
+
+// startSegment implements uiSegmentOutput.
+func (rec *UIRecorder) startSegment(header []byte, dts int64, discontinuity bool) (err error) {
+	if err = rec.closeFile(); err != nil {
+		return
+	}
+	if discontinuity {
+		// Keep the start of the previous segments in the timeline of the new UI stream for the ring buffer
+		shift := rec.remuxer.lastDTS - dts
+		for _, segment := range rec.segments {
+			segment.startDTS -= shift
+		}
+	}
+
+	// In ring buffer mode the oldest segments are deleted once the following ones cover the ring buffer
+	first := rec.ringStart(dts)
+	for _, segment := range rec.segments[:first] {
+		os.Remove(segment.path)
+	}
+	rec.segments = rec.segments[first:]
+
+	segment := &uiRecordSegment{path: rec.segmentPath(rec.next), header: append([]byte(nil), header...), startDTS: dts}
+	rec.next++
+	rec.file, err = os.Create(segment.path)
+	if err != nil {
+		return
+	}
+	rec.writer = bufio.NewWriter(rec.file)
+	rec.segments = append(rec.segments, segment)
+	return rec.writeData(header)
+}
+
+// ringStart returns the index of the first segment covering the ring buffer which ends at the given DTS.
+func (rec *UIRecorder) ringStart(dts int64) (first int) {
+	if rec.config.RingDuration == 0 {
+		return 0
+	}
+	limit := dts - durationToUITime(rec.config.RingDuration)
+	for first+1 < len(rec.segments) && rec.segments[first+1].startDTS <= limit {
+		first++
+	}
+	return
+}
+
+// writeData implements uiSegmentOutput.
+func (rec *UIRecorder) writeData(data []byte) (err error) {
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err = rec.writer.Write(data); err != nil {
+		return
+	}
+	rec.segments[len(rec.segments)-1].size += int64(len(data))
+	return nil
+}
+
+// durationToUITime converts a duration to UI_TIMESCALE units.
+func durationToUITime(d time.Duration) int64 {
+	return int64(math.Round(d.Seconds() * UI_TIMESCALE))
+}
+
+// SessionUIRecordStart starts recording the UI stream of the session with a new UIRecorder, which is added as a frame
+// sink. The recording lasts until SessionUIRecordStop() or the end of the session, across UI stream restarts.
+func SessionUIRecordStart(ctx *SessionContext, config *UIRecorderConfig) (rec *UIRecorder, err error) {
+	rec, err = NewUIRecorder(config)
+	if err != nil {
+		return
+	}
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.uiRecorder != nil {
+		return nil, withClass(ErrInvalidState, errors.New("UI is already being recorded"))
+	}
+	ctx.uiRecorder = rec
+	ctx.uiRecorderSinkId = ctx.addUIFrameSink(rec)
+	return rec, nil
+}
+
+// SessionUIRecordStop stops the recording started by SessionUIRecordStart() and returns the error which stopped it
+// earlier, if any.
+func SessionUIRecordStop(ctx *SessionContext) (err error) {
+	ctx.mutex.Lock()
+	rec := ctx.uiRecorder
+	if rec != nil {
+		ctx.removeUIFrameSink(ctx.uiRecorderSinkId)
+		ctx.uiRecorder = nil
+	}
+	ctx.mutex.Unlock()
+	if rec == nil {
+		return withClass(ErrInvalidState, errors.New("UI is not being recorded"))
+	}
+	return rec.Close()
+}
+
+// SessionUIRecordSave saves the recording started by SessionUIRecordStart() to a single file, see UIRecorder.Save().
+func SessionUIRecordSave(ctx *SessionContext, path string) (err error) {
+	ctx.mutex.Lock()
+	rec := ctx.uiRecorder
+	ctx.mutex.Unlock()
+	if rec == nil {
+		return withClass(ErrInvalidState, errors.New("UI is not being recorded"))
+	}
+	return rec.Save(path)
+}
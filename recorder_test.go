@@ -0,0 +1,176 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordTestFrames passes the frames to the recorder.
+func recordTestFrames(t *testing.T, rec *UIRecorder, frames []*UIFrame) {
+	for _, frame := range frames {
+		if err := rec.OnUIFrameData("recorder-session", frame); err != nil {
+			t.Fatalf("OnUIFrameData() failed: %v", err)
+		}
+	}
+}
+
+func TestNewUIRecorder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ui.ts")
+	tests := []struct {
+		name   string
+		config *UIRecorderConfig
+		valid  bool
+	}{
+		{"default format", &UIRecorderConfig{Path: path}, true},
+		{"fmp4", &UIRecorderConfig{Path: path, Format: UI_RECORD_FMT_FMP4}, true},
+		{"ring buffer", &UIRecorderConfig{Path: path, RingDuration: time.Minute}, true},
+		{"missing config", nil, false},
+		{"missing path", &UIRecorderConfig{}, false},
+		{"invalid format", &UIRecorderConfig{Path: path, Format: "avi"}, false},
+		{"negative limit", &UIRecorderConfig{Path: path, MaxSegmentSize: -1}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewUIRecorder(test.config)
+			if test.valid && err != nil {
+				t.Errorf("NewUIRecorder() failed: %v", err)
+			} else if !test.valid && !errors.Is(err, ErrInvalidArgument) {
+				t.Errorf("NewUIRecorder() returned %v, want ErrInvalidArgument", err)
+			}
+		})
+	}
+}
+
+func TestUIRecorderSave(t *testing.T) {
+	for _, format := range []string{UI_RECORD_FMT_TS, UI_RECORD_FMT_FMP4} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			rec, err := NewUIRecorder(&UIRecorderConfig{Format: format, Path: filepath.Join(dir, "ui"),
+				MaxSegmentDuration: 800 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewUIRecorder() failed: %v", err)
+			}
+			if err = rec.Save(filepath.Join(dir, "empty")); !errors.Is(err, ErrInvalidState) {
+				t.Errorf("Save() returned %v before the recording, want ErrInvalidState", err)
+			}
+
+			// A segment every 20 frames, and one more when the UI stream is restarted
+			recordTestFrames(t, rec, testUIFrames(90000, 40, true))
+			recordTestFrames(t, rec, testUIFrames(0, 20, true))
+			paths := rec.Segments()
+			if len(paths) != 3 {
+				t.Fatalf("got segments %v, want 3", paths)
+			}
+			saved := filepath.Join(dir, "saved")
+			if err = rec.Save(saved); err != nil {
+				t.Fatalf("Save() failed: %v", err)
+			}
+			data, _ := os.ReadFile(saved)
+
+			// The segments are concatenated, in fMP4 under the initialization segment of the first one
+			var want []byte
+			var header []byte
+			for i, path := range paths {
+				segment, _ := os.ReadFile(path)
+				if format == UI_RECORD_FMT_FMP4 {
+					boxes := parseMP4Boxes(t, segment)
+					header = segment[:boxes[2].offset]
+					if i > 0 {
+						segment = segment[len(header):]
+					}
+				}
+				want = append(want, segment...)
+			}
+			if !bytes.Equal(data, want) {
+				t.Fatalf("saved %d bytes, want the %d bytes of the segments", len(data), len(want))
+			}
+
+			if format == UI_RECORD_FMT_TS {
+				pkts, _ := readUIPackets(data)
+				if len(pkts) != 120 {
+					t.Errorf("saved %d packets, want 120", len(pkts))
+				}
+				if !discontinuityFound(data, _MUX_TS_VIDEO_PID) {
+					t.Error("the restart is not signalled")
+				}
+			} else {
+				// The decode times keep increasing across the restart
+				decodeTime := int64(90000)
+				for i, fragment := range parseFMP4Fragments(t, data) {
+					if fragment.track != _MUX_FMP4_VIDEO_TRACK {
+						continue
+					}
+					if fragment.decodeTime != decodeTime {
+						t.Errorf("video fragment %d: decode time %d, want %d", i, fragment.decodeTime, decodeTime)
+					}
+					for _, duration := range fragment.durations {
+						decodeTime += duration
+					}
+				}
+				if want := int64(90000 + 60*testVideoInterval); decodeTime != want {
+					t.Errorf("video ends at %d, want %d", decodeTime, want)
+				}
+			}
+
+			// The recording goes on after saving, and can be saved after it is closed
+			recordTestFrames(t, rec, testUIFrames(20*testVideoInterval, 20, true)[2:])
+			if err = rec.Close(); err != nil {
+				t.Fatalf("Close() failed: %v", err)
+			}
+			if err = rec.Save(saved); err != nil {
+				t.Fatalf("Save() failed after Close(): %v", err)
+			}
+			if info, _ := os.Stat(saved); info.Size() <= int64(len(data)) {
+				t.Errorf("saved %d bytes after recording more, want more than %d", info.Size(), len(data))
+			}
+		})
+	}
+}
+
+func TestUIRecorderRingBuffer(t *testing.T) {
+	dir := t.TempDir()
+	// A segment per GOP
+	rec, err := NewUIRecorder(&UIRecorderConfig{Path: filepath.Join(dir, "ui.ts"), RingDuration: time.Second})
+	if err != nil {
+		t.Fatalf("NewUIRecorder() failed: %v", err)
+	}
+	recordTestFrames(t, rec, testUIFrames(0, 60, true))
+
+	// The segments older than the ring buffer are deleted
+	want := []string{"ui-2.ts", "ui-3.ts", "ui-4.ts", "ui-5.ts"}
+	paths := rec.Segments()
+	if len(paths) != len(want) {
+		t.Fatalf("got segments %v, want %v", paths, want)
+	}
+	for i, path := range paths {
+		if filepath.Base(path) != want[i] {
+			t.Errorf("got segments %v, want %v", paths, want)
+			break
+		}
+	}
+	for _, name := range []string{"ui.ts", "ui-1.ts"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", name)
+		}
+	}
+
+	// Only the segments covering the last second are saved
+	saved := filepath.Join(dir, "saved.ts")
+	if err = rec.Save(saved); err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	data, _ := os.ReadFile(saved)
+	pkts, _ := readUIPackets(data)
+	if len(pkts) != 60 || pkts[0].isAudio() || pkts[0].dts != 30*testVideoInterval+_MUX_TS_OFFSET {
+		t.Errorf("saved %d packets, want the 30 last video and audio frames", len(pkts))
+	}
+	rec.Close()
+}
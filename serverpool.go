@@ -0,0 +1,314 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Server selection policies of a ServerPool
+	SERVER_SELECT_WEIGHTED = 0 // Random order, the probability of a server being first is proportional to its weight
+	SERVER_SELECT_LATENCY  = 1 // Lowest probe latency first
+	SERVER_SELECT_ORDER    = 2 // The order in which the servers were added, i.e. primary and backups
+
+	// Weight of the new probe latency in the moving average
+	_SERVER_LATENCY_ALPHA = 0.3
+)
+
+// ServerPoolConfig holds the settings of a ServerPool, zero values are replaced by defaults.
+type ServerPoolConfig struct {
+	Selection     int           // One of the SERVER_SELECT_* constants
+	ProbeInterval time.Duration // Period of the health probes started by Start(), 30 seconds if zero
+	ProbeTimeout  time.Duration // Maximum time of a probe, 5 seconds if zero
+	ProbePath     string        // Path requested by the probes, "/" if empty, any response but a server error means that the server is up
+}
+
+// ServerStatus describes a server of a ServerPool, see ServerPool.Servers().
+type ServerStatus struct {
+	ServerProtocolHost string
+	Weight             int
+	Healthy            bool          // False after a failed probe or a failed session start until the next success
+	Latency            time.Duration // Moving average of the probe and session start latency, zero if unknown
+	LastCheck          time.Time     // Time of the last probe or session start, zero if never checked
+}
+
+// ServerPool is a set of AppFlinger servers (e.g. regional clusters) among which sessions are started,
+// see SessionOptions.ServerPool. SessionStartWithOptions() tries the servers in the order given by the
+// selection policy, healthy servers first, and fails over to the next server when a server cannot be connected to
+// or fails with a server error.
+type ServerPool struct {
+	config  ServerPoolConfig
+	mutex   sync.Mutex
+	servers []*ServerStatus
+	rand    *rand.Rand
+	client  *http.Client // Used by the probes
+	stop    chan bool    // Non nil while the periodic probes are running
+	done    chan bool
+}
+
+// NewServerPool returns an empty pool with the given configuration, nil means the default configuration.
+func NewServerPool(config *ServerPoolConfig) *ServerPool {
+	pool := &ServerPool{
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		client: newHTTPClient(newHTTPTransports(nil).tr, nil),
+	}
+	if config != nil {
+		pool.config = *config
+	}
+	if pool.config.ProbeInterval <= 0 {
+		pool.config.ProbeInterval = 30 * time.Second
+	}
+	if pool.config.ProbeTimeout <= 0 {
+		pool.config.ProbeTimeout = 5 * time.Second
+	}
+	if pool.config.ProbePath == "" {
+		pool.config.ProbePath = "/"
+	}
+	return pool
+}
+
+// Add adds a server to the pool, the weight is only used by SERVER_SELECT_WEIGHTED and is at least 1.
+// Servers are considered healthy until a probe or a session start fails.
+func (pool *ServerPool) Add(serverProtocolHost string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, server := range pool.servers {
+		if server.ServerProtocolHost == serverProtocolHost {
+			server.Weight = weight
+			return
+		}
+	}
+	pool.servers = append(pool.servers, &ServerStatus{
+		ServerProtocolHost: serverProtocolHost,
+		Weight:             weight,
+		Healthy:            true,
+	})
+}
+
+// Servers returns the status of the servers of the pool.
+func (pool *ServerPool) Servers() []ServerStatus {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	servers := make([]ServerStatus, len(pool.servers))
+	for i, server := range pool.servers {
+		servers[i] = *server
+	}
+	return servers
+}
+
+// find returns the server with the given host, it is called with the mutex locked.
+func (pool *ServerPool) find(serverProtocolHost string) *ServerStatus {
+	for _, server := range pool.servers {
+		if server.ServerProtocolHost == serverProtocolHost {
+			return server
+		}
+	}
+	return nil
+}
+
+// report updates the status of a server following a probe or a session start.
+func (pool *ServerPool) report(serverProtocolHost string, healthy bool, latency time.Duration) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	server := pool.find(serverProtocolHost)
+	if server == nil {
+		return
+	}
+	if server.Healthy && !healthy {
+		log.Println("Server is unhealthy: ", serverProtocolHost)
+	} else if !server.Healthy && healthy {
+		log.Println("Server is healthy again: ", serverProtocolHost)
+	}
+	server.Healthy = healthy
+	server.LastCheck = time.Now()
+	if healthy && latency > 0 {
+		if server.Latency == 0 {
+			server.Latency = latency
+		} else {
+			server.Latency = time.Duration(_SERVER_LATENCY_ALPHA*float64(latency) + (1-_SERVER_LATENCY_ALPHA)*float64(server.Latency))
+		}
+	}
+}
+
+// candidates returns the hosts in the order in which they should be tried, healthy servers first.
+func (pool *ServerPool) candidates() []string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	var healthy, unhealthy []*ServerStatus
+	for _, server := range pool.servers {
+		if server.Healthy {
+			healthy = append(healthy, server)
+		} else {
+			unhealthy = append(unhealthy, server)
+		}
+	}
+
+	switch pool.config.Selection {
+	case SERVER_SELECT_WEIGHTED:
+		healthy = pool.weightedOrder(healthy)
+	case SERVER_SELECT_LATENCY:
+		// Servers with an unknown latency go last
+		sort.SliceStable(healthy, func(i, j int) bool {
+			li, lj := healthy[i].Latency, healthy[j].Latency
+			if li == 0 || lj == 0 {
+				return lj == 0 && li != 0
+			}
+			return li < lj
+		})
+	}
+
+	// Unhealthy servers are still tried as a last resort, least recently checked first
+	sort.SliceStable(unhealthy, func(i, j int) bool {
+		return unhealthy[i].LastCheck.Before(unhealthy[j].LastCheck)
+	})
+
+	hosts := make([]string, 0, len(pool.servers))
+	for _, server := range append(healthy, unhealthy...) {
+		hosts = append(hosts, server.ServerProtocolHost)
+	}
+	return hosts
+}
+
+// weightedOrder returns the servers in a random order, picking each next server with a probability proportional
+// to its weight. It is called with the mutex locked.
+func (pool *ServerPool) weightedOrder(servers []*ServerStatus) []*ServerStatus {
+	remaining := append([]*ServerStatus(nil), servers...)
+	ordered := make([]*ServerStatus, 0, len(servers))
+	for len(remaining) > 0 {
+		total := 0
+		for _, server := range remaining {
+			total += server.Weight
+		}
+		pick := pool.rand.Intn(total)
+		i := 0
+		for ; pick >= remaining[i].Weight; i++ {
+			pick -= remaining[i].Weight
+		}
+		ordered = append(ordered, remaining[i])
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return ordered
+}
+
+// probe checks whether the given server is reachable.
+func (pool *ServerPool) probe(serverProtocolHost string) {
+	reqCtx, cancel := context.WithTimeout(context.Background(), pool.config.ProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodHead, serverProtocolHost+pool.config.ProbePath, nil)
+	if err != nil {
+		pool.report(serverProtocolHost, false, 0)
+		return
+	}
+
+	start := time.Now()
+	res, err := pool.client.Do(req)
+	if err != nil {
+		log.Println("Server probe failed: ", err)
+		pool.report(serverProtocolHost, false, 0)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= http.StatusInternalServerError {
+		log.Println("Server probe failed with status: ", res.Status)
+		pool.report(serverProtocolHost, false, 0)
+		return
+	}
+	pool.report(serverProtocolHost, true, time.Since(start))
+}
+
+// Probe checks all the servers of the pool concurrently and returns once done.
+func (pool *ServerPool) Probe() {
+	var wg sync.WaitGroup
+	for _, host := range pool.candidates() {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			pool.probe(host)
+		}(host)
+	}
+	wg.Wait()
+}
+
+// Start probes the servers periodically in the background until Stop() is called.
+func (pool *ServerPool) Start() (err error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.stop != nil {
+		return withClass(ErrInvalidState, errors.New("Server pool probing is already started"))
+	}
+	pool.stop = make(chan bool)
+	pool.done = make(chan bool)
+	go pool.run(pool.stop, pool.done)
+	return nil
+}
+
+func (pool *ServerPool) run(stop chan bool, done chan bool) {
+	defer close(done)
+	ticker := time.NewTicker(pool.config.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		pool.Probe()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stop stops the periodic probes.
+func (pool *ServerPool) Stop() (err error) {
+	pool.mutex.Lock()
+	stop, done := pool.stop, pool.done
+	pool.stop = nil
+	pool.mutex.Unlock()
+	if stop == nil {
+		return withClass(ErrInvalidState, errors.New("Server pool probing is not started"))
+	}
+	close(stop)
+	<-done
+	return nil
+}
+
+// serverFailed checks whether a failed session start means that the server is unhealthy.
+func serverFailed(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= http.StatusInternalServerError
+	}
+	return errors.Is(err, ErrNetwork)
+}
+
+// shouldFailover checks whether a failed session start should be retried with another server. This is only the case
+// when the server failed with an error status or could not be connected to. Other network errors (e.g. a response
+// timeout) may happen after the server started the session, which retrying with another server would orphan.
+func shouldFailover(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= http.StatusInternalServerError
+	}
+	if !errors.Is(err, ErrNetwork) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerPoolCandidates(t *testing.T) {
+	now := time.Now()
+	type server struct {
+		host      string
+		healthy   bool
+		latency   time.Duration
+		lastCheck time.Time
+	}
+	tests := []struct {
+		name      string
+		selection int
+		servers   []server
+		want      []string
+	}{
+		{"empty", SERVER_SELECT_ORDER, nil, []string{}},
+		{"order", SERVER_SELECT_ORDER, []server{
+			{"a", true, 3, now}, {"b", true, 1, now}, {"c", true, 2, now},
+		}, []string{"a", "b", "c"}},
+		{"unhealthy last", SERVER_SELECT_ORDER, []server{
+			{"a", false, 0, now}, {"b", true, 0, now}, {"c", true, 0, now},
+		}, []string{"b", "c", "a"}},
+		{"unhealthy least recently checked first", SERVER_SELECT_ORDER, []server{
+			{"a", false, 0, now}, {"b", false, 0, now.Add(-time.Minute)}, {"c", true, 0, now},
+		}, []string{"c", "b", "a"}},
+		{"latency", SERVER_SELECT_LATENCY, []server{
+			{"a", true, 30, now}, {"b", true, 10, now}, {"c", true, 20, now},
+		}, []string{"b", "c", "a"}},
+		{"unknown latency last", SERVER_SELECT_LATENCY, []server{
+			{"a", true, 0, now}, {"b", true, 20, now}, {"c", true, 0, now}, {"d", true, 10, now},
+		}, []string{"d", "b", "a", "c"}},
+		{"latency of unhealthy servers ignored", SERVER_SELECT_LATENCY, []server{
+			{"a", false, 1, now}, {"b", true, 20, now}, {"c", true, 10, now},
+		}, []string{"c", "b", "a"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := NewServerPool(&ServerPoolConfig{Selection: test.selection})
+			for _, s := range test.servers {
+				pool.Add(s.host, 1)
+				status := pool.find(s.host)
+				status.Healthy, status.Latency, status.LastCheck = s.healthy, s.latency, s.lastCheck
+			}
+			if got := pool.candidates(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestServerPoolWeighted(t *testing.T) {
+	pool := NewServerPool(nil)
+	pool.rand = rand.New(rand.NewSource(1))
+	pool.Add("heavy", 9)
+	pool.Add("light", 1)
+	pool.Add("down", 100)
+	pool.report("down", false, 0)
+
+	const runs = 1000
+	first := map[string]int{}
+	for i := 0; i < runs; i++ {
+		hosts := pool.candidates()
+		if len(hosts) != 3 || hosts[2] != "down" {
+			t.Fatalf("got %v, want the unhealthy server last", hosts)
+		}
+		first[hosts[0]]++
+	}
+	// The heavy server is first about 90% of the time
+	if n := first["heavy"]; n < runs*8/10 || n > runs*95/100 {
+		t.Errorf("heavy server first %d times out of %d", n, runs)
+	}
+}
+
+func TestServerPoolReport(t *testing.T) {
+	pool := NewServerPool(nil)
+	pool.Add("a", 1)
+	pool.report("a", true, 100)
+	pool.report("a", true, 200)
+	status := pool.Servers()[0]
+	if want := time.Duration(_SERVER_LATENCY_ALPHA*200 + (1-_SERVER_LATENCY_ALPHA)*100); status.Latency != want {
+		t.Errorf("latency %v, want %v", status.Latency, want)
+	}
+	pool.report("a", false, 0)
+	if status = pool.Servers()[0]; status.Healthy || status.Latency == 0 {
+		t.Errorf("got %+v, want an unhealthy server which keeps its latency", status)
+	}
+}
+
+func TestShouldFailover(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+	status := func(code int) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		t.Cleanup(srv.Close)
+		return srv.URL
+	}
+	closed := httptest.NewServer(nil)
+	closed.Close()
+
+	tests := []struct {
+		name         string
+		uri          string
+		failover     bool
+		serverFailed bool
+	}{
+		{"connection refused", closed.URL, true, true},
+		{"response timeout", slow.URL, false, true},
+		{"server error", status(http.StatusServiceUnavailable), true, true},
+		{"client error", status(http.StatusBadRequest), false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &http.Client{Timeout: 200 * time.Millisecond}
+			err := apiReq(client, test.uri, nil, nil, nil)
+			if err == nil {
+				t.Fatal("request succeeded")
+			}
+			if got := shouldFailover(err); got != test.failover {
+				t.Errorf("shouldFailover(%v) = %v, want %v", err, got, test.failover)
+			}
+			if got := serverFailed(err); got != test.serverFailed {
+				t.Errorf("serverFailed(%v) = %v, want %v", err, got, test.serverFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// SessionState is the state of a session, see SessionGetState().
+type SessionState int
+
+const (
+	SESSION_STATE_STARTING     SessionState = iota // The session was started and the control channel is connecting
+	SESSION_STATE_RUNNING                          // The control channel is connected
+	SESSION_STATE_RECONNECTING                     // The control channel was interrupted and is reconnecting
+	SESSION_STATE_STOPPING                         // SessionStop() was called
+	SESSION_STATE_STOPPED                          // The session was stopped by the client or terminated by the server (terminal state)
+	SESSION_STATE_FAILED                           // The control channel failed, the session can only be stopped
+)
+
+var sessionStateNames = map[SessionState]string{
+	SESSION_STATE_STARTING:     "starting",
+	SESSION_STATE_RUNNING:      "running",
+	SESSION_STATE_RECONNECTING: "reconnecting",
+	SESSION_STATE_STOPPING:     "stopping",
+	SESSION_STATE_STOPPED:      "stopped",
+	SESSION_STATE_FAILED:       "failed",
+}
+
+func (state SessionState) String() string {
+	if name, ok := sessionStateNames[state]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Passed to sessionStateMachine.event() for the events which do not change the state
+const _SESSION_STATE_UNCHANGED SessionState = -1
+
+// The allowed transitions of the session state machine
+var sessionStateTransitions = map[SessionState][]SessionState{
+	SESSION_STATE_STARTING:     {SESSION_STATE_RUNNING, SESSION_STATE_STOPPING, SESSION_STATE_STOPPED, SESSION_STATE_FAILED},
+	SESSION_STATE_RUNNING:      {SESSION_STATE_RECONNECTING, SESSION_STATE_STOPPING, SESSION_STATE_STOPPED, SESSION_STATE_FAILED},
+	SESSION_STATE_RECONNECTING: {SESSION_STATE_RUNNING, SESSION_STATE_STOPPING, SESSION_STATE_STOPPED, SESSION_STATE_FAILED},
+	SESSION_STATE_STOPPING:     {SESSION_STATE_STOPPED},
+	SESSION_STATE_FAILED:       {SESSION_STATE_STOPPING},
+	SESSION_STATE_STOPPED:      {},
+}
+
+// SessionEventType is the type of a SessionEvent.
+type SessionEventType int
+
+const (
+	SESSION_EVENT_STATE_CHANGED        SessionEventType = iota // State changed without any of the events below, e.g. on SessionStop()
+	SESSION_EVENT_CONTROL_CHANNEL_UP                           // The control channel connected or reconnected
+	SESSION_EVENT_CONTROL_CHANNEL_DOWN                         // The control channel disconnected, Err holds the reason
+	SESSION_EVENT_UI_STREAM_STARTED                            // The UI stream is connected
+	SESSION_EVENT_UI_STREAM_STOPPED                            // The UI stream was stopped by SessionUIStreamStop() or SessionStop()
+	SESSION_EVENT_UI_STREAM_FAILED                             // The UI stream failed, Err holds the reason
+	SESSION_EVENT_PAGE_LOAD                                    // A page was loaded (the onPageLoad() control channel command)
+	SESSION_EVENT_PAGE_CLOSE                                   // A page was closed (the onPageClose() control channel command)
+	SESSION_EVENT_TERMINATED                                   // The server terminated the session
+	SESSION_EVENT_UI_BITRATE_CHANGED                           // The UI stream reconnected with a new bitrate, see SessionGetUIStreamStats()
+	SESSION_EVENT_UI_STREAM_BUFFERING                          // The UI stream was interrupted and is reconnecting, Err holds the reason
+	SESSION_EVENT_UI_STREAM_RESUMED                            // Frames flow again after SESSION_EVENT_UI_STREAM_BUFFERING
+)
+
+var sessionEventNames = map[SessionEventType]string{
+	SESSION_EVENT_STATE_CHANGED:        "state changed",
+	SESSION_EVENT_CONTROL_CHANNEL_UP:   "control channel up",
+	SESSION_EVENT_CONTROL_CHANNEL_DOWN: "control channel down",
+	SESSION_EVENT_UI_STREAM_STARTED:    "ui stream started",
+	SESSION_EVENT_UI_STREAM_STOPPED:    "ui stream stopped",
+	SESSION_EVENT_UI_STREAM_FAILED:     "ui stream failed",
+	SESSION_EVENT_PAGE_LOAD:            "page load",
+	SESSION_EVENT_PAGE_CLOSE:           "page close",
+	SESSION_EVENT_TERMINATED:           "terminated",
+	SESSION_EVENT_UI_BITRATE_CHANGED:   "ui bitrate changed",
+	SESSION_EVENT_UI_STREAM_BUFFERING:  "ui stream buffering",
+	SESSION_EVENT_UI_STREAM_RESUMED:    "ui stream resumed",
+}
+
+func (eventType SessionEventType) String() string {
+	if name, ok := sessionEventNames[eventType]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// SessionEvent describes a lifecycle event of a session.
+type SessionEvent struct {
+	Type      SessionEventType
+	PrevState SessionState // The state before the event
+	State     SessionState // The state after the event, the same as PrevState if the event did not change it
+	Time      time.Time
+	Err       error // The reason of failures and disconnections, nil otherwise
+}
+
+// sessionStateMachine holds the state of a session and its subscribers.
+type sessionStateMachine struct {
+	mutex            sync.Mutex
+	state            SessionState
+	subscribers      map[int]func(ev *SessionEvent)
+	nextSubscriberId int
+	queue            []*SessionEvent // Events waiting for delivery
+	dispatching      bool            // Whether a go routine is delivering the queued events
+}
+
+// event moves to the given state (if the transition is allowed) and notifies the subscribers of the event.
+// Pass _SESSION_STATE_UNCHANGED as the new state for events which do not change the state. When the transition is
+// not allowed the event is still delivered with the state unchanged, unless it is only a state change.
+func (sm *sessionStateMachine) event(eventType SessionEventType, state SessionState, err error) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	ev := &SessionEvent{
+		Type:      eventType,
+		PrevState: sm.state,
+		State:     sm.state,
+		Time:      time.Now(),
+		Err:       err,
+	}
+	if state != _SESSION_STATE_UNCHANGED && state != sm.state {
+		allowed := false
+		for _, to := range sessionStateTransitions[sm.state] {
+			if to == state {
+				allowed = true
+				break
+			}
+		}
+		if allowed {
+			sm.state = state
+			ev.State = state
+		} else {
+			log.Printf("Invalid state transition from %v to %v on session %s event", sm.state, state, eventType)
+			if eventType == SESSION_EVENT_STATE_CHANGED {
+				return
+			}
+		}
+	}
+
+	if len(sm.subscribers) == 0 {
+		return
+	}
+	sm.queue = append(sm.queue, ev)
+	if !sm.dispatching {
+		sm.dispatching = true
+		go sm.dispatch()
+	}
+}
+
+// dispatch delivers the queued events in order, it exits when the queue is empty.
+func (sm *sessionStateMachine) dispatch() {
+	for {
+		sm.mutex.Lock()
+		if len(sm.queue) == 0 {
+			sm.dispatching = false
+			sm.mutex.Unlock()
+			return
+		}
+		ev := sm.queue[0]
+		sm.queue = sm.queue[1:]
+		subscribers := make([]func(ev *SessionEvent), 0, len(sm.subscribers))
+		for _, subscriber := range sm.subscribers {
+			subscribers = append(subscribers, subscriber)
+		}
+		sm.mutex.Unlock()
+
+		for _, subscriber := range subscribers {
+			subscriber(ev)
+		}
+	}
+}
+
+func (sm *sessionStateMachine) getState() SessionState {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	return sm.state
+}
+
+// setState moves to the given state, see event().
+func (sm *sessionStateMachine) setState(state SessionState) {
+	sm.event(SESSION_EVENT_STATE_CHANGED, state, nil)
+}
+
+// SessionGetState returns the current state of the session.
+func SessionGetState(ctx *SessionContext) SessionState {
+	return ctx.state.getState()
+}
+
+// SessionSubscribe registers a function which is called on every lifecycle event of the session and returns
+// an id for SessionUnsubscribe(). Events are delivered in order on a go routine of the SDK, so the function
+// should return quickly, however it may call any of the session functions (including SessionStop()). The events
+// which occurred before the function is registered are not passed to it, see SessionOptions.Subscribers in order
+// to receive all of them.
+func SessionSubscribe(ctx *SessionContext, subscriber func(ev *SessionEvent)) (id int) {
+	sm := &ctx.state
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if sm.subscribers == nil {
+		sm.subscribers = make(map[int]func(ev *SessionEvent))
+	}
+	sm.nextSubscriberId++
+	id = sm.nextSubscriberId
+	sm.subscribers[id] = subscriber
+	return
+}
+
+// SessionSubscribeChan is the same as SessionSubscribe() except that the events are sent to the returned channel
+// which has room for the given number of events. Events are dropped when the channel is full.
+func SessionSubscribeChan(ctx *SessionContext, size int) (events <-chan *SessionEvent, id int) {
+	ch := make(chan *SessionEvent, size)
+	id = SessionSubscribe(ctx, func(ev *SessionEvent) {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("Dropping session %s event, the subscriber channel is full", ev.Type)
+		}
+	})
+	return ch, id
+}
+
+// SessionUnsubscribe unregisters a function registered by SessionSubscribe() or SessionSubscribeChan().
+// Events which are being delivered may still reach the function after this function returns.
+func SessionUnsubscribe(ctx *SessionContext, id int) {
+	sm := &ctx.state
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	delete(sm.subscribers, id)
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionStateMachine(t *testing.T) {
+	errDown := errors.New("down")
+	type step struct {
+		eventType SessionEventType
+		state     SessionState
+		err       error
+	}
+	type delivered struct {
+		eventType       SessionEventType
+		prevState, next SessionState
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []delivered
+		final SessionState
+	}{
+		{"lifecycle", []step{
+			{SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_RUNNING, nil},
+			{SESSION_EVENT_CONTROL_CHANNEL_DOWN, SESSION_STATE_RECONNECTING, errDown},
+			{SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_RUNNING, nil},
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STOPPING, nil},
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STOPPED, nil},
+		}, []delivered{
+			{SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_STARTING, SESSION_STATE_RUNNING},
+			{SESSION_EVENT_CONTROL_CHANNEL_DOWN, SESSION_STATE_RUNNING, SESSION_STATE_RECONNECTING},
+			{SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_RECONNECTING, SESSION_STATE_RUNNING},
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_RUNNING, SESSION_STATE_STOPPING},
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STOPPING, SESSION_STATE_STOPPED},
+		}, SESSION_STATE_STOPPED},
+		{"events without a state change", []step{
+			{SESSION_EVENT_PAGE_LOAD, _SESSION_STATE_UNCHANGED, nil},
+			{SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_RUNNING, nil},
+			{SESSION_EVENT_UI_STREAM_FAILED, _SESSION_STATE_UNCHANGED, errDown},
+		}, []delivered{
+			{SESSION_EVENT_PAGE_LOAD, SESSION_STATE_STARTING, SESSION_STATE_STARTING},
+			{SESSION_EVENT_CONTROL_CHANNEL_UP, SESSION_STATE_STARTING, SESSION_STATE_RUNNING},
+			{SESSION_EVENT_UI_STREAM_FAILED, SESSION_STATE_RUNNING, SESSION_STATE_RUNNING},
+		}, SESSION_STATE_RUNNING},
+		{"invalid transition delivers the event", []step{
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STOPPING, nil},
+			{SESSION_EVENT_CONTROL_CHANNEL_DOWN, SESSION_STATE_FAILED, errDown},
+			{SESSION_EVENT_TERMINATED, SESSION_STATE_STOPPED, nil},
+		}, []delivered{
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STARTING, SESSION_STATE_STOPPING},
+			{SESSION_EVENT_CONTROL_CHANNEL_DOWN, SESSION_STATE_STOPPING, SESSION_STATE_STOPPING},
+			{SESSION_EVENT_TERMINATED, SESSION_STATE_STOPPING, SESSION_STATE_STOPPED},
+		}, SESSION_STATE_STOPPED},
+		{"invalid state change is dropped", []step{
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STOPPED, nil},
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_RUNNING, nil},
+			{SESSION_EVENT_PAGE_CLOSE, _SESSION_STATE_UNCHANGED, nil},
+		}, []delivered{
+			{SESSION_EVENT_STATE_CHANGED, SESSION_STATE_STARTING, SESSION_STATE_STOPPED},
+			{SESSION_EVENT_PAGE_CLOSE, SESSION_STATE_STOPPED, SESSION_STATE_STOPPED},
+		}, SESSION_STATE_STOPPED},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sm := &sessionStateMachine{}
+			events := make(chan *SessionEvent, len(test.steps))
+			sm.subscribers = map[int]func(ev *SessionEvent){1: func(ev *SessionEvent) { events <- ev }}
+			for _, step := range test.steps {
+				sm.event(step.eventType, step.state, step.err)
+			}
+			for i, want := range test.want {
+				select {
+				case ev := <-events:
+					got := delivered{ev.Type, ev.PrevState, ev.State}
+					if got != want {
+						t.Errorf("event %d: got %v, want %v", i, got, want)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("event %d was not delivered", i)
+				}
+			}
+			select {
+			case ev := <-events:
+				t.Errorf("unexpected event %+v", ev)
+			case <-time.After(10 * time.Millisecond):
+			}
+			if state := sm.getState(); state != test.final {
+				t.Errorf("final state %v, want %v", state, test.final)
+			}
+		})
+	}
+}
+
+func TestSessionOptionsSubscribers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/osb/session/start":
+			w.Write([]byte(`{"SessionID": "subscribers-session"}`))
+		case "/osb/session/control":
+			// The control channel connects at once and waits for commands
+			w.Header().Set("Content-Type", "text/json")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	events := make(chan *SessionEvent, 16)
+	ctx, err := SessionStartWithOptions(&SessionOptions{
+		ServerProtocolHost: srv.URL,
+		BrowserURL:         "http://www.example.com/",
+		PullMode:           true,
+		VideoPassthru:      true,
+		Subscribers:        []func(ev *SessionEvent){func(ev *SessionEvent) { events <- ev }},
+	}, nil)
+	if err != nil {
+		t.Fatalf("SessionStartWithOptions() failed: %v", err)
+	}
+	defer SessionStop(ctx)
+
+	// The first event is not missed even though it occurs before SessionStartWithOptions() returns
+	select {
+	case ev := <-events:
+		if ev.Type != SESSION_EVENT_CONTROL_CHANNEL_UP || ev.PrevState != SESSION_STATE_STARTING {
+			t.Errorf("got the %s event from %v, want the control channel up event from starting", ev.Type, ev.PrevState)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the control channel up event was not delivered")
+	}
+}
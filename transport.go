@@ -0,0 +1,149 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HTTPConfig controls the HTTP transports of a session, which are shared by all the requests the SDK makes to the
+// server for the session (session start/stop, input events, notifications, UI streaming and the control channel).
+// Connections are kept alive and pooled, and HTTP/2 is used when the server supports it.
+type HTTPConfig struct {
+	DialTimeout           time.Duration // Maximum time to establish a TCP connection
+	KeepAlive             time.Duration // TCP keep-alive period of open connections
+	TLSHandshakeTimeout   time.Duration // Maximum time to complete the TLS handshake
+	ResponseHeaderTimeout time.Duration // Maximum time to wait for response headers, not applied to the control channel long polling
+	IdleConnTimeout       time.Duration // How long an idle connection is kept in the pool
+	MaxIdleConnsPerHost   int           // Maximum number of idle connections kept per server
+	DisableHTTP2          bool          // Use only HTTP/1.1 even if the server supports HTTP/2
+	InsecureSkipVerify    bool          // Do not verify the server certificate, e.g. for a self-signed one, off by default
+
+	// Proxy returns the proxy to use for a given request, see http.ProxyURL() for a fixed proxy.
+	// When nil the proxy is taken from the environment (HTTP_PROXY, HTTPS_PROXY and NO_PROXY).
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// DefaultHTTPConfig returns the configuration used by the SDK unless SetHTTPConfig() is called.
+func DefaultHTTPConfig() *HTTPConfig {
+	return &HTTPConfig{
+		DialTimeout:           10 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   8,
+	}
+}
+
+var (
+	httpMutex  sync.Mutex
+	httpConfig *HTTPConfig // See SetHTTPConfig()
+)
+
+// httpTransports are the transports of a session, see HTTPConfig.
+type httpTransports struct {
+	tr        *http.Transport // Used for all API requests and UI streaming
+	controlTr *http.Transport // Used for the control channel, same as tr without a response header timeout
+}
+
+func newHTTPTransport(config *HTTPConfig) *http.Transport {
+	proxy := config.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	tr := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify},
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxIdleConns:          100,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     !config.DisableHTTP2,
+	}
+	if config.DisableHTTP2 {
+		// A non nil empty map disables HTTP/2
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return tr
+}
+
+// newHTTPTransports returns the transports of a session, using the configuration set by SetHTTPConfig() if nil.
+func newHTTPTransports(config *HTTPConfig) *httpTransports {
+	if config == nil {
+		config = getHTTPConfig()
+	}
+	tr := newHTTPTransport(config)
+	controlTr := tr.Clone()
+	controlTr.ResponseHeaderTimeout = 0
+	return &httpTransports{tr: tr, controlTr: controlTr}
+}
+
+// close closes the idle connections, the requests in progress are allowed to complete.
+func (transports *httpTransports) close() {
+	transports.tr.CloseIdleConnections()
+	transports.controlTr.CloseIdleConnections()
+}
+
+// SetHTTPConfig sets the HTTP configuration of the sessions started or attached to afterwards without an
+// HTTPConfig in their SessionOptions, and of the server pools created afterwards. A nil configuration restores
+// DefaultHTTPConfig(). Note that the server certificate is verified unless InsecureSkipVerify is set, whereas
+// previous versions of the SDK never verified it, hence servers with a self-signed certificate require it.
+func SetHTTPConfig(config *HTTPConfig) {
+	if config != nil {
+		c := *config
+		config = &c
+	}
+	httpMutex.Lock()
+	httpConfig = config
+	httpMutex.Unlock()
+}
+
+// getHTTPConfig returns the configuration set by SetHTTPConfig(), or the default one.
+func getHTTPConfig() *HTTPConfig {
+	httpMutex.Lock()
+	config := httpConfig
+	httpMutex.Unlock()
+	if config == nil {
+		return DefaultHTTPConfig()
+	}
+	return config
+}
+
+// newHTTPClient returns a client on top of the transport of a session, the cookie jar is optional.
+func newHTTPClient(tr http.RoundTripper, cookieJar http.CookieJar) *http.Client {
+	if cookieJar != nil {
+		return &http.Client{Jar: cookieJar, Transport: tr}
+	}
+	return &http.Client{Transport: tr}
+}
+
+// cancelOnClose is a response body that releases the context of its request once closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
@@ -0,0 +1,467 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	// UI_TIMESCALE is the number of UIFrame timestamp units per second (90 kHz, as in MPEG-TS)
+	UI_TIMESCALE = 90000
+
+	// Bitstream formats of the UI frames, see SessionSetUIBitstreamFormat()
+	UI_BITSTREAM_ANNEXB = 0 // NAL units with start codes, the parameter sets are repeated before each key frame
+	UI_BITSTREAM_AVCC   = 1 // NAL units with 4 bytes length prefixes, the codec config frames hold an avcC or hvcC record
+
+	// Indexes of the streams of the UI stream, see UIFrame.Idx
+	UI_STREAM_VIDEO = 0
+	UI_STREAM_AUDIO = 1
+
+	// MPEG-TS timestamps are 33 bit and wrap around after about 26.5 hours
+	_TS_WRAP = 1 << 33
+
+	// A jump of the stream timestamps larger than this is handled as a discontinuity
+	_TS_MAX_JUMP = 10 * UI_TIMESCALE
+)
+
+// UIFrame is a frame of the UI stream, see UIFrameListener.
+type UIFrame struct {
+	Codec string // One of the UI_CODEC_* constants
+
+	// Codec config frames hold the parameter sets of the codec rather than a picture, either as a decoder
+	// configuration record (see UI_BITSTREAM_AVCC) or as a bitstream. For the audio they hold the
+	// AudioSpecificConfig. One is passed before the first frame, after
+	// a discontinuity and whenever the parameter sets change (e.g. after a bitrate switch). In UI_BITSTREAM_ANNEXB
+	// format the parameter sets are also repeated before each key frame so that decoding can start at any key frame.
+	IsCodecConfig bool
+	IsKeyFrame    bool
+
+	// Set on the first frame following a discontinuity, e.g. a reconnection, see UIDiscontinuityListener
+	Discontinuity bool
+
+	// One of the UI_STREAM_* constants. The audio frames are raw AAC frames, they are only passed to the frame sinks
+	// (see SessionAddUIFrameSink()) and not to the AppflingerListener.
+	Idx int
+
+	// Timestamps in UI_TIMESCALE units. They start at zero and increase monotonically for the lifetime of the UI
+	// stream, across the wraparound of the MPEG-TS timestamps and across discontinuities.
+	PTS int64
+	DTS int64
+
+	// Duration in UI_TIMESCALE units, estimated from the previous frame interval, zero if unknown
+	Duration int64
+
+	Data []byte // The bitstream in the format given to SessionSetUIBitstreamFormat()
+
+	allocated bool // The data is in a buffer returned by the UIFrameBufferAllocator, which the sinks must not keep
+}
+
+// UIFrameListener can be implemented in addition to AppflingerListener, in which case OnUIFrameData() is called
+// instead of OnUIFrame(). OnUIFrame() is passed the same values, with the timestamps in UI_TIMESCALE units.
+type UIFrameListener interface {
+	OnUIFrameData(sessionId string, frame *UIFrame) (err error)
+}
+
+// UIFrameBufferAllocator can be implemented in addition to AppflingerListener, in which case the data of the video
+// frames, other than the codec config frames, is written directly into the buffers it returns, e.g. the input buffers
+// of a decoder. It is called before the frame is passed to the frame sinks and to the listener, it returns a buffer
+// of at least the given size or nil for the data to be allocated by the library.
+type UIFrameBufferAllocator interface {
+	GetUIFrameBuffer(sessionId string, size int) []byte
+}
+
+// uiTimeline maps the MPEG-TS timestamps of the UI stream to monotonic timestamps starting at zero.
+type uiTimeline struct {
+	started  bool
+	rebase   bool  // The next frame follows a discontinuity
+	offset   int64 // Added to the stream timestamps
+	lastIn   int64 // The last stream DTS
+	lastDTS  int64 // The last DTS returned
+	duration int64 // The last frame interval
+}
+
+// discontinuity makes the next frame follow the last one by one frame interval, whatever its timestamps.
+func (tl *uiTimeline) discontinuity() {
+	tl.rebase = true
+}
+
+// convertAudio returns the timestamp of an audio frame given its stream PTS, using the offset of the video. It returns
+// false when the timestamp cannot be related to the video, e.g. before the first video frame.
+func (tl *uiTimeline) convertAudio(pts int64) (outPTS int64, ok bool) {
+	if !tl.started || tl.rebase {
+		return 0, false
+	}
+	delta := pts - tl.lastIn
+	if delta < -_TS_WRAP/2 {
+		delta += _TS_WRAP
+	} else if delta > _TS_WRAP/2 {
+		delta -= _TS_WRAP
+	}
+	if delta < -_TS_MAX_JUMP || delta > _TS_MAX_JUMP || tl.lastDTS+delta < 0 {
+		return 0, false
+	}
+	return tl.lastDTS + delta, true
+}
+
+// convert returns the timestamps of a video frame given its stream DTS and its PTS-DTS offset.
+func (tl *uiTimeline) convert(dts int64, cts int64) (outPTS int64, outDTS int64) {
+	if !tl.started {
+		tl.started = true
+		tl.offset = -dts
+	} else if tl.rebase {
+		tl.offset = tl.lastDTS + tl.duration - dts
+	} else {
+		delta := dts - tl.lastIn
+		if delta < -_TS_WRAP/2 {
+			// The 33 bit timestamps wrapped around
+			tl.offset += _TS_WRAP
+		} else if delta < -_TS_MAX_JUMP || delta > _TS_MAX_JUMP {
+			// Discontinuity which was not signalled
+			tl.offset = tl.lastDTS + tl.duration - dts
+		}
+	}
+	if cts < -_TS_WRAP/2 {
+		// The PTS wrapped around before the DTS
+		cts += _TS_WRAP
+	}
+	tl.lastIn = dts
+	outDTS = dts + tl.offset
+	if tl.started && !tl.rebase && outDTS > tl.lastDTS {
+		tl.duration = outDTS - tl.lastDTS
+	}
+	tl.rebase = false
+	tl.lastDTS = outDTS
+	return outDTS + cts, outDTS
+}
+
+// uiFramer turns the demuxed packets into UI frames, it lasts for the lifetime of the UI stream so that the
+// timestamps and the parameter sets are tracked across reconnections.
+type uiFramer struct {
+	bitstream     int // One of the UI_BITSTREAM_* constants
+	timeline      uiTimeline
+	codec         string
+	params        [3][]byte // The current parameter sets: VPS (HEVC only), SPS and PPS
+	configSent    bool      // Whether a codec config frame was passed for the current parameter sets
+	discontinuity bool      // The next frame follows a discontinuity
+
+	audioConfig     aacparser.MPEG4AudioConfig
+	audioConfigSent bool // Whether a codec config frame was passed for audioConfig
+
+	alloc func(size int) []byte // Returns the buffer of the data of a video frame, nil if allocated by the framer
+}
+
+func newUIFramer(bitstream int, alloc func(size int) []byte) *uiFramer {
+	return &uiFramer{bitstream: bitstream, alloc: alloc}
+}
+
+// setDiscontinuity marks the next frame as following a discontinuity.
+func (framer *uiFramer) setDiscontinuity() {
+	framer.discontinuity = true
+	framer.configSent = false
+	framer.audioConfigSent = false
+	framer.timeline.discontinuity()
+}
+
+// hasParameterSets checks whether all the parameter sets of the codec were received.
+func (framer *uiFramer) hasParameterSets() bool {
+	return (framer.codec != UI_CODEC_HEVC || len(framer.params[0]) > 0) && len(framer.params[1]) > 0 && len(framer.params[2]) > 0
+}
+
+// codecConfig returns the data of a codec config frame, the decoder configuration record (avcC or hvcC) or the
+// parameter sets as an Annex B bitstream.
+func (framer *uiFramer) codecConfig() (data []byte, err error) {
+	if framer.bitstream == UI_BITSTREAM_AVCC {
+		if framer.codec == UI_CODEC_HEVC {
+			return hevcDecoderConfRecord(framer.params[0], framer.params[1], framer.params[2])
+		}
+		codecData, e := h264parser.NewCodecDataFromSPSAndPPS(framer.params[1], framer.params[2])
+		if e != nil {
+			return nil, e
+		}
+		return codecData.AVCDecoderConfRecordBytes(), nil
+	}
+	return framer.appendParameterSets(nil), nil
+}
+
+// appendParameterSets appends the parameter sets as an Annex B bitstream.
+func (framer *uiFramer) appendParameterSets(data []byte) []byte {
+	for _, nalu := range framer.params {
+		if len(nalu) > 0 {
+			data = append(data, h264parser.StartCodeBytes...)
+			data = append(data, nalu...)
+		}
+	}
+	return data
+}
+
+// frameSize returns the size of the data of a video frame made of the given NAL units.
+func (framer *uiFramer) frameSize(nalus [][]byte, withParams bool) (size int) {
+	prefix := len(h264parser.StartCodeBytes)
+	if framer.bitstream == UI_BITSTREAM_AVCC {
+		prefix = 4
+	}
+	for _, nalu := range nalus {
+		size += prefix + len(nalu)
+	}
+	if withParams {
+		for _, nalu := range framer.params {
+			if len(nalu) > 0 {
+				size += len(h264parser.StartCodeBytes) + len(nalu)
+			}
+		}
+	}
+	return
+}
+
+// frames returns the frames of a packet, preceded by a codec config frame when needed.
+func (framer *uiFramer) frames(pkt *uiPacket) (frames []*UIFrame) {
+	if pkt.isAudio() {
+		return framer.audioFrames(pkt)
+	}
+	if pkt.codec != framer.codec {
+		framer.codec = pkt.codec
+		framer.params = [3][]byte{}
+		framer.configSent = false
+	}
+
+	frame := &UIFrame{
+		Codec:         pkt.codec,
+		IsKeyFrame:    pkt.isKeyFrame,
+		Discontinuity: framer.discontinuity,
+	}
+	frame.PTS, frame.DTS = framer.timeline.convert(pkt.dts, pkt.pts-pkt.dts)
+	frame.Duration = framer.timeline.duration
+	framer.discontinuity = false
+
+	// The parameter sets are taken out of the frame, they are passed in the codec config frames and, in Annex B
+	// format, before each key frame
+	var nalus [][]byte
+	for _, nalu := range pkt.nalus {
+		if isAUDNALU(pkt.codec, nalu) {
+			// The frames are already delimited
+			continue
+		}
+		i := parameterSetIndex(pkt.codec, nalu)
+		if i < 0 {
+			nalus = append(nalus, nalu)
+			continue
+		}
+		if !bytes.Equal(nalu, framer.params[i]) {
+			framer.params[i] = append([]byte(nil), nalu...)
+			framer.configSent = false
+		}
+	}
+	withParams := pkt.isKeyFrame && framer.bitstream == UI_BITSTREAM_ANNEXB && len(nalus) > 0
+	if framer.alloc != nil && len(nalus) > 0 {
+		if buf := framer.alloc(framer.frameSize(nalus, withParams)); buf != nil {
+			frame.Data = buf[:0]
+			frame.allocated = true
+		}
+	}
+	if withParams {
+		frame.Data = framer.appendParameterSets(frame.Data)
+	}
+	for _, nalu := range nalus {
+		if framer.bitstream == UI_BITSTREAM_AVCC {
+			frame.Data = append(frame.Data, byte(len(nalu)>>24), byte(len(nalu)>>16), byte(len(nalu)>>8), byte(len(nalu)))
+		} else {
+			frame.Data = append(frame.Data, h264parser.StartCodeBytes...)
+		}
+		frame.Data = append(frame.Data, nalu...)
+	}
+
+	if !framer.configSent && framer.hasParameterSets() {
+		framer.configSent = true
+		data, err := framer.codecConfig()
+		if err != nil {
+			log.Println("Failed to create the UI codec config: ", err)
+		} else {
+			frames = append(frames, &UIFrame{
+				Codec:         frame.Codec,
+				IsCodecConfig: true,
+				Discontinuity: frame.Discontinuity,
+				PTS:           frame.PTS,
+				DTS:           frame.DTS,
+				Data:          data,
+			})
+			frame.Discontinuity = false
+		}
+	}
+	if len(frame.Data) == 0 {
+		// Only parameter sets
+		return frames
+	}
+	return append(frames, frame)
+}
+
+// audioFrames returns the AAC frames of an audio packet, preceded by a codec config frame when needed.
+func (framer *uiFramer) audioFrames(pkt *uiPacket) (frames []*UIFrame) {
+	pts, ok := framer.timeline.convertAudio(pkt.pts)
+	if !ok {
+		return nil
+	}
+	data := pkt.adts
+	for len(data) >= aacparser.ADTSHeaderLength {
+		config, hdrlen, framelen, samples, err := aacparser.ParseADTSHeader(data)
+		if err == nil && (framelen > len(data) || config.SampleRate == 0) {
+			err = errors.New("Invalid ADTS frame")
+		}
+		if err != nil {
+			log.Println("Failed to parse the UI audio: ", err)
+			break
+		}
+
+		if !framer.audioConfigSent || config != framer.audioConfig {
+			codecData, e := aacparser.NewCodecDataFromMPEG4AudioConfig(config)
+			if e != nil {
+				log.Println("Failed to create the UI audio codec config: ", e)
+				break
+			}
+			framer.audioConfig = config
+			framer.audioConfigSent = true
+			frames = append(frames, &UIFrame{
+				Codec:         UI_CODEC_AAC,
+				IsCodecConfig: true,
+				Idx:           UI_STREAM_AUDIO,
+				PTS:           pts,
+				DTS:           pts,
+				Data:          codecData.MPEG4AudioConfigBytes(),
+			})
+		}
+
+		duration := int64(samples) * UI_TIMESCALE / int64(config.SampleRate)
+		frames = append(frames, &UIFrame{
+			Codec:      UI_CODEC_AAC,
+			IsKeyFrame: true,
+			Idx:        UI_STREAM_AUDIO,
+			PTS:        pts,
+			DTS:        pts,
+			Duration:   duration,
+			Data:       data[hdrlen:framelen],
+		})
+		pts += duration
+		data = data[framelen:]
+	}
+	return
+}
+
+// deliverUIFrame passes a frame to the frame sinks and, unless it is an audio frame, to the listener, using
+// OnUIFrameData() if implemented.
+func deliverUIFrame(ctx *SessionContext, frame *UIFrame) (err error) {
+	deliverUIFrameToSinks(ctx, frame)
+	if frame.Idx != UI_STREAM_VIDEO {
+		return nil
+	}
+	if listener, ok := ctx.appflingerListener.(UIFrameListener); ok {
+		return listener.OnUIFrameData(ctx.SessionId, frame)
+	}
+	return ctx.appflingerListener.OnUIFrame(ctx.SessionId, frame.IsCodecConfig, frame.IsKeyFrame, frame.Idx, int(frame.PTS), int(frame.DTS), frame.Data)
+}
+
+// SessionSetUIBitstreamFormat sets the bitstream format of the UI frames (one of the UI_BITSTREAM_* constants),
+// UI_BITSTREAM_ANNEXB by default. It takes effect on the next SessionUIStreamStart().
+func SessionSetUIBitstreamFormat(ctx *SessionContext, format int) (err error) {
+	if format != UI_BITSTREAM_ANNEXB && format != UI_BITSTREAM_AVCC {
+		return withClass(ErrInvalidArgument, errors.New("Invalid bitstream format"))
+	}
+	ctx.mutex.Lock()
+	ctx.uiBitstream = format
+	ctx.mutex.Unlock()
+	return nil
+}
+
+// uiFrameSink is a listener registered by SessionAddUIFrameSink().
+type uiFrameSink struct {
+	id          int
+	listener    UIFrameListener
+	needsConfig bool // The last codec config frames are to be passed before the next frame
+}
+
+// deliverUIFrameToSinks passes a frame to the frame sinks, a sink which was just added is first passed the last codec
+// config frames. The sinks may keep the frames, hence they are passed a copy of the data written into a buffer of
+// the UIFrameBufferAllocator, which the client may reuse once the frame is delivered. The errors of the sinks are
+// logged and otherwise ignored.
+func deliverUIFrameToSinks(ctx *SessionContext, frame *UIFrame) {
+	type delivery struct {
+		sink   *uiFrameSink
+		frames []*UIFrame
+	}
+	ctx.mutex.Lock()
+	if frame.IsCodecConfig {
+		ctx.uiConfigFrames[frame.Idx] = frame
+	}
+	deliveries := make([]delivery, 0, len(ctx.uiSinks))
+	for _, sink := range ctx.uiSinks {
+		var frames []*UIFrame
+		if sink.needsConfig {
+			sink.needsConfig = false
+			for _, config := range ctx.uiConfigFrames {
+				if config != nil && config != frame {
+					frames = append(frames, config)
+				}
+			}
+		}
+		deliveries = append(deliveries, delivery{sink, append(frames, frame)})
+	}
+	ctx.mutex.Unlock()
+
+	if frame.allocated && len(deliveries) > 0 {
+		copied := *frame
+		copied.Data = append([]byte(nil), frame.Data...)
+		copied.allocated = false
+		for _, d := range deliveries {
+			d.frames[len(d.frames)-1] = &copied
+		}
+	}
+	for _, d := range deliveries {
+		for _, f := range d.frames {
+			if err := d.sink.listener.OnUIFrameData(ctx.SessionId, f); err != nil {
+				log.Println("UI frame sink failed: ", err)
+			}
+		}
+	}
+}
+
+// SessionAddUIFrameSink registers a listener which is passed the frames of the UI stream, including the audio frames,
+// in addition to the AppflingerListener, e.g. a UIRecorder. The frames are in the format given to
+// SessionSetUIBitstreamFormat() and must not be modified. A sink added while the UI is streaming is first passed the
+// last codec config frames. It returns an id to be passed to SessionRemoveUIFrameSink().
+func SessionAddUIFrameSink(ctx *SessionContext, sink UIFrameListener) (id int) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	return ctx.addUIFrameSink(sink)
+}
+
+// SessionRemoveUIFrameSink unregisters a listener registered by SessionAddUIFrameSink(). A frame being passed
+// concurrently may still reach it.
+func SessionRemoveUIFrameSink(ctx *SessionContext, id int) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.removeUIFrameSink(id)
+}
+
+// addUIFrameSink is called with the mutex locked.
+func (ctx *SessionContext) addUIFrameSink(sink UIFrameListener) (id int) {
+	ctx.nextUISinkId++
+	id = ctx.nextUISinkId
+	ctx.uiSinks = append(ctx.uiSinks, &uiFrameSink{id: id, listener: sink, needsConfig: true})
+	return
+}
+
+// removeUIFrameSink is called with the mutex locked.
+func (ctx *SessionContext) removeUIFrameSink(id int) {
+	for i, sink := range ctx.uiSinks {
+		if sink.id == id {
+			ctx.uiSinks = append(ctx.uiSinks[:i:i], ctx.uiSinks[i+1:]...)
+			return
+		}
+	}
+}
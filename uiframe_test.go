@@ -0,0 +1,379 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+func TestUITimeline(t *testing.T) {
+	type step struct {
+		dts, cts      int64
+		discontinuity bool // Signalled before the frame
+		pts, outDTS   int64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"starts at zero", []step{
+			{90000, 0, false, 0, 0},
+			{93600, 3600, false, 7200, 3600},
+			{97200, 0, false, 7200, 7200},
+		}},
+		{"wraparound", []step{
+			{_TS_WRAP - 3600, 0, false, 0, 0},
+			{0, 0, false, 3600, 3600},
+			{3600, 0, false, 7200, 7200},
+		}},
+		{"pts wrapped around before the dts", []step{
+			{_TS_WRAP - 3600, 1800 - (_TS_WRAP - 3600), false, 5400, 0},
+			{_TS_WRAP - 1800, 5400 - (_TS_WRAP - 1800), false, 9000, 1800},
+		}},
+		{"jump forward", []step{
+			{0, 0, false, 0, 0},
+			{3600, 0, false, 3600, 3600},
+			{3600 + 20*UI_TIMESCALE, 1800, false, 9000, 7200},
+			{7200 + 20*UI_TIMESCALE, 0, false, 10800, 10800},
+		}},
+		{"jump backward", []step{
+			{1000000, 0, false, 0, 0},
+			{1003600, 0, false, 3600, 3600},
+			{500, 0, false, 7200, 7200},
+		}},
+		{"jump within the limit", []step{
+			{0, 0, false, 0, 0},
+			{5 * UI_TIMESCALE, 0, false, 5 * UI_TIMESCALE, 5 * UI_TIMESCALE},
+		}},
+		{"signalled discontinuity", []step{
+			{0, 0, false, 0, 0},
+			{3600, 0, false, 3600, 3600},
+			{3700, 3600, true, 10800, 7200},
+			{7300, 0, false, 10800, 10800},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tl := &uiTimeline{}
+			for i, s := range test.steps {
+				if s.discontinuity {
+					tl.discontinuity()
+				}
+				if pts, dts := tl.convert(s.dts, s.cts); pts != s.pts || dts != s.outDTS {
+					t.Errorf("frame %d: got %d/%d, want %d/%d", i, pts, dts, s.pts, s.outDTS)
+				}
+			}
+		})
+	}
+}
+
+func TestUITimelineAudio(t *testing.T) {
+	tl := &uiTimeline{}
+	if _, ok := tl.convertAudio(0); ok {
+		t.Error("audio converted before the first video frame")
+	}
+	tl.convert(_TS_WRAP-900, 0)
+	tests := []struct {
+		pts  int64
+		want int64
+		ok   bool
+	}{
+		{_TS_WRAP - 900, 0, true},
+		{900, 1800, true},
+		{_TS_WRAP - 1800, 0, false}, // Before the start of the timeline
+		{20 * UI_TIMESCALE, 0, false},
+	}
+	for _, test := range tests {
+		if got, ok := tl.convertAudio(test.pts); got != test.want || ok != test.ok {
+			t.Errorf("convertAudio(%d) returned %d, %v, want %d, %v", test.pts, got, ok, test.want, test.ok)
+		}
+	}
+
+	tl.discontinuity()
+	if _, ok := tl.convertAudio(_TS_WRAP - 900); ok {
+		t.Error("audio converted after a discontinuity, before the next video frame")
+	}
+	tl.convert(5000, 0)
+	if got, ok := tl.convertAudio(5000); !ok || got != tl.lastDTS {
+		t.Errorf("convertAudio() returned %d, %v after the discontinuity, want %d", got, ok, tl.lastDTS)
+	}
+}
+
+func TestUIFramer(t *testing.T) {
+	pps2 := []byte{0x68, 0xce, 0x38, 0x80}
+	avcC := func(sps []byte, pps []byte) []byte {
+		codecData, err := h264parser.NewCodecDataFromSPSAndPPS(sps, pps)
+		if err != nil {
+			t.Fatalf("NewCodecDataFromSPSAndPPS() failed: %v", err)
+		}
+		return codecData.AVCDecoderConfRecordBytes()
+	}
+	avcc := func(nalus ...[]byte) (data []byte) {
+		for _, nalu := range nalus {
+			data = append(append(data, be32(uint32(len(nalu)))...), nalu...)
+		}
+		return
+	}
+	keyPkt := func(dts int64, nalus ...[]byte) *uiPacket {
+		return &uiPacket{codec: UI_CODEC_H264, isKeyFrame: true, pts: dts, dts: dts, nalus: nalus}
+	}
+	pkt := func(dts int64, nalus ...[]byte) *uiPacket {
+		return &uiPacket{codec: UI_CODEC_H264, pts: dts, dts: dts, nalus: nalus}
+	}
+	config := func(pts int64, discontinuity bool, data []byte) *UIFrame {
+		return &UIFrame{Codec: UI_CODEC_H264, IsCodecConfig: true, Discontinuity: discontinuity, PTS: pts, DTS: pts, Data: data}
+	}
+	frame := func(pts int64, isKeyFrame bool, duration int64, data []byte) *UIFrame {
+		return &UIFrame{Codec: UI_CODEC_H264, IsKeyFrame: isKeyFrame, PTS: pts, DTS: pts, Duration: duration, Data: data}
+	}
+
+	type step struct {
+		discontinuity bool // setDiscontinuity() is called before the packet
+		pkt           *uiPacket
+		want          []*UIFrame
+	}
+	tests := []struct {
+		name      string
+		bitstream int
+		steps     []step
+	}{
+		{"annex b", UI_BITSTREAM_ANNEXB, []step{
+			{false, keyPkt(90000, testH264AUD, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				config(0, false, annexB(testH264SPS, testH264PPS)),
+				frame(0, true, 0, annexB(testH264SPS, testH264PPS, testH264IDR)),
+			}},
+			{false, pkt(93600, testH264AUD, testH264Slice), []*UIFrame{
+				frame(3600, false, 3600, annexB(testH264Slice)),
+			}},
+			// The parameter sets are repeated before the key frames
+			{false, keyPkt(97200, testH264IDR), []*UIFrame{
+				frame(7200, true, 3600, annexB(testH264SPS, testH264PPS, testH264IDR)),
+			}},
+		}},
+		{"avcc", UI_BITSTREAM_AVCC, []step{
+			{false, keyPkt(0, testH264AUD, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				config(0, false, avcC(testH264SPS, testH264PPS)),
+				frame(0, true, 0, avcc(testH264IDR)),
+			}},
+			{false, pkt(3600, testH264Slice, testH264Slice), []*UIFrame{
+				frame(3600, false, 3600, avcc(testH264Slice, testH264Slice)),
+			}},
+		}},
+		{"parameter sets change", UI_BITSTREAM_AVCC, []step{
+			{false, keyPkt(0, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				config(0, false, avcC(testH264SPS, testH264PPS)),
+				frame(0, true, 0, avcc(testH264IDR)),
+			}},
+			{false, keyPkt(3600, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				frame(3600, true, 3600, avcc(testH264IDR)),
+			}},
+			{false, keyPkt(7200, testH264SPS, pps2, testH264IDR), []*UIFrame{
+				config(7200, false, avcC(testH264SPS, pps2)),
+				frame(7200, true, 3600, avcc(testH264IDR)),
+			}},
+		}},
+		{"parameter sets in their own packet", UI_BITSTREAM_ANNEXB, []step{
+			{false, keyPkt(0, testH264SPS), nil},
+			{false, pkt(0, testH264PPS), []*UIFrame{config(0, false, annexB(testH264SPS, testH264PPS))}},
+			{false, keyPkt(3600, testH264IDR), []*UIFrame{
+				frame(3600, true, 3600, annexB(testH264SPS, testH264PPS, testH264IDR)),
+			}},
+		}},
+		{"frames before the parameter sets", UI_BITSTREAM_AVCC, []step{
+			{false, pkt(0, testH264Slice), []*UIFrame{frame(0, false, 0, avcc(testH264Slice))}},
+			{false, keyPkt(3600, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				config(3600, false, avcC(testH264SPS, testH264PPS)),
+				frame(3600, true, 3600, avcc(testH264IDR)),
+			}},
+		}},
+		{"discontinuity", UI_BITSTREAM_AVCC, []step{
+			{false, keyPkt(0, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				config(0, false, avcC(testH264SPS, testH264PPS)),
+				frame(0, true, 0, avcc(testH264IDR)),
+			}},
+			{false, pkt(3600, testH264Slice), []*UIFrame{frame(3600, false, 3600, avcc(testH264Slice))}},
+			// The config frame is passed again, flagged as following the discontinuity
+			{true, keyPkt(500, testH264SPS, testH264PPS, testH264IDR), []*UIFrame{
+				config(7200, true, avcC(testH264SPS, testH264PPS)),
+				frame(7200, true, 3600, avcc(testH264IDR)),
+			}},
+		}},
+		{"discontinuity without a config frame", UI_BITSTREAM_AVCC, []step{
+			{true, pkt(0, testH264Slice), []*UIFrame{
+				{Codec: UI_CODEC_H264, Discontinuity: true, Data: avcc(testH264Slice)},
+			}},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			framer := newUIFramer(test.bitstream, nil)
+			for i, s := range test.steps {
+				if s.discontinuity {
+					framer.setDiscontinuity()
+				}
+				if got := framer.frames(s.pkt); !reflect.DeepEqual(got, s.want) {
+					t.Errorf("packet %d: got %d frames:", i, len(got))
+					for _, f := range got {
+						t.Errorf("  %+v", *f)
+					}
+				}
+			}
+		})
+	}
+
+	// The avcC record holds the parameter sets
+	codecData, err := h264parser.NewCodecDataFromAVCDecoderConfRecord(avcC(testH264SPS, testH264PPS))
+	if err != nil || !bytes.Equal(codecData.SPS(), testH264SPS) || !bytes.Equal(codecData.PPS(), testH264PPS) ||
+		codecData.Width() != 640 || codecData.Height() != 360 {
+		t.Errorf("invalid avcC record: %v", err)
+	}
+}
+
+func TestUIFramerAlloc(t *testing.T) {
+	for _, bitstream := range []int{UI_BITSTREAM_ANNEXB, UI_BITSTREAM_AVCC} {
+		var buffers [][]byte
+		var sizes []int
+		framer := newUIFramer(bitstream, func(size int) []byte {
+			sizes = append(sizes, size)
+			buf := make([]byte, size+16)
+			buffers = append(buffers, buf)
+			return buf
+		})
+		reference := newUIFramer(bitstream, nil)
+
+		pkts := []*uiPacket{
+			{codec: UI_CODEC_H264, pts: 0, dts: 0, nalus: [][]byte{testH264SPS, testH264PPS}},
+			{codec: UI_CODEC_H264, isKeyFrame: true, pts: 3600, dts: 3600, nalus: [][]byte{testH264AUD, testH264IDR}},
+			{codec: UI_CODEC_H264, pts: 7200, dts: 7200, nalus: [][]byte{testH264Slice, testH264Slice}},
+		}
+		for i, pkt := range pkts {
+			got, want := framer.frames(pkt), reference.frames(pkt)
+			if last := got[len(got)-1]; last.allocated != (i > 0) {
+				t.Errorf("bitstream %d, packet %d: allocated is %v", bitstream, i, last.allocated)
+			} else {
+				last.allocated = false
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("bitstream %d, packet %d: got %+v, want %+v", bitstream, i, got, want)
+				continue
+			}
+			if i == 0 {
+				// No buffer is allocated for the parameter sets
+				if len(buffers) != 0 {
+					t.Errorf("bitstream %d: buffer allocated for a config frame", bitstream)
+				}
+				continue
+			}
+			data := got[len(got)-1].Data
+			buf := buffers[len(buffers)-1]
+			if len(buffers) != i || &data[0] != &buf[0] {
+				t.Errorf("bitstream %d, packet %d: the data is not written to the allocated buffer", bitstream, i)
+			}
+			if size := sizes[len(sizes)-1]; size != len(data) {
+				t.Errorf("bitstream %d, packet %d: allocated %d bytes for %d", bitstream, i, size, len(data))
+			}
+		}
+	}
+
+	// The data is allocated by the framer when the allocator returns nil
+	framer := newUIFramer(UI_BITSTREAM_ANNEXB, func(size int) []byte { return nil })
+	frames := framer.frames(&uiPacket{codec: UI_CODEC_H264, nalus: [][]byte{testH264Slice}})
+	if len(frames) != 1 || !bytes.Equal(frames[0].Data, annexB(testH264Slice)) {
+		t.Errorf("got %+v, want a frame with the slice", frames)
+	}
+}
+
+func TestUIFramerAudio(t *testing.T) {
+	audioConfig := testAudioConfig()
+	codecData, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(audioConfig)
+	duration := int64(1024 * UI_TIMESCALE / audioConfig.SampleRate)
+	audioPkt := func(pts int64, adts []byte) *uiPacket {
+		return &uiPacket{codec: UI_CODEC_AAC, isKeyFrame: true, pts: pts, dts: pts, adts: adts}
+	}
+	audioFrame := func(pts int64, data []byte) *UIFrame {
+		return &UIFrame{Codec: UI_CODEC_AAC, IsKeyFrame: true, Idx: UI_STREAM_AUDIO, PTS: pts, DTS: pts, Duration: duration,
+			Data: data}
+	}
+	configFrame := func(pts int64) *UIFrame {
+		return &UIFrame{Codec: UI_CODEC_AAC, IsCodecConfig: true, Idx: UI_STREAM_AUDIO, PTS: pts, DTS: pts,
+			Data: codecData.MPEG4AudioConfigBytes()}
+	}
+
+	framer := newUIFramer(UI_BITSTREAM_ANNEXB, nil)
+	if frames := framer.frames(audioPkt(90000, testADTS([]byte{1}))); frames != nil {
+		t.Errorf("got %+v before the first video frame, want none", frames)
+	}
+	framer.frames(&uiPacket{codec: UI_CODEC_H264, isKeyFrame: true, pts: 90000, dts: 90000, nalus: [][]byte{testH264IDR}})
+
+	steps := []struct {
+		name string
+		pkt  *uiPacket
+		want []*UIFrame
+	}{
+		{"first frames", audioPkt(90900, testADTS([]byte{1, 2, 3}, []byte{4, 5})), []*UIFrame{
+			configFrame(900), audioFrame(900, []byte{1, 2, 3}), audioFrame(900+duration, []byte{4, 5}),
+		}},
+		{"same configuration", audioPkt(92000, testADTS([]byte{6})), []*UIFrame{audioFrame(2000, []byte{6})}},
+		{"truncated frame", audioPkt(93000, testADTS([]byte{7}, []byte{8, 9})[:12]), []*UIFrame{audioFrame(3000, []byte{7})}},
+		{"invalid frame", audioPkt(94000, make([]byte, 10)), nil},
+	}
+	for _, step := range steps {
+		if got := framer.frames(step.pkt); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %d frames:", step.name, len(got))
+			for _, f := range got {
+				t.Errorf("  %+v", *f)
+			}
+		}
+	}
+
+	// The configuration is passed again after a discontinuity
+	framer.setDiscontinuity()
+	framer.frames(&uiPacket{codec: UI_CODEC_H264, isKeyFrame: true, pts: 1000, dts: 1000, nalus: [][]byte{testH264IDR}})
+	frames := framer.frames(audioPkt(1000, testADTS([]byte{1})))
+	if len(frames) != 2 || !frames[0].IsCodecConfig {
+		t.Errorf("got %d frames after the discontinuity, want a config frame and an audio frame", len(frames))
+	}
+}
+
+func TestDeliverUIFrameToSinks(t *testing.T) {
+	ctx := &SessionContext{}
+	var received []*UIFrame
+	ctx.addUIFrameSink(uiFrameListenerFunc(func(sessionId string, frame *UIFrame) error {
+		received = append(received, frame)
+		return nil
+	}))
+
+	config := &UIFrame{Codec: UI_CODEC_H264, IsCodecConfig: true, Data: annexB(testH264SPS, testH264PPS)}
+	deliverUIFrameToSinks(ctx, config)
+	allocated := &UIFrame{Codec: UI_CODEC_H264, IsKeyFrame: true, Data: annexB(testH264IDR), allocated: true}
+	deliverUIFrameToSinks(ctx, allocated)
+	if len(received) != 2 || received[0] != config {
+		t.Fatalf("got %d frames, want the config frame and a copy of the allocated frame", len(received))
+	}
+
+	// The sinks keep their data once the client reuses its buffer
+	copied := received[1]
+	allocated.Data[len(allocated.Data)-1] = 0
+	if copied == allocated || copied.allocated || !bytes.Equal(copied.Data, annexB(testH264IDR)) {
+		t.Errorf("the data of the allocated frame is passed to the sinks as is")
+	}
+
+	// A sink added later is first passed the last config frame
+	var later []*UIFrame
+	ctx.addUIFrameSink(uiFrameListenerFunc(func(sessionId string, frame *UIFrame) error {
+		later = append(later, frame)
+		return nil
+	}))
+	frame := &UIFrame{Codec: UI_CODEC_H264, Data: annexB(testH264Slice)}
+	deliverUIFrameToSinks(ctx, frame)
+	if len(later) != 2 || later[0] != config || later[1] != frame {
+		t.Errorf("got %d frames in the sink added later, want the config frame and the frame", len(later))
+	}
+}
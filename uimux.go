@@ -0,0 +1,818 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"errors"
+	"log"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/ts/tsio"
+)
+
+const (
+	// The remuxing starts at the first video key frame once the audio configuration is known, or after this much
+	// video when the UI stream has no audio
+	_MUX_AUDIO_WAIT = UI_TIMESCALE / 2
+
+	// MPEG-TS output
+	_MUX_TS_VIDEO_PID = 0x100
+	_MUX_TS_AUDIO_PID = 0x101
+	_MUX_TS_OFFSET    = UI_TIMESCALE // Added to the timestamps, as done by the joy4 muxer
+
+	// fMP4 output, the fragments are cut at each video key frame and at least this often
+	_MUX_FMP4_FRAGMENT_DURATION = UI_TIMESCALE
+	_MUX_FMP4_VIDEO_TRACK       = 1
+	_MUX_FMP4_AUDIO_TRACK       = 2
+)
+
+// uiMediaInfo is the codec configuration of a remuxed UI stream.
+type uiMediaInfo struct {
+	videoCodec    string    // One of the UI_CODEC_* video constants, empty until known
+	params        [3][]byte // The parameter sets: VPS (HEVC only), SPS and PPS
+	width, height int
+	audio         *aacparser.CodecData // Nil until an audio codec config frame is received
+}
+
+func (info *uiMediaInfo) hasVideo() bool {
+	return info.videoCodec != "" && (info.videoCodec != UI_CODEC_HEVC || len(info.params[0]) > 0) &&
+		len(info.params[1]) > 0 && len(info.params[2]) > 0
+}
+
+// uiSample is a video or audio frame being remuxed, with the timestamps in UI_TIMESCALE units.
+type uiSample struct {
+	idx        int // One of the UI_STREAM_* constants
+	isKeyFrame bool
+	pts, dts   int64
+	duration   int64    // Zero if unknown
+	nalus      [][]byte // The NAL units of a video frame, without the parameter sets
+	data       []byte   // The raw AAC frame of an audio frame
+}
+
+// uiFrameReader turns UI frames in either bitstream format into samples and tracks the codec configuration.
+type uiFrameReader struct {
+	info    uiMediaInfo
+	version int  // Incremented whenever info changes
+	avcc    bool // Whether the video frames are in UI_BITSTREAM_AVCC format, as told by the codec config frames
+}
+
+// read returns the sample of a frame, or nil for a codec config frame.
+func (reader *uiFrameReader) read(frame *UIFrame) (sample *uiSample, err error) {
+	if frame.Idx == UI_STREAM_AUDIO {
+		if frame.IsCodecConfig {
+			if reader.info.audio == nil || !bytes.Equal(reader.info.audio.MPEG4AudioConfigBytes(), frame.Data) {
+				codecData, e := aacparser.NewCodecDataFromMPEG4AudioConfigBytes(frame.Data)
+				if e != nil {
+					return nil, e
+				}
+				reader.info.audio = &codecData
+				reader.version++
+			}
+			return nil, nil
+		}
+		return &uiSample{idx: UI_STREAM_AUDIO, isKeyFrame: true, pts: frame.PTS, dts: frame.DTS, duration: frame.Duration,
+			data: frame.Data}, nil
+	}
+
+	codec := frame.Codec
+	if codec == "" {
+		// Passed to OnUIFrame(), which lacks the codec
+		codec = reader.info.videoCodec
+		if codec == "" || frame.IsCodecConfig {
+			codec = detectUICodec(frame.Data)
+		}
+	}
+	params := reader.info.params
+	if codec != reader.info.videoCodec {
+		params = [3][]byte{}
+	}
+
+	var nalus [][]byte
+	if frame.IsCodecConfig && len(frame.Data) > 0 && frame.Data[0] == 1 {
+		// A decoder configuration record, whereas an Annex B bitstream starts with a start code
+		reader.avcc = true
+		if codec == UI_CODEC_HEVC {
+			params[0], params[1], params[2], err = parseHEVCDecoderConfRecord(frame.Data)
+		} else {
+			var codecData h264parser.CodecData
+			if codecData, err = h264parser.NewCodecDataFromAVCDecoderConfRecord(frame.Data); err == nil {
+				params[1], params[2] = codecData.SPS(), codecData.PPS()
+			}
+		}
+		if err != nil {
+			return
+		}
+	} else if frame.IsCodecConfig || !reader.avcc {
+		reader.avcc = reader.avcc && !frame.IsCodecConfig
+		nalus = splitAnnexB(frame.Data)
+	} else if nalus, err = splitAVCC(frame.Data); err != nil {
+		return
+	}
+
+	sample = &uiSample{idx: UI_STREAM_VIDEO, isKeyFrame: frame.IsKeyFrame, pts: frame.PTS, dts: frame.DTS,
+		duration: frame.Duration}
+	for _, nalu := range nalus {
+		if isAUDNALU(codec, nalu) {
+			continue
+		}
+		if i := parameterSetIndex(codec, nalu); i >= 0 {
+			params[i] = nalu
+			continue
+		}
+		sample.nalus = append(sample.nalus, nalu)
+	}
+	reader.setVideoConfig(codec, params)
+	if frame.IsCodecConfig || len(sample.nalus) == 0 {
+		return nil, nil
+	}
+	return sample, nil
+}
+
+// setVideoConfig updates the video configuration if it changed.
+func (reader *uiFrameReader) setVideoConfig(codec string, params [3][]byte) {
+	info := &reader.info
+	if codec == info.videoCodec && bytes.Equal(params[0], info.params[0]) && bytes.Equal(params[1], info.params[1]) &&
+		bytes.Equal(params[2], info.params[2]) {
+		return
+	}
+	info.videoCodec = codec
+	for i := range params {
+		info.params[i] = append([]byte(nil), params[i]...)
+	}
+	info.width, info.height = 0, 0
+	if codec == UI_CODEC_HEVC {
+		if sps, err := parseHEVCSPS(info.params[1]); err == nil {
+			info.width, info.height = sps.width, sps.height
+		}
+	} else if len(info.params[1]) > 0 {
+		if sps, err := h264parser.ParseSPS(info.params[1]); err == nil {
+			info.width, info.height = int(sps.Width), int(sps.Height)
+		}
+	}
+	reader.version++
+}
+
+// detectUICodec guesses the video codec of a frame passed to OnUIFrame() from the NAL unit headers.
+func detectUICodec(data []byte) string {
+	if len(data) > 0 && data[0] == 1 {
+		// An avcC record has the reserved bits set before the number of SPS and the SPS follows
+		if len(data) > 8 && data[5]&0xe0 == 0xe0 && data[8]&0x1f == _H264_NALU_SPS {
+			return UI_CODEC_H264
+		}
+		return UI_CODEC_HEVC
+	}
+	for _, nalu := range splitAnnexB(data) {
+		// The HEVC VPS, SPS, PPS and AUD headers are unusual H.264 NAL unit headers
+		t := naluType(UI_CODEC_HEVC, nalu)
+		if len(nalu) > 1 && t >= _HEVC_NALU_VPS && t <= _HEVC_NALU_AUD && nalu[1]&0x07 != 0 {
+			return UI_CODEC_HEVC
+		}
+		return UI_CODEC_H264
+	}
+	return UI_CODEC_H264
+}
+
+// splitAVCC returns the NAL units of a bitstream with 4 bytes length prefixes.
+func splitAVCC(b []byte) (nalus [][]byte, err error) {
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errors.New("Invalid AVCC bitstream")
+		}
+		n := int(b[0])<<24 | int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if n < 0 || n > len(b)-4 {
+			return nil, errors.New("Invalid AVCC bitstream")
+		}
+		if n > 0 {
+			nalus = append(nalus, b[4:4+n])
+		}
+		b = b[4+n:]
+	}
+	return
+}
+
+// uiContainerWriter writes the samples of a UI stream in a container format. The returned data is only valid until
+// the next call.
+type uiContainerWriter interface {
+	// header returns the data starting a segment, info is retained until the next call
+	header(info *uiMediaInfo) (data []byte, err error)
+
+	// write adds a sample and returns the data which is complete
+	write(sample *uiSample) (data []byte)
+
+	// flush returns the data of the buffered samples, nextDTS is the DTS of the video frame following them or -1
+	flush(nextDTS int64) (data []byte)
+
+	// fixedConfig tells whether the codec configuration is only given by the header, in which case a change of the
+	// configuration requires a new segment
+	fixedConfig() bool
+
+	// discontinuity is called before the header of a segment whose timestamps start over, i.e. when the UI stream was
+	// restarted
+	discontinuity()
+}
+
+// uiSegmentOutput receives the data of a uiRemuxer.
+type uiSegmentOutput interface {
+	// cutSegment is called at each video key frame, it returns whether to start a new segment there
+	cutSegment(dts int64) bool
+
+	// startSegment starts a segment with the given header, its first sample is a video key frame with the given DTS.
+	// discontinuity is set when the timestamps start over, i.e. when the UI stream was restarted.
+	startSegment(header []byte, dts int64, discontinuity bool) (err error)
+
+	// writeData appends data to the current segment
+	writeData(data []byte) (err error)
+}
+
+// uiRemuxer remuxes UI frames into segments starting with a video key frame.
+type uiRemuxer struct {
+	reader  uiFrameReader
+	writer  uiContainerWriter
+	output  uiSegmentOutput
+	started bool        // Whether the first segment was started
+	waiting []*uiSample // The samples from the first key frame on, while waiting for the audio configuration
+	version int         // The version of the configuration in the header of the current segment
+	lastDTS int64       // The DTS of the last video sample
+
+	// Whether the timestamps started over since the last segment was started
+	discontinuity bool
+}
+
+func newUIRemuxer(writer uiContainerWriter, output uiSegmentOutput) *uiRemuxer {
+	return &uiRemuxer{writer: writer, output: output}
+}
+
+// writeFrame remuxes a frame, the frames which cannot be parsed are logged and dropped. It only fails when the
+// output fails.
+func (remuxer *uiRemuxer) writeFrame(frame *UIFrame) (err error) {
+	sample, err := remuxer.reader.read(frame)
+	if err != nil {
+		log.Println("Failed to parse UI frame for remuxing: ", err)
+		return nil
+	}
+	if sample == nil {
+		return nil
+	}
+	if remuxer.started && sample.idx == UI_STREAM_VIDEO && sample.dts < remuxer.lastDTS {
+		// A new UI stream whose timestamps start over, the remuxing starts again at its first key frame
+		if err = remuxer.flush(); err != nil {
+			return
+		}
+		remuxer.started = false
+		remuxer.discontinuity = true
+	}
+	if remuxer.started {
+		return remuxer.writeSample(sample)
+	}
+
+	if len(remuxer.waiting) == 0 &&
+		(sample.idx != UI_STREAM_VIDEO || !sample.isKeyFrame || !remuxer.reader.info.hasVideo()) {
+		// Nothing can be decoded before the first key frame
+		return nil
+	}
+	remuxer.waiting = append(remuxer.waiting, sample)
+	if remuxer.reader.info.audio == nil && sample.dts-remuxer.waiting[0].dts < _MUX_AUDIO_WAIT {
+		return nil
+	}
+	waiting := remuxer.waiting
+	remuxer.waiting = nil
+	remuxer.started = true
+	if err = remuxer.startSegment(waiting[0].dts); err != nil {
+		return
+	}
+	for _, sample := range waiting {
+		if sample.idx == UI_STREAM_VIDEO {
+			remuxer.lastDTS = sample.dts
+		}
+		if err = remuxer.output.writeData(remuxer.writer.write(sample)); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (remuxer *uiRemuxer) writeSample(sample *uiSample) (err error) {
+	if sample.idx == UI_STREAM_VIDEO {
+		remuxer.lastDTS = sample.dts
+	}
+	if sample.idx == UI_STREAM_VIDEO && sample.isKeyFrame {
+		configChanged := remuxer.writer.fixedConfig() && remuxer.reader.version != remuxer.version
+		if configChanged || remuxer.output.cutSegment(sample.dts) {
+			if err = remuxer.output.writeData(remuxer.writer.flush(sample.dts)); err != nil {
+				return
+			}
+			if err = remuxer.startSegment(sample.dts); err != nil {
+				return
+			}
+		}
+	}
+	return remuxer.output.writeData(remuxer.writer.write(sample))
+}
+
+func (remuxer *uiRemuxer) startSegment(dts int64) (err error) {
+	if remuxer.discontinuity {
+		remuxer.writer.discontinuity()
+	}
+	header, err := remuxer.writer.header(&remuxer.reader.info)
+	if err != nil {
+		return
+	}
+	remuxer.version = remuxer.reader.version
+	discontinuity := remuxer.discontinuity
+	remuxer.discontinuity = false
+	return remuxer.output.startSegment(header, dts, discontinuity)
+}
+
+// flush writes the buffered samples, e.g. before closing the output.
+func (remuxer *uiRemuxer) flush() (err error) {
+	if !remuxer.started {
+		return nil
+	}
+	return remuxer.output.writeData(remuxer.writer.flush(-1))
+}
+
+// uiTsWriter writes MPEG-TS, with the PAT and PMT repeated before each video key frame, hence the empty header. The packets are written
+// here rather than by the joy4 muxer as it only supports H.264 and its PCR overflows after a few minutes.
+type uiTsWriter struct {
+	info          *uiMediaInfo
+	buf           []byte
+	continuity    map[int]byte // The continuity counter of each PID
+	discontinuous map[int]bool // The PIDs whose next packet has the discontinuity_indicator set
+	pmt           []byte       // The last PMT
+	pmtVersion    int
+	pmtAudio      bool // Whether the last PMT has the audio stream
+}
+
+func newUITsWriter() *uiTsWriter {
+	return &uiTsWriter{continuity: map[int]byte{}}
+}
+
+func (w *uiTsWriter) fixedConfig() bool {
+	return false
+}
+
+// discontinuity sets the discontinuity_indicator of the next packet of the elementary streams, whose timestamps
+// start over.
+func (w *uiTsWriter) discontinuity() {
+	w.discontinuous = map[int]bool{_MUX_TS_VIDEO_PID: true, _MUX_TS_AUDIO_PID: true}
+}
+
+func (w *uiTsWriter) header(info *uiMediaInfo) (data []byte, err error) {
+	w.info = info
+	return nil, nil
+}
+
+func (w *uiTsWriter) flush(nextDTS int64) (data []byte) {
+	return nil
+}
+
+func (w *uiTsWriter) write(sample *uiSample) (data []byte) {
+	w.buf = w.buf[:0]
+	pts, dts := sample.pts+_MUX_TS_OFFSET, sample.dts+_MUX_TS_OFFSET
+	if sample.idx == UI_STREAM_AUDIO {
+		if !w.pmtAudio {
+			// The audio started after the last PMT, it is added by the next one
+			return nil
+		}
+		adts := make([]byte, aacparser.ADTSHeaderLength)
+		aacparser.FillADTSHeader(adts, w.info.audio.Config, 1024, len(sample.data))
+		pes := appendPESHeader(nil, tsio.StreamIdAAC, len(adts)+len(sample.data), pts, pts)
+		pes = append(append(pes, adts...), sample.data...)
+		w.writePackets(_MUX_TS_AUDIO_PID, pes, -1, true)
+		return w.buf
+	}
+
+	if sample.isKeyFrame {
+		w.writePSI()
+	}
+	pes := appendPESHeader(nil, tsio.StreamIdH264, -1, pts, dts)
+	if w.info.videoCodec == UI_CODEC_HEVC {
+		pes = append(pes, 0, 0, 0, 1, _HEVC_NALU_AUD<<1, 1, 0x50)
+	} else {
+		pes = append(pes, 0, 0, 0, 1, _H264_NALU_AUD, 0xf0)
+	}
+	if sample.isKeyFrame {
+		for _, nalu := range w.info.params {
+			if len(nalu) > 0 {
+				pes = append(append(pes, h264parser.StartCodeBytes...), nalu...)
+			}
+		}
+	}
+	for _, nalu := range sample.nalus {
+		pes = append(append(pes, h264parser.StartCodeBytes...), nalu...)
+	}
+	w.writePackets(_MUX_TS_VIDEO_PID, pes, dts, sample.isKeyFrame)
+	return w.buf
+}
+
+// writePSI writes the PAT and the PMT, the version of the PMT is incremented when the streams change.
+func (w *uiTsWriter) writePSI() {
+	pat := tsio.PAT{Entries: []tsio.PATEntry{{ProgramNumber: 1, ProgramMapPID: tsio.PMT_PID}}}
+	patData := make([]byte, pat.Len())
+	pat.Marshal(patData)
+	w.writeSection(tsio.PAT_PID, tsio.TableIdPAT, tsio.TableExtPAT, 0, patData)
+
+	streamType := byte(_TS_STREAM_TYPE_H264)
+	if w.info.videoCodec == UI_CODEC_HEVC {
+		streamType = _TS_STREAM_TYPE_HEVC
+	}
+	pmt := tsio.PMT{
+		PCRPID: _MUX_TS_VIDEO_PID,
+		ElementaryStreamInfos: []tsio.ElementaryStreamInfo{
+			{StreamType: streamType, ElementaryPID: _MUX_TS_VIDEO_PID},
+		},
+	}
+	if w.info.audio != nil {
+		pmt.ElementaryStreamInfos = append(pmt.ElementaryStreamInfos,
+			tsio.ElementaryStreamInfo{StreamType: _TS_STREAM_TYPE_AAC, ElementaryPID: _MUX_TS_AUDIO_PID})
+	}
+	pmtData := make([]byte, pmt.Len())
+	pmt.Marshal(pmtData)
+	if w.pmt != nil && !bytes.Equal(pmtData, w.pmt) {
+		w.pmtVersion = (w.pmtVersion + 1) & 0x1f
+	}
+	w.pmt = pmtData
+	w.pmtAudio = w.info.audio != nil
+	w.writeSection(tsio.PMT_PID, tsio.TableIdPMT, tsio.TableExtPMT, w.pmtVersion, pmtData)
+}
+
+// writeSection writes a PSI section in a single TS packet.
+func (w *uiTsWriter) writeSection(pid int, tableId byte, tableExt uint16, version int, data []byte) {
+	n := 5 + len(data) + 4 // Section length, from the table id extension to the CRC
+	section := []byte{
+		0, // pointer_field
+		tableId,
+		0xb0 | byte(n>>8)&0x0f, byte(n), // section_syntax_indicator(1)=1, '0', reserved(2), section_length(12)
+		byte(tableExt >> 8), byte(tableExt),
+		0xc1 | byte(version)<<1, // reserved(2), version_number(5), current_next_indicator(1)=1
+		0, 0,                    // section_number, last_section_number
+	}
+	section = append(section, data...)
+	crc := mpegCRC32(section[1:])
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+	for len(section) < _TS_PACKET_SIZE-4 {
+		section = append(section, 0xff)
+	}
+	w.writePackets(pid, section, -1, false)
+}
+
+// writePackets splits a PES packet or a PSI section into TS packets, with a PCR when pcr is not negative.
+func (w *uiTsWriter) writePackets(pid int, data []byte, pcr int64, randomAccess bool) {
+	discontinuous := w.discontinuous[pid]
+	delete(w.discontinuous, pid)
+	first := true
+	for len(data) > 0 {
+		header := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0x10 | w.continuity[pid]}
+		w.continuity[pid] = (w.continuity[pid] + 1) & 0x0f
+		if first {
+			header[1] |= 0x40 // payload_unit_start_indicator
+		}
+
+		// The adaptation field, without its length
+		var adaptation []byte
+		if first && (pcr >= 0 || randomAccess || discontinuous) {
+			flags := byte(0)
+			if discontinuous {
+				flags |= 0x80
+			}
+			if randomAccess {
+				flags |= 0x40
+			}
+			adaptation = []byte{flags}
+			if pcr >= 0 {
+				adaptation[0] |= 0x10
+				base := pcr & (_TS_WRAP - 1)
+				adaptation = append(adaptation, byte(base>>25), byte(base>>17), byte(base>>9), byte(base>>1),
+					byte(base<<7)|0x7e, 0)
+			}
+		}
+		first = false
+
+		payloadSize := _TS_PACKET_SIZE - 4
+		if adaptation != nil || len(data) < payloadSize {
+			payloadSize = _TS_PACKET_SIZE - 5 - len(adaptation)
+			if len(data) < payloadSize {
+				// Stuffing bytes in the adaptation field
+				if adaptation == nil {
+					adaptation = []byte{0}
+				}
+				for len(data) < _TS_PACKET_SIZE-5-len(adaptation) {
+					adaptation = append(adaptation, 0xff)
+				}
+				payloadSize = len(data)
+			}
+			header[3] |= 0x20
+			header = append(append(header, byte(len(adaptation))), adaptation...)
+		}
+		w.buf = append(append(w.buf, header...), data[:payloadSize]...)
+		data = data[payloadSize:]
+	}
+}
+
+// appendPESHeader appends a PES header, with the packet length unbounded when negative.
+func appendPESHeader(b []byte, streamId byte, payloadLen int, pts int64, dts int64) []byte {
+	flags, hdrlen := byte(0x80), byte(5)
+	if dts != pts {
+		flags, hdrlen = 0xc0, 10
+	}
+	length := 0
+	if payloadLen >= 0 && 3+int(hdrlen)+payloadLen <= 0xffff {
+		length = 3 + int(hdrlen) + payloadLen
+	}
+	b = append(b, 0, 0, 1, streamId, byte(length>>8), byte(length), 0x80, flags, hdrlen)
+	if dts != pts {
+		b = appendPESTimestamp(b, 0x3, pts)
+		return appendPESTimestamp(b, 0x1, dts)
+	}
+	return appendPESTimestamp(b, 0x2, pts)
+}
+
+func appendPESTimestamp(b []byte, prefix byte, ts int64) []byte {
+	ts &= _TS_WRAP - 1
+	return append(b, prefix<<4|byte(ts>>29)&0x0e|1, byte(ts>>22), byte(ts>>14)|1, byte(ts>>7), byte(ts<<1)|1)
+}
+
+// mpegCRC32 returns the CRC of a PSI section.
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc ^= uint32(b) << 24
+		for i := 0; i < 8; i++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// uiFMP4Writer writes fragmented MP4 (ISO/IEC 14496-12), with a fragment per GOP or per second if shorter. The
+// decode times keep increasing when the timestamps start over, so that the segments can be concatenated.
+type uiFMP4Writer struct {
+	audioRate int // The audio timescale, zero without audio
+	sequence  uint32
+	pending   [2][]*uiSample // The samples of the fragment being built, per stream
+	offset    int64          // Added to the timestamps of the samples
+	end       int64          // The end of the last video sample, offset included
+	rebase    bool           // The offset is to be set by the next sample
+}
+
+func newUIFMP4Writer() *uiFMP4Writer {
+	return &uiFMP4Writer{}
+}
+
+func (w *uiFMP4Writer) fixedConfig() bool {
+	return true
+}
+
+// discontinuity makes the next sample, the video key frame starting the segment, follow the last video sample.
+func (w *uiFMP4Writer) discontinuity() {
+	w.rebase = true
+}
+
+// header returns the initialization segment.
+func (w *uiFMP4Writer) header(info *uiMediaInfo) (data []byte, err error) {
+	var entry []byte
+	if info.videoCodec == UI_CODEC_HEVC {
+		record, e := hevcDecoderConfRecord(info.params[0], info.params[1], info.params[2])
+		if e != nil {
+			return nil, e
+		}
+		entry = mp4VisualSampleEntry("hvc1", info.width, info.height, mp4Box("hvcC", record))
+	} else {
+		codecData, e := h264parser.NewCodecDataFromSPSAndPPS(info.params[1], info.params[2])
+		if e != nil {
+			return nil, e
+		}
+		entry = mp4VisualSampleEntry("avc1", info.width, info.height, mp4Box("avcC", codecData.AVCDecoderConfRecordBytes()))
+	}
+	traks := [][]byte{mp4Track(_MUX_FMP4_VIDEO_TRACK, "vide", UI_TIMESCALE, info.width, info.height, entry)}
+	trexs := [][]byte{mp4TrackExtends(_MUX_FMP4_VIDEO_TRACK)}
+
+	w.audioRate = 0
+	if info.audio != nil {
+		w.audioRate = info.audio.SampleRate()
+		traks = append(traks, mp4Track(_MUX_FMP4_AUDIO_TRACK, "soun", w.audioRate, 0, 0, mp4AudioSampleEntry(info.audio)))
+		trexs = append(trexs, mp4TrackExtends(_MUX_FMP4_AUDIO_TRACK))
+	}
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		be32(0), be32(0), // creation_time, modification_time
+		be32(1000), be32(0), // timescale, duration
+		be32(0x00010000), be16(0x0100), make([]byte, 10), // rate, volume, reserved
+		mp4Matrix, make([]byte, 24), // matrix, pre_defined
+		be32(_MUX_FMP4_AUDIO_TRACK+1), // next_track_ID
+	)
+	moov := mp4Box("moov", append(append([][]byte{mvhd}, traks...), mp4Box("mvex", trexs...))...)
+	ftyp := mp4Box("ftyp", []byte("iso5"), be32(512), []byte("iso5iso6mp41"))
+	w.pending = [2][]*uiSample{}
+	return append(ftyp, moov...), nil
+}
+
+func (w *uiFMP4Writer) write(sample *uiSample) (data []byte) {
+	if sample.idx == UI_STREAM_AUDIO && w.audioRate == 0 {
+		// The audio started after the header, it is added by the next one
+		return nil
+	}
+	if w.rebase {
+		w.rebase = false
+		w.offset = w.end - sample.dts
+	}
+	shifted := *sample
+	shifted.pts += w.offset
+	shifted.dts += w.offset
+	if video := w.pending[UI_STREAM_VIDEO]; shifted.idx == UI_STREAM_VIDEO && len(video) > 0 &&
+		(shifted.isKeyFrame || shifted.dts-video[0].dts >= _MUX_FMP4_FRAGMENT_DURATION) {
+		data = w.fragment(shifted.dts)
+	}
+	if shifted.idx == UI_STREAM_VIDEO {
+		w.end = shifted.dts + shifted.duration
+	}
+	w.pending[shifted.idx] = append(w.pending[shifted.idx], &shifted)
+	return
+}
+
+// flush returns a fragment with the pending samples.
+func (w *uiFMP4Writer) flush(nextDTS int64) (data []byte) {
+	if nextDTS >= 0 {
+		nextDTS += w.offset
+	}
+	return w.fragment(nextDTS)
+}
+
+// fragment returns a fragment with the pending samples, nextDTS includes the offset.
+func (w *uiFMP4Writer) fragment(nextDTS int64) (data []byte) {
+	video, audio := w.pending[UI_STREAM_VIDEO], w.pending[UI_STREAM_AUDIO]
+	w.pending = [2][]*uiSample{}
+	if len(video) == 0 && len(audio) == 0 {
+		return nil
+	}
+	w.sequence++
+
+	// The sample data, the video followed by the audio
+	var mdat []byte
+	var videoEntries, audioEntries []byte
+	for i, sample := range video {
+		start := len(mdat)
+		for _, nalu := range sample.nalus {
+			mdat = append(append(mdat, be32(uint32(len(nalu)))...), nalu...)
+		}
+		next := nextDTS
+		if i+1 < len(video) {
+			next = video[i+1].dts
+		}
+		duration := sample.duration
+		if next > sample.dts {
+			duration = next - sample.dts
+		}
+		flags := uint32(0x01010000) // sample_depends_on=1, sample_is_non_sync_sample=1
+		if sample.isKeyFrame {
+			flags = 0x02000000 // sample_depends_on=2
+		}
+		cts := sample.pts - sample.dts
+		if cts < 0 {
+			cts = 0
+		}
+		videoEntries = append(videoEntries, mp4Concat(be32(uint32(duration)), be32(uint32(len(mdat)-start)), be32(flags),
+			be32(uint32(cts)))...)
+	}
+	audioOffset := len(mdat)
+	for i, sample := range audio {
+		mdat = append(mdat, sample.data...)
+		t := w.audioTime(sample.dts)
+		duration := w.audioTime(sample.duration)
+		if i+1 < len(audio) {
+			duration = w.audioTime(audio[i+1].dts) - t
+		}
+		audioEntries = append(audioEntries, mp4Concat(be32(uint32(duration)), be32(uint32(len(sample.data))), be32(0x02000000))...)
+	}
+
+	// The data offsets are relative to the start of the moof box, whose size does not depend on them
+	moof := func(moofSize int) []byte {
+		boxes := [][]byte{mp4FullBox("mfhd", 0, 0, be32(w.sequence))}
+		if len(video) > 0 {
+			boxes = append(boxes, mp4TrackFragment(_MUX_FMP4_VIDEO_TRACK, uint64(video[0].dts), 0xf01, len(video),
+				moofSize+8, videoEntries))
+		}
+		if len(audio) > 0 {
+			boxes = append(boxes, mp4TrackFragment(_MUX_FMP4_AUDIO_TRACK, uint64(w.audioTime(audio[0].dts)), 0x701,
+				len(audio), moofSize+8+audioOffset, audioEntries))
+		}
+		return mp4Box("moof", boxes...)
+	}
+	data = moof(len(moof(0)))
+	return append(data, mp4Box("mdat", mdat)...)
+}
+
+// audioTime converts a time in UI_TIMESCALE units to the audio timescale.
+func (w *uiFMP4Writer) audioTime(t int64) int64 {
+	return t * int64(w.audioRate) / UI_TIMESCALE
+}
+
+var mp4Matrix = mp4Concat(be32(0x00010000), be32(0), be32(0), be32(0), be32(0x00010000), be32(0), be32(0), be32(0),
+	be32(0x40000000))
+
+func mp4Track(trackId int, handler string, timescale int, width int, height int, entry []byte) []byte {
+	volume := 0
+	mediaHeader := mp4FullBox("vmhd", 0, 1, make([]byte, 8)) // graphicsmode, opcolor
+	if handler == "soun" {
+		volume = 0x0100
+		mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4)) // balance, reserved
+	}
+	tkhd := mp4FullBox("tkhd", 0, 7, // track_enabled, track_in_movie, track_in_preview
+		be32(0), be32(0), be32(uint32(trackId)), be32(0), be32(0), // times, track_ID, reserved, duration
+		make([]byte, 8), be16(0), be16(0), be16(uint16(volume)), be16(0), // reserved, layer, alternate_group, volume
+		mp4Matrix, be32(uint32(width)<<16), be32(uint32(height)<<16),
+	)
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(uint32(timescale)), be32(0), be16(0x55c4), be16(0)) // "und"
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), []byte("AppFlinger\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be32(1), entry),
+		mp4FullBox("stts", 0, 0, be32(0)),
+		mp4FullBox("stsc", 0, 0, be32(0)),
+		mp4FullBox("stsz", 0, 0, be32(0), be32(0)),
+		mp4FullBox("stco", 0, 0, be32(0)),
+	)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+func mp4TrackExtends(trackId int) []byte {
+	// track_ID, default_sample_description_index, default_sample_duration, default_sample_size, default_sample_flags
+	return mp4FullBox("trex", 0, 0, be32(uint32(trackId)), be32(1), be32(0), be32(0), be32(0))
+}
+
+func mp4VisualSampleEntry(format string, width int, height int, config []byte) []byte {
+	return mp4Box(format,
+		make([]byte, 6), be16(1), // reserved, data_reference_index
+		make([]byte, 16), be16(uint16(width)), be16(uint16(height)), // pre_defined, reserved, width, height
+		be32(0x00480000), be32(0x00480000), be32(0), be16(1), // resolution, reserved, frame_count
+		make([]byte, 32), be16(0x18), be16(0xffff), // compressorname, depth, pre_defined
+		config,
+	)
+}
+
+func mp4AudioSampleEntry(codecData *aacparser.CodecData) []byte {
+	config := codecData.MPEG4AudioConfigBytes()
+	decoderConfig := mp4Descriptor(0x04, // DecoderConfigDescriptor
+		[]byte{0x40, 0x15}, // objectTypeIndication (MPEG-4 audio), streamType (audio)
+		make([]byte, 11),   // bufferSizeDB, maxBitrate, avgBitrate
+		mp4Descriptor(0x05, config),
+	)
+	esds := mp4FullBox("esds", 0, 0, mp4Descriptor(0x03, be16(0), []byte{0}, decoderConfig, mp4Descriptor(0x06, []byte{0x02})))
+	return mp4Box("mp4a",
+		make([]byte, 6), be16(1), make([]byte, 8), // reserved, data_reference_index, reserved
+		be16(uint16(codecData.ChannelLayout().Count())), be16(16), be32(0), // channelcount, samplesize, reserved
+		be32(uint32(codecData.SampleRate())<<16),
+		esds,
+	)
+}
+
+func mp4TrackFragment(trackId int, decodeTime uint64, trunFlags uint32, count int, dataOffset int, entries []byte) []byte {
+	return mp4Box("traf",
+		mp4FullBox("tfhd", 0, 0x020000, be32(uint32(trackId))), // default-base-is-moof
+		mp4FullBox("tfdt", 1, 0, be64(decodeTime)),
+		mp4FullBox("trun", 0, trunFlags, be32(uint32(count)), be32(uint32(dataOffset)), entries),
+	)
+}
+
+// mp4Descriptor returns an MPEG-4 descriptor (ISO/IEC 14496-1), with its size coded on 4 bytes.
+func mp4Descriptor(tag byte, payload ...[]byte) []byte {
+	data := mp4Concat(payload...)
+	n := len(data)
+	return append([]byte{tag, 0x80 | byte(n>>21)&0x7f, 0x80 | byte(n>>14)&0x7f, 0x80 | byte(n>>7)&0x7f, byte(n) & 0x7f}, data...)
+}
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	data := mp4Concat(payload...)
+	return append(append(be32(uint32(8+len(data))), boxType...), data...)
+}
+
+func mp4FullBox(boxType string, version byte, flags uint32, payload ...[]byte) []byte {
+	return mp4Box(boxType, append([][]byte{{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}}, payload...)...)
+}
+
+func mp4Concat(parts ...[]byte) (data []byte) {
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	return
+}
+
+func be16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func be32(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func be64(v uint64) []byte {
+	return append(be32(uint32(v>>32)), be32(uint32(v))...)
+}
@@ -0,0 +1,381 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+)
+
+const (
+	testVideoInterval = 3600 // 25 fps
+	testGOPFrames     = 10
+)
+
+// testUIFrames returns the frames of an H.264 UI stream in Annex B format, preceded by the codec config frames. The
+// given number of video frames start at the given DTS with a key frame every testGOPFrames frames, and each one is
+// followed by an audio frame when withAudio is set.
+func testUIFrames(start int64, count int, withAudio bool) (frames []*UIFrame) {
+	frames = append(frames, &UIFrame{Codec: UI_CODEC_H264, IsCodecConfig: true, PTS: start, DTS: start,
+		Data: annexB(testH264SPS, testH264PPS)})
+	if withAudio {
+		codecData, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(testAudioConfig())
+		frames = append(frames, &UIFrame{Codec: UI_CODEC_AAC, IsCodecConfig: true, Idx: UI_STREAM_AUDIO, PTS: start,
+			DTS: start, Data: codecData.MPEG4AudioConfigBytes()})
+	}
+	for i := 0; i < count; i++ {
+		dts := start + int64(i)*testVideoInterval
+		frame := &UIFrame{Codec: UI_CODEC_H264, PTS: dts + testVideoInterval, DTS: dts, Duration: testVideoInterval,
+			Data: annexB(testH264Slice)}
+		if i%testGOPFrames == 0 {
+			frame.IsKeyFrame, frame.PTS, frame.Data = true, dts, annexB(testH264SPS, testH264PPS, testH264IDR)
+		}
+		frames = append(frames, frame)
+		if withAudio {
+			frames = append(frames, &UIFrame{Codec: UI_CODEC_AAC, IsKeyFrame: true, Idx: UI_STREAM_AUDIO, PTS: dts + 100,
+				DTS: dts + 100, Duration: 2089, Data: []byte{byte(i), 0x21}})
+		}
+	}
+	return
+}
+
+// testSegment is a segment received by testSegmentOutput.
+type testSegment struct {
+	header        []byte
+	dts           int64
+	discontinuity bool
+	data          []byte
+}
+
+// testSegmentOutput collects the segments of a uiRemuxer, a segment is cut at each key frame when cut is set.
+type testSegmentOutput struct {
+	cut      bool
+	segments []*testSegment
+}
+
+func (output *testSegmentOutput) cutSegment(dts int64) bool {
+	return output.cut
+}
+
+func (output *testSegmentOutput) startSegment(header []byte, dts int64, discontinuity bool) (err error) {
+	output.segments = append(output.segments, &testSegment{append([]byte(nil), header...), dts, discontinuity, nil})
+	return nil
+}
+
+func (output *testSegmentOutput) writeData(data []byte) (err error) {
+	segment := output.segments[len(output.segments)-1]
+	segment.data = append(segment.data, data...)
+	return nil
+}
+
+// data returns the data of all the segments.
+func (output *testSegmentOutput) data() (data []byte) {
+	for _, segment := range output.segments {
+		data = append(append(data, segment.header...), segment.data...)
+	}
+	return
+}
+
+// remuxTestFrames passes the frames to the remuxer, which is then flushed.
+func remuxTestFrames(t *testing.T, remuxer *uiRemuxer, frames ...[]*UIFrame) {
+	for _, stream := range frames {
+		for _, frame := range stream {
+			if err := remuxer.writeFrame(frame); err != nil {
+				t.Fatalf("writeFrame() failed: %v", err)
+			}
+		}
+	}
+	if err := remuxer.flush(); err != nil {
+		t.Fatalf("flush() failed: %v", err)
+	}
+}
+
+func TestUITsWriter(t *testing.T) {
+	output := &testSegmentOutput{}
+	remuxer := newUIRemuxer(newUITsWriter(), output)
+	remuxTestFrames(t, remuxer, testUIFrames(90000, 25, true))
+	restart := len(output.data())
+	// The UI stream is restarted, without audio
+	remuxTestFrames(t, remuxer, testUIFrames(0, 15, false))
+	data := output.data()
+
+	if len(output.segments) != 2 || output.segments[0].discontinuity || !output.segments[1].discontinuity {
+		t.Errorf("got %d segments, want one before and one after the restart", len(output.segments))
+	}
+	if len(data)%_TS_PACKET_SIZE != 0 {
+		t.Fatalf("%d bytes, not a whole number of packets", len(data))
+	}
+	continuity := map[int]byte{}
+	for pos := 0; pos < len(data); pos += _TS_PACKET_SIZE {
+		packet := data[pos : pos+_TS_PACKET_SIZE]
+		if packet[0] != 0x47 {
+			t.Fatalf("invalid sync byte at %d", pos)
+		}
+		pid := int(packet[1]&0x1f)<<8 | int(packet[2])
+		if counter, ok := continuity[pid]; ok && packet[3]&0x0f != (counter+1)&0x0f {
+			t.Errorf("continuity counter of PID %#x went from %d to %d", pid, counter, packet[3]&0x0f)
+		}
+		continuity[pid] = packet[3] & 0x0f
+		discontinuous := packet[3]&0x20 != 0 && packet[4] > 0 && packet[5]&0x80 != 0
+		wantDiscontinuous := pid == _MUX_TS_VIDEO_PID && pos > restart && !discontinuityFound(data[restart:pos], pid)
+		if discontinuous != wantDiscontinuous {
+			t.Errorf("packet at %d of PID %#x: discontinuity_indicator %v, want %v", pos, pid, discontinuous,
+				wantDiscontinuous)
+		}
+	}
+
+	pkts, err := readUIPackets(data)
+	if err == nil || len(pkts) == 0 {
+		t.Fatalf("demuxing failed: %v", err)
+	}
+	var video, audio []*uiPacket
+	for _, pkt := range pkts {
+		if pkt.isAudio() {
+			audio = append(audio, pkt)
+		} else {
+			video = append(video, pkt)
+		}
+	}
+	var wantVideo []*uiPacket
+	for _, stream := range []struct {
+		start int64
+		count int
+	}{{90000, 25}, {0, 15}} {
+		for i := 0; i < stream.count; i++ {
+			dts := stream.start + int64(i)*testVideoInterval + _MUX_TS_OFFSET
+			pkt := &uiPacket{codec: UI_CODEC_H264, pts: dts + testVideoInterval, dts: dts,
+				nalus: [][]byte{testH264AUD, testH264Slice}}
+			if i%testGOPFrames == 0 {
+				pkt.isKeyFrame, pkt.pts, pkt.nalus = true, dts, [][]byte{testH264AUD, testH264SPS, testH264PPS, testH264IDR}
+			}
+			wantVideo = append(wantVideo, pkt)
+		}
+	}
+	if !reflect.DeepEqual(video, wantVideo) {
+		t.Errorf("got %d video packets, want %d", len(video), len(wantVideo))
+		for i := range video {
+			if i < len(wantVideo) && !reflect.DeepEqual(video[i], wantVideo[i]) {
+				t.Errorf("video packet %d: got %+v, want %+v", i, *video[i], *wantVideo[i])
+				break
+			}
+		}
+	}
+	if len(audio) != 25 {
+		t.Fatalf("got %d audio packets, want 25", len(audio))
+	}
+	for i, pkt := range audio {
+		pts := 90000 + int64(i)*testVideoInterval + 100 + _MUX_TS_OFFSET
+		if want := testADTS([]byte{byte(i), 0x21}); pkt.pts != pts || !bytes.Equal(pkt.adts, want) {
+			t.Errorf("audio packet %d: got %d %x, want %d %x", i, pkt.pts, pkt.adts, pts, want)
+		}
+	}
+}
+
+// discontinuityFound checks whether a packet of the PID has the discontinuity_indicator set in a stream.
+func discontinuityFound(data []byte, pid int) bool {
+	for pos := 0; pos+_TS_PACKET_SIZE <= len(data); pos += _TS_PACKET_SIZE {
+		packet := data[pos:]
+		if int(packet[1]&0x1f)<<8|int(packet[2]) == pid && packet[3]&0x20 != 0 && packet[4] > 0 && packet[5]&0x80 != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUITsWriterPMT(t *testing.T) {
+	output := &testSegmentOutput{cut: true}
+	remuxer := newUIRemuxer(newUITsWriter(), output)
+	frames := testUIFrames(0, 30, false)
+	// The audio starts in the second GOP, it is added to the PMT at the next key frame
+	codecData, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(testAudioConfig())
+	audio := []*UIFrame{
+		{Codec: UI_CODEC_AAC, IsCodecConfig: true, Idx: UI_STREAM_AUDIO, Data: codecData.MPEG4AudioConfigBytes()},
+		{Codec: UI_CODEC_AAC, IsKeyFrame: true, Idx: UI_STREAM_AUDIO, PTS: 15 * testVideoInterval,
+			DTS: 15 * testVideoInterval, Data: []byte{1}},
+	}
+	frames = append(append(append([]*UIFrame(nil), frames[:16]...), audio...), frames[16:]...)
+	remuxTestFrames(t, remuxer, frames)
+
+	// Without audio the remuxing starts after _MUX_AUDIO_WAIT, hence the first segment has two GOPs
+	if len(output.segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(output.segments))
+	}
+	for i, segment := range output.segments {
+		pkts, _ := readUIPackets(segment.data)
+		if want := []int{2 * testGOPFrames, testGOPFrames}[i]; len(pkts) != want || pkts[0].isAudio() || !pkts[0].isKeyFrame {
+			t.Errorf("segment %d: got %d packets, want %d video packets starting with a key frame", i, len(pkts), want)
+		}
+		// The PMT is the second packet, its version is incremented once the audio is added
+		pmt := segment.data[_TS_PACKET_SIZE:]
+		if version := int(pmt[10]>>1) & 0x1f; version != i {
+			t.Errorf("segment %d: PMT version %d, want %d", i, version, i)
+		}
+		hasAudio := bytes.Contains(pmt[:_TS_PACKET_SIZE], []byte{_TS_STREAM_TYPE_AAC, 0xe0 | _MUX_TS_AUDIO_PID>>8, _MUX_TS_AUDIO_PID & 0xff})
+		if hasAudio != (i == 1) {
+			t.Errorf("segment %d: audio in the PMT %v", i, hasAudio)
+		}
+	}
+}
+
+// testBox is an MP4 box.
+type testBox struct {
+	boxType string
+	offset  int // In the data the box was parsed from
+	payload []byte
+}
+
+// parseMP4Boxes returns the boxes of MP4 data.
+func parseMP4Boxes(t *testing.T, data []byte) (boxes []testBox) {
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 8 {
+			t.Fatalf("truncated box at %d", offset)
+		}
+		size := int(binary.BigEndian.Uint32(data[offset:]))
+		if size < 8 || size > len(data)-offset {
+			t.Fatalf("invalid box size %d at %d", size, offset)
+		}
+		boxes = append(boxes, testBox{string(data[offset+4 : offset+8]), offset, data[offset+8 : offset+size]})
+		offset += size
+	}
+	return
+}
+
+// findMP4Box returns the payload of the box at the given path, skipping the fields of the boxes holding both fields
+// and boxes.
+func findMP4Box(t *testing.T, data []byte, path ...string) []byte {
+	skip := map[string]int{"stsd": 8, "avc1": 78, "hvc1": 78, "mp4a": 28}
+	for _, boxType := range path {
+		found := false
+		for _, box := range parseMP4Boxes(t, data) {
+			if box.boxType == boxType {
+				data, found = box.payload[skip[boxType]:], true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("box %v not found", path)
+		}
+	}
+	return data
+}
+
+// testFragment is a track fragment of an fMP4 stream.
+type testFragment struct {
+	track      int
+	decodeTime int64
+	durations  []int64
+	samples    [][]byte
+}
+
+// parseFMP4Fragments returns the track fragments of fMP4 data which follow the initialization segment.
+func parseFMP4Fragments(t *testing.T, data []byte) (fragments []testFragment) {
+	boxes := parseMP4Boxes(t, data)
+	for i, box := range boxes {
+		if box.boxType != "moof" {
+			continue
+		}
+		if i+1 == len(boxes) || boxes[i+1].boxType != "mdat" {
+			t.Fatalf("moof at %d is not followed by an mdat", box.offset)
+		}
+		for _, traf := range parseMP4Boxes(t, box.payload) {
+			if traf.boxType != "traf" {
+				continue
+			}
+			tfhd := findMP4Box(t, traf.payload, "tfhd")
+			tfdt := findMP4Box(t, traf.payload, "tfdt")
+			trun := findMP4Box(t, traf.payload, "trun")
+			fragment := testFragment{track: int(binary.BigEndian.Uint32(tfhd[4:])),
+				decodeTime: int64(binary.BigEndian.Uint64(tfdt[4:]))}
+			count := int(binary.BigEndian.Uint32(trun[4:]))
+			offset := box.offset + int(binary.BigEndian.Uint32(trun[8:]))
+			entrySize := (len(trun) - 12) / count
+			for j := 0; j < count; j++ {
+				entry := trun[12+j*entrySize:]
+				size := int(binary.BigEndian.Uint32(entry[4:]))
+				fragment.durations = append(fragment.durations, int64(binary.BigEndian.Uint32(entry)))
+				fragment.samples = append(fragment.samples, data[offset:offset+size])
+				offset += size
+			}
+			fragments = append(fragments, fragment)
+		}
+	}
+	return
+}
+
+func TestUIFMP4Writer(t *testing.T) {
+	output := &testSegmentOutput{}
+	remuxer := newUIRemuxer(newUIFMP4Writer(), output)
+	remuxTestFrames(t, remuxer, testUIFrames(90000, 25, true))
+	remuxTestFrames(t, remuxer, testUIFrames(0, 15, true))
+	if len(output.segments) != 2 || !bytes.Equal(output.segments[0].header, output.segments[1].header) ||
+		!output.segments[1].discontinuity {
+		t.Fatalf("got %d segments, want two with the same header", len(output.segments))
+	}
+
+	// The initialization segment
+	header := output.segments[0].header
+	if boxes := parseMP4Boxes(t, header); len(boxes) != 2 || boxes[0].boxType != "ftyp" || boxes[1].boxType != "moov" {
+		t.Fatalf("got %v, want ftyp and moov boxes", boxes)
+	}
+	codecData, _ := h264parser.NewCodecDataFromSPSAndPPS(testH264SPS, testH264PPS)
+	stbl := []string{"moov", "trak", "mdia", "minf", "stbl", "stsd"}
+	if avcC := findMP4Box(t, header, append(stbl, "avc1", "avcC")...); !bytes.Equal(avcC, codecData.AVCDecoderConfRecordBytes()) {
+		t.Errorf("got avcC %x, want %x", avcC, codecData.AVCDecoderConfRecordBytes())
+	}
+	audioConfig, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(testAudioConfig())
+	moov := findMP4Box(t, header, "moov")
+	if traks := parseMP4Boxes(t, moov); len(traks) != 4 || !bytes.Contains(traks[2].payload, audioConfig.MPEG4AudioConfigBytes()) {
+		t.Errorf("got %d boxes in moov, want the audio track with its configuration", len(traks))
+	}
+
+	// The fragments of both segments, the decode times of the second one follow the first one
+	var video, audio []testFragment
+	for _, segment := range output.segments {
+		for _, fragment := range parseFMP4Fragments(t, segment.data) {
+			if fragment.track == _MUX_FMP4_VIDEO_TRACK {
+				video = append(video, fragment)
+			} else {
+				audio = append(audio, fragment)
+			}
+		}
+	}
+	if len(video) != 5 {
+		t.Fatalf("got %d video fragments, want 5", len(video))
+	}
+	decodeTime := int64(90000)
+	for i, fragment := range video {
+		if fragment.decodeTime != decodeTime {
+			t.Errorf("video fragment %d: decode time %d, want %d", i, fragment.decodeTime, decodeTime)
+		}
+		for j, sample := range fragment.samples {
+			want := append(be32(uint32(len(testH264Slice))), testH264Slice...)
+			if j == 0 {
+				want = append(be32(uint32(len(testH264IDR))), testH264IDR...)
+			}
+			if !bytes.Equal(sample, want) {
+				t.Errorf("video fragment %d, sample %d: got %x, want %x", i, j, sample, want)
+			}
+			decodeTime += fragment.durations[j]
+		}
+	}
+	if want := int64(90000 + 40*testVideoInterval); decodeTime != want {
+		t.Errorf("video ends at %d, want %d", decodeTime, want)
+	}
+	audioSamples := 0
+	for i, fragment := range audio {
+		if i > 0 && fragment.decodeTime <= audio[i-1].decodeTime {
+			t.Errorf("audio fragment %d: decode time %d after %d", i, fragment.decodeTime, audio[i-1].decodeTime)
+		}
+		audioSamples += len(fragment.samples)
+	}
+	if audioSamples != 40 {
+		t.Errorf("got %d audio samples, want 40", audioSamples)
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"errors"
+	"io"
+
+	"github.com/nareix/joy4/format/ts/tsio"
+)
+
+const (
+	// Codecs of the UI stream, see UIFrame.Codec
+	UI_CODEC_H264 = "h264"
+	UI_CODEC_HEVC = "hevc"
+	UI_CODEC_AAC  = "aac"
+
+	_TS_PACKET_SIZE = 188
+
+	// MPEG-TS stream types of the supported codecs
+	_TS_STREAM_TYPE_H264 = 0x1b
+	_TS_STREAM_TYPE_HEVC = 0x24
+	_TS_STREAM_TYPE_AAC  = 0x0f
+
+	// PES payloads larger than this are considered corrupt
+	_TS_MAX_PES_SIZE = 16 * 1024 * 1024
+)
+
+// uiPacket is a video access unit or a PES packet of audio frames of the UI stream.
+type uiPacket struct {
+	codec      string // One of the UI_CODEC_* constants
+	isKeyFrame bool
+	pts, dts   int64    // 33 bit MPEG-TS timestamps
+	nalus      [][]byte // The NAL units of a video access unit
+	adts       []byte   // The ADTS frames of an audio packet
+}
+
+func (pkt *uiPacket) isAudio() bool {
+	return pkt.codec == UI_CODEC_AAC
+}
+
+// uiPESStream is an elementary stream of the UI stream.
+type uiPESStream struct {
+	pid      int // -1 until the PMT is received
+	codec    string
+	pes      []byte // The PES packet being received
+	keyFrame bool   // The random access indicator of the PES packet being received
+}
+
+// uiTsDemuxer demuxes the video (either H.264 or HEVC) and the AAC audio of an MPEG-TS UI stream. Unlike the joy4
+// demuxer it keeps the parameter sets which are sent in band and supports HEVC.
+type uiTsDemuxer struct {
+	reader io.Reader
+	buf    [_TS_PACKET_SIZE]byte
+	pmtPid int // -1 until the PAT is received
+	video  uiPESStream
+	audio  uiPESStream
+	queue  []*uiPacket // Packets completed at the end of the stream
+	err    error       // The error to return once the last PES packets are returned
+}
+
+func newUITsDemuxer(reader io.Reader) *uiTsDemuxer {
+	return &uiTsDemuxer{reader: reader, pmtPid: -1, video: uiPESStream{pid: -1}, audio: uiPESStream{pid: -1, codec: UI_CODEC_AAC}}
+}
+
+// readPacket returns the next video access unit or audio packet.
+func (demuxer *uiTsDemuxer) readPacket() (pkt *uiPacket, err error) {
+	for {
+		if len(demuxer.queue) > 0 {
+			pkt = demuxer.queue[0]
+			demuxer.queue = demuxer.queue[1:]
+			return pkt, nil
+		}
+		if demuxer.err != nil {
+			return nil, demuxer.err
+		}
+		if _, err = io.ReadFull(demuxer.reader, demuxer.buf[:]); err != nil {
+			// The last PES packets are complete at the end of the stream
+			demuxer.err = err
+			for _, stream := range []*uiPESStream{&demuxer.video, &demuxer.audio} {
+				if pkt = stream.flush(); pkt != nil {
+					demuxer.queue = append(demuxer.queue, pkt)
+				}
+			}
+			continue
+		}
+		if pkt, err = demuxer.handleTSPacket(demuxer.buf[:]); pkt != nil || err != nil {
+			return
+		}
+	}
+}
+
+func (demuxer *uiTsDemuxer) handleTSPacket(b []byte) (pkt *uiPacket, err error) {
+	if b[0] != 0x47 {
+		return nil, errors.New("Invalid MPEG-TS sync byte")
+	}
+	pid := int(b[1]&0x1f)<<8 | int(b[2])
+	start := b[1]&0x40 != 0
+	payload := b[4:]
+	randomAccess := false
+	if b[3]&0x20 != 0 {
+		// Adaptation field
+		n := int(b[4]) + 1
+		if n > len(payload) {
+			return nil, errors.New("Invalid MPEG-TS adaptation field")
+		}
+		randomAccess = n > 1 && b[5]&0x40 != 0
+		payload = payload[n:]
+	}
+	if b[3]&0x10 == 0 {
+		// No payload
+		payload = nil
+	}
+
+	switch {
+	case pid == tsio.PAT_PID && start:
+		var pat tsio.PAT
+		if data, e := psiData(payload); e == nil {
+			if _, e = pat.Unmarshal(data); e == nil {
+				for _, entry := range pat.Entries {
+					if entry.ProgramNumber != 0 {
+						demuxer.pmtPid = int(entry.ProgramMapPID)
+						break
+					}
+				}
+			}
+		}
+
+	case pid == demuxer.pmtPid && start:
+		var pmt tsio.PMT
+		if data, e := psiData(payload); e == nil {
+			if _, e = pmt.Unmarshal(data); e == nil {
+				demuxer.handlePMT(&pmt)
+			}
+		}
+
+	case pid == demuxer.video.pid:
+		return demuxer.video.handlePayload(payload, start, randomAccess)
+
+	case pid == demuxer.audio.pid:
+		return demuxer.audio.handlePayload(payload, start, randomAccess)
+	}
+	return
+}
+
+// handlePMT selects the first video stream and the first audio stream of the program.
+func (demuxer *uiTsDemuxer) handlePMT(pmt *tsio.PMT) {
+	videoFound, audioFound := false, false
+	for _, info := range pmt.ElementaryStreamInfos {
+		switch {
+		case !videoFound && (info.StreamType == _TS_STREAM_TYPE_H264 || info.StreamType == _TS_STREAM_TYPE_HEVC):
+			videoFound = true
+			demuxer.video.pid = int(info.ElementaryPID)
+			demuxer.video.codec = UI_CODEC_H264
+			if info.StreamType == _TS_STREAM_TYPE_HEVC {
+				demuxer.video.codec = UI_CODEC_HEVC
+			}
+		case !audioFound && info.StreamType == _TS_STREAM_TYPE_AAC:
+			audioFound = true
+			demuxer.audio.pid = int(info.ElementaryPID)
+		}
+	}
+}
+
+// handlePayload adds the payload of a TS packet to the PES packet being received, the previous PES packet is
+// returned when a new one starts.
+func (stream *uiPESStream) handlePayload(payload []byte, start bool, randomAccess bool) (pkt *uiPacket, err error) {
+	if start {
+		pkt = stream.flush()
+		stream.pes = append(stream.pes[:0], payload...)
+		stream.keyFrame = randomAccess
+	} else if stream.pes != nil {
+		if len(stream.pes)+len(payload) > _TS_MAX_PES_SIZE {
+			return nil, errors.New("MPEG-TS PES packet is too large")
+		}
+		stream.pes = append(stream.pes, payload...)
+	}
+	return
+}
+
+// psiData returns the section data of a PSI packet, i.e. without the header and the CRC.
+func psiData(payload []byte) ([]byte, error) {
+	_, _, hdrlen, datalen, err := tsio.ParsePSI(payload)
+	if err != nil {
+		return nil, err
+	}
+	if hdrlen+datalen > len(payload) {
+		return nil, tsio.ErrPSIHeader
+	}
+	return payload[hdrlen : hdrlen+datalen], nil
+}
+
+// flush returns the PES packet being received, if any.
+func (stream *uiPESStream) flush() *uiPacket {
+	pes := stream.pes
+	stream.pes = nil
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return nil
+	}
+	hdrlen := int(pes[8]) + 9
+	if hdrlen > len(pes) {
+		return nil
+	}
+
+	pkt := &uiPacket{codec: stream.codec, isKeyFrame: stream.keyFrame}
+	flags := pes[7]
+	if flags&0x80 != 0 && hdrlen >= 14 {
+		pkt.pts = pesTimestamp(pes[9:14])
+		pkt.dts = pkt.pts
+		if flags&0x40 != 0 && hdrlen >= 19 {
+			pkt.dts = pesTimestamp(pes[14:19])
+		}
+	}
+
+	if pkt.isAudio() {
+		pkt.isKeyFrame = true
+		pkt.adts = pes[hdrlen:]
+		return pkt
+	}
+	pkt.nalus = splitAnnexB(pes[hdrlen:])
+	for _, nalu := range pkt.nalus {
+		if isKeyFrameNALU(pkt.codec, nalu) {
+			pkt.isKeyFrame = true
+		}
+	}
+	return pkt
+}
+
+// pesTimestamp returns the 33 bit PTS or DTS of a PES header.
+func pesTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
+
+// splitAnnexB returns the NAL units of an Annex B bitstream.
+func splitAnnexB(b []byte) (nalus [][]byte) {
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = appendNALU(nalus, b[start:i])
+		}
+		i += 2
+		start = i + 1
+	}
+	if start >= 0 && start < len(b) {
+		nalus = appendNALU(nalus, b[start:])
+	}
+	return
+}
+
+// appendNALU appends a NAL unit without its trailing zero bytes (which belong to the next start code).
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// naluType returns the type of a NAL unit.
+func naluType(codec string, nalu []byte) int {
+	if codec == UI_CODEC_HEVC {
+		return int(nalu[0]>>1) & 0x3f
+	}
+	return int(nalu[0]) & 0x1f
+}
+
+const (
+	// H.264 NAL unit types
+	_H264_NALU_IDR = 5
+	_H264_NALU_SPS = 7
+	_H264_NALU_PPS = 8
+	_H264_NALU_AUD = 9
+
+	// HEVC NAL unit types
+	_HEVC_NALU_IRAP_FIRST = 16 // BLA, IDR and CRA pictures
+	_HEVC_NALU_IRAP_LAST  = 23
+	_HEVC_NALU_VPS        = 32
+	_HEVC_NALU_SPS        = 33
+	_HEVC_NALU_PPS        = 34
+	_HEVC_NALU_AUD        = 35
+)
+
+func isKeyFrameNALU(codec string, nalu []byte) bool {
+	t := naluType(codec, nalu)
+	if codec == UI_CODEC_HEVC {
+		return t >= _HEVC_NALU_IRAP_FIRST && t <= _HEVC_NALU_IRAP_LAST
+	}
+	return t == _H264_NALU_IDR
+}
+
+func isAUDNALU(codec string, nalu []byte) bool {
+	t := naluType(codec, nalu)
+	if codec == UI_CODEC_HEVC {
+		return t == _HEVC_NALU_AUD
+	}
+	return t == _H264_NALU_AUD
+}
+
+// parameterSetIndex returns the index of a parameter set NAL unit in uiFramer.params (VPS, SPS, PPS), or -1.
+func parameterSetIndex(codec string, nalu []byte) int {
+	t := naluType(codec, nalu)
+	if codec == UI_CODEC_HEVC {
+		switch t {
+		case _HEVC_NALU_VPS:
+			return 0
+		case _HEVC_NALU_SPS:
+			return 1
+		case _HEVC_NALU_PPS:
+			return 2
+		}
+		return -1
+	}
+	switch t {
+	case _H264_NALU_SPS:
+		return 1
+	case _H264_NALU_PPS:
+		return 2
+	}
+	return -1
+}
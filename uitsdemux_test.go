@@ -0,0 +1,203 @@
+// Copyright 2015 TVersity Inc. All rights reserved.
+// Use of this source code is governed by an Apache 2.0
+// license that can be found in the LICENSE file.
+
+package appflinger
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/nareix/joy4/codec/aacparser"
+	"github.com/nareix/joy4/codec/h264parser"
+	"github.com/nareix/joy4/format/ts/tsio"
+)
+
+// H.264 test NAL units, a 640x360 baseline SPS with its PPS
+var (
+	testH264SPS   = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x02, 0x80, 0xbf, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04, 0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x58, 0xb9, 0x20}
+	testH264PPS   = []byte{0x68, 0xce, 0x3c, 0x80}
+	testH264AUD   = []byte{0x09, 0xf0}
+	testH264IDR   = []byte{0x65, 0x88, 0x84, 0x00, 0x33, 0xff}
+	testH264Slice = []byte{0x41, 0x9a, 0x02, 0x04, 0x01}
+)
+
+// testAudioConfig returns the configuration of the AAC test frames, AAC LC stereo at 44.1 kHz.
+func testAudioConfig() aacparser.MPEG4AudioConfig {
+	config := aacparser.MPEG4AudioConfig{ObjectType: aacparser.AOT_AAC_LC, SampleRateIndex: 4, ChannelConfig: 2}
+	config.Complete()
+	return config
+}
+
+// testADTS returns ADTS frames of 1024 samples with the given payloads.
+func testADTS(payloads ...[]byte) (data []byte) {
+	for _, payload := range payloads {
+		header := make([]byte, aacparser.ADTSHeaderLength)
+		aacparser.FillADTSHeader(header, testAudioConfig(), 1024, len(payload))
+		data = append(append(data, header...), payload...)
+	}
+	return
+}
+
+// annexB returns the Annex B bitstream of the given NAL units.
+func annexB(nalus ...[]byte) (data []byte) {
+	for _, nalu := range nalus {
+		data = append(append(data, h264parser.StartCodeBytes...), nalu...)
+	}
+	return
+}
+
+// testTsMuxer builds MPEG-TS test streams, packetized as done by uiTsWriter.
+type testTsMuxer struct {
+	w    *uiTsWriter
+	data []byte
+}
+
+func newTestTsMuxer(videoCodec string, withAudio bool) *testTsMuxer {
+	info := &uiMediaInfo{videoCodec: videoCodec}
+	if withAudio {
+		codecData, _ := aacparser.NewCodecDataFromMPEG4AudioConfig(testAudioConfig())
+		info.audio = &codecData
+	}
+	w := newUITsWriter()
+	w.info = info
+	return &testTsMuxer{w: w}
+}
+
+func (m *testTsMuxer) take() *testTsMuxer {
+	m.data = append(m.data, m.w.buf...)
+	m.w.buf = m.w.buf[:0]
+	return m
+}
+
+// psi adds the PAT and the PMT.
+func (m *testTsMuxer) psi() *testTsMuxer {
+	m.w.writePSI()
+	return m.take()
+}
+
+// video adds an access unit made of the given NAL units.
+func (m *testTsMuxer) video(pts int64, dts int64, randomAccess bool, nalus ...[]byte) *testTsMuxer {
+	pes := append(appendPESHeader(nil, tsio.StreamIdH264, -1, pts, dts), annexB(nalus...)...)
+	m.w.writePackets(_MUX_TS_VIDEO_PID, pes, dts, randomAccess)
+	return m.take()
+}
+
+// audio adds a PES packet of ADTS frames.
+func (m *testTsMuxer) audio(pts int64, adts []byte) *testTsMuxer {
+	pes := append(appendPESHeader(nil, tsio.StreamIdAAC, len(adts), pts, pts), adts...)
+	m.w.writePackets(_MUX_TS_AUDIO_PID, pes, -1, true)
+	return m.take()
+}
+
+// readUIPackets returns the packets of a stream and the error which ended it.
+func readUIPackets(data []byte) (pkts []*uiPacket, err error) {
+	demuxer := newUITsDemuxer(bytes.NewReader(data))
+	for {
+		pkt, e := demuxer.readPacket()
+		if e != nil {
+			return pkts, e
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestUITsDemuxer(t *testing.T) {
+	largeSlice := append([]byte{0x41}, bytes.Repeat([]byte{0x5a}, 1000)...)
+	hevcIDR := []byte{0x26, 0x01, 0xaf, 0x20}   // IDR_W_RADL
+	hevcSlice := []byte{0x02, 0x01, 0xd0, 0x10} // TRAIL_R
+	adts := testADTS([]byte{1, 2, 3}, []byte{4, 5})
+
+	tests := []struct {
+		name string
+		data []byte
+		want []*uiPacket
+	}{
+		{"h264 access units", newTestTsMuxer(UI_CODEC_H264, false).psi().
+			video(90000, 90000, true, testH264AUD, testH264SPS, testH264PPS, testH264IDR).
+			video(99000, 93600, false, testH264AUD, testH264Slice).data,
+			[]*uiPacket{
+				{codec: UI_CODEC_H264, isKeyFrame: true, pts: 90000, dts: 90000,
+					nalus: [][]byte{testH264AUD, testH264SPS, testH264PPS, testH264IDR}},
+				{codec: UI_CODEC_H264, pts: 99000, dts: 93600, nalus: [][]byte{testH264AUD, testH264Slice}},
+			}},
+		{"access unit split into several packets", newTestTsMuxer(UI_CODEC_H264, false).psi().
+			video(0, 0, false, largeSlice, testH264Slice).data,
+			[]*uiPacket{{codec: UI_CODEC_H264, nalus: [][]byte{largeSlice, testH264Slice}}}},
+		{"key frame signalled by the random access indicator only", newTestTsMuxer(UI_CODEC_H264, false).psi().
+			video(3600, 3600, true, testH264Slice).data,
+			[]*uiPacket{{codec: UI_CODEC_H264, isKeyFrame: true, pts: 3600, dts: 3600, nalus: [][]byte{testH264Slice}}}},
+		{"hevc", newTestTsMuxer(UI_CODEC_HEVC, false).psi().
+			video(3600, 3600, false, hevcIDR).video(7200, 7200, false, hevcSlice).data,
+			[]*uiPacket{
+				{codec: UI_CODEC_HEVC, isKeyFrame: true, pts: 3600, dts: 3600, nalus: [][]byte{hevcIDR}},
+				{codec: UI_CODEC_HEVC, pts: 7200, dts: 7200, nalus: [][]byte{hevcSlice}},
+			}},
+		{"packets before the PAT are dropped", newTestTsMuxer(UI_CODEC_H264, false).
+			video(0, 0, true, testH264IDR).psi().video(3600, 3600, false, testH264Slice).data,
+			[]*uiPacket{{codec: UI_CODEC_H264, pts: 3600, dts: 3600, nalus: [][]byte{testH264Slice}}}},
+		{"audio", newTestTsMuxer(UI_CODEC_H264, true).psi().
+			audio(1000, adts).video(0, 0, true, testH264IDR).audio(3000, adts).data,
+			[]*uiPacket{
+				{codec: UI_CODEC_AAC, isKeyFrame: true, pts: 1000, dts: 1000, adts: adts},
+				{codec: UI_CODEC_H264, isKeyFrame: true, nalus: [][]byte{testH264IDR}},
+				{codec: UI_CODEC_AAC, isKeyFrame: true, pts: 3000, dts: 3000, adts: adts},
+			}},
+		{"timestamps wrapped around", newTestTsMuxer(UI_CODEC_H264, false).psi().
+			video(_TS_WRAP+1800, _TS_WRAP-1800, false, testH264Slice).data,
+			[]*uiPacket{{codec: UI_CODEC_H264, pts: 1800, dts: _TS_WRAP - 1800, nalus: [][]byte{testH264Slice}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pkts, err := readUIPackets(test.data)
+			if err != io.EOF {
+				t.Errorf("stream ended with %v, want EOF", err)
+			}
+			if !reflect.DeepEqual(pkts, test.want) {
+				t.Errorf("got %d packets:", len(pkts))
+				for _, pkt := range pkts {
+					t.Errorf("  %+v", *pkt)
+				}
+			}
+		})
+	}
+}
+
+func TestUITsDemuxerErrors(t *testing.T) {
+	data := newTestTsMuxer(UI_CODEC_H264, false).psi().video(0, 0, true, testH264IDR).data
+	if _, err := readUIPackets(data[:len(data)-10]); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated stream ended with %v, want ErrUnexpectedEOF", err)
+	}
+
+	data = append(data, bytes.Repeat([]byte{0}, _TS_PACKET_SIZE)...)
+	demuxer := newUITsDemuxer(bytes.NewReader(data))
+	if _, err := demuxer.readPacket(); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("invalid sync byte returned %v", err)
+	}
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want [][]byte
+	}{
+		{"empty", nil, nil},
+		{"no start code", []byte{0x65, 0x88}, nil},
+		{"3 bytes start codes", annexB(testH264SPS, testH264PPS), [][]byte{testH264SPS, testH264PPS}},
+		{"4 bytes start codes", []byte{0, 0, 0, 1, 0x09, 0xf0, 0, 0, 0, 1, 0x65, 0x88}, [][]byte{{0x09, 0xf0}, {0x65, 0x88}}},
+		{"trailing zeros", []byte{0, 0, 1, 0x65, 0x88, 0, 0, 0, 0, 1, 0x41, 0x9a, 0, 0}, [][]byte{{0x65, 0x88}, {0x41, 0x9a}}},
+		{"data before the first start code", []byte{0x12, 0, 0, 1, 0x65, 0x88}, [][]byte{{0x65, 0x88}}},
+		{"empty NAL units", []byte{0, 0, 1, 0, 0, 1, 0x65, 0, 0, 1}, [][]byte{{0x65}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := splitAnnexB(test.data); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %x, want %x", got, test.want)
+			}
+		})
+	}
+}